@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Change request types
+const (
+	changeRequestSuperior    = "superior"     // PUT /api/custom-field-values/{id}/superior
+	changeRequestCustomField = "custom_field" // PUT /api/custom-fields/{id}
+)
+
+// Change request statuses
+const (
+	changeRequestPending   = "pending"
+	changeRequestApproved  = "approved"
+	changeRequestRejected  = "rejected"
+	changeRequestCancelled = "cancelled"
+)
+
+// Change request history actions
+const (
+	changeRequestActionSubmitted = "submitted"
+	changeRequestActionCommented = "commented"
+	changeRequestActionApproved  = "approved"
+	changeRequestActionRejected  = "rejected"
+	changeRequestActionCancelled = "cancelled"
+)
+
+// changeApprovalConfig controls the approval workflow. When it is disabled
+// structural changes are applied immediately, as before.
+type changeApprovalConfig struct {
+	enabled   bool
+	approvers map[string]bool // user IDs that may decide any change request
+}
+
+// loadChangeApprovalConfig reads CHANGE_APPROVAL_ENABLED and CHANGE_APPROVER_IDS.
+// The list of approvers is configured on the server, but who is making a
+// request comes from X-User-ID: approval is only as trustworthy as the
+// authenticating proxy that sets that header.
+func loadChangeApprovalConfig() changeApprovalConfig {
+	cfg := changeApprovalConfig{
+		enabled:   envBool("CHANGE_APPROVAL_ENABLED", false),
+		approvers: make(map[string]bool),
+	}
+	for _, id := range strings.Split(os.Getenv("CHANGE_APPROVER_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			cfg.approvers[id] = true
+		}
+	}
+	if cfg.enabled {
+		log.Printf("Structural changes require approval (%d configured approvers)", len(cfg.approvers))
+	}
+	return cfg
+}
+
+// errUserIDRequired is returned when a change needs approval but the user
+// submitting it is unknown
+var errUserIDRequired = errors.New(userIDHeader + " header is required")
+
+// submitChangeRequest stores a structural change of userID as a pending
+// request instead of applying it. The current version of the target is
+// recorded so approval can detect later changes. It returns sql.ErrNoRows if
+// the target does not exist.
+func (h *Handler) submitChangeRequest(ctx context.Context, userID, changeType string, targetID uuid.UUID, payload interface{}) (*ChangeRequest, error) {
+	if userID == "" {
+		return nil, errUserIDRequired
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	version, err := changeRequestTargetVersion(ctx, tx, changeType, targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	cr, err := scanChangeRequest(tx.QueryRowContext(ctx,
+		`INSERT INTO change_requests (id, change_type, target_id, payload, status, requested_by, target_updated_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW())
+		RETURNING `+changeRequestColumns,
+		uuid.New(), changeType, targetID, payloadJSON, changeRequestPending, userID, version,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if err := addChangeRequestEvent(ctx, tx, cr.ID, changeRequestActionSubmitted, userID, nil); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+// changeRequestConflict reports a request that cannot be decided or applied
+// in its current state
+type changeRequestConflict struct {
+	message string
+}
+
+func (e *changeRequestConflict) Error() string {
+	return e.message
+}
+
+// superiorChange is the payload of a superior change request
+type superiorChange struct {
+	Superior *int64 `json:"superior"`
+}
+
+const changeRequestColumns = `id, change_type, target_id, payload, status, requested_by, target_updated_at, decided_by, decided_at, created_at, updated_at`
+
+func scanChangeRequest(row interface{ Scan(...interface{}) error }) (ChangeRequest, error) {
+	var cr ChangeRequest
+	var payload []byte
+	err := row.Scan(&cr.ID, &cr.Type, &cr.TargetID, &payload, &cr.Status, &cr.RequestedBy, &cr.TargetUpdatedAt,
+		&cr.DecidedBy, &cr.DecidedAt, &cr.CreatedAt, &cr.UpdatedAt)
+	cr.Payload = payload
+	return cr, err
+}
+
+// loadChangeRequestHistory loads the history of a change request, oldest first
+func loadChangeRequestHistory(ctx context.Context, db dbQuerier, id uuid.UUID) ([]ChangeRequestEvent, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, action, user_id, comment, created_at FROM change_request_events
+		WHERE change_request_id = $1 ORDER BY id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []ChangeRequestEvent{}
+	for rows.Next() {
+		var e ChangeRequestEvent
+		if err := rows.Scan(&e.ID, &e.Action, &e.UserID, &e.Comment, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+// addChangeRequestEvent appends an entry to the history of a change request
+func addChangeRequestEvent(ctx context.Context, db dbQuerier, id uuid.UUID, action, userID string, comment *string) error {
+	if comment != nil && strings.TrimSpace(*comment) == "" {
+		comment = nil
+	}
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO change_request_events (change_request_id, action, user_id, comment, created_at)
+		VALUES ($1, $2, $3, $4, NOW())`,
+		id, action, userID, comment,
+	)
+	return err
+}
+
+// canApproveChangeRequest reports whether a user may approve or reject a
+// change request: configured approvers may decide any request, the employee
+// of the superior position of a value may decide changes to it. Nobody
+// decides their own requests. userID must come from an authenticated source
+// (see userIDHeader), otherwise anyone can claim to be an approver.
+func (h *Handler) canApproveChangeRequest(ctx context.Context, db dbQuerier, cr ChangeRequest, userID string) (bool, error) {
+	if userID == "" || userID == cr.RequestedBy {
+		return false, nil
+	}
+	if h.approval.approvers[userID] {
+		return true, nil
+	}
+
+	var valueIDs []uuid.UUID
+	switch cr.Type {
+	case changeRequestSuperior:
+		valueIDs = []uuid.UUID{cr.TargetID}
+	case changeRequestCustomField:
+		var err error
+		valueIDs, err = affectedCustomFieldValues(ctx, db, cr)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(valueIDs) == 0 {
+		return false, nil
+	}
+
+	for _, valueID := range valueIDs {
+		var isSuperior bool
+		err := db.QueryRowContext(ctx,
+			`SELECT EXISTS (
+				SELECT 1 FROM custom_fields_values cfv
+				JOIN positions p ON p.id = cfv.superior
+				WHERE cfv.id = $1 AND p.employee_id = $2
+			)`,
+			valueID, userID,
+		).Scan(&isSuperior)
+		if err != nil {
+			return false, err
+		}
+		if !isSuperior {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// affectedCustomFieldValues returns the existing values of a field that a
+// custom field change request renames, relinks or removes
+func affectedCustomFieldValues(ctx context.Context, db dbQuerier, cr ChangeRequest) ([]uuid.UUID, error) {
+	var f CustomFieldDefinition
+	if err := json.Unmarshal(cr.Payload, &f); err != nil {
+		return nil, err
+	}
+	proposed := make(map[uuid.UUID]AllowedValue)
+	if f.AllowedValues != nil {
+		for _, v := range *f.AllowedValues {
+			proposed[v.ValueID] = v
+		}
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, value, linked_custom_fields_values_ids FROM custom_fields_values WHERE custom_field_id = $1`,
+		cr.TargetID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var affected []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		var value string
+		var linkedValueIDs UUIDArray
+		if err := rows.Scan(&id, &value, &linkedValueIDs); err != nil {
+			return nil, err
+		}
+		v, ok := proposed[id]
+		if !ok || v.Value != value || !sameLinkedValues(v, linkedValueIDs) {
+			affected = append(affected, id)
+		}
+	}
+	return affected, rows.Err()
+}
+
+// sameLinkedValues compares the linked values of a proposed allowed value with stored ones
+func sameLinkedValues(v AllowedValue, stored UUIDArray) bool {
+	proposed := make(map[uuid.UUID]bool)
+	for _, linked := range v.LinkedCustomFields {
+		for _, lv := range linked.LinkedCustomFieldValues {
+			proposed[lv.LinkedCustomFieldValueID] = true
+		}
+	}
+	if len(proposed) != len(stored) {
+		return false
+	}
+	for _, id := range stored {
+		if !proposed[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// changeRequestTargetVersion returns the updated_at of the target of a change
+// request, locking it: for a value its own, for a custom field the latest of
+// the field and its values, since the request replaces all of them. It
+// returns sql.ErrNoRows if the target does not exist.
+func changeRequestTargetVersion(ctx context.Context, db dbQuerier, changeType string, targetID uuid.UUID) (time.Time, error) {
+	var version time.Time
+	var err error
+	switch changeType {
+	case changeRequestSuperior:
+		err = db.QueryRowContext(ctx,
+			`SELECT updated_at FROM custom_fields_values WHERE id = $1 FOR UPDATE`, targetID,
+		).Scan(&version)
+	case changeRequestCustomField:
+		err = db.QueryRowContext(ctx,
+			`SELECT GREATEST(cf.updated_at, (SELECT MAX(updated_at) FROM custom_fields_values WHERE custom_field_id = cf.id))
+			FROM custom_fields cf WHERE cf.id = $1 FOR UPDATE`,
+			targetID,
+		).Scan(&version)
+	default:
+		err = fmt.Errorf("unknown change request type %q", changeType)
+	}
+	return version, err
+}
+
+// applyChangeRequest applies an approved change request within tx. A request
+// whose target was deleted or changed after it was submitted is a conflict:
+// applying its stored payload would revert the later changes.
+func applyChangeRequest(ctx context.Context, tx *sql.Tx, cr ChangeRequest) error {
+	version, err := changeRequestTargetVersion(ctx, tx, cr.Type, cr.TargetID)
+	if err == sql.ErrNoRows {
+		if cr.Type == changeRequestSuperior {
+			return &changeRequestConflict{"custom field value no longer exists"}
+		}
+		return &changeRequestConflict{"custom field no longer exists"}
+	}
+	if err != nil {
+		return err
+	}
+	if cr.TargetUpdatedAt != nil && !version.Equal(*cr.TargetUpdatedAt) {
+		return &changeRequestConflict{"the target has changed since the request was submitted"}
+	}
+
+	switch cr.Type {
+	case changeRequestSuperior:
+		var change superiorChange
+		if err := json.Unmarshal(cr.Payload, &change); err != nil {
+			return err
+		}
+		return updateValueSuperior(ctx, tx, cr.TargetID, change.Superior)
+
+	case changeRequestCustomField:
+		var f CustomFieldDefinition
+		if err := json.Unmarshal(cr.Payload, &f); err != nil {
+			return err
+		}
+		err := updateCustomField(ctx, tx, cr.TargetID, &f)
+		if err == sql.ErrNoRows {
+			return &changeRequestConflict{"custom field no longer exists"}
+		}
+		return err
+	}
+	return fmt.Errorf("unknown change request type %q", cr.Type)
+}
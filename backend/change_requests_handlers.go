@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// changeRequestComment is the optional body of decision and comment requests
+type changeRequestComment struct {
+	Comment *string `json:"comment"`
+}
+
+// writeSubmittedChangeRequest answers a change that was submitted for
+// approval instead of being applied with 202 Accepted and the request
+func writeSubmittedChangeRequest(w http.ResponseWriter, cr *ChangeRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(cr)
+}
+
+// GetChangeRequests lists change requests, newest first. Filters: status,
+// type and target_id.
+func (h *Handler) GetChangeRequests(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var conditions []string
+	var args []interface{}
+	if status := query.Get("status"); status != "" {
+		args = append(args, status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+	if changeType := query.Get("type"); changeType != "" {
+		args = append(args, changeType)
+		conditions = append(conditions, fmt.Sprintf("change_type = $%d", len(args)))
+	}
+	if targetIDStr := query.Get("target_id"); targetIDStr != "" {
+		targetID, err := uuid.Parse(targetIDStr)
+		if err != nil {
+			http.Error(w, "Invalid target_id", http.StatusBadRequest)
+			return
+		}
+		args = append(args, targetID)
+		conditions = append(conditions, fmt.Sprintf("target_id = $%d", len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := h.db.QueryContext(r.Context(),
+		`SELECT `+changeRequestColumns+` FROM change_requests `+where+` ORDER BY created_at DESC`,
+		args...,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []ChangeRequest{}
+	for rows.Next() {
+		cr, err := scanChangeRequest(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, cr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// GetChangeRequest returns a change request with its history
+func (h *Handler) GetChangeRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	h.writeChangeRequest(w, r, id)
+}
+
+// ApproveChangeRequest applies a pending change request and marks it approved
+func (h *Handler) ApproveChangeRequest(w http.ResponseWriter, r *http.Request) {
+	h.decideChangeRequest(w, r, changeRequestApproved)
+}
+
+// RejectChangeRequest marks a pending change request rejected without applying it
+func (h *Handler) RejectChangeRequest(w http.ResponseWriter, r *http.Request) {
+	h.decideChangeRequest(w, r, changeRequestRejected)
+}
+
+// CancelChangeRequest lets the author withdraw a pending change request
+func (h *Handler) CancelChangeRequest(w http.ResponseWriter, r *http.Request) {
+	h.decideChangeRequest(w, r, changeRequestCancelled)
+}
+
+func (h *Handler) decideChangeRequest(w http.ResponseWriter, r *http.Request, status string) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	userID := currentUserID(r)
+	if userID == "" {
+		http.Error(w, userIDHeader+" header is required", http.StatusUnauthorized)
+		return
+	}
+	var body changeRequestComment
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	cr, err := scanChangeRequest(tx.QueryRowContext(r.Context(),
+		`SELECT `+changeRequestColumns+` FROM change_requests WHERE id = $1 FOR UPDATE`, id,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Change request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cr.Status != changeRequestPending {
+		http.Error(w, "Change request is already "+cr.Status, http.StatusConflict)
+		return
+	}
+
+	action := changeRequestActionCancelled
+	if status == changeRequestCancelled {
+		if userID != cr.RequestedBy {
+			http.Error(w, "Only the author can cancel a change request", http.StatusForbidden)
+			return
+		}
+	} else {
+		if userID == cr.RequestedBy {
+			http.Error(w, "The author cannot decide their own change request", http.StatusForbidden)
+			return
+		}
+		allowed, err := h.canApproveChangeRequest(r.Context(), tx, cr, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Not allowed to decide this change request", http.StatusForbidden)
+			return
+		}
+		action = changeRequestActionRejected
+		if status == changeRequestApproved {
+			action = changeRequestActionApproved
+			err := applyChangeRequest(r.Context(), tx, cr)
+			var conflict *changeRequestConflict
+			if errors.As(err, &conflict) {
+				http.Error(w, conflict.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(r.Context(),
+		`UPDATE change_requests SET status = $1, decided_by = $2, decided_at = NOW(), updated_at = NOW() WHERE id = $3`,
+		status, userID, id,
+	); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := addChangeRequestEvent(r.Context(), tx, id, action, userID, body.Comment); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeChangeRequest(w, r, id)
+}
+
+// CommentChangeRequest adds a comment to the history of a change request
+func (h *Handler) CommentChangeRequest(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	userID := currentUserID(r)
+	if userID == "" {
+		http.Error(w, userIDHeader+" header is required", http.StatusUnauthorized)
+		return
+	}
+	var body changeRequestComment
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Comment == nil || strings.TrimSpace(*body.Comment) == "" {
+		http.Error(w, "comment is required", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRowContext(r.Context(),
+		`SELECT EXISTS (SELECT 1 FROM change_requests WHERE id = $1)`, id,
+	).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Change request not found", http.StatusNotFound)
+		return
+	}
+	if err := addChangeRequestEvent(r.Context(), h.db, id, changeRequestActionCommented, userID, body.Comment); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeChangeRequest(w, r, id)
+}
+
+// writeChangeRequest answers with change request id and its history
+func (h *Handler) writeChangeRequest(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	cr, err := scanChangeRequest(h.db.QueryRowContext(r.Context(),
+		`SELECT `+changeRequestColumns+` FROM change_requests WHERE id = $1`, id,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Change request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cr.History, err = loadChangeRequestHistory(r.Context(), h.db, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cr)
+}
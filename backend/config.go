@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envDuration reads a duration like "15s" or "2m" from the environment,
+// falling back to def when the variable is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %s: %v", name, value, def, err)
+		return def
+	}
+	return d
+}
+
+// envInt reads an integer from the environment, falling back to def when the
+// variable is unset or invalid
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %d: %v", name, value, def, err)
+		return def
+	}
+	return n
+}
+
+// envBool reads a boolean like "true" or "0" from the environment, falling
+// back to def when the variable is unset or invalid
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %t: %v", name, value, def, err)
+		return def
+	}
+	return b
+}
+
+// envString reads a string from the environment, falling back to def when the
+// variable is unset; an empty value is kept
+func envString(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return strings.TrimSpace(value)
+	}
+	return def
+}
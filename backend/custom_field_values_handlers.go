@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"net/http"
@@ -20,7 +21,7 @@ func (h *Handler) GetAvailableSuperiors(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Query positions that have this custom_field_value_id in their custom_fields_values_id array
-	rows, err := h.db.Query(
+	rows, err := h.db.QueryContext(r.Context(),
 		`SELECT id, position_name, employee_surname, employee_name, employee_patronymic, employee_id
 		FROM positions
 		WHERE custom_fields_values_id @> $1::text::jsonb
@@ -103,22 +104,27 @@ func (h *Handler) UpdateCustomFieldValueSuperior(w http.ResponseWriter, r *http.
 		return
 	}
 
-	// Update the superior field
-	_, err = h.db.Exec(
-		`UPDATE custom_fields_values 
-		SET superior = $1, updated_at = NOW()
-		WHERE id = $2`,
-		requestBody.Superior,
-		valueID,
-	)
+	cr, err := h.changeValueSuperior(r.Context(), currentUserID(r), valueID, requestBody.Superior)
+	if err == errUserIDRequired {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Custom field value not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if cr != nil {
+		writeSubmittedChangeRequest(w, cr)
+		return
+	}
 
 	// Get the updated custom field value with superior information
 	var superior sql.NullInt64
-	err = h.db.QueryRow(
+	err = h.db.QueryRowContext(r.Context(),
 		`SELECT superior FROM custom_fields_values WHERE id = $1`,
 		valueID,
 	).Scan(&superior)
@@ -157,7 +163,7 @@ func (h *Handler) GetCustomFieldValueSuperior(w http.ResponseWriter, r *http.Req
 	var employeeName sql.NullString
 	var patronymic sql.NullString
 
-	err = h.db.QueryRow(
+	err = h.db.QueryRowContext(r.Context(),
 		`SELECT cfv.superior, p.position_name, 
 			p.employee_surname, p.employee_name, p.employee_patronymic
 		FROM custom_fields_values cfv
@@ -220,3 +226,35 @@ func (h *Handler) GetCustomFieldValueSuperior(w http.ResponseWriter, r *http.Req
 	json.NewEncoder(w).Encode(response)
 }
 
+
+// changeValueSuperior sets or clears the superior position of a custom field
+// value. When changes need approval it submits the change as a request of
+// userID and returns the request instead. It returns sql.ErrNoRows if the
+// value does not exist.
+func (h *Handler) changeValueSuperior(ctx context.Context, userID string, valueID uuid.UUID, superior *int64) (*ChangeRequest, error) {
+	if h.approval.enabled {
+		return h.submitChangeRequest(ctx, userID, changeRequestSuperior, valueID, superiorChange{Superior: superior})
+	}
+	var exists bool
+	if err := h.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM custom_fields_values WHERE id = $1)`, valueID,
+	).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+	return nil, updateValueSuperior(ctx, h.db, valueID, superior)
+}
+
+// updateValueSuperior sets or clears the superior position of a custom field value
+func updateValueSuperior(ctx context.Context, db dbQuerier, valueID uuid.UUID, superior *int64) error {
+	_, err := db.ExecContext(ctx,
+		`UPDATE custom_fields_values 
+		SET superior = $1, updated_at = NOW()
+		WHERE id = $2`,
+		superior,
+		valueID,
+	)
+	return err
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"strings"
 
@@ -14,7 +15,7 @@ import (
 
 func (h *Handler) GetCustomFields(w http.ResponseWriter, r *http.Request) {
 	// Pre-load all custom field definitions for linked fields lookup (once, before the loop)
-	allFieldsRows, err := h.db.Query(`SELECT id, key, label FROM custom_fields`)
+	allFieldsRows, err := h.db.QueryContext(r.Context(), `SELECT id, key, label FROM custom_fields`)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -36,7 +37,7 @@ func (h *Handler) GetCustomFields(w http.ResponseWriter, r *http.Request) {
 	allFieldsRows.Close()
 
 	// Pre-load all custom field values for linked values lookup (once, before the loop)
-	allValuesRows, err := h.db.Query(`SELECT id, value FROM custom_fields_values`)
+	allValuesRows, err := h.db.QueryContext(r.Context(), `SELECT id, value FROM custom_fields_values`)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -53,7 +54,7 @@ func (h *Handler) GetCustomFields(w http.ResponseWriter, r *http.Request) {
 
 	// Pre-load field-to-values mapping (which values belong to which fields) (once, before the loop)
 	fieldToValuesMap := make(map[uuid.UUID]map[uuid.UUID]bool)
-	fieldsForMappingRows, err := h.db.Query(`SELECT id, allowed_values_ids FROM custom_fields WHERE allowed_values_ids IS NOT NULL`)
+	fieldsForMappingRows, err := h.db.QueryContext(r.Context(), `SELECT id, allowed_values_ids FROM custom_fields WHERE allowed_values_ids IS NOT NULL`)
 	if err == nil {
 		for fieldsForMappingRows.Next() {
 			var fieldID uuid.UUID
@@ -74,7 +75,7 @@ func (h *Handler) GetCustomFields(w http.ResponseWriter, r *http.Request) {
 		fieldsForMappingRows.Close()
 	}
 
-	rows, err := h.db.Query(
+	rows, err := h.db.QueryContext(r.Context(),
 		`SELECT id, key, label, allowed_values_ids, created_at, updated_at
 		FROM custom_fields ORDER BY label`,
 	)
@@ -117,11 +118,12 @@ func (h *Handler) GetCustomFields(w http.ResponseWriter, r *http.Request) {
 				var cv CustomFieldValue
 				var linkedCustomFieldIDsJSON []byte
 				var linkedCustomFieldValueIDsJSON []byte
-				err := h.db.QueryRow(
-					`SELECT id, value, linked_custom_fields_ids, linked_custom_fields_values_ids, created_at, updated_at
+				var sortOrder sql.NullInt64
+				err := h.db.QueryRowContext(r.Context(),
+					`SELECT id, value, linked_custom_fields_ids, linked_custom_fields_values_ids, sort_order, created_at, updated_at
 					FROM custom_fields_values WHERE id = $1`,
 					valueID,
-				).Scan(&cv.ID, &cv.Value, &linkedCustomFieldIDsJSON, &linkedCustomFieldValueIDsJSON, &cv.CreatedAt, &cv.UpdatedAt)
+				).Scan(&cv.ID, &cv.Value, &linkedCustomFieldIDsJSON, &linkedCustomFieldValueIDsJSON, &sortOrder, &cv.CreatedAt, &cv.UpdatedAt)
 				if err == nil {
 					// Build linked_custom_fields structure
 					linkedCustomFields := []LinkedCustomField{}
@@ -188,11 +190,16 @@ func (h *Handler) GetCustomFields(w http.ResponseWriter, r *http.Request) {
 						}
 					}
 
-					allowedValues = append(allowedValues, AllowedValue{
+					allowedValue := AllowedValue{
 						ValueID:            cv.ID,
 						Value:              cv.Value,
 						LinkedCustomFields: linkedCustomFields,
-					})
+					}
+					if sortOrder.Valid {
+						order := int(sortOrder.Int64)
+						allowedValue.SortOrder = &order
+					}
+					allowedValues = append(allowedValues, allowedValue)
 				}
 			}
 			f.AllowedValues = &allowedValues
@@ -212,13 +219,33 @@ func (h *Handler) CreateCustomField(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err := h.createCustomField(r.Context(), &f)
+	if err == errCustomFieldKeyExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+// errCustomFieldKeyExists is returned when a new custom field reuses a key
+var errCustomFieldKeyExists = errors.New("Field with this key already exists")
+
+// createCustomField creates custom field f with its allowed values, filling
+// in the generated IDs of the field and the values
+func (h *Handler) createCustomField(ctx context.Context, f *CustomFieldDefinition) error {
 	f.ID = uuid.New()
 
 	// Start transaction
-	tx, err := h.db.Begin()
+	tx, err := h.db.BeginTx(ctx, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	defer tx.Rollback()
 
@@ -239,7 +266,7 @@ func (h *Handler) CreateCustomField(w http.ResponseWriter, r *http.Request) {
 	allowedValueIDsJSON, _ := allowedValueIDsArray.Value()
 
 	// First, create the custom field itself (must exist before creating values due to FK constraint)
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		`INSERT INTO custom_fields (id, key, label, allowed_values_ids, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, NOW(), NOW())`,
 		f.ID, f.Key, f.Label, allowedValueIDsJSON,
@@ -247,11 +274,9 @@ func (h *Handler) CreateCustomField(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		if strings.Contains(err.Error(), "duplicate key") {
-			http.Error(w, "Field with this key already exists", http.StatusConflict)
-			return
+			return errCustomFieldKeyExists
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	// Now create the values (field must exist first due to FK constraint)
@@ -276,7 +301,7 @@ func (h *Handler) CreateCustomField(w http.ResponseWriter, r *http.Request) {
 			linkedCustomFieldIDsJSON, _ := linkedCustomFieldIDsArray.Value()
 			linkedCustomFieldValueIDsJSON, _ := linkedCustomFieldValueIDsArray.Value()
 
-			_, err = tx.Exec(
+			_, err = tx.ExecContext(ctx,
 				`INSERT INTO custom_fields_values (id, value, custom_field_id, linked_custom_fields_ids, linked_custom_fields_values_ids, created_at, updated_at)
 				VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
 				ON CONFLICT (id) DO UPDATE SET
@@ -292,21 +317,13 @@ func (h *Handler) CreateCustomField(w http.ResponseWriter, r *http.Request) {
 				linkedCustomFieldValueIDsJSON,
 			)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
 		}
 	}
 
 	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(f)
+	return tx.Commit()
 }
 
 func (h *Handler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
@@ -323,23 +340,61 @@ func (h *Handler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Start transaction
-	tx, err := h.db.Begin()
+	cr, err := h.changeCustomField(r.Context(), currentUserID(r), id, &f)
+	if err == errUserIDRequired {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Field not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if cr != nil {
+		writeSubmittedChangeRequest(w, cr)
+		return
+	}
+
+	f.ID = id
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// changeCustomField replaces the label and allowed values of custom field id.
+// When changes need approval it submits them as a change request of userID
+// and returns the request instead. It returns sql.ErrNoRows if the field does
+// not exist.
+func (h *Handler) changeCustomField(ctx context.Context, userID string, id uuid.UUID, f *CustomFieldDefinition) (*ChangeRequest, error) {
+	if h.approval.enabled {
+		return h.submitChangeRequest(ctx, userID, changeRequestCustomField, id, f)
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Rollback()
 
+	if err := updateCustomField(ctx, tx, id, f); err != nil {
+		return nil, err
+	}
+	return nil, tx.Commit()
+}
+
+// updateCustomField replaces the label and allowed values of custom field id
+// within tx and removes values no longer used by any field
+func updateCustomField(ctx context.Context, tx *sql.Tx, id uuid.UUID, f *CustomFieldDefinition) error {
 	// Get old allowed_values_ids to delete unused values
 	var oldAllowedValueIDsJSON []byte
-	err = tx.QueryRow(
+	err := tx.QueryRowContext(ctx,
 		`SELECT allowed_values_ids FROM custom_fields WHERE id = $1`,
 		id,
 	).Scan(&oldAllowedValueIDsJSON)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	// Generate value_id for each allowed value if not present
@@ -371,7 +426,7 @@ func (h *Handler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
 			linkedCustomFieldIDsJSON, _ := linkedCustomFieldIDsArray.Value()
 			linkedCustomFieldValueIDsJSON, _ := linkedCustomFieldValueIDsArray.Value()
 
-			_, err = tx.Exec(
+			_, err = tx.ExecContext(ctx,
 				`INSERT INTO custom_fields_values (id, value, custom_field_id, linked_custom_fields_ids, linked_custom_fields_values_ids, created_at, updated_at)
 				VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
 				ON CONFLICT (id) DO UPDATE SET
@@ -387,8 +442,7 @@ func (h *Handler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
 				linkedCustomFieldValueIDsJSON,
 			)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
 		}
 	}
@@ -409,14 +463,14 @@ func (h *Handler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
 				if oldID, err := uuid.Parse(oldIDStr); err == nil {
 					// Check if this value is used by other custom_fields
 					var count int
-					err = tx.QueryRow(
+					err = tx.QueryRowContext(ctx,
 						`SELECT COUNT(*) FROM custom_fields 
 						WHERE id != $1 AND allowed_values_ids @> $2::text::jsonb`,
 						id, `["`+oldIDStr+`"]`,
 					).Scan(&count)
 					if err == nil && count == 0 {
 						// Not used by other definitions, safe to delete
-						tx.Exec(`DELETE FROM custom_fields_values WHERE id = $1`, oldID)
+						tx.ExecContext(ctx, `DELETE FROM custom_fields_values WHERE id = $1`, oldID)
 					}
 				}
 			}
@@ -427,71 +481,68 @@ func (h *Handler) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
 	allowedValueIDsArray := UUIDArray(allowedValueIDs)
 	allowedValueIDsJSON, _ := allowedValueIDsArray.Value()
 
-	_, err = tx.Exec(
+	_, err = tx.ExecContext(ctx,
 		`UPDATE custom_fields SET label = $1, allowed_values_ids = $2, updated_at = NOW() WHERE id = $3`,
 		f.Label, allowedValueIDsJSON, id,
 	)
+	return err
+}
 
+func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err = h.deleteCustomField(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Field not found", http.StatusNotFound)
 		return
 	}
-
-	f.ID = id
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(f)
-}
-
-func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := uuid.Parse(vars["id"])
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteCustomField deletes custom field id: its values are removed from
+// positions and its levels from tree definitions. It returns sql.ErrNoRows if
+// the field does not exist.
+func (h *Handler) deleteCustomField(ctx context.Context, id uuid.UUID) error {
 	// Get field key before deletion
 	var fieldKey string
-	log.Printf("[DeleteCustomField] Deleting custom field %s", id.String())
-	err = h.db.QueryRow(
+	logf(ctx, "[DeleteCustomField] Deleting custom field %s", id.String())
+	err := h.db.QueryRowContext(ctx,
 		"SELECT key FROM custom_fields WHERE id = $1",
 		id,
 	).Scan(&fieldKey)
 
-	if err == sql.ErrNoRows {
-		http.Error(w, "Field not found", http.StatusNotFound)
-		return
-	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	// Start transaction to ensure atomicity
-	tx, err := h.db.Begin()
+	tx, err := h.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("[DeleteCustomField] begin tx error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logErrorf(ctx, "[DeleteCustomField] begin tx error: %v", err)
+		return err
 	}
 	defer tx.Rollback()
 
 	// Get allowed_values_ids for this field to remove them (and the field itself)
 	// from all positions.
 	var allowedValueIDsJSON []byte
-	err = tx.QueryRow(
+	err = tx.QueryRowContext(ctx,
 		`SELECT allowed_values_ids FROM custom_fields WHERE id = $1`,
 		id,
 	).Scan(&allowedValueIDsJSON)
 
 	if err == nil && allowedValueIDsJSON != nil {
-		log.Printf("[DeleteCustomField] Loaded allowed_values_ids for field %s", id.String())
+		logf(ctx, "[DeleteCustomField] Loaded allowed_values_ids for field %s", id.String())
 		var valueIDs []string
 		if err := json.Unmarshal(allowedValueIDsJSON, &valueIDs); err == nil && len(valueIDs) > 0 {
 			// Prepare sets for fast lookup:
@@ -507,14 +558,13 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 			// ВАЖНО: мы сначала собираем все изменения в память, а затем выполняем UPDATE,
 			// чтобы не вызывать Exec на том же соединении, пока открыт rows (иначе pq путается
 			// в протоколе и выдаёт "unexpected Parse response 'C'").
-			rows, err := tx.Query(`
+			rows, err := tx.QueryContext(ctx, `
 				SELECT id, custom_fields_ids, custom_fields_values_ids 
 				FROM positions 
 				WHERE custom_fields_ids IS NOT NULL OR custom_fields_values_ids IS NOT NULL`)
 			if err != nil {
-				log.Printf("[DeleteCustomField] query positions error: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				logErrorf(ctx, "[DeleteCustomField] query positions error: %v", err)
+				return err
 			}
 			defer rows.Close()
 
@@ -530,9 +580,8 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 				var positionID int64
 				var cfIDsJSON, cfValuesJSON []byte
 				if err := rows.Scan(&positionID, &cfIDsJSON, &cfValuesJSON); err != nil {
-					log.Printf("[DeleteCustomField] scan position row error: %v", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+					logErrorf(ctx, "[DeleteCustomField] scan position row error: %v", err)
+					return err
 				}
 
 				// custom_fields_ids and custom_fields_values_ids are stored
@@ -540,18 +589,16 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 				var cfIDs []string
 				if cfIDsJSON != nil {
 					if err := json.Unmarshal(cfIDsJSON, &cfIDs); err != nil {
-						log.Printf("[DeleteCustomField] unmarshal custom_fields_ids error: %v", err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
+						logErrorf(ctx, "[DeleteCustomField] unmarshal custom_fields_ids error: %v", err)
+						return err
 					}
 				}
 
 				var cfValueIDs []string
 				if cfValuesJSON != nil {
 					if err := json.Unmarshal(cfValuesJSON, &cfValueIDs); err != nil {
-						log.Printf("[DeleteCustomField] unmarshal custom_fields_values_ids error: %v", err)
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
+						logErrorf(ctx, "[DeleteCustomField] unmarshal custom_fields_values_ids error: %v", err)
+						return err
 					}
 				}
 
@@ -589,16 +636,14 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 
 				newCFIDsJSON, err := json.Marshal(cfIDs)
 				if err != nil {
-					log.Printf("[DeleteCustomField] marshal new custom_fields_ids error: %v", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+					logErrorf(ctx, "[DeleteCustomField] marshal new custom_fields_ids error: %v", err)
+					return err
 				}
 
 				newCFValuesJSON, err := json.Marshal(cfValueIDs)
 				if err != nil {
-					log.Printf("[DeleteCustomField] marshal new custom_fields_values_ids error: %v", err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+					logErrorf(ctx, "[DeleteCustomField] marshal new custom_fields_values_ids error: %v", err)
+					return err
 				}
 
 				updates = append(updates, positionUpdate{
@@ -608,14 +653,13 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 				})
 			}
 			if err := rows.Err(); err != nil {
-				log.Printf("[DeleteCustomField] rows.Err(): %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				logErrorf(ctx, "[DeleteCustomField] rows.Err(): %v", err)
+				return err
 			}
 
 			// Выполняем UPDATE по всем накопленным позициям.
 			for _, upd := range updates {
-				_, err = tx.Exec(
+				_, err = tx.ExecContext(ctx,
 					`UPDATE positions 
 					SET custom_fields_ids = $1, custom_fields_values_ids = $2, updated_at = NOW()
 					WHERE id = $3`,
@@ -624,17 +668,15 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 					upd.id,
 				)
 				if err != nil {
-					log.Printf("[DeleteCustomField] update position %d error: %v", upd.id, err)
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
+					logErrorf(ctx, "[DeleteCustomField] update position %d error: %v", upd.id, err)
+					return err
 				}
 			}
 		}
 	}
 	if err != nil {
-		log.Printf("[DeleteCustomField] error loading allowed_values_ids: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logErrorf(ctx, "[DeleteCustomField] error loading allowed_values_ids: %v", err)
+		return err
 	}
 
 	// Remove levels from tree_definitions that use this custom field.
@@ -646,15 +688,14 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 		levelsJSON   []byte
 	}
 
-	treeRows, err := tx.Query(
+	treeRows, err := tx.QueryContext(ctx,
 		`SELECT id, levels FROM tree_definitions 
 		WHERE levels::text LIKE '%' || $1 || '%'`,
 		fieldKey,
 	)
 	if err != nil {
-		log.Printf("[DeleteCustomField] query tree_definitions error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logErrorf(ctx, "[DeleteCustomField] query tree_definitions error: %v", err)
+		return err
 	}
 	defer treeRows.Close()
 
@@ -664,17 +705,15 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 		var treeID uuid.UUID
 		var levelsJSON []byte
 		if err := treeRows.Scan(&treeID, &levelsJSON); err != nil {
-			log.Printf("[DeleteCustomField] scan tree_definitions row error: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			logErrorf(ctx, "[DeleteCustomField] scan tree_definitions row error: %v", err)
+			return err
 		}
 
 		// Parse levels JSON
 		var levels []TreeLevel
 		if err := json.Unmarshal(levelsJSON, &levels); err != nil {
-			log.Printf("[DeleteCustomField] unmarshal levels JSON error: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			logErrorf(ctx, "[DeleteCustomField] unmarshal levels JSON error: %v", err)
+			return err
 		}
 
 		// Filter out levels that use the deleted field
@@ -692,39 +731,34 @@ func (h *Handler) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 	if err = treeRows.Err(); err != nil {
-		log.Printf("[DeleteCustomField] tree_definitions rows.Err(): %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logErrorf(ctx, "[DeleteCustomField] tree_definitions rows.Err(): %v", err)
+		return err
 	}
 
 	for _, upd := range treeUpdates {
-		_, err = tx.Exec(
+		_, err = tx.ExecContext(ctx,
 			`UPDATE tree_definitions 
 			SET levels = $1, updated_at = NOW() 
 			WHERE id = $2`,
 			upd.levelsJSON, upd.id,
 		)
 		if err != nil {
-			log.Printf("[DeleteCustomField] update tree_definitions %s error: %v", upd.id.String(), err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			logErrorf(ctx, "[DeleteCustomField] update tree_definitions %s error: %v", upd.id.String(), err)
+			return err
 		}
 	}
 
 	// Delete the custom field definition
-	_, err = tx.Exec("DELETE FROM custom_fields WHERE id = $1", id)
+	_, err = tx.ExecContext(ctx, "DELETE FROM custom_fields WHERE id = $1", id)
 	if err != nil {
-		log.Printf("[DeleteCustomField] delete custom_fields error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logErrorf(ctx, "[DeleteCustomField] delete custom_fields error: %v", err)
+		return err
 	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
-		log.Printf("[DeleteCustomField] tx commit error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		logErrorf(ctx, "[DeleteCustomField] tx commit error: %v", err)
+		return err
 	}
-
-	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 
@@ -9,11 +10,11 @@ import (
 
 // CustomFieldsService provides reusable functions for working with custom fields
 type CustomFieldsService struct {
-	db *sql.DB
+	db dbQuerier
 }
 
 // NewCustomFieldsService creates a new CustomFieldsService
-func NewCustomFieldsService(db *sql.DB) *CustomFieldsService {
+func NewCustomFieldsService(db dbQuerier) *CustomFieldsService {
 	return &CustomFieldsService{db: db}
 }
 
@@ -33,9 +34,12 @@ type ValueInfoMap map[uuid.UUID]string
 type FieldToValuesMap map[uuid.UUID]map[uuid.UUID]bool
 
 // LoadFieldInfoMap loads all custom field definitions into a map
-func (s *CustomFieldsService) LoadFieldInfoMap() (FieldInfoMap, error) {
+func (s *CustomFieldsService) LoadFieldInfoMap(ctx context.Context) (FieldInfoMap, error) {
+	ctx, span := tracer.Start(ctx, "CustomFieldsService.LoadFieldInfoMap")
+	defer span.End()
+
 	fieldInfoMap := make(FieldInfoMap)
-	rows, err := s.db.Query(`SELECT id, key, label FROM custom_fields`)
+	rows, err := s.db.QueryContext(ctx, `SELECT id, key, label FROM custom_fields`)
 	if err != nil {
 		return nil, err
 	}
@@ -52,9 +56,12 @@ func (s *CustomFieldsService) LoadFieldInfoMap() (FieldInfoMap, error) {
 }
 
 // LoadValueInfoMap loads all custom field values into a map
-func (s *CustomFieldsService) LoadValueInfoMap() (ValueInfoMap, error) {
+func (s *CustomFieldsService) LoadValueInfoMap(ctx context.Context) (ValueInfoMap, error) {
+	ctx, span := tracer.Start(ctx, "CustomFieldsService.LoadValueInfoMap")
+	defer span.End()
+
 	valueInfoMap := make(ValueInfoMap)
-	rows, err := s.db.Query(`SELECT id, value FROM custom_fields_values`)
+	rows, err := s.db.QueryContext(ctx, `SELECT id, value FROM custom_fields_values`)
 	if err != nil {
 		return nil, err
 	}
@@ -71,9 +78,12 @@ func (s *CustomFieldsService) LoadValueInfoMap() (ValueInfoMap, error) {
 }
 
 // LoadFieldToValuesMap loads the mapping of which values belong to which fields
-func (s *CustomFieldsService) LoadFieldToValuesMap() (FieldToValuesMap, error) {
+func (s *CustomFieldsService) LoadFieldToValuesMap(ctx context.Context) (FieldToValuesMap, error) {
+	ctx, span := tracer.Start(ctx, "CustomFieldsService.LoadFieldToValuesMap")
+	defer span.End()
+
 	fieldToValuesMap := make(FieldToValuesMap)
-	rows, err := s.db.Query(`SELECT id, allowed_values_ids FROM custom_fields WHERE allowed_values_ids IS NOT NULL`)
+	rows, err := s.db.QueryContext(ctx, `SELECT id, allowed_values_ids FROM custom_fields WHERE allowed_values_ids IS NOT NULL`)
 	if err != nil {
 		return fieldToValuesMap, nil // Return empty map on error, not critical
 	}
@@ -99,18 +109,21 @@ func (s *CustomFieldsService) LoadFieldToValuesMap() (FieldToValuesMap, error) {
 }
 
 // LoadAllCustomFieldsData loads all custom fields related data in one call
-func (s *CustomFieldsService) LoadAllCustomFieldsData() (FieldInfoMap, ValueInfoMap, FieldToValuesMap, error) {
-	fieldInfoMap, err := s.LoadFieldInfoMap()
+func (s *CustomFieldsService) LoadAllCustomFieldsData(ctx context.Context) (FieldInfoMap, ValueInfoMap, FieldToValuesMap, error) {
+	ctx, span := tracer.Start(ctx, "CustomFieldsService.LoadAllCustomFieldsData")
+	defer span.End()
+
+	fieldInfoMap, err := s.LoadFieldInfoMap(ctx)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	valueInfoMap, err := s.LoadValueInfoMap()
+	valueInfoMap, err := s.LoadValueInfoMap(ctx)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	fieldToValuesMap, err := s.LoadFieldToValuesMap()
+	fieldToValuesMap, err := s.LoadFieldToValuesMap(ctx)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -204,4 +217,161 @@ func (s *CustomFieldsService) BuildLinkedCustomFields(
 	return linkedFields, nil
 }
 
+// BuildCustomFieldsArrayFromIDs builds the nested custom_fields array structure
+// customFieldsIDs          - массив ID кастомных полей (custom_field_id) для позиции
+// customFieldsValuesIDs    - массив ID выбранных значений (custom_field_value_id и linked_custom_field_value_id)
+func (s *CustomFieldsService) BuildCustomFieldsArrayFromIDs(ctx context.Context, customFieldsIDs *UUIDArray, customFieldsValuesIDs *UUIDArray) ([]PositionCustomFieldValue, error) {
+	ctx, span := tracer.Start(ctx, "CustomFieldsService.BuildCustomFieldsArrayFromIDs")
+	defer span.End()
 
+	customFieldsArray := []PositionCustomFieldValue{}
+
+	if customFieldsIDs == nil || len(*customFieldsIDs) == 0 || customFieldsValuesIDs == nil || len(*customFieldsValuesIDs) == 0 {
+		return customFieldsArray, nil
+	}
+
+	// Build a set of selected value IDs (как для основных, так и для привязанных значений)
+	selectedValueIDs := make(map[uuid.UUID]bool)
+	if customFieldsValuesIDs != nil {
+		for _, id := range *customFieldsValuesIDs {
+			selectedValueIDs[id] = true
+		}
+	}
+
+	// Load all custom fields data using service
+	fieldInfoMap, valueInfoMap, fieldToValuesMap, err := s.LoadAllCustomFieldsData(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load all custom field definitions
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, key, label, allowed_values_ids, created_at, updated_at
+		FROM custom_fields`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Build a map of custom field definitions by ID and map valueID -> fieldID
+	fieldDefsByID := make(map[uuid.UUID]CustomFieldDefinition)
+	valueToFieldMap := make(map[uuid.UUID]uuid.UUID) // Maps value ID to field ID
+	for rows.Next() {
+		var f CustomFieldDefinition
+		var allowedValueIDsJSON []byte
+		err := rows.Scan(&f.ID, &f.Key, &f.Label, &allowedValueIDsJSON,
+			&f.CreatedAt, &f.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		fieldDefsByID[f.ID] = f
+
+		// Map each allowed value to this field
+		if allowedValueIDsJSON != nil {
+			var ids []string
+			if err := json.Unmarshal(allowedValueIDsJSON, &ids); err == nil {
+				for _, idStr := range ids {
+					if valueID, err := uuid.Parse(idStr); err == nil {
+						valueToFieldMap[valueID] = f.ID
+					}
+				}
+			}
+		}
+	}
+
+	// Построим отображение: ID поля -> выбранное для него значение (valueID)
+	fieldToSelectedValue := make(map[uuid.UUID]uuid.UUID)
+	for _, valueID := range *customFieldsValuesIDs {
+		fieldID, exists := valueToFieldMap[valueID]
+		if !exists {
+			continue
+		}
+		// Берём первое найденное значение для поля (предполагаем по одному значению на поле)
+		if _, already := fieldToSelectedValue[fieldID]; !already {
+			fieldToSelectedValue[fieldID] = valueID
+		}
+	}
+
+	// Process each field ID from the position (верхнеуровневые поля должности)
+	for _, fieldID := range *customFieldsIDs {
+		valueID, hasValue := fieldToSelectedValue[fieldID]
+		if !hasValue {
+			continue
+		}
+
+		fieldDef := fieldDefsByID[fieldID]
+		valueText := valueInfoMap[valueID]
+
+		// Build linked custom fields structure from custom_fields_values
+		// Also load superior information (superior position ID and employee full name)
+		var linkedCustomFieldIDsJSON []byte
+		var linkedCustomFieldValueIDsJSON []byte
+		var superior sql.NullInt64
+		var superiorSurname sql.NullString
+		var superiorEmployeeName sql.NullString
+		var superiorPatronymic sql.NullString
+		err := s.db.QueryRowContext(ctx,
+			`SELECT cfv.linked_custom_fields_ids, cfv.linked_custom_fields_values_ids, 
+			        cfv.superior, p.employee_surname, p.employee_name, p.employee_patronymic
+			FROM custom_fields_values cfv
+			LEFT JOIN positions p ON cfv.superior = p.id
+			WHERE cfv.id = $1`,
+			valueID,
+		).Scan(&linkedCustomFieldIDsJSON, &linkedCustomFieldValueIDsJSON, 
+			&superior, &superiorSurname, &superiorEmployeeName, &superiorPatronymic)
+
+		var linkedFields []LinkedCustomField
+		if err == nil {
+			linkedFields, _ = s.BuildLinkedCustomFields(
+				linkedCustomFieldIDsJSON,
+				linkedCustomFieldValueIDsJSON,
+				fieldInfoMap,
+				fieldToValuesMap,
+				valueInfoMap,
+				selectedValueIDs,
+			)
+		}
+
+		// Build superior employee full name if superior exists
+		var superiorEmployeeFullName *string
+		if superior.Valid && (superiorSurname.Valid || superiorEmployeeName.Valid || superiorPatronymic.Valid) {
+			var surnamePtr, employeeNamePtr, patronymicPtr *string
+			if superiorSurname.Valid {
+				surnamePtr = &superiorSurname.String
+			}
+			if superiorEmployeeName.Valid {
+				employeeNamePtr = &superiorEmployeeName.String
+			}
+			if superiorPatronymic.Valid {
+				patronymicPtr = &superiorPatronymic.String
+			}
+			fullName := combineEmployeeFullName(surnamePtr, employeeNamePtr, patronymicPtr)
+			if fullName != nil && *fullName != "" {
+				superiorEmployeeFullName = fullName
+			}
+		}
+
+		// Extract superior position ID
+		var superiorID *int64
+		if superior.Valid {
+			superiorID = &superior.Int64
+		}
+
+		valueItem := PositionCustomFieldValue{
+			CustomFieldID:           fieldDef.ID.String(),
+			CustomFieldKey:          fieldDef.Key,
+			CustomFieldLabel:        fieldDef.Label,
+			CustomFieldValue:        valueText,
+			CustomFieldValueID:      valueID,
+			Superior:                superiorID,
+			SuperiorEmployeeFullName: superiorEmployeeFullName,
+		}
+		if len(linkedFields) > 0 {
+			valueItem.LinkedCustomFields = linkedFields
+		}
+		customFieldsArray = append(customFieldsArray, valueItem)
+	}
+
+	return customFieldsArray, nil
+}
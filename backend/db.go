@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// dbQuerier is implemented by both *sql.DB and *sql.Tx. Read helpers that take
+// it can run inside a transaction; they must not issue a query while rows of
+// another query are still open, as a transaction uses a single connection.
+type dbQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 func NewDB() (*sql.DB, error) {
 	host := os.Getenv("DB_HOST")
 	if host == "" {
@@ -37,11 +48,17 @@ func NewDB() (*sql.DB, error) {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
 		host, port, user, password, dbname, sslmode)
 
-	db, err := sql.Open("postgres", connStr)
+	db, err := openTracedDB("postgres", connStr)
 	if err != nil {
 		return nil, err
 	}
 
+	// Connection pool settings
+	db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 25))
+	db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 25))
+	db.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute))
+	db.SetConnMaxIdleTime(envDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute))
+
 	if err := db.Ping(); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// runDiagnosticsCommand implements the `diagnostics` subcommand
+func runDiagnosticsCommand(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("diagnostics", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server diagnostics [-checks list] [-fix list] [-json]")
+		fmt.Fprintln(fs.Output(), "\nchecks:")
+		for _, name := range diagnosticChecks {
+			fix := diagnosticFixes[name]
+			if fix != "" {
+				fix = "fix: " + fix
+			}
+			fmt.Fprintf(fs.Output(), "  %-24s %s\n", name, fix)
+		}
+		fmt.Fprintln(fs.Output(), "\nflags:")
+		fs.PrintDefaults()
+	}
+	checksFlag := fs.String("checks", "", "comma-separated checks to run (default all)")
+	fixFlag := fs.String("fix", "", "comma-separated checks to auto-fix before reporting")
+	jsonFlag := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	checks, err := parseDiagnosticChecks(*checksFlag)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if *fixFlag != "" {
+		fixChecks, err := parseFixableChecks(*fixFlag)
+		if err != nil {
+			return err
+		}
+		if loadChangeApprovalConfig().enabled {
+			if name, ok := diagnosticFixNeedingApproval(fixChecks); ok {
+				return fmt.Errorf("fixing %s requires approval while CHANGE_APPROVAL_ENABLED is set; submit the changes as change requests", name)
+			}
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		fixed, err := fixDiagnostics(ctx, tx, fixChecks)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(fixed))
+		for name := range fixed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "fixed %d %s\n", fixed[name], name)
+		}
+	}
+
+	report, err := runDiagnostics(ctx, db, checks)
+	if err != nil {
+		return err
+	}
+
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(report.Issues) > 0 {
+		fmt.Fprintln(tw, "CHECK\tSEVERITY\tMESSAGE")
+		for _, issue := range report.Issues {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", issue.Check, issue.Severity, issue.Message)
+		}
+		fmt.Fprintln(tw)
+	}
+	var summary []string
+	for _, name := range diagnosticChecks {
+		if checks[name] {
+			summary = append(summary, fmt.Sprintf("%s: %d", name, report.Summary[name]))
+		}
+	}
+	fmt.Fprintf(tw, "%d issues (%s)\n", len(report.Issues), strings.Join(summary, ", "))
+	return tw.Flush()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GetDiagnostics runs data quality checks; ?checks= selects some of them
+func (h *Handler) GetDiagnostics(w http.ResponseWriter, r *http.Request) {
+	checks, err := parseDiagnosticChecks(r.URL.Query().Get("checks"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := runDiagnostics(r.Context(), h.db, checks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// FixDiagnostics applies the auto-fixes of the listed checks in one
+// transaction and answers with the number of fixed issues and a new report
+func (h *Handler) FixDiagnostics(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Checks []string `json:"checks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Checks) == 0 {
+		http.Error(w, "checks is required", http.StatusBadRequest)
+		return
+	}
+	checks, err := parseFixableChecks(strings.Join(req.Checks, ","))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.approval.enabled {
+		if name, ok := diagnosticFixNeedingApproval(checks); ok {
+			http.Error(w, fmt.Sprintf("Fixing %s requires approval; submit the changes as change requests", name), http.StatusConflict)
+			return
+		}
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	fixed, err := fixDiagnostics(r.Context(), tx, checks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logf(r.Context(), "Diagnostics fixes applied: %v", fixed)
+
+	report, err := runDiagnostics(r.Context(), h.db, checks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fixed":  fixed,
+		"report": report,
+	})
+}
+
+// parseFixableChecks parses a list of checks that all must have an auto-fix
+func parseFixableChecks(list string) (map[string]bool, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, fmt.Errorf("no checks to fix")
+	}
+	checks, err := parseDiagnosticChecks(list)
+	if err != nil {
+		return nil, err
+	}
+	for name := range checks {
+		if _, ok := diagnosticFixes[name]; !ok {
+			return nil, fmt.Errorf("check %q has no auto-fix", name)
+		}
+	}
+	return checks, nil
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Data quality checks
+const (
+	diagDuplicateEmployeeID   = "duplicate_employee_id"
+	diagDuplicateEmployeeName = "duplicate_employee_name"
+	diagIncompleteEmployee    = "incomplete_employee"
+	diagOrphanValue           = "orphan_value"
+	diagLinkedFieldMismatch   = "linked_field_mismatch"
+	diagDanglingSuperior      = "dangling_superior"
+	diagUnusedAllowedValue    = "unused_allowed_value"
+)
+
+// diagnosticChecks lists all checks in report order
+var diagnosticChecks = []string{
+	diagDuplicateEmployeeID,
+	diagDuplicateEmployeeName,
+	diagIncompleteEmployee,
+	diagOrphanValue,
+	diagLinkedFieldMismatch,
+	diagDanglingSuperior,
+	diagUnusedAllowedValue,
+}
+
+// diagnosticFixes describes the auto-fix of the checks that have one.
+// Duplicates and incomplete employee data need a human decision.
+var diagnosticFixes = map[string]string{
+	diagOrphanValue:         "remove the value from the position",
+	diagLinkedFieldMismatch: "remove the linked value from the position",
+	diagDanglingSuperior:    "clear the superior of the value",
+	diagUnusedAllowedValue:  "delete the allowed value",
+}
+
+// diagnosticFixNeedingApproval returns the first selected check whose fix
+// clears superiors or deletes allowed values, which go through change
+// requests when approval is enabled
+func diagnosticFixNeedingApproval(checks map[string]bool) (string, bool) {
+	for _, name := range diagnosticChecks {
+		if checks[name] && (name == diagDanglingSuperior || name == diagUnusedAllowedValue) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Issue severities
+const (
+	diagSeverityError   = "error"
+	diagSeverityWarning = "warning"
+	diagSeverityInfo    = "info"
+)
+
+// DiagnosticIssue is one problem found by a check
+type DiagnosticIssue struct {
+	Check         string     `json:"check"`
+	Severity      string     `json:"severity"`
+	Message       string     `json:"message"`
+	PositionIDs   []int64    `json:"position_ids,omitempty"`
+	EmployeeIDs   []int64    `json:"employee_ids,omitempty"`
+	CustomFieldID *uuid.UUID `json:"custom_field_id,omitempty"`
+	ValueID       *uuid.UUID `json:"value_id,omitempty"`
+	Fixable       bool       `json:"fixable"`
+}
+
+// DiagnosticsReport is the result of GET /api/diagnostics
+type DiagnosticsReport struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Summary     map[string]int    `json:"summary"` // number of issues per check that was run
+	Issues      []DiagnosticIssue `json:"issues"`
+}
+
+// parseDiagnosticChecks parses a comma-separated list of checks; an empty list
+// selects all of them
+func parseDiagnosticChecks(list string) (map[string]bool, error) {
+	checks := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			checks[name] = true
+		}
+	}
+	known := make(map[string]bool)
+	for _, name := range diagnosticChecks {
+		known[name] = true
+	}
+	for name := range checks {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown check %q (use %s)", name, strings.Join(diagnosticChecks, ", "))
+		}
+	}
+	if len(checks) == 0 {
+		return known, nil
+	}
+	return checks, nil
+}
+
+// diagnosticsValue is an allowed value as the checks see it
+type diagnosticsValue struct {
+	fieldID  uuid.UUID
+	value    string
+	linked   map[uuid.UUID]map[uuid.UUID]bool // linked field -> its values allowed with this value
+	superior *int64
+}
+
+// diagnosticsData holds custom fields and their values
+type diagnosticsData struct {
+	fieldKeys map[uuid.UUID]string
+	values    map[uuid.UUID]*diagnosticsValue // only values listed in allowed_values_ids of a field
+	allowed   []uuid.UUID                     // allowed values in field order
+}
+
+func loadDiagnosticsData(ctx context.Context, db dbQuerier) (*diagnosticsData, error) {
+	data := &diagnosticsData{
+		fieldKeys: make(map[uuid.UUID]string),
+		values:    make(map[uuid.UUID]*diagnosticsValue),
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT id, key, allowed_values_ids FROM custom_fields ORDER BY key`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var fieldID uuid.UUID
+		var key string
+		var allowed UUIDArray
+		if err := rows.Scan(&fieldID, &key, &allowed); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		data.fieldKeys[fieldID] = key
+		for _, valueID := range allowed {
+			if _, ok := data.values[valueID]; !ok {
+				data.values[valueID] = &diagnosticsValue{fieldID: fieldID}
+				data.allowed = append(data.allowed, valueID)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx,
+		`SELECT id, value, linked_custom_fields_ids, linked_custom_fields_values_ids, superior FROM custom_fields_values`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var valueID uuid.UUID
+		var value string
+		var linkedFieldIDs, linkedValueIDs UUIDArray
+		var superior *int64
+		if err := rows.Scan(&valueID, &value, &linkedFieldIDs, &linkedValueIDs, &superior); err != nil {
+			return nil, err
+		}
+		v, ok := data.values[valueID]
+		if !ok {
+			continue
+		}
+		v.value, v.superior = value, superior
+		// Linked values are grouped by the field they belong to, as in BuildLinkedCustomFields
+		v.linked = make(map[uuid.UUID]map[uuid.UUID]bool)
+		for _, linkedFieldID := range linkedFieldIDs {
+			v.linked[linkedFieldID] = make(map[uuid.UUID]bool)
+		}
+		for _, linkedValueID := range linkedValueIDs {
+			if lv, ok := data.values[linkedValueID]; ok && v.linked[lv.fieldID] != nil {
+				v.linked[lv.fieldID][linkedValueID] = true
+			}
+		}
+	}
+	return data, rows.Err()
+}
+
+// describe names a value for messages, e.g. `"Moscow" (city)`
+func (d *diagnosticsData) describe(valueID uuid.UUID) string {
+	v := d.values[valueID]
+	return fmt.Sprintf("%q (%s)", v.value, d.fieldKeys[v.fieldID])
+}
+
+// runDiagnostics runs the selected checks and returns their issues
+func runDiagnostics(ctx context.Context, db dbQuerier, checks map[string]bool) (DiagnosticsReport, error) {
+	ctx, span := tracer.Start(ctx, "runDiagnostics")
+	defer span.End()
+
+	report := DiagnosticsReport{
+		GeneratedAt: time.Now(),
+		Summary:     make(map[string]int),
+		Issues:      []DiagnosticIssue{},
+	}
+	add := func(issue DiagnosticIssue) {
+		if checks[issue.Check] {
+			_, issue.Fixable = diagnosticFixes[issue.Check]
+			report.Issues = append(report.Issues, issue)
+			report.Summary[issue.Check]++
+		}
+	}
+	for name := range checks {
+		report.Summary[name] = 0
+	}
+
+	data, err := loadDiagnosticsData(ctx, db)
+	if err != nil {
+		return report, err
+	}
+
+	// Superior positions are checked while positions are read
+	isSuperior := make(map[int64]bool)
+	for _, v := range data.values {
+		if v.superior != nil {
+			isSuperior[*v.superior] = true
+		}
+	}
+	superiorExists := make(map[int64]bool)
+	superiorHolds := make(map[uuid.UUID]bool)
+
+	type employeePosition struct {
+		id   int64
+		name string
+	}
+	byEmployeeID := make(map[string][]employeePosition)
+	used := make(map[uuid.UUID]bool)
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name,
+		employee_patronymic, employee_profile_url
+		FROM positions ORDER BY id`,
+	)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var id int64
+		var fieldIDs, valueIDs UUIDArray
+		var e positionEmployeeFields
+		if err := rows.Scan(&id, &fieldIDs, &valueIDs, &e.ExternalID, &e.Surname, &e.EmployeeName,
+			&e.Patronymic, &e.ProfileURL); err != nil {
+			rows.Close()
+			return report, err
+		}
+
+		for _, valueID := range valueIDs {
+			used[valueID] = true
+		}
+		if isSuperior[id] {
+			superiorExists[id] = true
+			for _, valueID := range valueIDs {
+				if v, ok := data.values[valueID]; ok && v.superior != nil && *v.superior == id {
+					superiorHolds[valueID] = true
+				}
+			}
+		}
+		for _, issue := range checkPositionValues(data, id, fieldIDs, valueIDs) {
+			add(issue)
+		}
+
+		if !employeeFieldsEmpty(e) && trimmed(e.Surname) == "" {
+			add(DiagnosticIssue{
+				Check:       diagIncompleteEmployee,
+				Severity:    diagSeverityWarning,
+				Message:     fmt.Sprintf("position %d has employee data without a surname", id),
+				PositionIDs: []int64{id},
+			})
+		}
+		if externalID := strings.ToLower(trimmed(e.ExternalID)); externalID != "" {
+			name := ""
+			if fullName := combineEmployeeFullName(e.Surname, e.EmployeeName, e.Patronymic); fullName != nil {
+				name = strings.ToLower(*fullName)
+			}
+			byEmployeeID[externalID] = append(byEmployeeID[externalID], employeePosition{id, name})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	if checks[diagDuplicateEmployeeID] {
+		// Positions shared by an employee through part-time assignments that
+		// add up to at most one full-time equivalent are fine
+		fte, err := activeEmployeeFTE(ctx, db)
+		if err != nil {
+			return report, err
+		}
+		externalIDs := make([]string, 0, len(byEmployeeID))
+		for externalID, positions := range byEmployeeID {
+			if len(positions) > 1 && fte[externalID] > 1 {
+				externalIDs = append(externalIDs, externalID)
+			}
+		}
+		sort.Strings(externalIDs)
+		for _, externalID := range externalIDs {
+			positions := byEmployeeID[externalID]
+			ids := make([]int64, len(positions))
+			sameName := true
+			for i, p := range positions {
+				ids[i] = p.id
+				sameName = sameName && p.name == positions[0].name
+			}
+			message := fmt.Sprintf("employee_id %q is on %d positions", externalID, len(positions))
+			if !sameName {
+				message += " with different names"
+			}
+			add(DiagnosticIssue{Check: diagDuplicateEmployeeID, Severity: diagSeverityWarning, Message: message, PositionIDs: ids})
+		}
+	}
+
+	if checks[diagDuplicateEmployeeName] {
+		issues, err := duplicateEmployeeNames(ctx, db)
+		if err != nil {
+			return report, err
+		}
+		for _, issue := range issues {
+			add(issue)
+		}
+	}
+
+	for _, valueID := range data.allowed {
+		v := data.values[valueID]
+		valueID := valueID
+		if v.superior != nil && !superiorHolds[valueID] {
+			message := fmt.Sprintf("superior position %d of %s does not have the value", *v.superior, data.describe(valueID))
+			if !superiorExists[*v.superior] {
+				message = fmt.Sprintf("superior position %d of %s does not exist", *v.superior, data.describe(valueID))
+			}
+			add(DiagnosticIssue{
+				Check:       diagDanglingSuperior,
+				Severity:    diagSeverityError,
+				Message:     message,
+				PositionIDs: []int64{*v.superior},
+				ValueID:     &valueID,
+			})
+		}
+		if !used[valueID] {
+			fieldID := v.fieldID
+			add(DiagnosticIssue{
+				Check:         diagUnusedAllowedValue,
+				Severity:      diagSeverityInfo,
+				Message:       fmt.Sprintf("%s is not used by any position", data.describe(valueID)),
+				CustomFieldID: &fieldID,
+				ValueID:       &valueID,
+			})
+		}
+	}
+
+	// Issues are grouped by check in the order of diagnosticChecks
+	order := make(map[string]int)
+	for i, name := range diagnosticChecks {
+		order[name] = i
+	}
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return order[report.Issues[i].Check] < order[report.Issues[j].Check]
+	})
+	return report, nil
+}
+
+// checkPositionValues finds values of a position that belong to no field of
+// the position, and linked values not allowed with the selected value
+func checkPositionValues(data *diagnosticsData, positionID int64, fieldIDs, valueIDs UUIDArray) []DiagnosticIssue {
+	fields := make(map[uuid.UUID]bool)
+	for _, fieldID := range fieldIDs {
+		fields[fieldID] = true
+	}
+	// Linked fields of the selected values with the values allowed in them
+	linked := make(map[uuid.UUID]map[uuid.UUID]bool)
+	linkedBy := make(map[uuid.UUID]uuid.UUID)
+	for _, valueID := range valueIDs {
+		v, ok := data.values[valueID]
+		if !ok {
+			continue
+		}
+		for linkedFieldID, allowed := range v.linked {
+			if linked[linkedFieldID] == nil {
+				linked[linkedFieldID] = make(map[uuid.UUID]bool)
+				linkedBy[linkedFieldID] = valueID
+			}
+			for linkedValueID := range allowed {
+				linked[linkedFieldID][linkedValueID] = true
+			}
+		}
+	}
+
+	var issues []DiagnosticIssue
+	for _, valueID := range valueIDs {
+		valueID := valueID
+		v, ok := data.values[valueID]
+		switch {
+		case !ok:
+			issues = append(issues, DiagnosticIssue{
+				Check:       diagOrphanValue,
+				Severity:    diagSeverityError,
+				Message:     fmt.Sprintf("position %d has value %s that is not an allowed value of any custom field", positionID, valueID),
+				PositionIDs: []int64{positionID},
+				ValueID:     &valueID,
+			})
+		case linked[v.fieldID] != nil && !linked[v.fieldID][valueID]:
+			issues = append(issues, DiagnosticIssue{
+				Check:    diagLinkedFieldMismatch,
+				Severity: diagSeverityError,
+				Message: fmt.Sprintf("position %d has %s that is not linked to %s",
+					positionID, data.describe(valueID), data.describe(linkedBy[v.fieldID])),
+				PositionIDs: []int64{positionID},
+				ValueID:     &valueID,
+			})
+		case !fields[v.fieldID] && linked[v.fieldID] == nil:
+			fieldID := v.fieldID
+			issues = append(issues, DiagnosticIssue{
+				Check:         diagOrphanValue,
+				Severity:      diagSeverityError,
+				Message:       fmt.Sprintf("position %d has %s but not its custom field", positionID, data.describe(valueID)),
+				PositionIDs:   []int64{positionID},
+				CustomFieldID: &fieldID,
+				ValueID:       &valueID,
+			})
+		}
+	}
+	return issues
+}
+
+// activeEmployeeFTE sums the active assignments of employees by lower-cased external ID
+func activeEmployeeFTE(ctx context.Context, db dbQuerier) (map[string]float64, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT LOWER(e.external_id), SUM(a.fte) FROM position_assignments a
+		JOIN employees e ON e.id = a.employee_id
+		WHERE e.external_id IS NOT NULL AND `+assignmentActive+`
+		GROUP BY 1`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fte := make(map[string]float64)
+	for rows.Next() {
+		var externalID string
+		var sum float64
+		if err := rows.Scan(&externalID, &sum); err != nil {
+			return nil, err
+		}
+		fte[externalID] = sum
+	}
+	return fte, rows.Err()
+}
+
+// duplicateEmployeeNames finds employees with the same full name where at
+// least one has no external ID, i.e. was probably entered twice by hand
+func duplicateEmployeeNames(ctx context.Context, db dbQuerier) ([]DiagnosticIssue, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT MIN(CONCAT_WS(' ', surname, name, patronymic)), ARRAY_AGG(id ORDER BY id)
+		FROM employees
+		WHERE surname IS NOT NULL
+		GROUP BY LOWER(CONCAT_WS(' ', surname, name, patronymic))
+		HAVING COUNT(*) > 1 AND BOOL_OR(external_id IS NULL)
+		ORDER BY 1`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	issues := []DiagnosticIssue{}
+	for rows.Next() {
+		var name string
+		var ids []int64
+		if err := rows.Scan(&name, pq.Array(&ids)); err != nil {
+			return nil, err
+		}
+		issues = append(issues, DiagnosticIssue{
+			Check:       diagDuplicateEmployeeName,
+			Severity:    diagSeverityWarning,
+			Message:     fmt.Sprintf("%d employees are named %q", len(ids), name),
+			EmployeeIDs: ids,
+		})
+	}
+	return issues, rows.Err()
+}
+
+// fixDiagnostics applies the auto-fixes of the selected checks within tx and
+// returns the number of fixed issues per check
+func fixDiagnostics(ctx context.Context, tx *sql.Tx, checks map[string]bool) (map[string]int, error) {
+	report, err := runDiagnostics(ctx, tx, checks)
+	if err != nil {
+		return nil, err
+	}
+	data, err := loadDiagnosticsData(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := make(map[string]int)
+	for name := range checks {
+		fixed[name] = 0
+	}
+	removals := make(map[int64]map[uuid.UUID]bool)
+	var positionIDs []int64
+	for _, issue := range report.Issues {
+		if !issue.Fixable {
+			continue
+		}
+		switch issue.Check {
+		case diagOrphanValue, diagLinkedFieldMismatch:
+			positionID := issue.PositionIDs[0]
+			if removals[positionID] == nil {
+				removals[positionID] = make(map[uuid.UUID]bool)
+				positionIDs = append(positionIDs, positionID)
+			}
+			removals[positionID][*issue.ValueID] = true
+		case diagDanglingSuperior:
+			if err := updateValueSuperior(ctx, tx, *issue.ValueID, nil); err != nil {
+				return nil, err
+			}
+		case diagUnusedAllowedValue:
+			if err := deleteAllowedValue(ctx, tx, *issue.CustomFieldID, *issue.ValueID); err != nil {
+				return nil, err
+			}
+		}
+		fixed[issue.Check]++
+	}
+
+	for _, positionID := range positionIDs {
+		if err := removePositionValues(ctx, tx, data, positionID, removals[positionID]); err != nil {
+			return nil, err
+		}
+	}
+	return fixed, nil
+}
+
+// removePositionValues removes values from a position together with the
+// fields left without a value
+func removePositionValues(ctx context.Context, tx dbQuerier, data *diagnosticsData, positionID int64, remove map[uuid.UUID]bool) error {
+	var fieldIDs, valueIDs UUIDArray
+	err := tx.QueryRowContext(ctx,
+		`SELECT custom_fields_id, custom_fields_values_id FROM positions WHERE id = $1 FOR UPDATE`,
+		positionID,
+	).Scan(&fieldIDs, &valueIDs)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	newValues := UUIDArray{}
+	removedFields := make(map[uuid.UUID]bool)
+	keptFields := make(map[uuid.UUID]bool)
+	for _, valueID := range valueIDs {
+		v, known := data.values[valueID]
+		if remove[valueID] {
+			if known {
+				removedFields[v.fieldID] = true
+			}
+			continue
+		}
+		if known {
+			keptFields[v.fieldID] = true
+		}
+		newValues = append(newValues, valueID)
+	}
+	newFields := UUIDArray{}
+	for _, fieldID := range fieldIDs {
+		if !removedFields[fieldID] || keptFields[fieldID] {
+			newFields = append(newFields, fieldID)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE positions SET custom_fields_id = $1, custom_fields_values_id = $2, updated_at = NOW() WHERE id = $3`,
+		newFields, newValues, positionID,
+	)
+	return err
+}
+
+// deleteAllowedValue removes a value from its field and from the linked
+// values of other values, then deletes it
+func deleteAllowedValue(ctx context.Context, tx dbQuerier, fieldID, valueID uuid.UUID) error {
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE custom_fields SET allowed_values_ids = allowed_values_ids - $1::text, updated_at = NOW() WHERE id = $2`,
+		valueID.String(), fieldID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE custom_fields_values
+		SET linked_custom_fields_values_ids = linked_custom_fields_values_ids - $1::text, updated_at = NOW()
+		WHERE linked_custom_fields_values_ids @> jsonb_build_array($1::text)`,
+		valueID.String(),
+	); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM custom_fields_values WHERE id = $1`, valueID)
+	return err
+}
+
+// trimmed returns the trimmed value of an optional string
+func trimmed(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return strings.TrimSpace(*s)
+}
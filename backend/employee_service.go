@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// assignmentActive is true for assignments that cover today; end_date is exclusive
+const assignmentActive = `(a.start_date <= CURRENT_DATE AND (a.end_date IS NULL OR a.end_date > CURRENT_DATE))`
+
+// assignmentPrimaryOrder picks the employee shown on a position when several
+// assignments to it are active
+const assignmentPrimaryOrder = `a.fte DESC, a.start_date, a.id`
+
+const assignmentColumns = `a.id, a.employee_id, a.position_id, COALESCE(p.position_name, a.position_name),
+	a.start_date, a.end_date, a.fte, ` + assignmentActive + `, a.created_at, a.updated_at,
+	e.external_id, e.surname, e.name, e.patronymic, e.profile_url, e.created_at, e.updated_at`
+
+const assignmentFrom = `position_assignments a
+	JOIN employees e ON e.id = a.employee_id
+	LEFT JOIN positions p ON p.id = a.position_id`
+
+const employeeColumns = `id, external_id, surname, name, patronymic, profile_url, created_at, updated_at`
+
+// assignmentDateLayout is the format of assignment dates in the API
+const assignmentDateLayout = "2006-01-02"
+
+func scanEmployee(row interface{ Scan(...interface{}) error }) (Employee, error) {
+	var e Employee
+	err := row.Scan(&e.ID, &e.ExternalID, &e.Surname, &e.Name, &e.Patronymic, &e.ProfileURL, &e.CreatedAt, &e.UpdatedAt)
+	e.FullName = combineEmployeeFullName(e.Surname, e.Name, e.Patronymic)
+	return e, err
+}
+
+// loadAssignments loads assignments matching condition (over aliases a, e and p)
+// together with their employees
+func loadAssignments(ctx context.Context, db dbQuerier, condition, order string, args ...interface{}) ([]PositionAssignment, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+assignmentColumns+` FROM `+assignmentFrom+` WHERE `+condition+` ORDER BY `+order,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignments := []PositionAssignment{}
+	for rows.Next() {
+		var a PositionAssignment
+		var e Employee
+		var startDate time.Time
+		var endDate *time.Time
+		if err := rows.Scan(&a.ID, &a.EmployeeID, &a.PositionID, &a.PositionName,
+			&startDate, &endDate, &a.FTE, &a.Active, &a.CreatedAt, &a.UpdatedAt,
+			&e.ExternalID, &e.Surname, &e.Name, &e.Patronymic, &e.ProfileURL, &e.CreatedAt, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		a.StartDate = startDate.Format(assignmentDateLayout)
+		if endDate != nil {
+			end := endDate.Format(assignmentDateLayout)
+			a.EndDate = &end
+		}
+		e.ID = a.EmployeeID
+		e.FullName = combineEmployeeFullName(e.Surname, e.Name, e.Patronymic)
+		a.Employee = &e
+		assignments = append(assignments, a)
+	}
+	return assignments, rows.Err()
+}
+
+// employeeFieldsEmpty reports whether a position request leaves the position vacant
+func employeeFieldsEmpty(e positionEmployeeFields) bool {
+	for _, v := range []*string{e.Surname, e.EmployeeName, e.Patronymic, e.ExternalID, e.ProfileURL} {
+		if v != nil && strings.TrimSpace(*v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// syncPositionEmployee records the employee fields written to a position as
+// an assignment. The employee is found by external ID (or is the current
+// employee without one when only their data changed) and created otherwise.
+// A different employee replaces the current ones: their assignments to the
+// position are closed today. Empty fields vacate the position.
+func syncPositionEmployee(ctx context.Context, db dbQuerier, positionID int64, e positionEmployeeFields) error {
+	closeOthers := func(employeeID int64) error {
+		_, err := db.ExecContext(ctx,
+			`UPDATE position_assignments
+			SET end_date = GREATEST(start_date, CURRENT_DATE), updated_at = NOW()
+			WHERE position_id = $1 AND employee_id <> $2 AND (end_date IS NULL OR end_date > CURRENT_DATE)`,
+			positionID, employeeID,
+		)
+		return err
+	}
+
+	if employeeFieldsEmpty(e) {
+		return closeOthers(0)
+	}
+
+	var currentID int64
+	var currentExternalID *string
+	err := db.QueryRowContext(ctx,
+		`SELECT a.employee_id, e.external_id FROM position_assignments a
+		JOIN employees e ON e.id = a.employee_id
+		WHERE a.position_id = $1 AND `+assignmentActive+`
+		ORDER BY `+assignmentPrimaryOrder+` LIMIT 1`,
+		positionID,
+	).Scan(&currentID, &currentExternalID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	var externalID *string
+	if e.ExternalID != nil && strings.TrimSpace(*e.ExternalID) != "" {
+		id := strings.TrimSpace(*e.ExternalID)
+		externalID = &id
+	}
+
+	var employeeID int64
+	if externalID != nil {
+		err := db.QueryRowContext(ctx, `SELECT id FROM employees WHERE external_id = $1`, *externalID).Scan(&employeeID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	} else if currentID != 0 && currentExternalID == nil {
+		employeeID = currentID
+	}
+
+	if employeeID == 0 {
+		err = db.QueryRowContext(ctx,
+			`INSERT INTO employees (external_id, surname, name, patronymic, profile_url, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+			RETURNING id`,
+			externalID, e.Surname, e.EmployeeName, e.Patronymic, e.ProfileURL,
+		).Scan(&employeeID)
+	} else {
+		_, err = db.ExecContext(ctx,
+			`UPDATE employees SET external_id = $1, surname = $2, name = $3, patronymic = $4, profile_url = $5, updated_at = NOW()
+			WHERE id = $6`,
+			externalID, e.Surname, e.EmployeeName, e.Patronymic, e.ProfileURL, employeeID,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := closeOthers(employeeID); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx,
+		`INSERT INTO position_assignments (employee_id, position_id, position_name, start_date, fte, created_at, updated_at)
+		SELECT $1, p.id, p.position_name, CURRENT_DATE, 1, NOW(), NOW() FROM positions p
+		WHERE p.id = $2 AND NOT EXISTS (
+			SELECT 1 FROM position_assignments a
+			WHERE a.employee_id = $1 AND a.position_id = $2 AND `+assignmentActive+`
+		)`,
+		employeeID, positionID,
+	); err != nil {
+		return err
+	}
+
+	// Other positions of the employee show the updated data too
+	return refreshEmployeePositions(ctx, db, employeeID)
+}
+
+// refreshPositionEmployee copies the employee of the primary active assignment
+// of a position into its employee columns, or clears them
+func refreshPositionEmployee(ctx context.Context, db dbQuerier, positionID int64) error {
+	var e Employee
+	err := db.QueryRowContext(ctx,
+		`SELECT e.external_id, e.surname, e.name, e.patronymic, e.profile_url
+		FROM position_assignments a JOIN employees e ON e.id = a.employee_id
+		WHERE a.position_id = $1 AND `+assignmentActive+`
+		ORDER BY `+assignmentPrimaryOrder+` LIMIT 1`,
+		positionID,
+	).Scan(&e.ExternalID, &e.Surname, &e.Name, &e.Patronymic, &e.ProfileURL)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx,
+		`UPDATE positions SET employee_id = $1, employee_surname = $2, employee_name = $3, employee_patronymic = $4,
+		employee_profile_url = $5, updated_at = NOW()
+		WHERE id = $6 AND (employee_id, employee_surname, employee_name, employee_patronymic, employee_profile_url)
+			IS DISTINCT FROM ($1, $2, $3, $4, $5)`,
+		e.ExternalID, e.Surname, e.Name, e.Patronymic, e.ProfileURL, positionID,
+	)
+	return err
+}
+
+// refreshEmployeePositions refreshes the employee columns of all positions an
+// employee currently holds
+func refreshEmployeePositions(ctx context.Context, db dbQuerier, employeeID int64) error {
+	rows, err := db.QueryContext(ctx,
+		`SELECT DISTINCT a.position_id FROM position_assignments a
+		WHERE a.employee_id = $1 AND a.position_id IS NOT NULL AND `+assignmentActive,
+		employeeID,
+	)
+	if err != nil {
+		return err
+	}
+	var positionIDs []int64
+	for rows.Next() {
+		var positionID int64
+		if err := rows.Scan(&positionID); err != nil {
+			rows.Close()
+			return err
+		}
+		positionIDs = append(positionIDs, positionID)
+	}
+	rows.Close()
+
+	for _, positionID := range positionIDs {
+		if err := refreshPositionEmployee(ctx, db, positionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEmployee deletes an employee with their assignment history and
+// refreshes the positions they held; found is false for unknown IDs
+func deleteEmployee(ctx context.Context, db dbQuerier, id int64) (found bool, err error) {
+	assignments, err := loadAssignments(ctx, db,
+		`a.employee_id = $1 AND a.position_id IS NOT NULL AND `+assignmentActive, `a.id`, id)
+	if err != nil {
+		return false, err
+	}
+	result, err := db.ExecContext(ctx, "DELETE FROM employees WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	for _, a := range assignments {
+		if err := refreshPositionEmployee(ctx, db, *a.PositionID); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// positionHolder is the employee of the primary active assignment of a position
+type positionHolder struct {
+	EmployeeID int64
+	ExternalID *string
+	FullName   *string
+}
+
+// loadPositionHolders returns the primary employee of every occupied position
+func loadPositionHolders(ctx context.Context, db dbQuerier) (map[int64]positionHolder, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT DISTINCT ON (a.position_id) a.position_id, e.id, e.external_id, e.surname, e.name, e.patronymic
+		FROM position_assignments a JOIN employees e ON e.id = a.employee_id
+		WHERE a.position_id IS NOT NULL AND `+assignmentActive+`
+		ORDER BY a.position_id, `+assignmentPrimaryOrder,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holders := make(map[int64]positionHolder)
+	for rows.Next() {
+		var positionID int64
+		var h positionHolder
+		var surname, name, patronymic *string
+		if err := rows.Scan(&positionID, &h.EmployeeID, &h.ExternalID, &surname, &name, &patronymic); err != nil {
+			return nil, err
+		}
+		h.FullName = combineEmployeeFullName(surname, name, patronymic)
+		holders[positionID] = h
+	}
+	return holders, rows.Err()
+}
+
+// managerResolver finds managers through the superiors of custom field values:
+// the manager of a position is the employee holding the superior position of
+// its most specific value that has one
+type managerResolver struct {
+	fields    []string             // custom field keys, most specific first
+	valueKeys map[uuid.UUID]string // allowed value -> key of its field
+	superiors map[uuid.UUID]*int64
+	holders   map[int64]positionHolder
+}
+
+// newManagerResolver loads what manager lookups need. Without fields the
+// levels of the default tree are used, from the narrowest to the widest.
+func newManagerResolver(ctx context.Context, db dbQuerier, fields []string) (*managerResolver, error) {
+	if len(fields) == 0 {
+		keys, err := defaultTreeFieldKeys(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			fields = append(fields, keys[i])
+		}
+	}
+
+	customFieldsService := NewCustomFieldsService(db)
+	fieldInfoMap, err := customFieldsService.LoadFieldInfoMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fieldToValuesMap, err := customFieldsService.LoadFieldToValuesMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	holders, err := loadPositionHolders(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &managerResolver{
+		fields:    fields,
+		valueKeys: make(map[uuid.UUID]string),
+		superiors: loadSuperiorMap(ctx, db),
+		holders:   holders,
+	}
+	for fieldID, values := range fieldToValuesMap {
+		for valueID := range values {
+			m.valueKeys[valueID] = fieldInfoMap[fieldID].Key
+		}
+	}
+	return m, nil
+}
+
+// fieldValues returns the value a position has for each field, by field key
+func (m *managerResolver) fieldValues(valueIDs []uuid.UUID) map[string]uuid.UUID {
+	values := make(map[string]uuid.UUID)
+	for _, valueID := range valueIDs {
+		if key, ok := m.valueKeys[valueID]; ok {
+			if _, seen := values[key]; !seen {
+				values[key] = valueID
+			}
+		}
+	}
+	return values
+}
+
+// manager returns the manager of employeeID on a position. Vacant superior
+// positions and holders rejected by accept pass the search on to the wider
+// level.
+func (m *managerResolver) manager(positionID, employeeID int64, valueIDs []uuid.UUID, accept func(positionHolder) bool) (positionHolder, bool) {
+	values := m.fieldValues(valueIDs)
+	for _, key := range m.fields {
+		valueID, ok := values[key]
+		if !ok || m.superiors[valueID] == nil || *m.superiors[valueID] == positionID {
+			continue
+		}
+		holder, ok := m.holders[*m.superiors[valueID]]
+		if !ok || holder.EmployeeID == employeeID || (accept != nil && !accept(holder)) {
+			continue
+		}
+		return holder, true
+	}
+	return positionHolder{}, false
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Employee handlers
+
+// GetEmployees lists employees ordered by name. search matches the name parts
+// and the external ID.
+func (h *Handler) GetEmployees(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o >= 0 {
+		offset = o
+	}
+	search := strings.TrimSpace(r.URL.Query().Get("search"))
+
+	rows, err := h.db.QueryContext(r.Context(),
+		`SELECT `+employeeColumns+` FROM employees
+		WHERE $1 = '' OR concat_ws(' ', surname, name, patronymic, external_id) ILIKE '%' || $1 || '%'
+		ORDER BY surname, name, patronymic, id
+		LIMIT $2 OFFSET $3`,
+		search, limit, offset,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	employees := []Employee{}
+	for rows.Next() {
+		e, err := scanEmployee(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		employees = append(employees, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(employees)
+}
+
+// GetEmployee returns an employee with their current assignments
+func (h *Handler) GetEmployee(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	e, err := scanEmployee(h.db.QueryRowContext(r.Context(),
+		`SELECT `+employeeColumns+` FROM employees WHERE id = $1`, id,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Employee not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e.Assignments, err = loadAssignments(r.Context(), h.db,
+		`a.employee_id = $1 AND `+assignmentActive, `a.start_date, a.id`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range e.Assignments {
+		e.Assignments[i].Employee = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+func (h *Handler) CreateEmployee(w http.ResponseWriter, r *http.Request) {
+	var e Employee
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	normalizeEmployee(&e)
+
+	created, err := scanEmployee(h.db.QueryRowContext(r.Context(),
+		`INSERT INTO employees (external_id, surname, name, patronymic, profile_url, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+		RETURNING `+employeeColumns,
+		e.ExternalID, e.Surname, e.Name, e.Patronymic, e.ProfileURL,
+	))
+	if isUniqueViolation(err) {
+		http.Error(w, "Employee with this external_id already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdateEmployee replaces the data of an employee; positions they hold show
+// the new data
+func (h *Handler) UpdateEmployee(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var e Employee
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	normalizeEmployee(&e)
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	updated, err := scanEmployee(tx.QueryRowContext(r.Context(),
+		`UPDATE employees SET external_id = $1, surname = $2, name = $3, patronymic = $4, profile_url = $5, updated_at = NOW()
+		WHERE id = $6
+		RETURNING `+employeeColumns,
+		e.ExternalID, e.Surname, e.Name, e.Patronymic, e.ProfileURL, id,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Employee not found", http.StatusNotFound)
+		return
+	}
+	if isUniqueViolation(err) {
+		http.Error(w, "Employee with this external_id already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := refreshEmployeePositions(r.Context(), tx, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteEmployee deletes an employee with their assignment history and
+// vacates the positions they held
+func (h *Handler) DeleteEmployee(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	found, err := deleteEmployee(r.Context(), tx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Employee not found", http.StatusNotFound)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetEmployeeAssignments returns the full assignment history of an employee, newest first
+func (h *Handler) GetEmployeeAssignments(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRowContext(r.Context(),
+		`SELECT EXISTS (SELECT 1 FROM employees WHERE id = $1)`, id,
+	).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Employee not found", http.StatusNotFound)
+		return
+	}
+
+	assignments, err := loadAssignments(r.Context(), h.db, `a.employee_id = $1`, `a.start_date DESC, a.id DESC`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range assignments {
+		assignments[i].Employee = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignments)
+}
+
+// GetPositionAssignments returns everyone who held a position, newest first
+func (h *Handler) GetPositionAssignments(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	assignments, err := loadAssignments(r.Context(), h.db, `a.position_id = $1`, `a.start_date DESC, a.id DESC`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignments)
+}
+
+// assignmentRequest is the body of the assignment endpoints
+type assignmentRequest struct {
+	PositionID *int64   `json:"position_id"` // only when creating
+	StartDate  string   `json:"start_date"`  // defaults to today
+	EndDate    *string  `json:"end_date"`
+	FTE        *float64 `json:"fte"` // defaults to 1
+}
+
+// parse validates the dates and FTE and returns them in database form
+func (req assignmentRequest) parse() (start time.Time, end *time.Time, fte float64, err error) {
+	start, _ = time.Parse(assignmentDateLayout, time.Now().Format(assignmentDateLayout))
+	if req.StartDate != "" {
+		if start, err = time.Parse(assignmentDateLayout, req.StartDate); err != nil {
+			return start, nil, 0, fmt.Errorf("invalid start_date %q (use YYYY-MM-DD)", req.StartDate)
+		}
+	}
+	if req.EndDate != nil && *req.EndDate != "" {
+		t, parseErr := time.Parse(assignmentDateLayout, *req.EndDate)
+		if parseErr != nil {
+			return start, nil, 0, fmt.Errorf("invalid end_date %q (use YYYY-MM-DD)", *req.EndDate)
+		}
+		if t.Before(start) {
+			return start, nil, 0, fmt.Errorf("end_date is before start_date")
+		}
+		end = &t
+	}
+	fte = 1
+	if req.FTE != nil {
+		fte = *req.FTE
+	}
+	if fte <= 0 || fte > 1 {
+		return start, nil, 0, fmt.Errorf("fte must be greater than 0 and at most 1")
+	}
+	return start, end, fte, nil
+}
+
+// CreateAssignment assigns an employee to a position
+func (h *Handler) CreateAssignment(w http.ResponseWriter, r *http.Request) {
+	employeeID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var req assignmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.PositionID == nil {
+		http.Error(w, "position_id is required", http.StatusBadRequest)
+		return
+	}
+	start, end, fte, err := req.parse()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(r.Context(),
+		`INSERT INTO position_assignments (employee_id, position_id, position_name, start_date, end_date, fte, created_at, updated_at)
+		SELECT e.id, p.id, p.position_name, $3, $4, $5, NOW(), NOW()
+		FROM employees e, positions p WHERE e.id = $1 AND p.id = $2
+		RETURNING id`,
+		employeeID, *req.PositionID, start, end, fte,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Employee or position not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := refreshPositionEmployee(r.Context(), tx, *req.PositionID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeAssignment(w, r, id, http.StatusCreated)
+}
+
+// UpdateAssignment changes the dates and FTE of an assignment; ending an
+// assignment is setting its end_date
+func (h *Handler) UpdateAssignment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var req assignmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.StartDate == "" {
+		http.Error(w, "start_date is required", http.StatusBadRequest)
+		return
+	}
+	start, end, fte, err := req.parse()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var positionID *int64
+	err = tx.QueryRowContext(r.Context(),
+		`UPDATE position_assignments SET start_date = $1, end_date = $2, fte = $3, updated_at = NOW()
+		WHERE id = $4
+		RETURNING position_id`,
+		start, end, fte, id,
+	).Scan(&positionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if positionID != nil {
+		if err := refreshPositionEmployee(r.Context(), tx, *positionID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeAssignment(w, r, id, http.StatusOK)
+}
+
+// DeleteAssignment removes an assignment entered by mistake; to record that
+// an employee left, set end_date instead
+func (h *Handler) DeleteAssignment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var positionID *int64
+	err = tx.QueryRowContext(r.Context(),
+		`DELETE FROM position_assignments WHERE id = $1 RETURNING position_id`, id,
+	).Scan(&positionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if positionID != nil {
+		if err := refreshPositionEmployee(r.Context(), tx, *positionID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeAssignment answers with assignment id
+func (h *Handler) writeAssignment(w http.ResponseWriter, r *http.Request, id int64, status int) {
+	assignments, err := loadAssignments(r.Context(), h.db, `a.id = $1`, `a.id`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(assignments) == 0 {
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(assignments[0])
+}
+
+// normalizeEmployee trims the employee data and turns empty strings into nulls
+func normalizeEmployee(e *Employee) {
+	for _, field := range []**string{&e.ExternalID, &e.Surname, &e.Name, &e.Patronymic, &e.ProfileURL} {
+		if *field == nil {
+			continue
+		}
+		value := strings.TrimSpace(**field)
+		if value == "" {
+			*field = nil
+		} else {
+			*field = &value
+		}
+	}
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
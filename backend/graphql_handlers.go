@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	graphqlotel "github.com/graph-gophers/graphql-go/trace/otel"
+)
+
+// graphqlMaxDepth limits the nesting of GraphQL queries. It leaves room for
+// the children of deep trees while rejecting runaway queries.
+const graphqlMaxDepth = 30
+
+// newGraphQLSchema parses graphqlSchema with the resolvers of h. Resolver
+// spans are recorded with the application tracer.
+func newGraphQLSchema(h *Handler) *graphql.Schema {
+	return graphql.MustParseSchema(graphqlSchema, &graphqlResolver{h: h},
+		graphql.MaxDepth(graphqlMaxDepth),
+		graphql.Tracer(&graphqlotel.Tracer{Tracer: tracer}),
+	)
+}
+
+// GraphQL executes a GraphQL request: {"query", "operationName", "variables"}.
+// Errors are reported in the "errors" of the response, as GraphQL clients
+// expect; only a malformed request body is answered with 400.
+func (h *Handler) GraphQL(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphqlLoadersKey{}, newGraphQLLoaders(h.db))
+	ctx = context.WithValue(ctx, graphqlUserKey{}, currentUserID(r))
+	response := h.schema.Exec(ctx, params.Query, params.OperationName, params.Variables)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
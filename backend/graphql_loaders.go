@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/graph-gophers/dataloader"
+	"github.com/lib/pq"
+)
+
+// graphqlLoaders batches and caches the lookups of one GraphQL request, so
+// nested fields of a list do not query the database once per item
+type graphqlLoaders struct {
+	db        dbQuerier
+	positions *dataloader.Loader // position ID -> *Position
+	superiors *dataloader.Loader // custom field value ID -> *int64 superior position ID
+
+	mu     sync.Mutex
+	fields *graphqlFieldIndex // loaded on first use
+}
+
+// graphqlLoadersKey is the context key of the request's graphqlLoaders
+type graphqlLoadersKey struct{}
+
+func newGraphQLLoaders(db dbQuerier) *graphqlLoaders {
+	l := &graphqlLoaders{db: db}
+	l.positions = dataloader.NewBatchedLoader(l.loadPositions)
+	l.superiors = dataloader.NewBatchedLoader(l.loadSuperiors)
+	return l
+}
+
+// loadersFrom returns the loaders of the GraphQL request of ctx
+func loadersFrom(ctx context.Context) *graphqlLoaders {
+	return ctx.Value(graphqlLoadersKey{}).(*graphqlLoaders)
+}
+
+// clear drops everything cached; mutations call it so their results and
+// later fields see the changed data
+func (l *graphqlLoaders) clear() {
+	l.positions.ClearAll()
+	l.superiors.ClearAll()
+	l.mu.Lock()
+	l.fields = nil
+	l.mu.Unlock()
+}
+
+// position returns the position with the given ID or nil if there is none
+func (l *graphqlLoaders) position(ctx context.Context, id int64) (*Position, error) {
+	data, err := l.positions.Load(ctx, dataloader.StringKey(strconv.FormatInt(id, 10)))()
+	if err != nil {
+		return nil, err
+	}
+	return data.(*Position), nil
+}
+
+// superior returns the superior position of a custom field value or nil if
+// it has none
+func (l *graphqlLoaders) superior(ctx context.Context, valueID uuid.UUID) (*Position, error) {
+	data, err := l.superiors.Load(ctx, dataloader.StringKey(valueID.String()))()
+	if err != nil {
+		return nil, err
+	}
+	superior := data.(*int64)
+	if superior == nil {
+		return nil, nil
+	}
+	return l.position(ctx, *superior)
+}
+
+func (l *graphqlLoaders) loadPositions(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+	ids := make([]int64, len(keys))
+	for i, key := range keys {
+		ids[i], _ = strconv.ParseInt(key.String(), 10, 64)
+	}
+
+	positions := make(map[int64]*Position, len(keys))
+	err := func() error {
+		rows, err := l.db.QueryContext(ctx,
+			`SELECT id, position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic,
+			employee_profile_url, created_at, updated_at
+			FROM positions WHERE id = ANY($1::bigint[])`,
+			pq.Array(ids),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p Position
+			var customFieldsIDsJSON, customFieldsValuesIDsJSON []byte
+			if err := rows.Scan(&p.ID, &p.Name, &customFieldsIDsJSON, &customFieldsValuesIDsJSON,
+				&p.EmployeeExternalID, &p.Surname, &p.EmployeeName, &p.Patronymic, &p.EmployeeProfileURL,
+				&p.CreatedAt, &p.UpdatedAt); err != nil {
+				return err
+			}
+			if customFieldsIDsJSON != nil {
+				json.Unmarshal(customFieldsIDsJSON, &p.CustomFieldsIDs)
+			}
+			if customFieldsValuesIDsJSON != nil {
+				json.Unmarshal(customFieldsValuesIDsJSON, &p.CustomFieldsValuesIDs)
+			}
+			positions[p.ID] = &p
+		}
+		return rows.Err()
+	}()
+
+	results := make([]*dataloader.Result, len(keys))
+	for i, id := range ids {
+		results[i] = &dataloader.Result{Data: positions[id], Error: err}
+	}
+	return results
+}
+
+func (l *graphqlLoaders) loadSuperiors(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+	superiors := make(map[string]*int64, len(keys))
+	err := func() error {
+		rows, err := l.db.QueryContext(ctx,
+			`SELECT id, superior FROM custom_fields_values WHERE id = ANY($1::uuid[])`,
+			pq.Array(keys.Keys()),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			var superior sql.NullInt64
+			if err := rows.Scan(&id, &superior); err != nil {
+				return err
+			}
+			if superior.Valid {
+				superiors[id] = &superior.Int64
+			}
+		}
+		return rows.Err()
+	}()
+
+	results := make([]*dataloader.Result, len(keys))
+	for i, key := range keys {
+		results[i] = &dataloader.Result{Data: superiors[key.String()], Error: err}
+	}
+	return results
+}
+
+// graphqlFieldIndex holds all custom field definitions. They are loaded
+// together with loadCustomFieldDefinitions, as for building trees, so the
+// custom fields of any number of positions and tree levels cost one load.
+type graphqlFieldIndex struct {
+	list   []CustomFieldDefinition // ordered by label, as GET /api/custom-fields
+	byID   map[uuid.UUID]CustomFieldDefinition
+	byKey  map[string]CustomFieldDefinition
+	values map[uuid.UUID]graphqlFieldValue
+}
+
+// graphqlFieldValue is an allowed value together with its field
+type graphqlFieldValue struct {
+	field CustomFieldDefinition
+	value AllowedValue
+}
+
+// fieldIndex returns the custom field definitions, loading them on first use
+func (l *graphqlLoaders) fieldIndex(ctx context.Context) *graphqlFieldIndex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fields != nil {
+		return l.fields
+	}
+
+	defs := loadCustomFieldDefinitions(ctx, l.db)
+	index := &graphqlFieldIndex{
+		list:   make([]CustomFieldDefinition, 0, len(defs)),
+		byID:   make(map[uuid.UUID]CustomFieldDefinition, len(defs)),
+		byKey:  defs,
+		values: make(map[uuid.UUID]graphqlFieldValue),
+	}
+	for _, f := range defs {
+		index.list = append(index.list, f)
+		index.byID[f.ID] = f
+		if f.AllowedValues != nil {
+			for _, v := range *f.AllowedValues {
+				index.values[v.ValueID] = graphqlFieldValue{field: f, value: v}
+			}
+		}
+	}
+	sort.Slice(index.list, func(i, j int) bool {
+		return index.list[i].Label < index.list[j].Label
+	})
+	l.fields = index
+	return index
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// Mutations call the same Handler methods as the REST handlers, so changes
+// made through GraphQL get the same validation, change approval and
+// employee sync as the REST API. The result is then read through the
+// loaders like any query.
+
+// graphqlUserKey is the context key of the user ID (X-User-ID) of a GraphQL call
+type graphqlUserKey struct{}
+
+// graphqlUserID returns the user of the GraphQL call of ctx
+func graphqlUserID(ctx context.Context) string {
+	userID, _ := ctx.Value(graphqlUserKey{}).(string)
+	return userID
+}
+
+// graphqlError is a mutation error with the HTTP status the REST API answers
+// the same error with
+type graphqlError struct {
+	status  int
+	message string
+	details interface{} // e.g. the problems of a tree definition
+}
+
+func (e *graphqlError) Error() string { return e.message }
+
+// Extensions adds the HTTP status of the REST API to the GraphQL error
+func (e *graphqlError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"status": e.status}
+	if e.details != nil {
+		ext["details"] = e.details
+	}
+	return ext
+}
+
+// graphqlErrorFrom converts the errors of the Handler methods that the REST
+// handlers answer with a client error status; notFound is the message for
+// sql.ErrNoRows. Other errors are returned as they are.
+func graphqlErrorFrom(err error, notFound string) error {
+	var problems TreeValidationErrors
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return &graphqlError{status: http.StatusNotFound, message: notFound}
+	case errors.Is(err, errUserIDRequired):
+		return &graphqlError{status: http.StatusUnauthorized, message: err.Error()}
+	case errors.Is(err, errCustomFieldKeyExists), errors.Is(err, errDeleteDefaultTree):
+		return &graphqlError{status: http.StatusConflict, message: err.Error()}
+	case errors.As(err, &problems):
+		return &graphqlError{
+			status:  http.StatusUnprocessableEntity,
+			message: "invalid tree definition",
+			details: map[string]interface{}{"errors": problems},
+		}
+	}
+	return err
+}
+
+type graphqlLinkedCustomFieldInput struct {
+	LinkedCustomFieldID       graphql.ID
+	LinkedCustomFieldValueIDs []graphql.ID
+}
+
+type graphqlPositionInput struct {
+	Name         string
+	CustomFields *[]struct {
+		CustomFieldID      graphql.ID
+		CustomFieldValueID graphql.ID
+		LinkedCustomFields *[]graphqlLinkedCustomFieldInput
+	}
+	EmployeeID         *string
+	Surname            *string
+	EmployeeName       *string
+	Patronymic         *string
+	EmployeeProfileURL *string
+}
+
+// position converts the input to the data of POST /api/positions and
+// PUT /api/positions/{id}
+func (in graphqlPositionInput) position() (positionInput, error) {
+	fields, values := newUUIDSet(), newUUIDSet()
+	parse := func(set *uuidSet, id graphql.ID, what string) error {
+		parsed, err := uuid.Parse(string(id))
+		if err != nil {
+			return fmt.Errorf("invalid %s ID %q", what, id)
+		}
+		set.add(parsed)
+		return nil
+	}
+	if in.CustomFields != nil {
+		for _, cf := range *in.CustomFields {
+			if err := parse(fields, cf.CustomFieldID, "custom field"); err != nil {
+				return positionInput{}, err
+			}
+			if err := parse(values, cf.CustomFieldValueID, "value"); err != nil {
+				return positionInput{}, err
+			}
+			if cf.LinkedCustomFields == nil {
+				continue
+			}
+			for _, lf := range *cf.LinkedCustomFields {
+				if err := parse(fields, lf.LinkedCustomFieldID, "custom field"); err != nil {
+					return positionInput{}, err
+				}
+				for _, id := range lf.LinkedCustomFieldValueIDs {
+					if err := parse(values, id, "value"); err != nil {
+						return positionInput{}, err
+					}
+				}
+			}
+		}
+	}
+
+	// Empty name parts are cleared, as parsePositionEmployeeFields does
+	nonEmpty := func(s *string) *string {
+		if s == nil || *s == "" {
+			return nil
+		}
+		return s
+	}
+	return positionInput{
+		Name:                  in.Name,
+		CustomFieldsIDs:       fields.ids,
+		CustomFieldsValuesIDs: values.ids,
+		Employee: positionEmployeeFields{
+			Surname:      nonEmpty(in.Surname),
+			EmployeeName: nonEmpty(in.EmployeeName),
+			Patronymic:   nonEmpty(in.Patronymic),
+			ExternalID:   in.EmployeeID,
+			ProfileURL:   in.EmployeeProfileURL,
+		},
+	}, nil
+}
+
+func (r *graphqlResolver) CreatePosition(ctx context.Context, args struct{ Input graphqlPositionInput }) (*graphqlPosition, error) {
+	in, err := args.Input.position()
+	if err != nil {
+		return nil, err
+	}
+	id, err := r.h.createPosition(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	loadersFrom(ctx).clear()
+	return r.changedPosition(ctx, id)
+}
+
+func (r *graphqlResolver) UpdatePosition(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input graphqlPositionInput
+}) (*graphqlPosition, error) {
+	id, err := parseGraphQLPositionID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	in, err := args.Input.position()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.h.updatePosition(ctx, id, in); err != nil {
+		return nil, graphqlErrorFrom(err, "Position not found")
+	}
+	loadersFrom(ctx).clear()
+	return r.changedPosition(ctx, id)
+}
+
+func (r *graphqlResolver) DeletePosition(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	id, err := parseGraphQLPositionID(args.ID)
+	if err != nil {
+		return false, err
+	}
+	if p, err := resolvePosition(ctx, id); err != nil || p == nil {
+		return false, notFoundOr(err, "Position not found")
+	}
+	if err := r.h.deletePosition(ctx, id); err != nil {
+		return false, err
+	}
+	loadersFrom(ctx).clear()
+	return true, nil
+}
+
+// changedPosition reads a position after a mutation
+func (r *graphqlResolver) changedPosition(ctx context.Context, id int64) (*graphqlPosition, error) {
+	p, err := resolvePosition(ctx, id)
+	if err != nil || p == nil {
+		return nil, notFoundOr(err, "Position not found")
+	}
+	return p, nil
+}
+
+// notFoundOr returns err or, if it is nil, a not found error with the message
+// of the REST API
+func notFoundOr(err error, message string) error {
+	if err != nil {
+		return err
+	}
+	return &graphqlError{status: http.StatusNotFound, message: message}
+}
+
+type graphqlCustomFieldInput struct {
+	Key           string
+	Label         string
+	AllowedValues *[]struct {
+		ValueID            *graphql.ID
+		Value              string
+		SortOrder          *int32
+		LinkedCustomFields *[]graphqlLinkedCustomFieldInput
+	}
+}
+
+// definition converts the input to the body of POST /api/custom-fields and
+// PUT /api/custom-fields/{id}
+func (in graphqlCustomFieldInput) definition() (CustomFieldDefinition, error) {
+	f := CustomFieldDefinition{Key: in.Key, Label: in.Label}
+	if in.AllowedValues == nil {
+		return f, nil
+	}
+	values := AllowedValuesArray{}
+	for _, v := range *in.AllowedValues {
+		value := AllowedValue{Value: v.Value}
+		if v.ValueID != nil {
+			id, err := uuid.Parse(string(*v.ValueID))
+			if err != nil {
+				return f, fmt.Errorf("invalid value ID %q", *v.ValueID)
+			}
+			value.ValueID = id
+		}
+		if v.SortOrder != nil {
+			order := int(*v.SortOrder)
+			value.SortOrder = &order
+		}
+		if v.LinkedCustomFields != nil {
+			for _, lf := range *v.LinkedCustomFields {
+				fieldID, err := uuid.Parse(string(lf.LinkedCustomFieldID))
+				if err != nil {
+					return f, fmt.Errorf("invalid custom field ID %q", lf.LinkedCustomFieldID)
+				}
+				linked := LinkedCustomField{LinkedCustomFieldID: fieldID}
+				for _, id := range lf.LinkedCustomFieldValueIDs {
+					valueID, err := uuid.Parse(string(id))
+					if err != nil {
+						return f, fmt.Errorf("invalid value ID %q", id)
+					}
+					linked.LinkedCustomFieldValues = append(linked.LinkedCustomFieldValues,
+						LinkedCustomFieldValue{LinkedCustomFieldValueID: valueID})
+				}
+				value.LinkedCustomFields = append(value.LinkedCustomFields, linked)
+			}
+		}
+		values = append(values, value)
+	}
+	f.AllowedValues = &values
+	return f, nil
+}
+
+type graphqlCustomFieldChange struct {
+	field *graphqlCustomField
+	cr    *graphqlChangeRequest
+}
+
+func (c *graphqlCustomFieldChange) CustomField() *graphqlCustomField     { return c.field }
+func (c *graphqlCustomFieldChange) ChangeRequest() *graphqlChangeRequest { return c.cr }
+
+type graphqlSuperiorChange struct {
+	value *graphqlAllowedValue
+	cr    *graphqlChangeRequest
+}
+
+func (c *graphqlSuperiorChange) Value() *graphqlAllowedValue          { return c.value }
+func (c *graphqlSuperiorChange) ChangeRequest() *graphqlChangeRequest { return c.cr }
+
+func (r *graphqlResolver) CreateCustomField(ctx context.Context, args struct{ Input graphqlCustomFieldInput }) (*graphqlCustomField, error) {
+	f, err := args.Input.definition()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.h.createCustomField(ctx, &f); err != nil {
+		return nil, graphqlErrorFrom(err, "")
+	}
+	loadersFrom(ctx).clear()
+	return changedCustomField(ctx, f.ID)
+}
+
+func (r *graphqlResolver) UpdateCustomField(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input graphqlCustomFieldInput
+}) (*graphqlCustomFieldChange, error) {
+	id, err := uuid.Parse(string(args.ID))
+	if err != nil {
+		return nil, fmt.Errorf("invalid custom field ID %q", args.ID)
+	}
+	f, err := args.Input.definition()
+	if err != nil {
+		return nil, err
+	}
+	cr, err := r.h.changeCustomField(ctx, graphqlUserID(ctx), id, &f)
+	if err != nil {
+		return nil, graphqlErrorFrom(err, "Field not found")
+	}
+	if cr != nil {
+		return &graphqlCustomFieldChange{cr: &graphqlChangeRequest{*cr}}, nil
+	}
+	loadersFrom(ctx).clear()
+	field, err := changedCustomField(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlCustomFieldChange{field: field}, nil
+}
+
+func (r *graphqlResolver) DeleteCustomField(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	id, err := uuid.Parse(string(args.ID))
+	if err != nil {
+		return false, fmt.Errorf("invalid custom field ID %q", args.ID)
+	}
+	if err := r.h.deleteCustomField(ctx, id); err != nil {
+		return false, graphqlErrorFrom(err, "Field not found")
+	}
+	loadersFrom(ctx).clear()
+	return true, nil
+}
+
+// changedCustomField reads a custom field after a mutation
+func changedCustomField(ctx context.Context, id uuid.UUID) (*graphqlCustomField, error) {
+	f, ok := loadersFrom(ctx).fieldIndex(ctx).byID[id]
+	if !ok {
+		return nil, notFoundOr(nil, "Field not found")
+	}
+	return &graphqlCustomField{f}, nil
+}
+
+func (r *graphqlResolver) SetValueSuperior(ctx context.Context, args struct {
+	ValueID    graphql.ID
+	SuperiorID *graphql.ID
+}) (*graphqlSuperiorChange, error) {
+	valueID, err := uuid.Parse(string(args.ValueID))
+	if err != nil {
+		return nil, fmt.Errorf("invalid custom field value ID %q", args.ValueID)
+	}
+	var superior *int64
+	if args.SuperiorID != nil {
+		id, err := parseGraphQLPositionID(*args.SuperiorID)
+		if err != nil {
+			return nil, err
+		}
+		superior = &id
+	}
+	cr, err := r.h.changeValueSuperior(ctx, graphqlUserID(ctx), valueID, superior)
+	if err != nil {
+		return nil, graphqlErrorFrom(err, "Custom field value not found")
+	}
+	if cr != nil {
+		return &graphqlSuperiorChange{cr: &graphqlChangeRequest{*cr}}, nil
+	}
+	loadersFrom(ctx).clear()
+	v, ok := loadersFrom(ctx).fieldIndex(ctx).values[valueID]
+	if !ok {
+		return nil, notFoundOr(nil, "Custom field value not found")
+	}
+	return &graphqlSuperiorChange{value: &graphqlAllowedValue{v.field, v.value}}, nil
+}
+
+type graphqlTreeInput struct {
+	Name        string
+	Description *string
+	IsDefault   *bool
+	Levels      []struct {
+		CustomFieldKey   string
+		Label            *string
+		Sort             *string
+		ValueOrder       *[]string
+		ShowEmptyValues  *bool
+		HoistSingleChild *bool
+		MissingValue     *string
+		MissingLabel     *string
+	}
+}
+
+// definition converts the input to the body of POST /api/trees and
+// PUT /api/trees/{id}
+func (in graphqlTreeInput) definition() TreeDefinition {
+	t := TreeDefinition{
+		Name:        in.Name,
+		Description: in.Description,
+		IsDefault:   in.IsDefault != nil && *in.IsDefault,
+		Levels:      make([]TreeLevel, len(in.Levels)),
+	}
+	value := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	for i, l := range in.Levels {
+		t.Levels[i] = TreeLevel{
+			Order:            i + 1,
+			CustomFieldKey:   l.CustomFieldKey,
+			Label:            value(l.Label),
+			Sort:             value(l.Sort),
+			ShowEmptyValues:  l.ShowEmptyValues != nil && *l.ShowEmptyValues,
+			HoistSingleChild: l.HoistSingleChild != nil && *l.HoistSingleChild,
+			MissingValue:     value(l.MissingValue),
+			MissingLabel:     value(l.MissingLabel),
+		}
+		if l.ValueOrder != nil {
+			t.Levels[i].ValueOrder = *l.ValueOrder
+		}
+	}
+	return t
+}
+
+func (r *graphqlResolver) CreateTree(ctx context.Context, args struct{ Input graphqlTreeInput }) (*graphqlTree, error) {
+	t := args.Input.definition()
+	if err := r.h.createTree(ctx, &t); err != nil {
+		return nil, graphqlErrorFrom(err, "")
+	}
+	return r.changedTree(ctx, t.ID)
+}
+
+func (r *graphqlResolver) UpdateTree(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input graphqlTreeInput
+}) (*graphqlTree, error) {
+	id, err := uuid.Parse(string(args.ID))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tree ID %q", args.ID)
+	}
+	t := args.Input.definition()
+	if err := r.h.updateTree(ctx, id, &t); err != nil {
+		return nil, graphqlErrorFrom(err, "Tree not found")
+	}
+	return r.changedTree(ctx, id)
+}
+
+func (r *graphqlResolver) DeleteTree(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	id, err := uuid.Parse(string(args.ID))
+	if err != nil {
+		return false, fmt.Errorf("invalid tree ID %q", args.ID)
+	}
+	if err := r.h.deleteTree(ctx, id); err != nil {
+		return false, graphqlErrorFrom(err, "Tree not found")
+	}
+	return true, nil
+}
+
+// changedTree reads a tree definition after a mutation
+func (r *graphqlResolver) changedTree(ctx context.Context, id uuid.UUID) (*graphqlTree, error) {
+	t, err := r.tree(ctx, id)
+	if err != nil || t == nil {
+		return nil, notFoundOr(err, "Tree not found")
+	}
+	return t, nil
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/google/uuid"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphqlResolver is the root resolver of graphqlSchema. Queries use the
+// same queries as the REST handlers; related objects are fetched through the
+// request's graphqlLoaders.
+type graphqlResolver struct {
+	h *Handler
+}
+
+func (r *graphqlResolver) Positions(ctx context.Context, args struct {
+	Search  *string
+	Filters *[]struct {
+		Key   string
+		Value string
+	}
+	Sort   *string
+	Cursor *string
+	Limit  int32
+	Offset int32
+}) (*graphqlPositionPage, error) {
+	q := positionListQuery{Limit: int(args.Limit), Offset: int(args.Offset)}
+	var err error
+	if args.Search != nil {
+		if q.Search, err = r.h.parseSearch(ctx, *args.Search); err != nil {
+			return nil, err
+		}
+	}
+	if args.Filters != nil {
+		values := url.Values{}
+		for _, f := range *args.Filters {
+			values.Add(f.Key, f.Value)
+		}
+		if q.Filters, err = ParsePositionFilters(values); err != nil {
+			return nil, err
+		}
+	}
+	if args.Sort != nil {
+		if q.Sort, err = ParsePositionSort(*args.Sort); err != nil {
+			return nil, err
+		}
+	}
+	if args.Cursor != nil && *args.Cursor != "" {
+		if q.Cursor, err = decodePositionCursor(*args.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	hits, err := r.h.queryPositions(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	page := &graphqlPositionPage{
+		items:      make([]*graphqlPosition, len(hits.Items)),
+		total:      int32(hits.Total),
+		nextCursor: hits.NextCursor,
+	}
+	for i, hit := range hits.Items {
+		page.items[i] = &graphqlPosition{hit.Position}
+	}
+	return page, nil
+}
+
+func (r *graphqlResolver) Position(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlPosition, error) {
+	id, err := parseGraphQLPositionID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	return resolvePosition(ctx, id)
+}
+
+func (r *graphqlResolver) CustomFields(ctx context.Context) []*graphqlCustomField {
+	index := loadersFrom(ctx).fieldIndex(ctx)
+	fields := make([]*graphqlCustomField, len(index.list))
+	for i, f := range index.list {
+		fields[i] = &graphqlCustomField{f}
+	}
+	return fields
+}
+
+func (r *graphqlResolver) CustomField(ctx context.Context, args struct {
+	ID  *graphql.ID
+	Key *string
+}) (*graphqlCustomField, error) {
+	var id uuid.UUID
+	switch {
+	case args.ID != nil:
+		var err error
+		if id, err = uuid.Parse(string(*args.ID)); err != nil {
+			return nil, fmt.Errorf("invalid custom field ID %q", *args.ID)
+		}
+	case args.Key == nil:
+		return nil, fmt.Errorf("id or key is required")
+	}
+
+	index := loadersFrom(ctx).fieldIndex(ctx)
+	f, ok := index.byID[id]
+	if args.ID == nil {
+		f, ok = index.byKey[*args.Key]
+	}
+	if !ok {
+		return nil, nil
+	}
+	return &graphqlCustomField{f}, nil
+}
+
+func (r *graphqlResolver) Trees(ctx context.Context) ([]*graphqlTree, error) {
+	trees, err := r.h.loadTreeDefinitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*graphqlTree, len(trees))
+	for i, t := range trees {
+		result[i] = &graphqlTree{r.h, t}
+	}
+	return result, nil
+}
+
+func (r *graphqlResolver) Tree(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlTree, error) {
+	id, err := uuid.Parse(string(args.ID))
+	if err != nil {
+		return nil, fmt.Errorf("invalid tree ID %q", args.ID)
+	}
+	return r.tree(ctx, id)
+}
+
+func (r *graphqlResolver) DefaultTree(ctx context.Context) (*graphqlTree, error) {
+	var id uuid.UUID
+	err := r.h.db.QueryRowContext(ctx,
+		`SELECT id FROM tree_definitions WHERE is_default LIMIT 1`,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.tree(ctx, id)
+}
+
+// tree returns the tree definition with the given ID or nil if there is none
+func (r *graphqlResolver) tree(ctx context.Context, id uuid.UUID) (*graphqlTree, error) {
+	t, err := r.h.loadTreeDefinition(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlTree{r.h, t}, nil
+}
+
+// parseGraphQLPositionID parses the ID of a position
+func parseGraphQLPositionID(id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid position ID %q", id)
+	}
+	return n, nil
+}
+
+// resolvePosition returns the position with the given ID or nil if there is none
+func resolvePosition(ctx context.Context, id int64) (*graphqlPosition, error) {
+	p, err := loadersFrom(ctx).position(ctx, id)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	return &graphqlPosition{*p}, nil
+}
+
+// resolveSuperior returns the superior position of a custom field value
+func resolveSuperior(ctx context.Context, valueID uuid.UUID) (*graphqlPosition, error) {
+	p, err := loadersFrom(ctx).superior(ctx, valueID)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	return &graphqlPosition{*p}, nil
+}
+
+// optionalString returns nil for empty strings, which the REST API omits
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// optionalID converts an optional string ID of the REST models
+func optionalID(s *string) *graphql.ID {
+	if s == nil {
+		return nil
+	}
+	id := graphql.ID(*s)
+	return &id
+}
+
+type graphqlPositionPage struct {
+	items      []*graphqlPosition
+	total      int32
+	nextCursor *string
+}
+
+func (p *graphqlPositionPage) Items() []*graphqlPosition { return p.items }
+func (p *graphqlPositionPage) Total() int32              { return p.total }
+func (p *graphqlPositionPage) NextCursor() *string       { return p.nextCursor }
+
+type graphqlPosition struct {
+	p Position
+}
+
+func (p *graphqlPosition) ID() graphql.ID              { return graphql.ID(strconv.FormatInt(p.p.ID, 10)) }
+func (p *graphqlPosition) Name() string                { return p.p.Name }
+func (p *graphqlPosition) EmployeeID() *string         { return p.p.EmployeeExternalID }
+func (p *graphqlPosition) Surname() *string            { return p.p.Surname }
+func (p *graphqlPosition) EmployeeName() *string       { return p.p.EmployeeName }
+func (p *graphqlPosition) Patronymic() *string         { return p.p.Patronymic }
+func (p *graphqlPosition) EmployeeProfileURL() *string { return p.p.EmployeeProfileURL }
+func (p *graphqlPosition) CreatedAt() graphql.Time     { return graphql.Time{Time: p.p.CreatedAt} }
+func (p *graphqlPosition) UpdatedAt() graphql.Time     { return graphql.Time{Time: p.p.UpdatedAt} }
+func (p *graphqlPosition) EmployeeFullName() *string {
+	return combineEmployeeFullName(p.p.Surname, p.p.EmployeeName, p.p.Patronymic)
+}
+
+// CustomFields builds the same list as the custom_fields of the REST API:
+// for every field of the position its first selected value, with the linked
+// values that are selected too
+func (p *graphqlPosition) CustomFields(ctx context.Context) []*graphqlPositionCustomField {
+	fields := []*graphqlPositionCustomField{}
+	if p.p.CustomFieldsIDs == nil || p.p.CustomFieldsValuesIDs == nil {
+		return fields
+	}
+	index := loadersFrom(ctx).fieldIndex(ctx)
+
+	selected := make(map[uuid.UUID]bool, len(*p.p.CustomFieldsValuesIDs))
+	fieldValues := make(map[uuid.UUID]graphqlFieldValue)
+	for _, valueID := range *p.p.CustomFieldsValuesIDs {
+		selected[valueID] = true
+		if v, ok := index.values[valueID]; ok {
+			if _, already := fieldValues[v.field.ID]; !already {
+				fieldValues[v.field.ID] = v
+			}
+		}
+	}
+
+	for _, fieldID := range *p.p.CustomFieldsIDs {
+		v, ok := fieldValues[fieldID]
+		if !ok {
+			continue
+		}
+		var linked []LinkedCustomField
+		for _, lf := range v.value.LinkedCustomFields {
+			var values []LinkedCustomFieldValue
+			for _, lv := range lf.LinkedCustomFieldValues {
+				if selected[lv.LinkedCustomFieldValueID] {
+					values = append(values, lv)
+				}
+			}
+			if len(values) > 0 {
+				lf.LinkedCustomFieldValues = values
+				linked = append(linked, lf)
+			}
+		}
+		fields = append(fields, &graphqlPositionCustomField{v.field, v.value, linked})
+	}
+	return fields
+}
+
+type graphqlPositionCustomField struct {
+	field  CustomFieldDefinition
+	value  AllowedValue
+	linked []LinkedCustomField
+}
+
+func (f *graphqlPositionCustomField) CustomField() *graphqlCustomField {
+	return &graphqlCustomField{f.field}
+}
+func (f *graphqlPositionCustomField) CustomFieldID() graphql.ID {
+	return graphql.ID(f.field.ID.String())
+}
+func (f *graphqlPositionCustomField) CustomFieldKey() string   { return f.field.Key }
+func (f *graphqlPositionCustomField) CustomFieldLabel() string { return f.field.Label }
+func (f *graphqlPositionCustomField) CustomFieldValue() string { return f.value.Value }
+func (f *graphqlPositionCustomField) CustomFieldValueID() graphql.ID {
+	return graphql.ID(f.value.ValueID.String())
+}
+func (f *graphqlPositionCustomField) LinkedCustomFields() []*graphqlLinkedCustomField {
+	return newGraphQLLinkedCustomFields(f.linked)
+}
+func (f *graphqlPositionCustomField) Superior(ctx context.Context) (*graphqlPosition, error) {
+	return resolveSuperior(ctx, f.value.ValueID)
+}
+
+type graphqlCustomField struct {
+	f CustomFieldDefinition
+}
+
+func (f *graphqlCustomField) ID() graphql.ID          { return graphql.ID(f.f.ID.String()) }
+func (f *graphqlCustomField) Key() string             { return f.f.Key }
+func (f *graphqlCustomField) Label() string           { return f.f.Label }
+func (f *graphqlCustomField) CreatedAt() graphql.Time { return graphql.Time{Time: f.f.CreatedAt} }
+func (f *graphqlCustomField) UpdatedAt() graphql.Time { return graphql.Time{Time: f.f.UpdatedAt} }
+func (f *graphqlCustomField) AllowedValues() []*graphqlAllowedValue {
+	values := []*graphqlAllowedValue{}
+	if f.f.AllowedValues != nil {
+		for _, v := range *f.f.AllowedValues {
+			values = append(values, &graphqlAllowedValue{f.f, v})
+		}
+	}
+	return values
+}
+
+type graphqlAllowedValue struct {
+	field CustomFieldDefinition
+	v     AllowedValue
+}
+
+func (v *graphqlAllowedValue) ValueID() graphql.ID              { return graphql.ID(v.v.ValueID.String()) }
+func (v *graphqlAllowedValue) Value() string                    { return v.v.Value }
+func (v *graphqlAllowedValue) CustomField() *graphqlCustomField { return &graphqlCustomField{v.field} }
+func (v *graphqlAllowedValue) SortOrder() *int32 {
+	if v.v.SortOrder == nil {
+		return nil
+	}
+	order := int32(*v.v.SortOrder)
+	return &order
+}
+func (v *graphqlAllowedValue) LinkedCustomFields() []*graphqlLinkedCustomField {
+	return newGraphQLLinkedCustomFields(v.v.LinkedCustomFields)
+}
+func (v *graphqlAllowedValue) Superior(ctx context.Context) (*graphqlPosition, error) {
+	return resolveSuperior(ctx, v.v.ValueID)
+}
+
+type graphqlLinkedCustomField struct {
+	l LinkedCustomField
+}
+
+func newGraphQLLinkedCustomFields(linked []LinkedCustomField) []*graphqlLinkedCustomField {
+	result := make([]*graphqlLinkedCustomField, len(linked))
+	for i, l := range linked {
+		result[i] = &graphqlLinkedCustomField{l}
+	}
+	return result
+}
+
+func (l *graphqlLinkedCustomField) LinkedCustomFieldID() graphql.ID {
+	return graphql.ID(l.l.LinkedCustomFieldID.String())
+}
+func (l *graphqlLinkedCustomField) LinkedCustomFieldKey() string   { return l.l.LinkedCustomFieldKey }
+func (l *graphqlLinkedCustomField) LinkedCustomFieldLabel() string { return l.l.LinkedCustomFieldLabel }
+func (l *graphqlLinkedCustomField) LinkedCustomFieldValues() []*graphqlLinkedCustomFieldValue {
+	values := make([]*graphqlLinkedCustomFieldValue, len(l.l.LinkedCustomFieldValues))
+	for i, v := range l.l.LinkedCustomFieldValues {
+		values[i] = &graphqlLinkedCustomFieldValue{v}
+	}
+	return values
+}
+
+type graphqlLinkedCustomFieldValue struct {
+	v LinkedCustomFieldValue
+}
+
+func (v *graphqlLinkedCustomFieldValue) LinkedCustomFieldValueID() graphql.ID {
+	return graphql.ID(v.v.LinkedCustomFieldValueID.String())
+}
+func (v *graphqlLinkedCustomFieldValue) LinkedCustomFieldValue() string {
+	return v.v.LinkedCustomFieldValue
+}
+
+type graphqlTree struct {
+	h *Handler
+	t TreeDefinition
+}
+
+func (t *graphqlTree) ID() graphql.ID          { return graphql.ID(t.t.ID.String()) }
+func (t *graphqlTree) Name() string            { return t.t.Name }
+func (t *graphqlTree) Description() *string    { return t.t.Description }
+func (t *graphqlTree) IsDefault() bool         { return t.t.IsDefault }
+func (t *graphqlTree) CreatedAt() graphql.Time { return graphql.Time{Time: t.t.CreatedAt} }
+func (t *graphqlTree) UpdatedAt() graphql.Time { return graphql.Time{Time: t.t.UpdatedAt} }
+func (t *graphqlTree) Levels() []*graphqlTreeLevel {
+	levels := make([]*graphqlTreeLevel, len(t.t.Levels))
+	for i, l := range t.t.Levels {
+		levels[i] = &graphqlTreeLevel{l}
+	}
+	return levels
+}
+
+// Root builds the tree like GET /api/trees/{id}/structure
+func (t *graphqlTree) Root(ctx context.Context) *graphqlTreeNode {
+	structure := buildTreeStructure(ctx, t.h.db, t.t)
+	return &graphqlTreeNode{structure.Root}
+}
+
+type graphqlTreeLevel struct {
+	l TreeLevel
+}
+
+func (l *graphqlTreeLevel) Order() int32           { return int32(l.l.Order) }
+func (l *graphqlTreeLevel) CustomFieldKey() string { return l.l.CustomFieldKey }
+func (l *graphqlTreeLevel) Label() *string         { return optionalString(l.l.Label) }
+func (l *graphqlTreeLevel) Sort() *string          { return optionalString(l.l.Sort) }
+func (l *graphqlTreeLevel) ShowEmptyValues() bool  { return l.l.ShowEmptyValues }
+func (l *graphqlTreeLevel) HoistSingleChild() bool { return l.l.HoistSingleChild }
+func (l *graphqlTreeLevel) MissingValue() *string  { return optionalString(l.l.MissingValue) }
+func (l *graphqlTreeLevel) MissingLabel() *string  { return optionalString(l.l.MissingLabel) }
+func (l *graphqlTreeLevel) ValueOrder() []string {
+	if l.l.ValueOrder == nil {
+		return []string{}
+	}
+	return l.l.ValueOrder
+}
+func (l *graphqlTreeLevel) CustomField(ctx context.Context) *graphqlCustomField {
+	f, ok := loadersFrom(ctx).fieldIndex(ctx).byKey[l.l.CustomFieldKey]
+	if !ok {
+		return nil
+	}
+	return &graphqlCustomField{f}
+}
+
+type graphqlTreeNode struct {
+	n TreeNode
+}
+
+func (n *graphqlTreeNode) Type() string               { return n.n.Type }
+func (n *graphqlTreeNode) LevelLabel() *string        { return n.n.LevelLabel }
+func (n *graphqlTreeNode) NodeKey() *string           { return n.n.NodeKey }
+func (n *graphqlTreeNode) CustomFieldID() *graphql.ID { return optionalID(n.n.CustomFieldID) }
+func (n *graphqlTreeNode) CustomFieldKey() *string    { return n.n.CustomFieldKey }
+func (n *graphqlTreeNode) CustomFieldValue() *string  { return n.n.CustomFieldValue }
+func (n *graphqlTreeNode) CustomFieldValueID() *graphql.ID {
+	return optionalID(n.n.CustomFieldValueID)
+}
+func (n *graphqlTreeNode) PositionID() *graphql.ID   { return optionalID(n.n.PositionID) }
+func (n *graphqlTreeNode) PositionName() *string     { return n.n.PositionName }
+func (n *graphqlTreeNode) EmployeeFullName() *string { return n.n.EmployeeFullName }
+func (n *graphqlTreeNode) LevelOrder() *int32 {
+	if n.n.LevelOrder == nil {
+		return nil
+	}
+	order := int32(*n.n.LevelOrder)
+	return &order
+}
+func (n *graphqlTreeNode) LinkedCustomFields() []*graphqlLinkedCustomField {
+	return newGraphQLLinkedCustomFields(n.n.LinkedCustomFields)
+}
+func (n *graphqlTreeNode) Superior(ctx context.Context) (*graphqlPosition, error) {
+	if n.n.Superior == nil {
+		return nil, nil
+	}
+	return resolvePosition(ctx, *n.n.Superior)
+}
+func (n *graphqlTreeNode) Position(ctx context.Context) (*graphqlPosition, error) {
+	if n.n.PositionID == nil {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(*n.n.PositionID, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	return resolvePosition(ctx, id)
+}
+func (n *graphqlTreeNode) Children() []*graphqlTreeNode {
+	children := make([]*graphqlTreeNode, len(n.n.Children))
+	for i, c := range n.n.Children {
+		children[i] = &graphqlTreeNode{c}
+	}
+	return children
+}
+
+type graphqlChangeRequest struct {
+	cr ChangeRequest
+}
+
+func (c *graphqlChangeRequest) ID() graphql.ID          { return graphql.ID(c.cr.ID.String()) }
+func (c *graphqlChangeRequest) Type() string            { return c.cr.Type }
+func (c *graphqlChangeRequest) TargetID() graphql.ID    { return graphql.ID(c.cr.TargetID.String()) }
+func (c *graphqlChangeRequest) Status() string          { return c.cr.Status }
+func (c *graphqlChangeRequest) RequestedBy() string     { return c.cr.RequestedBy }
+func (c *graphqlChangeRequest) CreatedAt() graphql.Time { return graphql.Time{Time: c.cr.CreatedAt} }
@@ -0,0 +1,229 @@
+package main
+
+// graphqlSchema is the schema of POST /api/graphql. Names follow the REST
+// API in camelCase; mutations accept the same data as the REST handlers.
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	# Same search syntax, filters and sort keys as GET /api/positions
+	positions(search: String, filters: [PositionFilter!], sort: String, cursor: String, limit: Int! = 100, offset: Int! = 0): PositionPage!
+	position(id: ID!): Position
+	customFields: [CustomField!]!
+	customField(id: ID, key: String): CustomField
+	trees: [TreeDefinition!]!
+	tree(id: ID!): TreeDefinition
+	defaultTree: TreeDefinition
+}
+
+type Mutation {
+	createPosition(input: PositionInput!): Position!
+	updatePosition(id: ID!, input: PositionInput!): Position!
+	deletePosition(id: ID!): Boolean!
+
+	createCustomField(input: CustomFieldInput!): CustomField!
+	# Returns a change request instead of the field when changes need approval
+	updateCustomField(id: ID!, input: CustomFieldInput!): CustomFieldChange!
+	deleteCustomField(id: ID!): Boolean!
+
+	# Sets or clears (superiorId: null) the superior position of a custom field value
+	setValueSuperior(valueId: ID!, superiorId: ID): SuperiorChange!
+
+	createTree(input: TreeInput!): TreeDefinition!
+	updateTree(id: ID!, input: TreeInput!): TreeDefinition!
+	deleteTree(id: ID!): Boolean!
+}
+
+# A structured filter such as {key: "has_employee", value: "false"};
+# keys are the filter parameters of GET /api/positions
+input PositionFilter {
+	key: String!
+	value: String!
+}
+
+type PositionPage {
+	items: [Position!]!
+	total: Int!
+	nextCursor: String
+}
+
+type Position {
+	id: ID!
+	name: String!
+	customFields: [PositionCustomField!]!
+	employeeId: String
+	surname: String
+	employeeName: String
+	patronymic: String
+	employeeFullName: String
+	employeeProfileUrl: String
+	createdAt: Time!
+	updatedAt: Time!
+}
+
+# The value of a custom field selected for a position
+type PositionCustomField {
+	customField: CustomField!
+	customFieldId: ID!
+	customFieldKey: String!
+	customFieldLabel: String!
+	customFieldValue: String!
+	customFieldValueId: ID!
+	# Only the linked values selected for the position
+	linkedCustomFields: [LinkedCustomField!]!
+	superior: Position
+}
+
+type CustomField {
+	id: ID!
+	key: String!
+	label: String!
+	allowedValues: [AllowedValue!]!
+	createdAt: Time!
+	updatedAt: Time!
+}
+
+type AllowedValue {
+	valueId: ID!
+	value: String!
+	sortOrder: Int
+	linkedCustomFields: [LinkedCustomField!]!
+	customField: CustomField!
+	superior: Position
+}
+
+type LinkedCustomField {
+	linkedCustomFieldId: ID!
+	linkedCustomFieldKey: String!
+	linkedCustomFieldLabel: String!
+	linkedCustomFieldValues: [LinkedCustomFieldValue!]!
+}
+
+type LinkedCustomFieldValue {
+	linkedCustomFieldValueId: ID!
+	linkedCustomFieldValue: String!
+}
+
+type TreeDefinition {
+	id: ID!
+	name: String!
+	description: String
+	isDefault: Boolean!
+	levels: [TreeLevel!]!
+	# The built tree, as GET /api/trees/{id}/structure
+	root: TreeNode!
+	createdAt: Time!
+	updatedAt: Time!
+}
+
+type TreeLevel {
+	order: Int!
+	customFieldKey: String!
+	customField: CustomField
+	label: String
+	sort: String
+	valueOrder: [String!]!
+	showEmptyValues: Boolean!
+	hoistSingleChild: Boolean!
+	missingValue: String
+	missingLabel: String
+}
+
+type TreeNode {
+	# root, custom_field_value or position
+	type: String!
+	levelOrder: Int
+	levelLabel: String
+	nodeKey: String
+	customFieldId: ID
+	customFieldKey: String
+	customFieldValue: String
+	customFieldValueId: ID
+	linkedCustomFields: [LinkedCustomField!]!
+	superior: Position
+	positionId: ID
+	positionName: String
+	employeeFullName: String
+	position: Position
+	children: [TreeNode!]!
+}
+
+type ChangeRequest {
+	id: ID!
+	type: String!
+	targetId: ID!
+	status: String!
+	requestedBy: String!
+	createdAt: Time!
+}
+
+# Exactly one of the fields is set
+type CustomFieldChange {
+	customField: CustomField
+	changeRequest: ChangeRequest
+}
+
+# Exactly one of the fields is set
+type SuperiorChange {
+	value: AllowedValue
+	changeRequest: ChangeRequest
+}
+
+input PositionInput {
+	name: String!
+	customFields: [PositionCustomFieldInput!]
+	employeeId: String
+	surname: String
+	employeeName: String
+	patronymic: String
+	employeeProfileUrl: String
+}
+
+input PositionCustomFieldInput {
+	customFieldId: ID!
+	customFieldValueId: ID!
+	linkedCustomFields: [LinkedCustomFieldInput!]
+}
+
+input LinkedCustomFieldInput {
+	linkedCustomFieldId: ID!
+	linkedCustomFieldValueIds: [ID!]!
+}
+
+input CustomFieldInput {
+	key: String!
+	label: String!
+	allowedValues: [AllowedValueInput!]
+}
+
+input AllowedValueInput {
+	# Omit to create a new value
+	valueId: ID
+	value: String!
+	sortOrder: Int
+	linkedCustomFields: [LinkedCustomFieldInput!]
+}
+
+input TreeInput {
+	name: String!
+	description: String
+	isDefault: Boolean
+	levels: [TreeLevelInput!]!
+}
+
+input TreeLevelInput {
+	customFieldKey: String!
+	label: String
+	sort: String
+	valueOrder: [String!]
+	showEmptyValues: Boolean
+	hoistSingleChild: Boolean
+	missingValue: String
+	missingLabel: String
+}
+`
@@ -2,18 +2,51 @@ package main
 
 import (
 	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	graphql "github.com/graph-gophers/graphql-go"
 )
 
 // Handler contains database connection and services
 type Handler struct {
 	db                  *sql.DB
 	customFieldsService *CustomFieldsService
+	migrator            *Migrator            // used by /readyz to check migration status
+	approval            changeApprovalConfig // whether structural changes need approval
+	hrSync              *hrSyncer            // nil when HR_SYNC_SOURCE is not set
+	scim                scimConfig           // SCIM_* settings of /scim/v2
+	schema              *graphql.Schema      // GraphQL schema of /api/graphql
+	draining            atomic.Bool          // set on shutdown so /readyz stops receiving traffic
 }
 
 // NewHandler creates a new Handler instance
-func NewHandler(db *sql.DB) *Handler {
-	return &Handler{
+func NewHandler(db *sql.DB, migrator *Migrator) *Handler {
+	hrSync, err := newHRSyncerFromEnv(db)
+	if err != nil {
+		log.Printf("HR sync disabled: %v", err)
+	}
+	h := &Handler{
 		db:                  db,
 		customFieldsService: NewCustomFieldsService(db),
+		migrator:            migrator,
+		approval:            loadChangeApprovalConfig(),
+		hrSync:              hrSync,
+		scim:                loadSCIMConfig(),
 	}
+	h.schema = newGraphQLSchema(h)
+	return h
+}
+
+// userIDHeader carries the identifier of the user making the request.
+// Authentication is handled outside of this service: the authenticating
+// proxy in front of it must set this header and drop any value sent by the
+// client, since change approval and self-approval checks rely on it.
+const userIDHeader = "X-User-ID"
+
+// currentUserID returns the user ID of the request or "" if it is not set
+func currentUserID(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get(userIDHeader))
 }
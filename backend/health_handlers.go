@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readinessCheckTimeout bounds the database checks of /readyz
+const readinessCheckTimeout = 2 * time.Second
+
+// Healthz reports that the process is alive. It does not touch the database,
+// so a database outage does not make the orchestrator restart the server.
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the server can take traffic: the database answers,
+// all migrations are applied and the server is not shutting down
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	if h.draining.Load() {
+		checks["server"] = "shutting down"
+		ready = false
+	} else {
+		checks["server"] = "ok"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	if err := h.db.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+		checks["migrations"] = "unknown"
+		ready = false
+	} else {
+		checks["database"] = "ok"
+		if h.migrator == nil {
+			checks["migrations"] = "unknown"
+			ready = false
+		} else if err := h.migrator.Check(ctx); err != nil {
+			checks["migrations"] = err.Error()
+			ready = false
+		} else {
+			checks["migrations"] = "ok"
+		}
+	}
+
+	status := "ok"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// runHRSyncCommand implements the `hr-sync` subcommand: one sync run with the
+// HR_SYNC_* configuration of the server
+func runHRSyncCommand(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("hr-sync", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server hr-sync [-dry-run] [-json]")
+		fs.PrintDefaults()
+	}
+	dryRun := fs.Bool("dry-run", false, "report changes without saving them")
+	jsonFlag := fs.Bool("json", false, "print the run as JSON")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	syncer, err := newHRSyncerFromEnv(db)
+	if err != nil {
+		return err
+	}
+	if syncer == nil {
+		return errors.New("HR sync is not configured (set HR_SYNC_SOURCE)")
+	}
+
+	run, err := syncer.Run(context.Background(), *dryRun)
+	if run.ID == 0 {
+		return err
+	}
+
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(run); encErr != nil {
+			return encErr
+		}
+		return err
+	}
+
+	s := run.Stats
+	fmt.Printf("run %d (%s, %s): %d fetched, %d updated, %d unchanged, %d created, %d unmatched, %d conflicts\n",
+		run.ID, run.Source, run.Status, s.Fetched, s.Updated, s.Unchanged, s.Created, s.Unmatched, s.Conflicts)
+	if run.DryRun {
+		fmt.Println("dry run: no changes were saved")
+	}
+	if len(run.Conflicts) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tEMPLOYEE_ID\tMESSAGE")
+		for _, c := range run.Conflicts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Kind, c.ExternalID, c.Message)
+		}
+		if flushErr := tw.Flush(); flushErr != nil {
+			return flushErr
+		}
+	}
+	return err
+}
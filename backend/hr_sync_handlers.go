@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// RunHRSync runs the employee sync now; ?dry_run=true reports what would
+// change without saving it
+func (h *Handler) RunHRSync(w http.ResponseWriter, r *http.Request) {
+	if h.hrSync == nil {
+		http.Error(w, "HR sync is not configured (set HR_SYNC_SOURCE)", http.StatusServiceUnavailable)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	run, err := h.hrSync.Run(r.Context(), dryRun)
+	var sourceErr *hrSourceError
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, errHRSyncRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.As(err, &sourceErr):
+		status = http.StatusBadGateway
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(run)
+}
+
+// GetHRSyncRuns lists recent sync runs, newest first
+func (h *Handler) GetHRSyncRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	rows, err := h.db.QueryContext(r.Context(),
+		`SELECT `+hrSyncRunColumns+` FROM hr_sync_runs ORDER BY started_at DESC, id DESC LIMIT $1`, limit,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	runs := []HRSyncRun{}
+	for rows.Next() {
+		run, err := scanHRSyncRun(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, run)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// GetHRSyncRun returns one sync run with its conflicts
+func (h *Handler) GetHRSyncRun(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	run, err := scanHRSyncRun(h.db.QueryRowContext(r.Context(),
+		`SELECT `+hrSyncRunColumns+` FROM hr_sync_runs WHERE id = $1`, id,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "HR sync run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
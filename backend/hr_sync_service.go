@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// HR sync conflict kinds
+const (
+	hrConflictInvalidRecord   = "invalid_record"
+	hrConflictDuplicate       = "duplicate_in_source"
+	hrConflictLocalChanges    = "local_changes"
+	hrConflictMissingInSource = "missing_in_source"
+)
+
+// HR sync run statuses
+const (
+	hrSyncStatusRunning   = "running"
+	hrSyncStatusSucceeded = "succeeded"
+	hrSyncStatusFailed    = "failed"
+)
+
+// hrSyncLockKey is the pg_try_advisory_xact_lock key that keeps runs of
+// several replicas from reconciling at the same time
+const hrSyncLockKey int64 = 7240915022
+
+var errHRSyncRunning = errors.New("another HR sync is running")
+
+// hrSourceError reports a failure to read the HR system
+type hrSourceError struct {
+	source string
+	err    error
+}
+
+func (e *hrSourceError) Error() string {
+	return fmt.Sprintf("fetch from %s: %v", e.source, e.err)
+}
+
+// hrSyncer reconciles employees with an HR source
+type hrSyncer struct {
+	db                 *sql.DB
+	source             HRSource
+	interval           time.Duration // 0 disables scheduled runs
+	overwriteLocal     bool          // source data replaces employees edited here since the last sync
+	createMissing      bool          // create employees that are only in the source
+	profileURLTemplate string        // used when the source has no profile URL, {employee_id} is replaced
+}
+
+// newHRSyncerFromEnv configures the sync from HR_SYNC_* variables; it returns
+// nil when HR_SYNC_SOURCE is not set
+func newHRSyncerFromEnv(db *sql.DB) (*hrSyncer, error) {
+	source, err := newHRSourceFromEnv()
+	if err != nil || source == nil {
+		return nil, err
+	}
+	return &hrSyncer{
+		db:                 db,
+		source:             source,
+		interval:           envDuration("HR_SYNC_INTERVAL", time.Hour),
+		overwriteLocal:     envBool("HR_SYNC_OVERWRITE_LOCAL", false),
+		createMissing:      envBool("HR_SYNC_CREATE_EMPLOYEES", false),
+		profileURLTemplate: os.Getenv("HR_SYNC_PROFILE_URL_TEMPLATE"),
+	}, nil
+}
+
+// schedule runs the sync every interval until ctx is done
+func (s *hrSyncer) schedule(ctx context.Context) {
+	if s.interval <= 0 {
+		return
+	}
+	logf(ctx, "HR sync from %s every %s", s.source.Name(), s.interval)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		run, err := s.Run(ctx, false)
+		if err != nil {
+			logErrorf(ctx, "HR sync run %d failed: %v", run.ID, err)
+			continue
+		}
+		logf(ctx, "HR sync run %d: %d fetched, %d updated, %d created, %d conflicts",
+			run.ID, run.Stats.Fetched, run.Stats.Updated, run.Stats.Created, run.Stats.Conflicts)
+	}
+}
+
+// Run fetches employees from the source and reconciles them in one
+// transaction, which is rolled back for dry runs. The run is recorded in
+// hr_sync_runs either way.
+func (s *hrSyncer) Run(ctx context.Context, dryRun bool) (HRSyncRun, error) {
+	run := HRSyncRun{
+		Source:    s.source.Name(),
+		DryRun:    dryRun,
+		Status:    hrSyncStatusRunning,
+		Conflicts: []HRSyncConflict{},
+	}
+	if err := s.db.QueryRowContext(ctx,
+		`INSERT INTO hr_sync_runs (source, dry_run, status, started_at) VALUES ($1, $2, $3, NOW()) RETURNING id, started_at`,
+		run.Source, run.DryRun, run.Status,
+	).Scan(&run.ID, &run.StartedAt); err != nil {
+		return run, err
+	}
+
+	err := s.sync(ctx, &run)
+	run.Status = hrSyncStatusSucceeded
+	if err != nil {
+		message := err.Error()
+		run.Status, run.Error = hrSyncStatusFailed, &message
+	}
+	run.Stats.Conflicts = len(run.Conflicts)
+
+	stats, _ := json.Marshal(run.Stats)
+	conflicts, _ := json.Marshal(run.Conflicts)
+	var finishedAt time.Time
+	if updateErr := s.db.QueryRowContext(context.WithoutCancel(ctx),
+		`UPDATE hr_sync_runs SET status = $1, stats = $2, conflicts = $3, error = $4, finished_at = NOW()
+		WHERE id = $5 RETURNING finished_at`,
+		run.Status, stats, conflicts, run.Error, run.ID,
+	).Scan(&finishedAt); updateErr != nil && err == nil {
+		err = updateErr
+	}
+	run.FinishedAt = &finishedAt
+	return run, err
+}
+
+func (s *hrSyncer) sync(ctx context.Context, run *HRSyncRun) error {
+	records, err := s.source.Fetch(ctx)
+	if err != nil {
+		return &hrSourceError{source: s.source.Name(), err: err}
+	}
+	run.Stats.Fetched = len(records)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, hrSyncLockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return errHRSyncRunning
+	}
+
+	if err := s.reconcile(ctx, tx, records, run); err != nil {
+		return err
+	}
+	if run.DryRun {
+		return nil
+	}
+	return tx.Commit()
+}
+
+// syncedEmployee is an employee with an external ID as the sync sees it
+type syncedEmployee struct {
+	id         int64
+	externalID string
+	surname    *string
+	name       *string
+	patronymic *string
+	profileURL *string
+	edited     bool // changed here since the last sync
+}
+
+// reconcile matches source records to employees by external ID and updates
+// their data; positions they hold show the new data
+func (s *hrSyncer) reconcile(ctx context.Context, tx *sql.Tx, records []HREmployee, run *HRSyncRun) error {
+	local := make(map[string]syncedEmployee)
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, external_id, surname, name, patronymic, profile_url,
+		hr_synced_at IS NOT NULL AND updated_at > hr_synced_at
+		FROM employees WHERE external_id IS NOT NULL`,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var e syncedEmployee
+		if err := rows.Scan(&e.id, &e.externalID, &e.surname, &e.name, &e.patronymic, &e.profileURL, &e.edited); err != nil {
+			rows.Close()
+			return err
+		}
+		local[e.externalID] = e
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	positions, err := activeEmployeePositions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	conflict := func(kind, externalID string, employeeID int64, format string, args ...interface{}) {
+		c := HRSyncConflict{Kind: kind, ExternalID: externalID, Message: fmt.Sprintf(format, args...)}
+		if employeeID != 0 {
+			c.EmployeeID = &employeeID
+			c.PositionIDs = positions[employeeID]
+		}
+		run.Conflicts = append(run.Conflicts, c)
+	}
+
+	counts := make(map[string]int)
+	for _, rec := range records {
+		counts[rec.ExternalID]++
+	}
+	seen := make(map[string]bool)
+	for i, rec := range records {
+		id := rec.ExternalID
+		if id == "" {
+			conflict(hrConflictInvalidRecord, "", 0, "record %d has no employee_id", i+1)
+			continue
+		}
+		e, exists := local[id]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if counts[id] > 1 {
+			conflict(hrConflictDuplicate, id, e.id, "employee_id %q appears %d times in the source", id, counts[id])
+			continue
+		}
+		if rec.Surname == nil {
+			conflict(hrConflictInvalidRecord, id, e.id, "record for employee_id %q has no surname", id)
+			continue
+		}
+		if rec.ProfileURL == nil && s.profileURLTemplate != "" {
+			profileURL := strings.ReplaceAll(s.profileURLTemplate, "{employee_id}", url.PathEscape(id))
+			rec.ProfileURL = &profileURL
+		}
+
+		if !exists {
+			if !s.createMissing {
+				run.Stats.Unmatched++
+				continue
+			}
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO employees (external_id, surname, name, patronymic, profile_url, hr_synced_at, created_at, updated_at)
+				VALUES ($1, $2, $3, $4, $5, NOW(), NOW(), NOW())`,
+				id, rec.Surname, rec.Name, rec.Patronymic, rec.ProfileURL,
+			); err != nil {
+				return err
+			}
+			run.Stats.Created++
+			continue
+		}
+
+		var changed []string
+		for _, f := range []struct {
+			name          string
+			local, source *string
+		}{
+			{"surname", e.surname, rec.Surname},
+			{"name", e.name, rec.Name},
+			{"patronymic", e.patronymic, rec.Patronymic},
+			{"profile_url", e.profileURL, rec.ProfileURL},
+		} {
+			if trimmed(f.local) != trimmed(f.source) {
+				changed = append(changed, f.name)
+			}
+		}
+
+		if len(changed) == 0 {
+			run.Stats.Unchanged++
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE employees SET hr_synced_at = NOW() WHERE id = $1 AND (hr_synced_at IS NULL OR updated_at > hr_synced_at)`,
+				e.id,
+			); err != nil {
+				return err
+			}
+			continue
+		}
+		if e.edited && !s.overwriteLocal {
+			conflict(hrConflictLocalChanges, id, e.id, "%s changed here since the last sync and differ from the source",
+				strings.Join(changed, ", "))
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE employees SET surname = $1, name = $2, patronymic = $3, profile_url = $4, updated_at = NOW(), hr_synced_at = NOW()
+			WHERE id = $5`,
+			rec.Surname, rec.Name, rec.Patronymic, rec.ProfileURL, e.id,
+		); err != nil {
+			return err
+		}
+		if err := refreshEmployeePositions(ctx, tx, e.id); err != nil {
+			return err
+		}
+		run.Stats.Updated++
+	}
+
+	// Employees who still hold positions but are gone from the HR system
+	var missing []string
+	for id, e := range local {
+		if !seen[id] && len(positions[e.id]) > 0 {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	for _, id := range missing {
+		conflict(hrConflictMissingInSource, id, local[id].id, "employee_id %q holds positions but is not in the source", id)
+	}
+	return nil
+}
+
+// activeEmployeePositions returns the positions every employee currently holds
+func activeEmployeePositions(ctx context.Context, db dbQuerier) (map[int64][]int64, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT a.employee_id, ARRAY_AGG(DISTINCT a.position_id) FROM position_assignments a
+		WHERE a.position_id IS NOT NULL AND `+assignmentActive+`
+		GROUP BY a.employee_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	positions := make(map[int64][]int64)
+	for rows.Next() {
+		var employeeID int64
+		var positionIDs []int64
+		if err := rows.Scan(&employeeID, pq.Array(&positionIDs)); err != nil {
+			return nil, err
+		}
+		positions[employeeID] = positionIDs
+	}
+	return positions, rows.Err()
+}
+
+const hrSyncRunColumns = `id, source, dry_run, status, stats, conflicts, error, started_at, finished_at`
+
+func scanHRSyncRun(row interface{ Scan(...interface{}) error }) (HRSyncRun, error) {
+	var run HRSyncRun
+	var stats, conflicts []byte
+	if err := row.Scan(&run.ID, &run.Source, &run.DryRun, &run.Status, &stats, &conflicts, &run.Error,
+		&run.StartedAt, &run.FinishedAt); err != nil {
+		return run, err
+	}
+	json.Unmarshal(stats, &run.Stats)
+	json.Unmarshal(conflicts, &run.Conflicts)
+	if run.Conflicts == nil {
+		run.Conflicts = []HRSyncConflict{}
+	}
+	return run, nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// HREmployee is an employee record of an HR system
+type HREmployee struct {
+	ExternalID string
+	Surname    *string
+	Name       *string
+	Patronymic *string
+	ProfileURL *string
+}
+
+// HRSource is a connector to an HR system. Fetch returns the full list of
+// employees; records missing from it are reported, not deleted.
+type HRSource interface {
+	Name() string
+	Fetch(ctx context.Context) ([]HREmployee, error)
+}
+
+// Employee attributes a source record is mapped to
+const (
+	hrFieldEmployeeID = "employee_id"
+	hrFieldSurname    = "surname"
+	hrFieldName       = "name"
+	hrFieldPatronymic = "patronymic"
+	hrFieldProfileURL = "profile_url"
+)
+
+// hrFieldMapping maps employee attributes to column, JSON key or LDAP
+// attribute names of a source
+type hrFieldMapping map[string]string
+
+// parseHRFieldMapping overrides defaults with "employee_id=id,surname=last_name"
+func parseHRFieldMapping(spec string, defaults hrFieldMapping) (hrFieldMapping, error) {
+	m := make(hrFieldMapping)
+	for k, v := range defaults {
+		m[k] = v
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		field, name, ok := strings.Cut(pair, "=")
+		field = strings.TrimSpace(field)
+		if _, known := defaults[field]; !ok || !known {
+			return nil, fmt.Errorf("invalid field mapping %q (use %s=<name>, ...)", pair, hrFieldEmployeeID)
+		}
+		m[field] = strings.TrimSpace(name)
+	}
+	if m[hrFieldEmployeeID] == "" {
+		return nil, fmt.Errorf("%s must be mapped", hrFieldEmployeeID)
+	}
+	return m, nil
+}
+
+// record builds an HREmployee from a lookup of source values by name
+func (m hrFieldMapping) record(get func(name string) string) HREmployee {
+	value := func(field string) *string {
+		if m[field] == "" {
+			return nil
+		}
+		if v := strings.TrimSpace(get(m[field])); v != "" {
+			return &v
+		}
+		return nil
+	}
+	e := HREmployee{
+		Surname:    value(hrFieldSurname),
+		Name:       value(hrFieldName),
+		Patronymic: value(hrFieldPatronymic),
+		ProfileURL: value(hrFieldProfileURL),
+	}
+	if id := value(hrFieldEmployeeID); id != nil {
+		e.ExternalID = *id
+	}
+	return e
+}
+
+var defaultHRFieldMapping = hrFieldMapping{
+	hrFieldEmployeeID: "employee_id",
+	hrFieldSurname:    "surname",
+	hrFieldName:       "name",
+	hrFieldPatronymic: "patronymic",
+	hrFieldProfileURL: "profile_url",
+}
+
+var defaultLDAPFieldMapping = hrFieldMapping{
+	hrFieldEmployeeID: "employeeID",
+	hrFieldSurname:    "sn",
+	hrFieldName:       "givenName",
+	hrFieldPatronymic: "middleName",
+	hrFieldProfileURL: "",
+}
+
+// csvFolderSource reads the newest *.csv file of a drop folder. The first row
+// holds column names.
+type csvFolderSource struct {
+	dir    string
+	fields hrFieldMapping
+}
+
+func (s *csvFolderSource) Name() string { return "csv" }
+
+func (s *csvFolderSource) Fetch(ctx context.Context) ([]HREmployee, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.csv"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no CSV files in %s", s.dir)
+	}
+	modTimes := make(map[string]time.Time)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	sort.Slice(paths, func(i, j int) bool { return modTimes[paths[i]].After(modTimes[paths[j]]) })
+
+	f, err := os.Open(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", paths[0], err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	if _, ok := columns[s.fields[hrFieldEmployeeID]]; !ok {
+		return nil, fmt.Errorf("%s: no %q column", paths[0], s.fields[hrFieldEmployeeID])
+	}
+
+	var records []HREmployee
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", paths[0], err)
+		}
+		records = append(records, s.fields.record(func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}))
+	}
+	return records, nil
+}
+
+// jsonHTTPSource loads employees from a JSON endpoint that returns an array of
+// objects, or an object with the array under itemsPath (e.g. "data.employees")
+type jsonHTTPSource struct {
+	url       string
+	token     string // sent as a bearer token when set
+	itemsPath string
+	fields    hrFieldMapping
+	client    *http.Client
+}
+
+func (s *jsonHTTPSource) Name() string { return "json" }
+
+func (s *jsonHTTPSource) Fetch(ctx context.Context) ([]HREmployee, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", s.url, resp.Status)
+	}
+	return decodeHREmployees(resp.Body, s.itemsPath, s.fields)
+}
+
+// decodeHREmployees reads employee objects from JSON
+func decodeHREmployees(r io.Reader, itemsPath string, fields hrFieldMapping) ([]HREmployee, error) {
+	var body interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, err
+	}
+	if itemsPath != "" {
+		for _, key := range strings.Split(itemsPath, ".") {
+			obj, ok := body.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("no %q in the response", itemsPath)
+			}
+			body = obj[key]
+		}
+	}
+	items, ok := body.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an array of employees")
+	}
+
+	records := make([]HREmployee, 0, len(items))
+	for _, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an employee object, got %T", item)
+		}
+		records = append(records, fields.record(func(name string) string {
+			switch v := obj[name].(type) {
+			case string:
+				return v
+			case json.Number:
+				return v.String()
+			}
+			return ""
+		}))
+	}
+	return records, nil
+}
+
+// ldapSource searches person entries of a directory
+type ldapSource struct {
+	url      string
+	bindDN   string
+	password string
+	baseDN   string
+	filter   string
+	fields   hrFieldMapping
+}
+
+func (s *ldapSource) Name() string { return "ldap" }
+
+func (s *ldapSource) Fetch(ctx context.Context) ([]HREmployee, error) {
+	conn, err := ldap.DialURL(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetTimeout(time.Until(deadline))
+	}
+	if s.bindDN != "" {
+		if err := conn.Bind(s.bindDN, s.password); err != nil {
+			return nil, err
+		}
+	}
+
+	var attributes []string
+	for _, name := range s.fields {
+		if name != "" {
+			attributes = append(attributes, name)
+		}
+	}
+	sort.Strings(attributes)
+	result, err := conn.SearchWithPaging(ldap.NewSearchRequest(
+		s.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		s.filter, attributes, nil,
+	), 500)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]HREmployee, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		records = append(records, s.fields.record(entry.GetAttributeValue))
+	}
+	return records, nil
+}
+
+// fakeHRSource serves records from a local JSON file in the format of the
+// JSON source, for trying the sync out without an HR system
+type fakeHRSource struct {
+	path   string
+	fields hrFieldMapping
+}
+
+func (s *fakeHRSource) Name() string { return "fake" }
+
+func (s *fakeHRSource) Fetch(ctx context.Context) ([]HREmployee, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeHREmployees(f, "", s.fields)
+}
+
+// newHRSourceFromEnv creates the source chosen by HR_SYNC_SOURCE, or returns
+// nil when the sync is not configured
+func newHRSourceFromEnv() (HRSource, error) {
+	kind := strings.TrimSpace(os.Getenv("HR_SYNC_SOURCE"))
+	if kind == "" {
+		return nil, nil
+	}
+	required := func(name string) (string, error) {
+		value := strings.TrimSpace(os.Getenv(name))
+		if value == "" {
+			return "", fmt.Errorf("%s is required for HR_SYNC_SOURCE=%s", name, kind)
+		}
+		return value, nil
+	}
+
+	defaults := defaultHRFieldMapping
+	if kind == "ldap" {
+		defaults = defaultLDAPFieldMapping
+	}
+	fields, err := parseHRFieldMapping(os.Getenv("HR_SYNC_FIELDS"), defaults)
+	if err != nil {
+		return nil, fmt.Errorf("HR_SYNC_FIELDS: %w", err)
+	}
+
+	switch kind {
+	case "csv":
+		dir, err := required("HR_SYNC_CSV_DIR")
+		if err != nil {
+			return nil, err
+		}
+		return &csvFolderSource{dir: dir, fields: fields}, nil
+	case "json":
+		url, err := required("HR_SYNC_JSON_URL")
+		if err != nil {
+			return nil, err
+		}
+		return &jsonHTTPSource{
+			url:       url,
+			token:     os.Getenv("HR_SYNC_JSON_TOKEN"),
+			itemsPath: os.Getenv("HR_SYNC_JSON_ITEMS"),
+			fields:    fields,
+			client:    &http.Client{Timeout: envDuration("HR_SYNC_TIMEOUT", time.Minute)},
+		}, nil
+	case "ldap":
+		url, err := required("HR_SYNC_LDAP_URL")
+		if err != nil {
+			return nil, err
+		}
+		baseDN, err := required("HR_SYNC_LDAP_BASE_DN")
+		if err != nil {
+			return nil, err
+		}
+		filter := os.Getenv("HR_SYNC_LDAP_FILTER")
+		if filter == "" {
+			filter = "(objectClass=person)"
+		}
+		return &ldapSource{
+			url:      url,
+			bindDN:   os.Getenv("HR_SYNC_LDAP_BIND_DN"),
+			password: os.Getenv("HR_SYNC_LDAP_PASSWORD"),
+			baseDN:   baseDN,
+			filter:   filter,
+			fields:   fields,
+		}, nil
+	case "fake":
+		path, err := required("HR_SYNC_FAKE_FILE")
+		if err != nil {
+			return nil, err
+		}
+		return &fakeHRSource{path: path, fields: fields}, nil
+	}
+	return nil, fmt.Errorf("unknown HR_SYNC_SOURCE %q (use csv, json, ldap or fake)", kind)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runLDAPExportCommand implements the `ldap-export` subcommand: it writes the
+// LDIF export or applies it to the directory with the LDAP_EXPORT_* settings
+func runLDAPExportCommand(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("ldap-export", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: server ldap-export [-format modify|add] [-o file] | -apply [-dry-run]")
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", ldifFormatModify, "LDIF format: modify (replace attributes) or add (full entries)")
+	output := fs.String("o", "", "write LDIF to this file instead of stdout")
+	apply := fs.Bool("apply", false, "update the directory at LDAP_EXPORT_URL instead of writing LDIF")
+	dryRun := fs.Bool("dry-run", false, "with -apply, report changes without making them")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if *format != ldifFormatModify && *format != ldifFormatAdd {
+		return fmt.Errorf("-format must be modify or add")
+	}
+
+	cfg, err := loadLDAPExportConfig()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	export, err := buildLDAPExport(ctx, db, cfg)
+	if err != nil {
+		return err
+	}
+
+	if !*apply {
+		var w io.Writer = os.Stdout
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := writeLDIF(w, export, *format, cfg); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d entries exported, %d employees without employee_id skipped\n",
+			len(export.Entries), export.Skipped)
+		return nil
+	}
+
+	result, err := applyLDAPExport(ctx, export, cfg, *dryRun)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d entries: %d updated, %d unchanged, %d missing, %d failed, %d skipped\n",
+		result.Entries, result.Updated, result.Unchanged, result.Missing, result.Failed, result.Skipped)
+	if result.DryRun {
+		fmt.Println("dry run: the directory was not changed")
+	}
+	if len(result.Changes) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATUS\tDN\tDETAILS")
+		for _, c := range result.Changes {
+			details := c.Error
+			if details == "" {
+				details = strings.Join(c.Attributes, ", ")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Status, c.DN, details)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d entries failed to update", result.Failed)
+	}
+	return nil
+}
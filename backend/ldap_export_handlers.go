@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// GetLDIFExport returns the org structure as LDIF; ?format=add produces full
+// entries instead of attribute replacements
+func (h *Handler) GetLDIFExport(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadLDAPExportConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ldifFormatModify
+	}
+	if format != ldifFormatModify && format != ldifFormatAdd {
+		http.Error(w, "format must be modify or add", http.StatusBadRequest)
+		return
+	}
+
+	export, err := buildLDAPExport(r.Context(), h.db, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeLDIF(&buf, export, format, cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="org-structure.ldif"`)
+	w.Write(buf.Bytes())
+}
+
+// ApplyLDAPExport updates the directory at LDAP_EXPORT_URL; ?dry_run=true
+// reports the entries that would change
+func (h *Handler) ApplyLDAPExport(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadLDAPExportConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if cfg.url == "" {
+		http.Error(w, "LDAP export is not configured (set LDAP_EXPORT_URL)", http.StatusServiceUnavailable)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	export, err := buildLDAPExport(r.Context(), h.db, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result, err := applyLDAPExport(r.Context(), export, cfg, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
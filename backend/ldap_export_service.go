@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDIF change types of the export
+const (
+	ldifFormatModify = "modify" // replace the exported attributes of existing entries
+	ldifFormatAdd    = "add"    // full entries for an empty directory
+)
+
+// ldapExportConfig is read from LDAP_EXPORT_* variables
+type ldapExportConfig struct {
+	baseDN           string
+	rdnAttribute     string
+	objectClasses    []string
+	titleAttribute   string            // position name, "" to skip
+	managerAttribute string            // DN of the manager entry, "" to skip
+	fieldAttributes  map[string]string // custom field key -> attribute
+	managerFields    []string          // custom field keys to look for a superior in, most specific first
+	url              string            // directory to apply changes to
+	bindDN           string
+	password         string
+}
+
+func loadLDAPExportConfig() (ldapExportConfig, error) {
+	cfg := ldapExportConfig{
+		baseDN:           strings.TrimSpace(os.Getenv("LDAP_EXPORT_BASE_DN")),
+		rdnAttribute:     envString("LDAP_EXPORT_RDN_ATTRIBUTE", "uid"),
+		objectClasses:    splitList(envString("LDAP_EXPORT_OBJECT_CLASSES", "top,person,organizationalPerson,inetOrgPerson")),
+		titleAttribute:   envString("LDAP_EXPORT_TITLE_ATTRIBUTE", "title"),
+		managerAttribute: envString("LDAP_EXPORT_MANAGER_ATTRIBUTE", "manager"),
+		fieldAttributes:  make(map[string]string),
+		managerFields:    splitList(os.Getenv("LDAP_EXPORT_MANAGER_FIELDS")),
+		url:              strings.TrimSpace(os.Getenv("LDAP_EXPORT_URL")),
+		bindDN:           os.Getenv("LDAP_EXPORT_BIND_DN"),
+		password:         os.Getenv("LDAP_EXPORT_PASSWORD"),
+	}
+	if cfg.baseDN == "" {
+		return cfg, fmt.Errorf("LDAP export is not configured (set LDAP_EXPORT_BASE_DN)")
+	}
+	if _, err := ldap.ParseDN(cfg.baseDN); err != nil {
+		return cfg, fmt.Errorf("LDAP_EXPORT_BASE_DN: %w", err)
+	}
+	for _, pair := range splitList(os.Getenv("LDAP_EXPORT_ATTRIBUTES")) {
+		key, attribute, ok := strings.Cut(pair, "=")
+		key, attribute = strings.TrimSpace(key), strings.TrimSpace(attribute)
+		if !ok || key == "" || attribute == "" {
+			return cfg, fmt.Errorf("LDAP_EXPORT_ATTRIBUTES: invalid mapping %q (use <custom field key>=<attribute>)", pair)
+		}
+		cfg.fieldAttributes[key] = attribute
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma-separated list and drops empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ldapAttribute is an exported attribute; no values clears it in the directory
+type ldapAttribute struct {
+	Name   string
+	Values []string
+}
+
+// ldapExportEntry is the directory entry of an employee
+type ldapExportEntry struct {
+	DN         string
+	EmployeeID string // external ID, the RDN value
+	Surname    string
+	GivenName  string
+	FullName   string
+	PositionID int64
+	Attributes []ldapAttribute // exported attributes, in a stable order
+}
+
+// ldapExport is the exported directory data
+type ldapExport struct {
+	Entries []ldapExportEntry
+	Skipped int // employees holding positions without an external ID
+}
+
+// buildLDAPExport builds an entry for every employee with an external ID who
+// holds a position. Attributes come from their primary position: its name,
+// the values of mapped custom fields and the manager, which is the employee of
+// the superior position of the most specific value that has one.
+func buildLDAPExport(ctx context.Context, db dbQuerier, cfg ldapExportConfig) (ldapExport, error) {
+	ctx, span := tracer.Start(ctx, "buildLDAPExport")
+	defer span.End()
+
+	var export ldapExport
+	managers, err := newManagerResolver(ctx, db, cfg.managerFields)
+	if err != nil {
+		return export, err
+	}
+	valueInfoMap, err := NewCustomFieldsService(db).LoadValueInfoMap(ctx)
+	if err != nil {
+		return export, err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT DISTINCT ON (a.employee_id) e.id, e.external_id, e.surname, e.name, e.patronymic,
+		p.id, p.position_name, p.custom_fields_values_id
+		FROM position_assignments a
+		JOIN employees e ON e.id = a.employee_id
+		JOIN positions p ON p.id = a.position_id
+		WHERE `+assignmentActive+`
+		ORDER BY a.employee_id, `+assignmentPrimaryOrder,
+	)
+	if err != nil {
+		return export, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var employeeID int64
+		var externalID, surname, name, patronymic *string
+		var e ldapExportEntry
+		var positionName string
+		var valueIDs UUIDArray
+		if err := rows.Scan(&employeeID, &externalID, &surname, &name, &patronymic, &e.PositionID, &positionName, &valueIDs); err != nil {
+			return export, err
+		}
+		if e.EmployeeID = trimmed(externalID); e.EmployeeID == "" {
+			export.Skipped++
+			continue
+		}
+		e.DN = cfg.entryDN(e.EmployeeID)
+		e.Surname, e.GivenName = trimmed(surname), trimmed(name)
+		if fullName := combineEmployeeFullName(surname, name, patronymic); fullName != nil {
+			e.FullName = *fullName
+		}
+
+		values := managers.fieldValues(valueIDs)
+		if cfg.titleAttribute != "" {
+			e.Attributes = append(e.Attributes, ldapAttribute{Name: cfg.titleAttribute, Values: []string{positionName}})
+		}
+		keys := make([]string, 0, len(cfg.fieldAttributes))
+		for key := range cfg.fieldAttributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			attribute := ldapAttribute{Name: cfg.fieldAttributes[key]}
+			if valueID, ok := values[key]; ok {
+				attribute.Values = []string{valueInfoMap[valueID]}
+			}
+			e.Attributes = append(e.Attributes, attribute)
+		}
+		if cfg.managerAttribute != "" {
+			// Managers without an external ID have no entry
+			attribute := ldapAttribute{Name: cfg.managerAttribute}
+			if manager, ok := managers.manager(e.PositionID, employeeID, valueIDs, func(h positionHolder) bool {
+				return trimmed(h.ExternalID) != ""
+			}); ok {
+				attribute.Values = []string{cfg.entryDN(trimmed(manager.ExternalID))}
+			}
+			e.Attributes = append(e.Attributes, attribute)
+		}
+		export.Entries = append(export.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return export, err
+	}
+
+	sort.Slice(export.Entries, func(i, j int) bool { return export.Entries[i].EmployeeID < export.Entries[j].EmployeeID })
+	return export, nil
+}
+
+// entryDN is the DN of the entry of an employee
+func (cfg ldapExportConfig) entryDN(employeeID string) string {
+	return cfg.rdnAttribute + "=" + ldap.EscapeDN(employeeID) + "," + cfg.baseDN
+}
+
+// writeLDIF writes the export as LDIF (RFC 2849) in the given format
+func writeLDIF(w io.Writer, export ldapExport, format string, cfg ldapExportConfig) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "version: 1")
+	if export.Skipped > 0 {
+		fmt.Fprintf(bw, "# %d employees without employee_id are not exported\n", export.Skipped)
+	}
+	for _, e := range export.Entries {
+		fmt.Fprintln(bw)
+		writeLDIFLine(bw, "dn", e.DN)
+		if format == ldifFormatAdd {
+			writeLDIFLine(bw, "changetype", "add")
+			for _, objectClass := range cfg.objectClasses {
+				writeLDIFLine(bw, "objectClass", objectClass)
+			}
+			writeLDIFLine(bw, cfg.rdnAttribute, e.EmployeeID)
+			cn, sn := e.FullName, e.Surname
+			if cn == "" {
+				cn = e.EmployeeID
+			}
+			if sn == "" {
+				sn = cn
+			}
+			if cfg.rdnAttribute != "cn" {
+				writeLDIFLine(bw, "cn", cn)
+			}
+			writeLDIFLine(bw, "sn", sn)
+			if e.GivenName != "" {
+				writeLDIFLine(bw, "givenName", e.GivenName)
+			}
+			for _, attribute := range e.Attributes {
+				for _, value := range attribute.Values {
+					writeLDIFLine(bw, attribute.Name, value)
+				}
+			}
+			continue
+		}
+
+		writeLDIFLine(bw, "changetype", "modify")
+		for _, attribute := range e.Attributes {
+			writeLDIFLine(bw, "replace", attribute.Name)
+			for _, value := range attribute.Values {
+				writeLDIFLine(bw, attribute.Name, value)
+			}
+			fmt.Fprintln(bw, "-")
+		}
+	}
+	return bw.Flush()
+}
+
+// writeLDIFLine writes "name: value", base64-encoding values that are not
+// safe strings, and folds lines longer than 76 characters
+func writeLDIFLine(w io.Writer, name, value string) {
+	line := name + ": " + value
+	if !ldifSafe(value) {
+		line = name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	for len(line) > 76 {
+		fmt.Fprintln(w, line[:76])
+		line = " " + line[76:]
+	}
+	fmt.Fprintln(w, line)
+}
+
+// ldifSafe reports whether a value can be written as is: printable ASCII
+// without a leading space, colon or '<' and without a trailing space
+func ldifSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if c := value[0]; c == ' ' || c == ':' || c == '<' {
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == 0 || c == '\n' || c == '\r' || c > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// LDAPExportResult is the outcome of applying the export to a directory
+type LDAPExportResult struct {
+	DryRun    bool              `json:"dry_run"`
+	Entries   int               `json:"entries"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Missing   int               `json:"missing"` // employees without an entry; entries are not created
+	Failed    int               `json:"failed"`
+	Skipped   int               `json:"skipped"` // employees without employee_id
+	Changes   []LDAPEntryChange `json:"changes"`
+}
+
+// LDAPEntryChange describes what happened to one entry
+type LDAPEntryChange struct {
+	DN         string   `json:"dn"`
+	EmployeeID string   `json:"employee_id"`
+	Status     string   `json:"status"`               // updated, missing or failed
+	Attributes []string `json:"attributes,omitempty"` // changed attributes
+	Error      string   `json:"error,omitempty"`
+}
+
+// applyLDAPExport replaces the exported attributes of existing entries that
+// differ from the export. Dry runs only compare.
+func applyLDAPExport(ctx context.Context, export ldapExport, cfg ldapExportConfig, dryRun bool) (LDAPExportResult, error) {
+	result := LDAPExportResult{
+		DryRun:  dryRun,
+		Entries: len(export.Entries),
+		Skipped: export.Skipped,
+		Changes: []LDAPEntryChange{},
+	}
+	if cfg.url == "" {
+		return result, fmt.Errorf("LDAP_EXPORT_URL is not set")
+	}
+
+	conn, err := ldap.DialURL(cfg.url)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	if cfg.bindDN != "" {
+		if err := conn.Bind(cfg.bindDN, cfg.password); err != nil {
+			return result, err
+		}
+	}
+
+	for _, e := range export.Entries {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		change := LDAPEntryChange{DN: e.DN, EmployeeID: e.EmployeeID}
+
+		names := make([]string, len(e.Attributes))
+		for i, attribute := range e.Attributes {
+			names[i] = attribute.Name
+		}
+		found, err := conn.Search(ldap.NewSearchRequest(
+			e.DN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+			"(objectClass=*)", names, nil,
+		))
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && len(found.Entries) == 0) {
+			change.Status = "missing"
+			result.Missing++
+			result.Changes = append(result.Changes, change)
+			continue
+		}
+		if err != nil {
+			change.Status, change.Error = "failed", err.Error()
+			result.Failed++
+			result.Changes = append(result.Changes, change)
+			continue
+		}
+
+		modify := ldap.NewModifyRequest(e.DN, nil)
+		for _, attribute := range e.Attributes {
+			current := found.Entries[0].GetEqualFoldAttributeValues(attribute.Name)
+			if !sameLDAPValues(current, attribute.Values, attribute.Name == cfg.managerAttribute) {
+				modify.Replace(attribute.Name, attribute.Values)
+				change.Attributes = append(change.Attributes, attribute.Name)
+			}
+		}
+		if len(change.Attributes) == 0 {
+			result.Unchanged++
+			continue
+		}
+		if !dryRun {
+			if err := conn.Modify(modify); err != nil {
+				change.Status, change.Error = "failed", err.Error()
+				result.Failed++
+				result.Changes = append(result.Changes, change)
+				continue
+			}
+		}
+		change.Status = "updated"
+		result.Updated++
+		result.Changes = append(result.Changes, change)
+	}
+	return result, nil
+}
+
+// sameLDAPValues compares attribute values as sets; DNs are compared
+// ignoring case
+func sameLDAPValues(current, exported []string, isDN bool) bool {
+	if len(current) != len(exported) {
+		return false
+	}
+	normalize := func(values []string) []string {
+		out := make([]string, len(values))
+		for i, v := range values {
+			if isDN {
+				v = strings.ToLower(v)
+			}
+			out[i] = v
+		}
+		sort.Strings(out)
+		return out
+	}
+	a, b := normalize(current), normalize(exported)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
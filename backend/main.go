@@ -1,40 +1,108 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 	_ "github.com/lib/pq"
 )
 
 func main() {
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
+	// Load environment variables; logging is set up afterwards so that
+	// LOG_FORMAT and LOG_LEVEL can come from .env
+	envErr := godotenv.Load()
+	setupLogging()
+	if envErr != nil {
 		log.Println("No .env file found, using environment variables")
 	}
+	// Tracing is set up before the database so SQL queries are traced
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatal("Failed to set up tracing:", err)
+	}
+
 	// Initialize database
 	db, err := NewDB()
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 	defer db.Close()
+	registerDBMetrics(db)
 
-	// Run database migrations on every server start
-	if err := RunMigrations(db); err != nil {
-		log.Fatal("Failed to run database migrations:", err)
+	// `migrate up|down|status|redo` manages the schema without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// `diagnostics` reports (and optionally fixes) data quality problems
+	if len(os.Args) > 1 && os.Args[1] == "diagnostics" {
+		if err := runDiagnosticsCommand(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// `hr-sync` runs the employee sync with the HR system once
+	if len(os.Args) > 1 && os.Args[1] == "hr-sync" {
+		if err := runHRSyncCommand(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// `ldap-export` writes the org structure as LDIF or applies it to the directory
+	if len(os.Args) > 1 && os.Args[1] == "ldap-export" {
+		if err := runLDAPExportCommand(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		log.Fatal("Failed to load database migrations:", err)
+	}
+
+	// Run database migrations on server start unless disabled
+	// (e.g. when `migrate up` is a separate deployment step)
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		if _, err := migrator.Up(context.Background()); err != nil {
+			log.Fatal("Failed to run database migrations:", err)
+		}
 	}
 
 	// Initialize handlers
-	h := NewHandler(db)
+	h := NewHandler(db, migrator)
+
+	// Report stored trees that reference missing fields or have broken levels
+	h.checkStoredTrees(context.Background())
 
 	// Setup routes
 	r := mux.NewRouter()
 
 	// CORS middleware - apply before routes so OPTIONS requests are handled
 	r.Use(corsMiddleware)
+	// One span per request, named after the route template
+	r.Use(otelmux.Middleware(serviceName))
+	// Request bodies larger than MAX_REQUEST_BODY_BYTES fail to decode
+	r.Use(limitRequestBody(int64(envInt("MAX_REQUEST_BODY_BYTES", 10<<20))))
+
+	// Liveness and readiness probes
+	r.HandleFunc("/healthz", h.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", h.Readyz).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
@@ -43,10 +111,31 @@ func main() {
 	api.HandleFunc("/positions", h.GetPositions).Methods("GET")
 	api.HandleFunc("/positions", h.CreatePosition).Methods("POST")
 	api.HandleFunc("/positions", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/positions/bulk", h.BulkPositions).Methods("POST")
+	api.HandleFunc("/positions/bulk", handleOptions).Methods("OPTIONS")
 	api.HandleFunc("/positions/{id}", h.GetPosition).Methods("GET")
 	api.HandleFunc("/positions/{id}", h.UpdatePosition).Methods("PUT")
 	api.HandleFunc("/positions/{id}", h.DeletePosition).Methods("DELETE")
 	api.HandleFunc("/positions/{id}", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/positions/{id}/clone", h.ClonePosition).Methods("POST")
+	api.HandleFunc("/positions/{id}/clone", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/positions/{id}/assignments", h.GetPositionAssignments).Methods("GET")
+	api.HandleFunc("/positions/{id}/assignments", handleOptions).Methods("OPTIONS")
+
+	// Employees and assignments
+	api.HandleFunc("/employees", h.GetEmployees).Methods("GET")
+	api.HandleFunc("/employees", h.CreateEmployee).Methods("POST")
+	api.HandleFunc("/employees", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/employees/{id}", h.GetEmployee).Methods("GET")
+	api.HandleFunc("/employees/{id}", h.UpdateEmployee).Methods("PUT")
+	api.HandleFunc("/employees/{id}", h.DeleteEmployee).Methods("DELETE")
+	api.HandleFunc("/employees/{id}", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/employees/{id}/assignments", h.GetEmployeeAssignments).Methods("GET")
+	api.HandleFunc("/employees/{id}/assignments", h.CreateAssignment).Methods("POST")
+	api.HandleFunc("/employees/{id}/assignments", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/assignments/{id}", h.UpdateAssignment).Methods("PUT")
+	api.HandleFunc("/assignments/{id}", h.DeleteAssignment).Methods("DELETE")
+	api.HandleFunc("/assignments/{id}", handleOptions).Methods("OPTIONS")
 
 	// Custom Fields
 	api.HandleFunc("/custom-fields", h.GetCustomFields).Methods("GET")
@@ -60,12 +149,91 @@ func main() {
 	api.HandleFunc("/trees", h.GetTrees).Methods("GET")
 	api.HandleFunc("/trees", h.CreateTree).Methods("POST")
 	api.HandleFunc("/trees", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/trees/preview", h.PreviewTree).Methods("POST")
+	api.HandleFunc("/trees/preview", handleOptions).Methods("OPTIONS")
 	api.HandleFunc("/trees/{id}", h.GetTree).Methods("GET")
 	api.HandleFunc("/trees/{id}", h.UpdateTree).Methods("PUT")
 	api.HandleFunc("/trees/{id}", h.DeleteTree).Methods("DELETE")
 	api.HandleFunc("/trees/{id}", handleOptions).Methods("OPTIONS")
 	api.HandleFunc("/trees/{id}/structure", h.GetTreeStructure).Methods("GET")
 	api.HandleFunc("/trees/{id}/structure", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/trees/{id}/search", h.SearchTree).Methods("GET")
+	api.HandleFunc("/trees/{id}/search", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/trees/{id}/order", h.UpdateTreeOrder).Methods("PUT")
+	api.HandleFunc("/trees/{id}/order", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/trees/{id}/move", h.MoveTreePositions).Methods("POST")
+	api.HandleFunc("/trees/{id}/move", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/trees/{id}/clone", h.CloneTreeBranch).Methods("POST")
+	api.HandleFunc("/trees/{id}/clone", handleOptions).Methods("OPTIONS")
+
+	// Reorganization scenarios
+	api.HandleFunc("/scenarios", h.GetScenarios).Methods("GET")
+	api.HandleFunc("/scenarios", h.CreateScenario).Methods("POST")
+	api.HandleFunc("/scenarios", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/scenarios/{id}", h.GetScenario).Methods("GET")
+	api.HandleFunc("/scenarios/{id}", h.DeleteScenario).Methods("DELETE")
+	api.HandleFunc("/scenarios/{id}", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/scenarios/{id}/changes", h.AddScenarioChange).Methods("POST")
+	api.HandleFunc("/scenarios/{id}/changes", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/scenarios/{id}/changes/{changeId}", h.DeleteScenarioChange).Methods("DELETE")
+	api.HandleFunc("/scenarios/{id}/changes/{changeId}", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/scenarios/{id}/tree", h.GetScenarioTree).Methods("GET")
+	api.HandleFunc("/scenarios/{id}/tree", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/scenarios/{id}/diff", h.GetScenarioDiff).Methods("GET")
+	api.HandleFunc("/scenarios/{id}/diff", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/scenarios/{id}/apply", h.ApplyScenario).Methods("POST")
+	api.HandleFunc("/scenarios/{id}/apply", handleOptions).Methods("OPTIONS")
+
+	// Change requests (approval workflow)
+	api.HandleFunc("/change-requests", h.GetChangeRequests).Methods("GET")
+	api.HandleFunc("/change-requests", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/change-requests/{id}", h.GetChangeRequest).Methods("GET")
+	api.HandleFunc("/change-requests/{id}", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/change-requests/{id}/approve", h.ApproveChangeRequest).Methods("POST")
+	api.HandleFunc("/change-requests/{id}/approve", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/change-requests/{id}/reject", h.RejectChangeRequest).Methods("POST")
+	api.HandleFunc("/change-requests/{id}/reject", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/change-requests/{id}/cancel", h.CancelChangeRequest).Methods("POST")
+	api.HandleFunc("/change-requests/{id}/cancel", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/change-requests/{id}/comments", h.CommentChangeRequest).Methods("POST")
+	api.HandleFunc("/change-requests/{id}/comments", handleOptions).Methods("OPTIONS")
+
+	// Data quality diagnostics
+	api.HandleFunc("/diagnostics", h.GetDiagnostics).Methods("GET")
+	api.HandleFunc("/diagnostics", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/diagnostics/fix", h.FixDiagnostics).Methods("POST")
+	api.HandleFunc("/diagnostics/fix", handleOptions).Methods("OPTIONS")
+
+	// HR system sync
+	api.HandleFunc("/hr-sync/run", h.RunHRSync).Methods("POST")
+	api.HandleFunc("/hr-sync/run", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/hr-sync/runs", h.GetHRSyncRuns).Methods("GET")
+	api.HandleFunc("/hr-sync/runs", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/hr-sync/runs/{id}", h.GetHRSyncRun).Methods("GET")
+	api.HandleFunc("/hr-sync/runs/{id}", handleOptions).Methods("OPTIONS")
+
+	// LDAP directory export
+	api.HandleFunc("/ldap-export/ldif", h.GetLDIFExport).Methods("GET")
+	api.HandleFunc("/ldap-export/ldif", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/ldap-export/apply", h.ApplyLDAPExport).Methods("POST")
+	api.HandleFunc("/ldap-export/apply", handleOptions).Methods("OPTIONS")
+
+	// GraphQL over positions, custom fields and trees
+	api.HandleFunc("/graphql", h.GraphQL).Methods("POST")
+	api.HandleFunc("/graphql", handleOptions).Methods("OPTIONS")
+
+	// Saved views
+	api.HandleFunc("/views", h.GetSavedViews).Methods("GET")
+	api.HandleFunc("/views", h.CreateSavedView).Methods("POST")
+	api.HandleFunc("/views", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/views/{id}", h.GetSavedView).Methods("GET")
+	api.HandleFunc("/views/{id}", h.UpdateSavedView).Methods("PUT")
+	api.HandleFunc("/views/{id}", h.DeleteSavedView).Methods("DELETE")
+	api.HandleFunc("/views/{id}", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/views/{id}/positions", h.ExecuteSavedViewPositions).Methods("GET")
+	api.HandleFunc("/views/{id}/positions", handleOptions).Methods("OPTIONS")
+	api.HandleFunc("/views/{id}/tree", h.ExecuteSavedViewTree).Methods("GET")
+	api.HandleFunc("/views/{id}/tree", handleOptions).Methods("OPTIONS")
 
 	// Custom Field Values
 	api.HandleFunc("/custom-field-values/{id}/available-superiors", h.GetAvailableSuperiors).Methods("GET")
@@ -74,25 +242,103 @@ func main() {
 	api.HandleFunc("/custom-field-values/{id}/superior", h.UpdateCustomFieldValueSuperior).Methods("PUT")
 	api.HandleFunc("/custom-field-values/{id}/superior", handleOptions).Methods("OPTIONS")
 
+	// SCIM 2.0 for identity providers; server-to-server, so no CORS preflight routes
+	scim := r.PathPrefix("/scim/v2").Subrouter()
+	scim.Use(h.scimAuth)
+	scim.HandleFunc("/ServiceProviderConfig", h.GetSCIMServiceProviderConfig).Methods("GET")
+	scim.HandleFunc("/ResourceTypes", h.GetSCIMResourceTypes).Methods("GET")
+	scim.HandleFunc("/Users", h.GetSCIMUsers).Methods("GET")
+	scim.HandleFunc("/Users", h.CreateSCIMUser).Methods("POST")
+	scim.HandleFunc("/Users/{id}", h.GetSCIMUser).Methods("GET")
+	scim.HandleFunc("/Users/{id}", h.ReplaceSCIMUser).Methods("PUT")
+	scim.HandleFunc("/Users/{id}", h.PatchSCIMUser).Methods("PATCH")
+	scim.HandleFunc("/Users/{id}", h.DeleteSCIMUser).Methods("DELETE")
+	scim.HandleFunc("/Groups", h.GetSCIMGroups).Methods("GET")
+	scim.HandleFunc("/Groups", h.RejectSCIMGroupChange).Methods("POST")
+	scim.HandleFunc("/Groups/{id}", h.GetSCIMGroup).Methods("GET")
+	scim.HandleFunc("/Groups/{id}", h.RejectSCIMGroupChange).Methods("PUT", "PATCH", "DELETE")
+
+	// Everything outside the API goes to the embedded frontend, if any
+	if spa := newSPAHandler(); spa != nil {
+		r.PathPrefix("/").Handler(spa)
+		log.Println("Serving embedded frontend")
+	}
+
 	port := os.Getenv("SERVER_PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           instrumentHandler(r),
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Graceful shutdown: on SIGTERM/SIGINT fail readiness first so the load
+	// balancer stops sending traffic, then drain in-flight requests
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Scheduled employee sync stops together with the server
+	if h.hrSync != nil {
+		go h.hrSync.schedule(stop)
+	}
+
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case <-stop.Done():
+	}
+
+	log.Println("Shutting down server...")
+	h.draining.Store(true)
+	time.Sleep(envDuration("SHUTDOWN_DRAIN_DELAY", 0))
+
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancelShutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Graceful shutdown failed: %v", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Flushing traces failed: %v", err)
+	}
+	log.Println("Server stopped")
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+userIDHeader+", "+requestIDHeader)
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// limitRequestBody caps the size of request bodies; reading past the limit
+// returns an error, which handlers answer with 400 like any malformed body
+func limitRequestBody(limit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func handleOptions(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsNamespace prefixes all application metrics
+const metricsNamespace = "position_management"
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method and route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	httpRequestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests currently being served.",
+	})
+
+	treeBuildDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tree_build_duration_seconds",
+		Help:      "Time spent in buildTreeStructure.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+
+	treeBuildNodes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tree_build_nodes",
+		Help:      "Number of nodes in built trees by node type.",
+		Buckets:   prometheus.ExponentialBuckets(10, 4, 8),
+	}, []string{"type"})
+)
+
+// registerDBMetrics exports connection pool statistics of db
+func registerDBMetrics(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "position_management"))
+}
+
+// unmatchedRoute labels requests that did not match any route, so that
+// arbitrary URLs do not create new time series
+const unmatchedRoute = "unmatched"
+
+// routeTemplate returns the mux path template matching the request, e.g.
+// "/api/trees/{id}/structure"
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if !router.Match(r, &match) || match.Route == nil {
+		return unmatchedRoute
+	}
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return unmatchedRoute
+	}
+	return template
+}
+
+// observeHTTPRequest records metrics of a finished request
+func observeHTTPRequest(method, route string, status int, duration time.Duration) {
+	httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// observeTreeBuild records the duration and node counts of a built tree
+func observeTreeBuild(start time.Time, structure *TreeStructure) {
+	treeBuildDuration.Observe(time.Since(start).Seconds())
+
+	counts := map[string]int{}
+	var walk func(node TreeNode)
+	walk = func(node TreeNode) {
+		counts[node.Type]++
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	for _, child := range structure.Root.Children {
+		walk(child)
+	}
+	for _, nodeType := range []string{"custom_field_value", "position"} {
+		treeBuildNodes.WithLabelValues(nodeType).Observe(float64(counts[nodeType]))
+	}
+}
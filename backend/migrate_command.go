@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+const migrateUsage = `usage: server migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [N]    roll back the last N applied migrations (default 1)
+  status      list migrations and whether they are applied
+  redo        roll back the last applied migration and apply it again`
+
+// runMigrateCommand implements the `migrate up|down|status|redo` subcommand
+func runMigrateCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", migrateUsage)
+	}
+
+	m, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, name := range applied {
+			fmt.Println("applied", name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("down expects a positive number of migrations, got %q", args[1])
+			}
+		}
+		rolledBack, err := m.Down(ctx, steps)
+		for _, name := range rolledBack {
+			fmt.Println("rolled back", name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(rolledBack) == 0 {
+			fmt.Println("no applied migrations")
+		}
+
+	case "redo":
+		name, err := m.Redo(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println("redone", name)
+
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "MIGRATION\tSTATUS\tAPPLIED AT\tDOWN")
+		for _, s := range statuses {
+			state := "pending"
+			appliedAt := "-"
+			if s.Applied {
+				state = "applied"
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if s.Drifted {
+				state = "modified"
+			}
+			if s.Missing {
+				state = "missing file"
+			}
+			down := "no"
+			if s.HasDown {
+				down = "yes"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Filename, state, appliedAt, down)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], migrateUsage)
+	}
+
+	return nil
+}
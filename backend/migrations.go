@@ -1,118 +1,446 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"embed"
+	"encoding/hex"
 	"fmt"
+	"io/fs"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
-// RunMigrations applies all pending SQL migrations from the migrations directory.
-// It is safe to call on every server start: already applied migrations are skipped.
-func RunMigrations(db *sql.DB) error {
-	// Ensure migrations tracking table exists
-	if err := ensureMigrationsTable(db); err != nil {
-		return fmt.Errorf("ensure migrations table: %w", err)
-	}
-	// Determine migrations directory (can be overridden via env)
-	migrationsDir := os.Getenv("MIGRATIONS_DIR")
-	if migrationsDir == "" {
-		// Try a couple of sensible defaults relative to current working directory:
-		// - project root: "database/migrations"
-		// - from backend subdir: "../database/migrations"
-		candidates := []string{
-			"database/migrations",
-			filepath.Join("..", "database", "migrations"),
-		}
-		for _, c := range candidates {
-			if info, err := os.Stat(c); err == nil && info.IsDir() {
-				migrationsDir = c
-				break
-			}
-		}
-		if migrationsDir == "" {
-			return fmt.Errorf("no migrations directory found; set MIGRATIONS_DIR or create database/migrations")
+// Migration files live in backend/migrations and are embedded into the binary:
+//
+//	NNN_name.sql       - up migration
+//	NNN_name.down.sql  - optional paired down migration
+//
+// Applied migrations are recorded in schema_migrations together with the
+// checksum of the up file; a file changed after it was applied is refused.
+// Each migration runs in its own transaction (BEGIN;/COMMIT; lines inside the
+// files are dropped), and the whole run holds a Postgres advisory lock so
+// several replicas starting at once do not migrate concurrently.
+
+const downMigrationSuffix = ".down.sql"
+
+// migrationLockKey is the pg_advisory_lock key guarding schema changes
+const migrationLockKey int64 = 7240915021
+
+// migration is a pair of up/down scripts
+type migration struct {
+	Filename string // up file name, also the key in schema_migrations
+	Up       string
+	Down     string // empty when there is no down migration
+	HasDown  bool
+	Checksum string // sha256 of the up file
+}
+
+// MigrationStatus describes a migration for `migrate status`
+type MigrationStatus struct {
+	Filename  string
+	Applied   bool
+	AppliedAt *time.Time
+	HasDown   bool
+	Drifted   bool // file changed after it was applied
+	Missing   bool // recorded in schema_migrations but the file is gone
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Filename  string
+	Checksum  sql.NullString
+	AppliedAt time.Time
+}
+
+// Migrator applies and rolls back migrations from a directory
+type Migrator struct {
+	db   *sql.DB
+	fsys fs.FS
+}
+
+// embeddedMigrations are the migrations compiled into the binary
+//
+//go:embed migrations/*.sql
+var embeddedMigrations embed.FS
+
+// NewMigrator creates a migrator reading the migrations embedded into the binary,
+// or the directory from MIGRATIONS_DIR when it is set
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	if dir := os.Getenv("MIGRATIONS_DIR"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("MIGRATIONS_DIR %q is not a directory", dir)
 		}
+		return &Migrator{db: db, fsys: os.DirFS(dir)}, nil
+	}
+	fsys, err := fs.Sub(embeddedMigrations, "migrations")
+	if err != nil {
+		return nil, err
 	}
+	return &Migrator{db: db, fsys: fsys}, nil
+}
 
-	entries, err := os.ReadDir(migrationsDir)
+// loadMigrations reads up/down pairs sorted by file name: 001_..., 002_..., etc.
+func (m *Migrator) loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(m.fsys, ".")
 	if err != nil {
-		return fmt.Errorf("read migrations dir: %w", err)
+		return nil, fmt.Errorf("read migrations dir: %w", err)
 	}
 
-	// Collect only .sql files
-	var files []string
+	byName := make(map[string]*migration)
+	downs := make(map[string]string)
 	for _, e := range entries {
 		if e.IsDir() {
 			continue
 		}
 		name := e.Name()
-		if strings.HasSuffix(strings.ToLower(name), ".sql") {
-			files = append(files, name)
+		lower := strings.ToLower(name)
+		if !strings.HasSuffix(lower, ".sql") {
+			continue
 		}
-	}
-
-	// Sort to ensure deterministic order: 001_..., 002_..., etc.
-	sort.Strings(files)
-
-	for _, fname := range files {
-		applied, err := isMigrationApplied(db, fname)
+		content, err := fs.ReadFile(m.fsys, name)
 		if err != nil {
-			return fmt.Errorf("check migration %s: %w", fname, err)
+			return nil, fmt.Errorf("read migration %s: %w", name, err)
 		}
-		if applied {
+		if strings.HasSuffix(lower, downMigrationSuffix) {
+			upName := name[:len(name)-len(downMigrationSuffix)] + ".sql"
+			downs[upName] = string(content)
 			continue
 		}
-
-		fullPath := filepath.Join(migrationsDir, fname)
-		content, err := os.ReadFile(fullPath)
-		if err != nil {
-			return fmt.Errorf("read migration %s: %w", fname, err)
+		sum := sha256.Sum256(content)
+		byName[name] = &migration{
+			Filename: name,
+			Up:       string(content),
+			Checksum: hex.EncodeToString(sum[:]),
 		}
+	}
 
-		// Execute migration; lib/pq allows multiple statements in one Exec
-		if _, err := db.Exec(string(content)); err != nil {
-			return fmt.Errorf("exec migration %s: %w", fname, err)
+	for upName := range downs {
+		if _, ok := byName[upName]; !ok {
+			return nil, fmt.Errorf("down migration for %s has no up migration", upName)
 		}
+	}
 
-		if err := markMigrationApplied(db, fname); err != nil {
-			return fmt.Errorf("mark migration %s applied: %w", fname, err)
+	migrations := make([]migration, 0, len(byName))
+	for name, mig := range byName {
+		if down, ok := downs[name]; ok {
+			mig.Down = down
+			mig.HasDown = true
 		}
+		migrations = append(migrations, *mig)
 	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Filename < migrations[j].Filename
+	})
+	return migrations, nil
+}
 
-	return nil
+// stripTransactionStatements drops top-level BEGIN;/COMMIT; lines: the runner
+// wraps every migration into its own transaction. plpgsql BEGIN ... END blocks
+// have no semicolon after BEGIN and are kept (END; is ambiguous and never dropped).
+func stripTransactionStatements(script string) string {
+	lines := strings.Split(script, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		switch strings.ToUpper(strings.TrimSpace(line)) {
+		case "BEGIN;", "BEGIN TRANSACTION;", "START TRANSACTION;", "COMMIT;":
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n")
 }
 
-func ensureMigrationsTable(db *sql.DB) error {
+func ensureMigrationsTable(ctx context.Context, conn *sql.Conn) error {
 	const q = `
 CREATE TABLE IF NOT EXISTS schema_migrations (
 	id SERIAL PRIMARY KEY,
 	filename TEXT NOT NULL UNIQUE,
 	applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-);`
-	_, err := db.Exec(q)
+);
+ALTER TABLE schema_migrations ADD COLUMN IF NOT EXISTS checksum TEXT;`
+	_, err := conn.ExecContext(ctx, q)
 	return err
 }
 
-func isMigrationApplied(db *sql.DB, filename string) (bool, error) {
-	const q = `SELECT 1 FROM schema_migrations WHERE filename = $1 LIMIT 1`
-	var dummy int
-	err := db.QueryRow(q, filename).Scan(&dummy)
-	if err == sql.ErrNoRows {
-		return false, nil
+func loadAppliedMigrations(ctx context.Context, conn *sql.Conn) (map[string]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT filename, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Filename, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.Filename] = a
+	}
+	return applied, rows.Err()
+}
+
+// withLock runs fn on a dedicated connection holding the migration advisory lock.
+// The migrations table is created and checksums are verified before fn is called.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn, migrations []migration, applied map[string]appliedMigration) error) error {
+	migrations, err := m.loadMigrations()
+	if err != nil {
+		return err
 	}
+
+	// Advisory locks belong to a session, so everything runs on one connection
+	conn, err := m.db.Conn(ctx)
 	if err != nil {
-		return false, err
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
 	}
-	return true, nil
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return fmt.Errorf("ensure migrations table: %w", err)
+	}
+	applied, err := loadAppliedMigrations(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("load applied migrations: %w", err)
+	}
+	if err := verifyChecksums(ctx, conn, migrations, applied); err != nil {
+		return err
+	}
+
+	return fn(conn, migrations, applied)
 }
 
-func markMigrationApplied(db *sql.DB, filename string) error {
-	const q = `INSERT INTO schema_migrations (filename) VALUES ($1)`
-	_, err := db.Exec(q, filename)
-	return err
+// verifyChecksums refuses to continue when an applied migration file was changed.
+// Migrations applied before checksums were recorded get the current checksum.
+func verifyChecksums(ctx context.Context, conn *sql.Conn, migrations []migration, applied map[string]appliedMigration) error {
+	var drifted []string
+	for _, mig := range migrations {
+		a, ok := applied[mig.Filename]
+		if !ok {
+			continue
+		}
+		if !a.Checksum.Valid {
+			if _, err := conn.ExecContext(ctx,
+				`UPDATE schema_migrations SET checksum = $1 WHERE filename = $2`, mig.Checksum, mig.Filename); err != nil {
+				return fmt.Errorf("record checksum of %s: %w", mig.Filename, err)
+			}
+			a.Checksum = sql.NullString{String: mig.Checksum, Valid: true}
+			applied[mig.Filename] = a
+			continue
+		}
+		if a.Checksum.String != mig.Checksum {
+			drifted = append(drifted, mig.Filename)
+		}
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("applied migrations were modified: %s; restore the original files and add a new migration instead",
+			strings.Join(drifted, ", "))
+	}
+	return nil
+}
+
+// applyUp runs an up migration and records it in one transaction
+func applyUp(ctx context.Context, conn *sql.Conn, mig migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lib/pq allows multiple statements in one Exec
+	if _, err := tx.ExecContext(ctx, stripTransactionStatements(mig.Up)); err != nil {
+		return fmt.Errorf("exec migration %s: %w", mig.Filename, err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO schema_migrations (filename, checksum) VALUES ($1, $2)`, mig.Filename, mig.Checksum); err != nil {
+		return fmt.Errorf("mark migration %s applied: %w", mig.Filename, err)
+	}
+	return tx.Commit()
+}
+
+// applyDown runs a down migration and removes its record in one transaction
+func applyDown(ctx context.Context, conn *sql.Conn, mig migration) error {
+	if !mig.HasDown {
+		return fmt.Errorf("migration %s has no down migration (%s)", mig.Filename,
+			strings.TrimSuffix(mig.Filename, ".sql")+downMigrationSuffix)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, stripTransactionStatements(mig.Down)); err != nil {
+		return fmt.Errorf("exec down migration %s: %w", mig.Filename, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE filename = $1`, mig.Filename); err != nil {
+		return fmt.Errorf("unmark migration %s: %w", mig.Filename, err)
+	}
+	return tx.Commit()
+}
+
+// appliedInOrder returns applied migrations that still have files, newest first
+func appliedInOrder(migrations []migration, applied map[string]appliedMigration) []migration {
+	var result []migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if _, ok := applied[migrations[i].Filename]; ok {
+			result = append(result, migrations[i])
+		}
+	}
+	return result
+}
+
+// Up applies all pending migrations and returns their file names
+func (m *Migrator) Up(ctx context.Context) ([]string, error) {
+	var done []string
+	err := m.withLock(ctx, func(conn *sql.Conn, migrations []migration, applied map[string]appliedMigration) error {
+		for _, mig := range migrations {
+			if _, ok := applied[mig.Filename]; ok {
+				continue
+			}
+			if err := applyUp(ctx, conn, mig); err != nil {
+				return err
+			}
+			done = append(done, mig.Filename)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the given number of most recently applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) ([]string, error) {
+	var done []string
+	err := m.withLock(ctx, func(conn *sql.Conn, migrations []migration, applied map[string]appliedMigration) error {
+		for _, mig := range appliedInOrder(migrations, applied) {
+			if len(done) >= steps {
+				break
+			}
+			if err := applyDown(ctx, conn, mig); err != nil {
+				return err
+			}
+			done = append(done, mig.Filename)
+		}
+		return nil
+	})
+	return done, err
 }
 
+// Redo rolls back the most recently applied migration and applies it again
+func (m *Migrator) Redo(ctx context.Context) (string, error) {
+	var redone string
+	err := m.withLock(ctx, func(conn *sql.Conn, migrations []migration, applied map[string]appliedMigration) error {
+		last := appliedInOrder(migrations, applied)
+		if len(last) == 0 {
+			return fmt.Errorf("no applied migrations to redo")
+		}
+		if err := applyDown(ctx, conn, last[0]); err != nil {
+			return err
+		}
+		if err := applyUp(ctx, conn, last[0]); err != nil {
+			return err
+		}
+		redone = last[0].Filename
+		return nil
+	})
+	return redone, err
+}
 
+// Status lists all known migrations and whether they are applied.
+// Unlike Up/Down it reports drifted files instead of failing.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := m.loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := ensureMigrationsTable(ctx, conn); err != nil {
+		return nil, fmt.Errorf("ensure migrations table: %w", err)
+	}
+	applied, err := loadAppliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("load applied migrations: %w", err)
+	}
+
+	var statuses []MigrationStatus
+	known := make(map[string]bool, len(migrations))
+	for _, mig := range migrations {
+		known[mig.Filename] = true
+		s := MigrationStatus{Filename: mig.Filename, HasDown: mig.HasDown}
+		if a, ok := applied[mig.Filename]; ok {
+			appliedAt := a.AppliedAt
+			s.Applied = true
+			s.AppliedAt = &appliedAt
+			s.Drifted = a.Checksum.Valid && a.Checksum.String != mig.Checksum
+		}
+		statuses = append(statuses, s)
+	}
+	for name, a := range applied {
+		if known[name] {
+			continue
+		}
+		appliedAt := a.AppliedAt
+		statuses = append(statuses, MigrationStatus{Filename: name, Applied: true, AppliedAt: &appliedAt, Missing: true})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Filename < statuses[j].Filename
+	})
+	return statuses, nil
+}
+
+// Check reports an error when migrations are pending or applied files were
+// modified. It only reads schema_migrations and is cheap enough for readiness probes.
+func (m *Migrator) Check(ctx context.Context) error {
+	migrations, err := m.loadMigrations()
+	if err != nil {
+		return err
+	}
+	rows, err := m.db.QueryContext(ctx, `SELECT filename, checksum FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	checksums := make(map[string]sql.NullString)
+	for rows.Next() {
+		var filename string
+		var checksum sql.NullString
+		if err := rows.Scan(&filename, &checksum); err != nil {
+			return err
+		}
+		checksums[filename] = checksum
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var pending, drifted []string
+	for _, mig := range migrations {
+		checksum, ok := checksums[mig.Filename]
+		if !ok {
+			pending = append(pending, mig.Filename)
+		} else if checksum.Valid && checksum.String != mig.Checksum {
+			drifted = append(drifted, mig.Filename)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("pending migrations: %s", strings.Join(pending, ", "))
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("modified migrations: %s", strings.Join(drifted, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+-- Откат миграции 021: удаление индексов и функций полнотекстового поиска
+-- Расширение pg_trgm не удаляется — его могут использовать другие объекты
+
+BEGIN;
+
+DROP INDEX IF EXISTS idx_positions_fts;
+DROP INDEX IF EXISTS idx_custom_fields_values_value_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_id_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_patronymic_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_name_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_surname_trgm;
+DROP INDEX IF EXISTS idx_positions_name_trgm;
+
+DROP FUNCTION IF EXISTS position_search_document(positions);
+DROP FUNCTION IF EXISTS position_custom_values_text(JSONB);
+
+COMMIT;
@@ -0,0 +1,50 @@
+-- Миграция 021: полнотекстовый и нечёткий поиск по должностям
+-- 1. Подключаем расширение pg_trgm для поиска по триграммам (опечатки, частичные совпадения)
+-- 2. Добавляем функцию position_custom_values_text, собирающую текст значений кастомных полей должности
+-- 3. Добавляем функцию position_search_document — общий текст, по которому ищется должность
+-- 4. Создаём триграммные индексы по названию должности, ФИО, employee_id и значениям кастомных полей
+
+BEGIN;
+
+-- 1. Расширение для similarity() / word_similarity()
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- 2. Текст всех значений кастомных полей, id которых лежат в custom_fields_values_id
+CREATE OR REPLACE FUNCTION position_custom_values_text(values_ids JSONB)
+RETURNS TEXT AS $$
+    SELECT COALESCE(string_agg(v.value, ' '), '')
+    FROM custom_fields_values v
+    WHERE values_ids IS NOT NULL
+      AND jsonb_typeof(values_ids) = 'array'
+      AND v.id::text IN (SELECT jsonb_array_elements_text(values_ids));
+$$ LANGUAGE sql STABLE;
+
+-- 3. Поисковый документ должности: название, ФИО, employee_id и значения кастомных полей
+CREATE OR REPLACE FUNCTION position_search_document(p positions)
+RETURNS TEXT AS $$
+    SELECT concat_ws(' ',
+        p.position_name,
+        p.employee_surname,
+        p.employee_name,
+        p.employee_patronymic,
+        p.employee_id,
+        position_custom_values_text(p.custom_fields_values_id)
+    );
+$$ LANGUAGE sql STABLE;
+
+-- 4. Триграммные индексы для ILIKE и нечёткого поиска
+CREATE INDEX IF NOT EXISTS idx_positions_name_trgm ON positions USING GIN (position_name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_surname_trgm ON positions USING GIN (employee_surname gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_name_trgm ON positions USING GIN (employee_name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_patronymic_trgm ON positions USING GIN (employee_patronymic gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_id_trgm ON positions USING GIN (employee_id gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_custom_fields_values_value_trgm ON custom_fields_values USING GIN (value gin_trgm_ops);
+
+-- Полнотекстовый индекс по неизменяемой части документа (название и ФИО)
+-- (concat_ws не IMMUTABLE, поэтому склеиваем через COALESCE и ||)
+CREATE INDEX IF NOT EXISTS idx_positions_fts ON positions USING GIN (
+    (to_tsvector('russian', position_name || ' ' || COALESCE(employee_surname, '') || ' ' || COALESCE(employee_name, '') || ' ' || COALESCE(employee_patronymic, ''))
+     || to_tsvector('english', position_name || ' ' || COALESCE(employee_surname, '') || ' ' || COALESCE(employee_name, '') || ' ' || COALESCE(employee_patronymic, '')))
+);
+
+COMMIT;
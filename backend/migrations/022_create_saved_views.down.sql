@@ -0,0 +1,7 @@
+-- Откат миграции 022: удаление таблицы сохранённых представлений
+
+BEGIN;
+
+DROP TABLE IF EXISTS saved_views;
+
+COMMIT;
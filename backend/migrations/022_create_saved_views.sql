@@ -0,0 +1,28 @@
+-- Миграция 022: сохранённые представления (saved views)
+-- Представление — именованная комбинация поискового запроса, фильтров по кастомным полям,
+-- сортировки, набора видимых колонок и (опционально) дерева.
+-- owner_id — идентификатор пользователя из заголовка X-User-ID,
+-- shared_with — JSONB массив идентификаторов пользователей, которым открыт доступ.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS saved_views (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    owner_id VARCHAR(255) NOT NULL,
+    shared_with JSONB NOT NULL DEFAULT '[]'::jsonb,
+    is_public BOOLEAN NOT NULL DEFAULT false,
+    search_query TEXT NOT NULL DEFAULT '',
+    filters JSONB NOT NULL DEFAULT '{}'::jsonb,
+    sort VARCHAR(255) NOT NULL DEFAULT '',
+    columns JSONB NOT NULL DEFAULT '[]'::jsonb,
+    tree_id UUID REFERENCES tree_definitions(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_saved_views_owner_id ON saved_views(owner_id);
+CREATE INDEX IF NOT EXISTS idx_saved_views_shared_with ON saved_views USING GIN(shared_with);
+
+COMMIT;
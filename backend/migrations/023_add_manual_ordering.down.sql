@@ -0,0 +1,11 @@
+-- Откат миграции 023: удаление ручного порядка значений и должностей
+
+BEGIN;
+
+DROP TABLE IF EXISTS tree_position_order;
+
+DROP INDEX IF EXISTS idx_custom_fields_values_sort_order;
+
+ALTER TABLE custom_fields_values DROP COLUMN IF EXISTS sort_order;
+
+COMMIT;
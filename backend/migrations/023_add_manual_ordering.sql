@@ -0,0 +1,21 @@
+-- Миграция 023: ручной порядок значений кастомных полей и должностей в ветках деревьев
+-- sort_order задаёт порядок значения внутри своего кастомного поля (NULL — после упорядоченных).
+-- tree_position_order хранит порядок должностей внутри узла дерева; узел определяется
+-- ключом node_key — цепочкой "<custom_field_key>=<value>" от корня, разделённой "/".
+
+BEGIN;
+
+ALTER TABLE custom_fields_values ADD COLUMN IF NOT EXISTS sort_order INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_custom_fields_values_sort_order
+    ON custom_fields_values(custom_field_id, sort_order);
+
+CREATE TABLE IF NOT EXISTS tree_position_order (
+    tree_id UUID NOT NULL REFERENCES tree_definitions(id) ON DELETE CASCADE,
+    node_key TEXT NOT NULL,
+    position_id BIGINT NOT NULL REFERENCES positions(id) ON DELETE CASCADE,
+    sort_order INTEGER NOT NULL,
+    PRIMARY KEY (tree_id, node_key, position_id)
+);
+
+COMMIT;
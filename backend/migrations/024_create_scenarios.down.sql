@@ -0,0 +1,8 @@
+-- Откат миграции 024: удаление сценариев реорганизации
+
+BEGIN;
+
+DROP TABLE IF EXISTS scenario_changes;
+DROP TABLE IF EXISTS scenarios;
+
+COMMIT;
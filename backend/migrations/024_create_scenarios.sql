@@ -0,0 +1,30 @@
+-- Миграция 024: сценарии реорганизации
+-- Сценарий — черновик структурных изменений (перенос должностей, новые значения полей,
+-- смена начальников, новые должности), который не затрагивает живые данные до применения.
+-- Изменения хранятся упорядоченным журналом scenario_changes и накладываются на живые
+-- данные внутри транзакции, которая откатывается (просмотр) или фиксируется (применение).
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS scenarios (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    owner_id VARCHAR(255) NOT NULL DEFAULT '',
+    status VARCHAR(20) NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'applied')),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    applied_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS scenario_changes (
+    id BIGSERIAL PRIMARY KEY,
+    scenario_id UUID NOT NULL REFERENCES scenarios(id) ON DELETE CASCADE,
+    change_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL DEFAULT '{}'::jsonb,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_scenario_changes_scenario_id ON scenario_changes(scenario_id, id);
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Откат миграции 025: удаление заявок на согласование изменений
+
+BEGIN;
+
+DROP TABLE IF EXISTS change_request_events;
+DROP TABLE IF EXISTS change_requests;
+
+COMMIT;
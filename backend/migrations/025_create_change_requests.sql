@@ -0,0 +1,35 @@
+-- Миграция 025: согласование структурных изменений
+-- Когда согласование включено (CHANGE_APPROVAL_ENABLED=true), изменения руководителя значения
+-- и допустимых значений кастомного поля не применяются сразу, а сохраняются как заявки.
+-- Заявка применяется только после одобрения; все действия по ней пишутся в историю.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS change_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    change_type VARCHAR(50) NOT NULL CHECK (change_type IN ('superior', 'custom_field')),
+    target_id UUID NOT NULL, -- значение кастомного поля или кастомное поле
+    payload JSONB NOT NULL DEFAULT '{}'::jsonb,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected', 'cancelled')),
+    requested_by VARCHAR(255) NOT NULL,
+    decided_by VARCHAR(255),
+    decided_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_change_requests_status ON change_requests(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_change_requests_target_id ON change_requests(target_id);
+
+CREATE TABLE IF NOT EXISTS change_request_events (
+    id BIGSERIAL PRIMARY KEY,
+    change_request_id UUID NOT NULL REFERENCES change_requests(id) ON DELETE CASCADE,
+    action VARCHAR(20) NOT NULL, -- submitted, commented, approved, rejected, cancelled
+    user_id VARCHAR(255) NOT NULL,
+    comment TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_change_request_events_request_id ON change_request_events(change_request_id, id);
+
+COMMIT;
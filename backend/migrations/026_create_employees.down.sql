@@ -0,0 +1,11 @@
+-- Откат миграции 026: удаление сотрудников и назначений
+-- Данные сотрудников остаются в столбцах employee_* таблицы positions.
+
+BEGIN;
+
+DROP TRIGGER IF EXISTS trg_close_assignments_on_position_delete ON positions;
+DROP FUNCTION IF EXISTS close_assignments_on_position_delete();
+DROP TABLE IF EXISTS position_assignments;
+DROP TABLE IF EXISTS employees;
+
+COMMIT;
@@ -0,0 +1,90 @@
+-- Миграция 026: сотрудники и история назначений
+-- 1. Создаём таблицу employees — сотрудник отдельно от должности
+-- 2. Создаём таблицу position_assignments — назначения сотрудников на должности с датами и ставкой (FTE)
+-- 3. Переносим сотрудников из столбцов positions: должности с одинаковым employee_id становятся
+--    назначениями одного сотрудника, сотрудники без employee_id заводятся по одному на должность
+-- 4. При удалении должности её открытые назначения закрываются, история сохраняется
+-- Столбцы employee_* в positions остаются и содержат текущего основного сотрудника должности.
+
+BEGIN;
+
+-- 1. Сотрудники
+CREATE TABLE IF NOT EXISTS employees (
+    id BIGSERIAL PRIMARY KEY,
+    external_id VARCHAR(255) UNIQUE,
+    surname VARCHAR(255),
+    name VARCHAR(255),
+    patronymic VARCHAR(255),
+    profile_url TEXT,
+    migrated_position_id BIGINT, -- временный столбец для переноса данных
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_employees_surname ON employees(surname);
+
+-- 2. Назначения; position_id обнуляется при удалении должности, название сохраняется в position_name
+CREATE TABLE IF NOT EXISTS position_assignments (
+    id BIGSERIAL PRIMARY KEY,
+    employee_id BIGINT NOT NULL REFERENCES employees(id) ON DELETE CASCADE,
+    position_id BIGINT REFERENCES positions(id) ON DELETE SET NULL,
+    position_name VARCHAR(255) NOT NULL DEFAULT '',
+    start_date DATE NOT NULL DEFAULT CURRENT_DATE,
+    end_date DATE,
+    fte NUMERIC(4, 2) NOT NULL DEFAULT 1 CHECK (fte > 0 AND fte <= 1),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK (end_date IS NULL OR end_date >= start_date)
+);
+
+CREATE INDEX IF NOT EXISTS idx_position_assignments_employee_id ON position_assignments(employee_id, start_date);
+CREATE INDEX IF NOT EXISTS idx_position_assignments_position_id ON position_assignments(position_id, start_date);
+
+-- 3. Перенос сотрудников из positions
+INSERT INTO employees (external_id, surname, name, patronymic, profile_url, created_at, updated_at)
+SELECT DISTINCT ON (employee_id)
+    employee_id, employee_surname, employee_name, employee_patronymic, employee_profile_url, created_at, updated_at
+FROM positions
+WHERE COALESCE(employee_id, '') <> ''
+ORDER BY employee_id, updated_at DESC
+ON CONFLICT (external_id) DO NOTHING;
+
+INSERT INTO employees (surname, name, patronymic, profile_url, migrated_position_id, created_at, updated_at)
+SELECT employee_surname, employee_name, employee_patronymic, employee_profile_url, id, created_at, updated_at
+FROM positions
+WHERE COALESCE(employee_id, '') = ''
+  AND (COALESCE(employee_surname, '') <> '' OR COALESCE(employee_name, '') <> ''
+       OR COALESCE(employee_patronymic, '') <> '' OR COALESCE(employee_profile_url, '') <> '');
+
+INSERT INTO position_assignments (employee_id, position_id, position_name, start_date, fte)
+SELECT e.id, p.id, p.position_name, p.created_at::date, 1
+FROM positions p
+JOIN employees e ON e.external_id = p.employee_id
+WHERE COALESCE(p.employee_id, '') <> ''
+UNION ALL
+SELECT e.id, p.id, p.position_name, p.created_at::date, 1
+FROM positions p
+JOIN employees e ON e.migrated_position_id = p.id;
+
+ALTER TABLE employees DROP COLUMN IF EXISTS migrated_position_id;
+
+-- 4. Закрытие назначений удаляемой должности
+CREATE OR REPLACE FUNCTION close_assignments_on_position_delete()
+RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE position_assignments
+    SET end_date = GREATEST(start_date, CURRENT_DATE), position_name = OLD.position_name, updated_at = NOW()
+    WHERE position_id = OLD.id AND (end_date IS NULL OR end_date > CURRENT_DATE);
+
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_close_assignments_on_position_delete ON positions;
+
+CREATE TRIGGER trg_close_assignments_on_position_delete
+BEFORE DELETE ON positions
+FOR EACH ROW
+EXECUTE FUNCTION close_assignments_on_position_delete();
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Откат миграции 027: удаление истории синхронизации с HR-системой
+
+BEGIN;
+
+DROP TABLE IF EXISTS hr_sync_runs;
+ALTER TABLE employees DROP COLUMN IF EXISTS hr_synced_at;
+
+COMMIT;
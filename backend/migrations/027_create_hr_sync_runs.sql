@@ -0,0 +1,24 @@
+-- Миграция 027: синхронизация сотрудников с HR-системой
+-- 1. employees.hr_synced_at — когда данные сотрудника последний раз сверялись с HR-системой;
+--    сотрудник, изменённый позже (updated_at > hr_synced_at), считается отредактированным вручную
+-- 2. hr_sync_runs — история запусков синхронизации со статистикой и конфликтами
+
+BEGIN;
+
+ALTER TABLE employees ADD COLUMN IF NOT EXISTS hr_synced_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS hr_sync_runs (
+    id BIGSERIAL PRIMARY KEY,
+    source VARCHAR(50) NOT NULL,
+    dry_run BOOLEAN NOT NULL DEFAULT FALSE,
+    status VARCHAR(20) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+    stats JSONB NOT NULL DEFAULT '{}'::jsonb,
+    conflicts JSONB NOT NULL DEFAULT '[]'::jsonb,
+    error TEXT,
+    started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_hr_sync_runs_started_at ON hr_sync_runs(started_at DESC);
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Откат миграции 028: удаление версии цели заявки
+
+BEGIN;
+
+ALTER TABLE change_requests DROP COLUMN IF EXISTS target_updated_at;
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Миграция 028: версия цели заявки на согласование
+-- Заявка хранит полный новый вид цели, поэтому одобрение старой заявки перезаписало бы изменения,
+-- сделанные после её подачи. При подаче запоминаем updated_at цели (для кастомного поля — самое позднее
+-- из поля и его значений); если при одобрении цель уже изменилась, заявка не применяется (409).
+-- У заявок, поданных до миграции, версии нет, и они применяются как раньше.
+
+BEGIN;
+
+ALTER TABLE change_requests ADD COLUMN IF NOT EXISTS target_updated_at TIMESTAMP;
+
+COMMIT;
@@ -0,0 +1,26 @@
+-- Откат миграции 029: возврат к поиску по функции position_search_document и индексам миграции 021
+
+BEGIN;
+
+DROP TRIGGER IF EXISTS custom_fields_values_search_document ON custom_fields_values;
+DROP FUNCTION IF EXISTS custom_fields_values_search_document_trigger();
+DROP TRIGGER IF EXISTS positions_search_document ON positions;
+DROP FUNCTION IF EXISTS positions_search_document_trigger();
+
+DROP INDEX IF EXISTS idx_positions_search_document_trgm;
+DROP INDEX IF EXISTS idx_positions_search_vector;
+ALTER TABLE positions DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE positions DROP COLUMN IF EXISTS search_document;
+
+CREATE INDEX IF NOT EXISTS idx_positions_name_trgm ON positions USING GIN (position_name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_surname_trgm ON positions USING GIN (employee_surname gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_name_trgm ON positions USING GIN (employee_name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_patronymic_trgm ON positions USING GIN (employee_patronymic gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_employee_id_trgm ON positions USING GIN (employee_id gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_custom_fields_values_value_trgm ON custom_fields_values USING GIN (value gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_positions_fts ON positions USING GIN (
+    (to_tsvector('russian', position_name || ' ' || COALESCE(employee_surname, '') || ' ' || COALESCE(employee_name, '') || ' ' || COALESCE(employee_patronymic, ''))
+     || to_tsvector('english', position_name || ' ' || COALESCE(employee_surname, '') || ' ' || COALESCE(employee_name, '') || ' ' || COALESCE(employee_patronymic, '')))
+);
+
+COMMIT;
@@ -0,0 +1,66 @@
+-- Миграция 029: индексируемый поисковый документ должности
+-- Индексы миграции 021 построены по отдельным столбцам и их склейке, а поиск фильтрует по
+-- position_search_document(positions), поэтому они не используются. Функцию нельзя проиндексировать
+-- напрямую: она читает значения кастомных полей из другой таблицы и не может быть IMMUTABLE.
+-- 1. Добавляем в positions хранимый документ search_document, который поддерживают триггеры
+-- 2. Добавляем генерируемый столбец search_vector (to_tsvector с явной конфигурацией IMMUTABLE)
+-- 3. Индексируем ровно те выражения, по которым ищет приложение: search_vector (@@) и
+--    search_document (ILIKE)
+-- 4. Удаляем неиспользуемые триграммные и полнотекстовый индексы миграции 021
+
+BEGIN;
+
+-- 1. Поисковый документ
+ALTER TABLE positions ADD COLUMN IF NOT EXISTS search_document TEXT NOT NULL DEFAULT '';
+
+UPDATE positions p SET search_document = position_search_document(p);
+
+CREATE OR REPLACE FUNCTION positions_search_document_trigger()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.search_document := position_search_document(NEW);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS positions_search_document ON positions;
+CREATE TRIGGER positions_search_document
+    BEFORE INSERT OR UPDATE OF position_name, employee_surname, employee_name, employee_patronymic,
+        employee_id, custom_fields_values_id
+    ON positions
+    FOR EACH ROW EXECUTE FUNCTION positions_search_document_trigger();
+
+-- Переименование или удаление значения кастомного поля меняет документы должностей с этим значением
+CREATE OR REPLACE FUNCTION custom_fields_values_search_document_trigger()
+RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE positions p
+    SET search_document = position_search_document(p)
+    WHERE p.custom_fields_values_id @> jsonb_build_array(OLD.id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS custom_fields_values_search_document ON custom_fields_values;
+CREATE TRIGGER custom_fields_values_search_document
+    AFTER UPDATE OF value OR DELETE ON custom_fields_values
+    FOR EACH ROW EXECUTE FUNCTION custom_fields_values_search_document_trigger();
+
+-- 2. Полнотекстовый вектор в конфигурациях russian и english
+ALTER TABLE positions ADD COLUMN IF NOT EXISTS search_vector TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('russian', search_document) || to_tsvector('english', search_document)) STORED;
+
+-- 3. Индексы поиска
+CREATE INDEX IF NOT EXISTS idx_positions_search_vector ON positions USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_positions_search_document_trgm ON positions USING GIN (search_document gin_trgm_ops);
+
+-- 4. Неиспользуемые индексы
+DROP INDEX IF EXISTS idx_positions_fts;
+DROP INDEX IF EXISTS idx_positions_name_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_surname_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_name_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_patronymic_trgm;
+DROP INDEX IF EXISTS idx_positions_employee_id_trgm;
+DROP INDEX IF EXISTS idx_custom_fields_values_value_trgm;
+
+COMMIT;
@@ -43,6 +43,7 @@ type AllowedValue struct {
 	ValueID            uuid.UUID          `json:"value_id"`
 	Value              string             `json:"value"`
 	LinkedCustomFields []LinkedCustomField `json:"linked_custom_fields,omitempty"`
+	SortOrder          *int                `json:"sort_order,omitempty"` // ручной порядок значения внутри поля
 }
 
 // AllowedValuesArray represents an array of allowed values
@@ -153,10 +154,37 @@ type CustomFieldDefinition struct {
 	UpdatedAt     time.Time          `json:"updated_at" db:"updated_at"`
 }
 
+// Sort modes of folder nodes within a tree level
+const (
+	TreeSortAlphabetical  = "alphabetical"   // by value text
+	TreeSortAllowedValues = "allowed_values" // in the order of the field's allowed values
+	TreeSortPositionCount = "position_count" // folders with more positions first
+	TreeSortManual        = "manual"         // in the order of TreeLevel.ValueOrder, or of the values' sort_order
+)
+
+// Without an explicit sort mode folders follow the values' persisted
+// sort_order when the field has one and are sorted alphabetically otherwise.
+
+// Placement of positions that match the path but have no value for the level
+const (
+	TreeMissingAfter   = "after"   // as leaves after the folders (default)
+	TreeMissingBefore  = "before"  // as leaves before the folders
+	TreeMissingGroup   = "group"   // in a separate folder labelled MissingLabel
+	TreeMissingOutside = "outside" // in the "Вне структуры" group
+	TreeMissingHide    = "hide"    // not shown
+)
+
 // TreeLevel represents a level in a tree definition
 type TreeLevel struct {
-	Order          int    `json:"order"`
-	CustomFieldKey string `json:"custom_field_key"`
+	Order            int      `json:"order"`
+	CustomFieldKey   string   `json:"custom_field_key"`
+	Label            string   `json:"label,omitempty"`              // overrides the custom field label
+	Sort             string   `json:"sort,omitempty"`               // one of the TreeSort* modes
+	ValueOrder       []string `json:"value_order,omitempty"`        // value IDs or texts for the manual sort mode
+	ShowEmptyValues  bool     `json:"show_empty_values,omitempty"`  // add folders for allowed values without positions
+	HoistSingleChild bool     `json:"hoist_single_child,omitempty"` // replace folders with a single child by that child
+	MissingValue     string   `json:"missing_value,omitempty"`      // one of the TreeMissing* placements
+	MissingLabel     string   `json:"missing_label,omitempty"`      // folder label for the group placement
 }
 
 // TreeDefinition represents a tree definition
@@ -192,6 +220,9 @@ type TreeNode struct {
 	CustomFieldValue *string   `json:"custom_field_value,omitempty"`
 	CustomFieldValueID *string `json:"custom_field_value_id,omitempty"` // ID значения кастомного поля для точного сопоставления
 	LinkedCustomFields []LinkedCustomField `json:"linked_custom_fields,omitempty"`
+	LevelLabel         *string             `json:"level_label,omitempty"`  // подпись уровня (TreeLevel.Label или label поля)
+	NodeKey            *string             `json:"node_key,omitempty"`     // ключ папки для PUT /api/trees/{id}/order
+	HoistedFrom        []TreePathNode      `json:"hoisted_from,omitempty"` // папки, поднятые за счёт hoist_single_child
 	Superior          *int64    `json:"superior,omitempty"` // ID должности-начальника
 	PositionID      *string    `json:"position_id,omitempty"`
 	PositionName    *string    `json:"position_name,omitempty"`
@@ -199,6 +230,227 @@ type TreeNode struct {
 	Children        []TreeNode `json:"children"`
 }
 
+// TreePathNode is a folder node on the path from the tree root to a position
+type TreePathNode struct {
+	LevelOrder         *int                `json:"level_order,omitempty"`
+	CustomFieldID      *string             `json:"custom_field_id,omitempty"`
+	CustomFieldKey     *string             `json:"custom_field_key,omitempty"`
+	CustomFieldValue   *string             `json:"custom_field_value,omitempty"`
+	CustomFieldValueID *string             `json:"custom_field_value_id,omitempty"`
+	LinkedCustomFields []LinkedCustomField `json:"linked_custom_fields,omitempty"`
+}
+
+// TreeSearchResult represents a position found in a tree together with its path
+type TreeSearchResult struct {
+	PositionID       string         `json:"position_id"`
+	PositionName     string         `json:"position_name"`
+	EmployeeFullName *string        `json:"employee_full_name,omitempty"`
+	Relevance        float64        `json:"relevance"`
+	Path             []TreePathNode `json:"path"`
+}
+
+// TreeValueOrder sets the manual order of the values of one custom field
+type TreeValueOrder struct {
+	CustomFieldKey string      `json:"custom_field_key"`
+	ValueIDs       []uuid.UUID `json:"value_ids"`
+}
+
+// TreePositionOrder sets the manual order of positions within one tree node;
+// NodeKey is the node_key of the folder ("" for the tree root)
+type TreePositionOrder struct {
+	NodeKey     string  `json:"node_key"`
+	PositionIDs []int64 `json:"position_ids"`
+}
+
+// TreeOrderRequest is the body of PUT /api/trees/{id}/order
+type TreeOrderRequest struct {
+	Values    []TreeValueOrder    `json:"values"`
+	Positions []TreePositionOrder `json:"positions"`
+}
+
+// TreeLevelStats describes how many folders and positions ended up on one tree level
+type TreeLevelStats struct {
+	LevelOrder     int    `json:"level_order"`
+	CustomFieldKey string `json:"custom_field_key"`
+	Nodes          int    `json:"nodes"`     // folder nodes (one per value or linked value combination)
+	Positions      int    `json:"positions"` // positions placed directly under folders of this level
+}
+
+// TreeStats summarizes a built tree structure
+type TreeStats struct {
+	TotalPositions        int              `json:"total_positions"`
+	RootPositions         int              `json:"root_positions"`         // positions without a value for the first level
+	UnstructuredPositions int              `json:"unstructured_positions"` // positions in the "Вне структуры" group
+	Levels                []TreeLevelStats `json:"levels"`
+	EmptyBranches         [][]TreePathNode `json:"empty_branches"` // paths to folders without positions
+}
+
+// TreePreview is a tree structure built from an unsaved definition
+type TreePreview struct {
+	Structure TreeStructure `json:"structure"`
+	Stats     TreeStats     `json:"stats"`
+}
+
+// SavedView represents a named, persisted combination of search query,
+// filters, sort order, visible columns and tree
+type SavedView struct {
+	ID          uuid.UUID       `json:"id" db:"id"`
+	Name        string          `json:"name" db:"name"`
+	Description *string         `json:"description" db:"description"`
+	OwnerID     string          `json:"owner_id" db:"owner_id"`
+	SharedWith  []string        `json:"shared_with" db:"shared_with"`
+	IsPublic    bool            `json:"is_public" db:"is_public"`
+	Search      string          `json:"search" db:"search_query"`
+	Filters     PositionFilters `json:"filters" db:"filters"`
+	Sort        string          `json:"sort" db:"sort"`
+	Columns     []string        `json:"columns" db:"columns"`
+	TreeID      *uuid.UUID      `json:"tree_id" db:"tree_id"`
+	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// Scenario is a draft of structural changes that are kept apart from live
+// data until the scenario is applied
+type Scenario struct {
+	ID          uuid.UUID        `json:"id" db:"id"`
+	Name        string           `json:"name" db:"name"`
+	Description *string          `json:"description" db:"description"`
+	OwnerID     string           `json:"owner_id" db:"owner_id"`
+	Status      string           `json:"status" db:"status"` // "draft" or "applied"
+	Changes     []ScenarioChange `json:"changes,omitempty" db:"-"`
+	CreatedAt   time.Time        `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at" db:"updated_at"`
+	AppliedAt   *time.Time       `json:"applied_at,omitempty" db:"applied_at"`
+}
+
+// ScenarioChange is one recorded change of a scenario; Payload depends on Type
+type ScenarioChange struct {
+	ID        int64           `json:"id" db:"id"`
+	Type      string          `json:"type" db:"change_type"`
+	Payload   json.RawMessage `json:"payload" db:"payload"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+}
+
+// ScenarioPositionDiff describes a position that is added, removed or moved by a scenario
+type ScenarioPositionDiff struct {
+	PositionID   string         `json:"position_id,omitempty"` // empty for positions created by the scenario
+	PositionName string         `json:"position_name"`
+	Change       string         `json:"change"` // "added", "removed" or "moved"
+	From         []TreePathNode `json:"from,omitempty"`
+	To           []TreePathNode `json:"to,omitempty"`
+}
+
+// ScenarioValueDiff describes a custom field value added by a scenario
+type ScenarioValueDiff struct {
+	CustomFieldKey string    `json:"custom_field_key"`
+	ValueID        uuid.UUID `json:"value_id"`
+	Value          string    `json:"value"`
+}
+
+// ScenarioSuperiorDiff describes a changed superior of a custom field value
+type ScenarioSuperiorDiff struct {
+	ValueID uuid.UUID `json:"value_id"`
+	Value   string    `json:"value"`
+	From    *int64    `json:"from"`
+	To      *int64    `json:"to"`
+}
+
+// ScenarioDiff compares a tree with a scenario applied to the live tree
+type ScenarioDiff struct {
+	TreeID    string                 `json:"tree_id"`
+	Positions []ScenarioPositionDiff `json:"positions"`
+	Values    []ScenarioValueDiff    `json:"values"`
+	Superiors []ScenarioSuperiorDiff `json:"superiors"`
+}
+
+// ChangeRequest is a pending or decided structural change that needs approval.
+// Payload holds the submitted body of the original request.
+type ChangeRequest struct {
+	ID              uuid.UUID            `json:"id" db:"id"`
+	Type            string               `json:"type" db:"change_type"` // "superior" or "custom_field"
+	TargetID        uuid.UUID            `json:"target_id" db:"target_id"`
+	Payload         json.RawMessage      `json:"payload" db:"payload"`
+	Status          string               `json:"status" db:"status"` // "pending", "approved", "rejected" or "cancelled"
+	RequestedBy     string               `json:"requested_by" db:"requested_by"`
+	TargetUpdatedAt *time.Time           `json:"target_updated_at,omitempty" db:"target_updated_at"` // version of the target at submission; nil for older requests
+	DecidedBy       *string              `json:"decided_by,omitempty" db:"decided_by"`
+	DecidedAt       *time.Time           `json:"decided_at,omitempty" db:"decided_at"`
+	History         []ChangeRequestEvent `json:"history,omitempty" db:"-"`
+	CreatedAt       time.Time            `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time            `json:"updated_at" db:"updated_at"`
+}
+
+// ChangeRequestEvent is one entry in the history of a change request
+type ChangeRequestEvent struct {
+	ID        int64     `json:"id" db:"id"`
+	Action    string    `json:"action" db:"action"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	Comment   *string   `json:"comment,omitempty" db:"comment"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Employee is a person who can hold positions through assignments
+type Employee struct {
+	ID          int64                `json:"id" db:"id"`
+	ExternalID  *string              `json:"external_id" db:"external_id"` // shown as employee_id on positions
+	Surname     *string              `json:"surname" db:"surname"`
+	Name        *string              `json:"name" db:"name"`
+	Patronymic  *string              `json:"patronymic" db:"patronymic"`
+	FullName    *string              `json:"full_name,omitempty" db:"-"`
+	ProfileURL  *string              `json:"profile_url" db:"profile_url"`
+	Assignments []PositionAssignment `json:"assignments,omitempty" db:"-"` // current assignments
+	CreatedAt   time.Time            `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time            `json:"updated_at" db:"updated_at"`
+}
+
+// PositionAssignment is a period during which an employee holds a position.
+// Dates are YYYY-MM-DD; end_date is exclusive and null while the assignment lasts.
+type PositionAssignment struct {
+	ID           int64     `json:"id" db:"id"`
+	EmployeeID   int64     `json:"employee_id" db:"employee_id"`
+	Employee     *Employee `json:"employee,omitempty" db:"-"`
+	PositionID   *int64    `json:"position_id" db:"position_id"` // null once the position is deleted
+	PositionName string    `json:"position_name" db:"position_name"`
+	StartDate    string    `json:"start_date" db:"start_date"`
+	EndDate      *string   `json:"end_date" db:"end_date"`
+	FTE          float64   `json:"fte" db:"fte"`
+	Active       bool      `json:"active" db:"-"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// HRSyncRun is one run of the employee sync with an HR system
+type HRSyncRun struct {
+	ID         int64            `json:"id" db:"id"`
+	Source     string           `json:"source" db:"source"`
+	DryRun     bool             `json:"dry_run" db:"dry_run"` // changes were rolled back
+	Status     string           `json:"status" db:"status"`   // running, succeeded or failed
+	Stats      HRSyncStats      `json:"stats" db:"stats"`
+	Conflicts  []HRSyncConflict `json:"conflicts" db:"conflicts"`
+	Error      *string          `json:"error" db:"error"`
+	StartedAt  time.Time        `json:"started_at" db:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at" db:"finished_at"`
+}
+
+// HRSyncStats counts the outcome of the source records of a run
+type HRSyncStats struct {
+	Fetched   int `json:"fetched"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Created   int `json:"created"`
+	Unmatched int `json:"unmatched"` // records of employees unknown here and not created
+	Conflicts int `json:"conflicts"`
+}
+
+// HRSyncConflict is a record or employee the sync could not reconcile
+type HRSyncConflict struct {
+	Kind        string  `json:"kind"`
+	ExternalID  string  `json:"external_id,omitempty"`
+	EmployeeID  *int64  `json:"employee_id,omitempty"`
+	PositionIDs []int64 `json:"position_ids,omitempty"` // positions the employee currently holds
+	Message     string  `json:"message"`
+}
+
 // PositionCustomFieldValue represents a custom field value in position response
 type PositionCustomFieldValue struct {
 	CustomFieldID           string              `json:"custom_field_id"`
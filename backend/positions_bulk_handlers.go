@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Bulk position operations
+const (
+	bulkOpSetCustomFieldValue   = "set_custom_field_value"
+	bulkOpUnsetCustomFieldValue = "unset_custom_field_value"
+	bulkOpSetEmployee           = "set_employee"
+	bulkOpDelete                = "delete"
+)
+
+// maxBulkPositionItems limits the number of position changes in one bulk request
+const maxBulkPositionItems = 10000
+
+// PositionBulkOperation is one operation of POST /api/positions/bulk applied
+// to every listed position
+type PositionBulkOperation struct {
+	Op                        string                 `json:"op"`
+	PositionIDs               []int64                `json:"position_ids"`
+	CustomFieldID             *uuid.UUID             `json:"custom_field_id,omitempty"`       // unset_custom_field_value
+	CustomFieldValueID        *uuid.UUID             `json:"custom_field_value_id,omitempty"` // set_custom_field_value
+	LinkedCustomFieldValueIDs []uuid.UUID            `json:"linked_custom_field_value_ids,omitempty"`
+	Employee                  map[string]interface{} `json:"employee,omitempty"` // set_employee, same fields as PUT /api/positions/{id}
+}
+
+// PositionBulkRequest is the body of POST /api/positions/bulk. Atomic requests
+// are applied in one transaction that is rolled back on the first failure;
+// otherwise every position change is applied on its own.
+type PositionBulkRequest struct {
+	Atomic     bool                    `json:"atomic"`
+	Operations []PositionBulkOperation `json:"operations"`
+}
+
+// PositionBulkResult is the outcome of one operation on one position
+type PositionBulkResult struct {
+	Operation  int    `json:"operation"` // index in operations
+	PositionID int64  `json:"position_id"`
+	Status     string `json:"status"` // "ok", "error" or "skipped" (not run after an atomic failure)
+	Error      string `json:"error,omitempty"`
+}
+
+// positionBulkError reports a position change that cannot be applied
+type positionBulkError struct {
+	message string
+}
+
+func (e *positionBulkError) Error() string {
+	return e.message
+}
+
+// plannedBulkOperation is a validated operation ready to be applied
+type plannedBulkOperation struct {
+	op       PositionBulkOperation
+	values   *treeMove // custom field value operations
+	employee positionEmployeeFields
+}
+
+// BulkPositions applies a list of operations to positions
+func (h *Handler) BulkPositions(w http.ResponseWriter, r *http.Request) {
+	var req PositionBulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 {
+		http.Error(w, "operations is required", http.StatusBadRequest)
+		return
+	}
+
+	planned, err := h.planBulkOperations(r.Context(), req.Operations)
+	var bulkErr *positionBulkError
+	if errors.As(err, &bulkErr) {
+		http.Error(w, bulkErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := []PositionBulkResult{}
+	applied := true
+	if req.Atomic {
+		tx, err := h.db.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		for i, p := range planned {
+			for _, positionID := range p.op.PositionIDs {
+				result := PositionBulkResult{Operation: i, PositionID: positionID, Status: "ok"}
+				if !applied {
+					result.Status = "skipped"
+				} else if err := applyBulkOperation(r.Context(), tx, p, positionID); err != nil {
+					if !errors.As(err, &bulkErr) {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+					result.Status, result.Error = "error", err.Error()
+					applied = false
+				}
+				results = append(results, result)
+			}
+		}
+		if applied {
+			if err = tx.Commit(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	} else {
+		for i, p := range planned {
+			for _, positionID := range p.op.PositionIDs {
+				result := PositionBulkResult{Operation: i, PositionID: positionID, Status: "ok"}
+				if err := h.applyBulkOperationTx(r.Context(), p, positionID); err != nil {
+					result.Status, result.Error = "error", err.Error()
+					applied = false
+				}
+				results = append(results, result)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if req.Atomic && !applied {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"applied": applied,
+		"results": results,
+	})
+}
+
+// planBulkOperations validates all operations before any position is changed.
+// Invalid operations are reported as *positionBulkError.
+func (h *Handler) planBulkOperations(ctx context.Context, ops []PositionBulkOperation) ([]plannedBulkOperation, error) {
+	invalid := func(i int, format string, args ...interface{}) error {
+		return &positionBulkError{fmt.Sprintf("operations[%d]: ", i) + fmt.Sprintf(format, args...)}
+	}
+
+	var fieldDefs map[string]CustomFieldDefinition
+	items := 0
+	planned := make([]plannedBulkOperation, len(ops))
+	for i, op := range ops {
+		if len(op.PositionIDs) == 0 {
+			return nil, invalid(i, "position_ids is required")
+		}
+		items += len(op.PositionIDs)
+		if items > maxBulkPositionItems {
+			return nil, &positionBulkError{fmt.Sprintf("too many position changes (at most %d)", maxBulkPositionItems)}
+		}
+		planned[i].op = op
+
+		switch op.Op {
+		case bulkOpSetCustomFieldValue, bulkOpUnsetCustomFieldValue:
+			if fieldDefs == nil {
+				fieldDefs = loadCustomFieldDefinitions(ctx, h.db)
+			}
+			values, err := planCustomFieldValueChange(fieldDefs, op)
+			if err != nil {
+				return nil, invalid(i, "%s", err.Error())
+			}
+			planned[i].values = values
+		case bulkOpSetEmployee:
+			planned[i].employee = parsePositionEmployeeFields(op.Employee)
+		case bulkOpDelete:
+		default:
+			return nil, invalid(i, "unknown op %q (use %s, %s, %s or %s)", op.Op,
+				bulkOpSetCustomFieldValue, bulkOpUnsetCustomFieldValue, bulkOpSetEmployee, bulkOpDelete)
+		}
+	}
+	return planned, nil
+}
+
+// planCustomFieldValueChange builds the rewrite of position values for setting
+// or clearing one custom field. Like in the position form, a value of a field
+// comes with the selected values of the fields linked to it, so those are
+// replaced together with the field.
+func planCustomFieldValueChange(fieldDefs map[string]CustomFieldDefinition, op PositionBulkOperation) (*treeMove, error) {
+	var def *CustomFieldDefinition
+	var selected *AllowedValue
+	for _, d := range fieldDefs {
+		d := d
+		if op.Op == bulkOpUnsetCustomFieldValue {
+			if op.CustomFieldID != nil && d.ID == *op.CustomFieldID {
+				def = &d
+			}
+		} else if op.CustomFieldValueID != nil && d.AllowedValues != nil {
+			for i := range *d.AllowedValues {
+				if (*d.AllowedValues)[i].ValueID == *op.CustomFieldValueID {
+					def, selected = &d, &(*d.AllowedValues)[i]
+				}
+			}
+		}
+		if def != nil {
+			break
+		}
+	}
+
+	if op.Op == bulkOpUnsetCustomFieldValue {
+		if op.CustomFieldID == nil {
+			return nil, errors.New("custom_field_id is required")
+		}
+		if def == nil {
+			return nil, fmt.Errorf("custom field %s not found", *op.CustomFieldID)
+		}
+	} else {
+		if op.CustomFieldValueID == nil {
+			return nil, errors.New("custom_field_value_id is required")
+		}
+		if def == nil {
+			return nil, fmt.Errorf("custom field value %s not found", *op.CustomFieldValueID)
+		}
+	}
+
+	move := &treeMove{
+		managedFields: map[uuid.UUID]bool{def.ID: true},
+		valueToField:  make(map[uuid.UUID]uuid.UUID),
+	}
+	if def.AllowedValues != nil {
+		for _, allowed := range *def.AllowedValues {
+			move.valueToField[allowed.ValueID] = def.ID
+			for _, linked := range allowed.LinkedCustomFields {
+				move.managedFields[linked.LinkedCustomFieldID] = true
+				for _, lv := range linked.LinkedCustomFieldValues {
+					move.valueToField[lv.LinkedCustomFieldValueID] = linked.LinkedCustomFieldID
+				}
+			}
+		}
+	}
+	if selected == nil {
+		return move, nil
+	}
+
+	move.addTarget(def.ID, selected.ValueID)
+	for _, linkedValueID := range op.LinkedCustomFieldValueIDs {
+		found := false
+		for _, linked := range selected.LinkedCustomFields {
+			for _, lv := range linked.LinkedCustomFieldValues {
+				if lv.LinkedCustomFieldValueID == linkedValueID {
+					move.addTarget(linked.LinkedCustomFieldID, linkedValueID)
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("value %s is not linked to %q", linkedValueID, selected.Value)
+		}
+	}
+	return move, nil
+}
+
+// applyBulkOperationTx applies one position change in its own transaction
+func (h *Handler) applyBulkOperationTx(ctx context.Context, p plannedBulkOperation, positionID int64) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := applyBulkOperation(ctx, tx, p, positionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyBulkOperation applies a planned operation to one position within tx.
+// Missing positions are reported as *positionBulkError.
+func applyBulkOperation(ctx context.Context, tx dbQuerier, p plannedBulkOperation, positionID int64) error {
+	notFound := &positionBulkError{fmt.Sprintf("position %d not found", positionID)}
+
+	switch p.op.Op {
+	case bulkOpSetCustomFieldValue, bulkOpUnsetCustomFieldValue:
+		var fieldIDs, valueIDs UUIDArray
+		err := tx.QueryRowContext(ctx,
+			`SELECT custom_fields_id, custom_fields_values_id FROM positions WHERE id = $1 FOR UPDATE`,
+			positionID,
+		).Scan(&fieldIDs, &valueIDs)
+		if err == sql.ErrNoRows {
+			return notFound
+		}
+		if err != nil {
+			return err
+		}
+		newFields, newValues := p.values.rewrite(fieldIDs, valueIDs)
+		_, err = tx.ExecContext(ctx,
+			`UPDATE positions SET custom_fields_id = $1, custom_fields_values_id = $2, updated_at = NOW() WHERE id = $3`,
+			newFields, newValues, positionID,
+		)
+		return err
+
+	case bulkOpSetEmployee:
+		e := p.employee
+		result, err := tx.ExecContext(ctx,
+			`UPDATE positions SET employee_id = $1, employee_surname = $2, employee_name = $3, employee_patronymic = $4,
+			employee_profile_url = $5, updated_at = NOW() WHERE id = $6`,
+			e.ExternalID, e.Surname, e.EmployeeName, e.Patronymic, e.ProfileURL, positionID,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return notFound
+		}
+		return syncPositionEmployee(ctx, tx, positionID, e)
+
+	case bulkOpDelete:
+		result, err := tx.ExecContext(ctx, "DELETE FROM positions WHERE id = $1", positionID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return notFound
+		}
+		return nil
+	}
+	return &positionBulkError{fmt.Sprintf("unknown op %q", p.op.Op)}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// PositionCloneRequest is the body of the clone endpoints. Substitutions map
+// old value IDs to new value IDs of the same custom field, e.g. the location
+// of the copied office to the location of the new one.
+type PositionCloneRequest struct {
+	Substitutions map[uuid.UUID]uuid.UUID `json:"substitutions"`
+	KeepEmployee  bool                    `json:"keep_employee"`
+}
+
+// TreeCloneRequest clones all positions under a tree node; Path is given as
+// in POST /api/trees/{id}/move and must not be empty
+type TreeCloneRequest struct {
+	PositionCloneRequest
+	Path map[string]uuid.UUID `json:"path"`
+}
+
+// ClonedPosition pairs a source position with its copy
+type ClonedPosition struct {
+	SourceID int64 `json:"source_id"`
+	ID       int64 `json:"id"`
+}
+
+// positionCloneError reports an invalid clone request
+type positionCloneError struct {
+	message string
+}
+
+func (e *positionCloneError) Error() string {
+	return e.message
+}
+
+// ClonePosition copies one position
+func (h *Handler) ClonePosition(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var req PositionCloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRowContext(r.Context(),
+		`SELECT EXISTS (SELECT 1 FROM positions WHERE id = $1)`, id,
+	).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Position not found", http.StatusNotFound)
+		return
+	}
+
+	h.writeClonedPositions(w, r, []int64{id}, req)
+}
+
+// CloneTreeBranch copies all positions under a node of a tree
+func (h *Handler) CloneTreeBranch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var req TreeCloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Path) == 0 {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.loadTreeDefinition(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tree not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The path is resolved like a move target; positions under the node are
+	// those having all of its values
+	move, err := planTreeMove(r.Context(), h.db, t, req.Path)
+	var moveErr *treeMoveError
+	if errors.As(err, &moveErr) {
+		http.Error(w, moveErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pathValues, _ := json.Marshal(UUIDArray(move.targetValues))
+
+	rows, err := h.db.QueryContext(r.Context(),
+		`SELECT id FROM positions WHERE custom_fields_values_id @> $1::text::jsonb ORDER BY id`,
+		string(pathValues),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var positionIDs []int64
+	for rows.Next() {
+		var positionID int64
+		if err := rows.Scan(&positionID); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		positionIDs = append(positionIDs, positionID)
+	}
+	rows.Close()
+
+	h.writeClonedPositions(w, r, positionIDs, req.PositionCloneRequest)
+}
+
+// writeClonedPositions clones positions in one transaction and answers with
+// the pairs of source and new IDs
+func (h *Handler) writeClonedPositions(w http.ResponseWriter, r *http.Request, positionIDs []int64, req PositionCloneRequest) {
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	cloned, err := clonePositions(r.Context(), tx, positionIDs, req)
+	var cloneErr *positionCloneError
+	if errors.As(err, &cloneErr) {
+		http.Error(w, cloneErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cloned": cloned,
+	})
+}
+
+// clonePositions inserts copies of positions with substituted values within
+// tx. Invalid substitutions are reported as *positionCloneError.
+func clonePositions(ctx context.Context, tx dbQuerier, positionIDs []int64, req PositionCloneRequest) ([]ClonedPosition, error) {
+	if len(req.Substitutions) > 0 {
+		fieldToValuesMap, err := NewCustomFieldsService(tx).LoadFieldToValuesMap(ctx)
+		if err != nil {
+			return nil, err
+		}
+		valueToField := make(map[uuid.UUID]uuid.UUID)
+		for fieldID, valueSet := range fieldToValuesMap {
+			for valueID := range valueSet {
+				valueToField[valueID] = fieldID
+			}
+		}
+		for oldID, newID := range req.Substitutions {
+			oldField, ok := valueToField[oldID]
+			if !ok {
+				return nil, &positionCloneError{fmt.Sprintf("value %s not found", oldID)}
+			}
+			newField, ok := valueToField[newID]
+			if !ok {
+				return nil, &positionCloneError{fmt.Sprintf("value %s not found", newID)}
+			}
+			if oldField != newField {
+				return nil, &positionCloneError{fmt.Sprintf("values %s and %s belong to different custom fields", oldID, newID)}
+			}
+		}
+	}
+
+	cloned := []ClonedPosition{}
+	for _, positionID := range positionIDs {
+		var name string
+		var fieldIDs, valueIDs UUIDArray
+		var surname, employeeName, patronymic, externalID, profileURL *string
+		err := tx.QueryRowContext(ctx,
+			`SELECT position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname,
+			employee_name, employee_patronymic, employee_profile_url
+			FROM positions WHERE id = $1`,
+			positionID,
+		).Scan(&name, &fieldIDs, &valueIDs, &externalID, &surname, &employeeName, &patronymic, &profileURL)
+		if err == sql.ErrNoRows {
+			return nil, &positionCloneError{fmt.Sprintf("position %d not found", positionID)}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		newValues := UUIDArray{}
+		seen := make(map[uuid.UUID]bool)
+		for _, valueID := range valueIDs {
+			if newID, ok := req.Substitutions[valueID]; ok {
+				valueID = newID
+			}
+			if !seen[valueID] {
+				seen[valueID] = true
+				newValues = append(newValues, valueID)
+			}
+		}
+		if fieldIDs == nil {
+			fieldIDs = UUIDArray{}
+		}
+		if !req.KeepEmployee {
+			surname, employeeName, patronymic, externalID, profileURL = nil, nil, nil, nil, nil
+		}
+
+		c := ClonedPosition{SourceID: positionID}
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO positions (position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic,
+			employee_profile_url, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW())
+			RETURNING id`,
+			name, fieldIDs, newValues, externalID, surname, employeeName, patronymic, profileURL,
+		).Scan(&c.ID)
+		if err != nil {
+			return nil, err
+		}
+		if req.KeepEmployee {
+			// The same employees also hold the copy from today on
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO position_assignments (employee_id, position_id, position_name, start_date, fte, created_at, updated_at)
+				SELECT a.employee_id, $1, $2, CURRENT_DATE, a.fte, NOW(), NOW() FROM position_assignments a
+				WHERE a.position_id = $3 AND `+assignmentActive,
+				c.ID, name, positionID,
+			); err != nil {
+				return nil, err
+			}
+		}
+		cloned = append(cloned, c)
+	}
+	return cloned, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Match modes for custom field value filters
+const (
+	FilterMatchAny = "any"
+	FilterMatchAll = "all"
+)
+
+// PositionFilters describes structured filters over positions.
+// It is used by saved views and by GET /api/positions.
+type PositionFilters struct {
+	// Positions having any (or all, see CustomFieldValuesMatch) of these values
+	// in custom_fields_values_id
+	CustomFieldValueIDs    []uuid.UUID `json:"custom_field_value_ids,omitempty"`
+	CustomFieldValuesMatch string      `json:"custom_field_values_match,omitempty"` // "any" (default) or "all"
+	// true: only positions with an employee, false: only vacant positions
+	HasEmployee *bool `json:"has_employee,omitempty"`
+	// Creation and update time ranges; "from" is inclusive, "to" is exclusive
+	CreatedFrom *time.Time `json:"created_from,omitempty"`
+	CreatedTo   *time.Time `json:"created_to,omitempty"`
+	UpdatedFrom *time.Time `json:"updated_from,omitempty"`
+	UpdatedTo   *time.Time `json:"updated_to,omitempty"`
+	// Positions holding a custom field value whose superior is this position
+	Superior *int64 `json:"superior,omitempty"`
+}
+
+// Validate checks filter values that cannot be expressed by the type system
+func (f PositionFilters) Validate() error {
+	switch f.CustomFieldValuesMatch {
+	case "", FilterMatchAny, FilterMatchAll:
+	default:
+		return fmt.Errorf("custom_field_values_match must be %q or %q", FilterMatchAny, FilterMatchAll)
+	}
+	if f.CreatedFrom != nil && f.CreatedTo != nil && !f.CreatedFrom.Before(*f.CreatedTo) {
+		return fmt.Errorf("created_from must be before created_to")
+	}
+	if f.UpdatedFrom != nil && f.UpdatedTo != nil && !f.UpdatedFrom.Before(*f.UpdatedTo) {
+		return fmt.Errorf("updated_from must be before updated_to")
+	}
+	return nil
+}
+
+// whereSQL returns SQL conditions over the positions table for the filters,
+// appending their parameters to args
+func (f PositionFilters) whereSQL(args *queryArgs) []string {
+	var conditions []string
+
+	if len(f.CustomFieldValueIDs) > 0 {
+		ids := make([]string, len(f.CustomFieldValueIDs))
+		for i, id := range f.CustomFieldValueIDs {
+			ids[i] = id.String()
+		}
+		param := args.add(pq.Array(ids)) + `::text[]`
+		if f.CustomFieldValuesMatch == FilterMatchAll {
+			conditions = append(conditions, `custom_fields_values_id ?& `+param)
+		} else {
+			conditions = append(conditions, `custom_fields_values_id ?| `+param)
+		}
+	}
+
+	if f.HasEmployee != nil {
+		if *f.HasEmployee {
+			conditions = append(conditions, `NOT `+vacantPositionSQL)
+		} else {
+			conditions = append(conditions, vacantPositionSQL)
+		}
+	}
+
+	if f.CreatedFrom != nil {
+		conditions = append(conditions, `created_at >= `+args.add(*f.CreatedFrom))
+	}
+	if f.CreatedTo != nil {
+		conditions = append(conditions, `created_at < `+args.add(*f.CreatedTo))
+	}
+	if f.UpdatedFrom != nil {
+		conditions = append(conditions, `updated_at >= `+args.add(*f.UpdatedFrom))
+	}
+	if f.UpdatedTo != nil {
+		conditions = append(conditions, `updated_at < `+args.add(*f.UpdatedTo))
+	}
+
+	if f.Superior != nil {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM custom_fields_values sv
+			WHERE sv.superior = `+args.add(*f.Superior)+`
+			AND positions.custom_fields_values_id @> jsonb_build_array(sv.id::text))`)
+	}
+
+	return conditions
+}
+
+// parseFilterTime parses an RFC 3339 timestamp or a YYYY-MM-DD date.
+// For upper bounds a bare date means "up to the end of that day".
+func parseFilterTime(name, value string, upperBound bool) (*time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a date (YYYY-MM-DD) or an RFC 3339 timestamp", name)
+	}
+	if upperBound {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+// ParsePositionFilters reads structured filters from URL query parameters:
+// custom_field_value_ids (comma separated or repeated), custom_field_values_match,
+// has_employee, created_from, created_to, updated_from, updated_to and superior.
+func ParsePositionFilters(values url.Values) (PositionFilters, error) {
+	var f PositionFilters
+
+	for _, raw := range values["custom_field_value_ids"] {
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			id, err := uuid.Parse(part)
+			if err != nil {
+				return f, fmt.Errorf("invalid custom field value ID %q", part)
+			}
+			f.CustomFieldValueIDs = append(f.CustomFieldValueIDs, id)
+		}
+	}
+	f.CustomFieldValuesMatch = values.Get("custom_field_values_match")
+
+	if v := values.Get("has_employee"); v != "" {
+		hasEmployee, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("has_employee must be true or false")
+		}
+		f.HasEmployee = &hasEmployee
+	}
+
+	timeParams := []struct {
+		name       string
+		target     **time.Time
+		upperBound bool
+	}{
+		{"created_from", &f.CreatedFrom, false},
+		{"created_to", &f.CreatedTo, true},
+		{"updated_from", &f.UpdatedFrom, false},
+		{"updated_to", &f.UpdatedTo, true},
+	}
+	for _, p := range timeParams {
+		if v := values.Get(p.name); v != "" {
+			t, err := parseFilterTime(p.name, v, p.upperBound)
+			if err != nil {
+				return f, err
+			}
+			*p.target = t
+		}
+	}
+
+	if v := values.Get("superior"); v != "" {
+		superior, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("superior must be a position ID")
+		}
+		f.Superior = &superior
+	}
+
+	return f, f.Validate()
+}
+
+// Sort keys for position lists
+const (
+	sortKeyRelevance   = "relevance"
+	sortKeyCustomField = "custom_field"
+)
+
+// positionSortColumns maps sort keys to SQL expressions over positions and
+// their types (used to cast cursor values back)
+var positionSortColumns = map[string]struct {
+	expr    string
+	sqlType string
+}{
+	"id":         {"id", "bigint"},
+	"name":       {"position_name", "text"},
+	"surname":    {"COALESCE(employee_surname, '')", "text"},
+	"created_at": {"created_at", "timestamp"},
+	"updated_at": {"updated_at", "timestamp"},
+}
+
+// PositionSort is a sort order for position lists: "name", "-created_at",
+// "custom_field:department" etc. A leading "-" means descending order.
+type PositionSort struct {
+	Key            string
+	CustomFieldKey string // for Key == "custom_field"
+	Desc           bool
+}
+
+// ParsePositionSort parses a sort parameter. An empty string yields the default
+// order (by relevance for searches, by id otherwise).
+func ParsePositionSort(value string) (PositionSort, error) {
+	var s PositionSort
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return s, nil
+	}
+	if strings.HasPrefix(value, "-") {
+		s.Desc = true
+		value = value[1:]
+	}
+	if strings.HasPrefix(value, sortKeyCustomField+":") {
+		s.Key = sortKeyCustomField
+		s.CustomFieldKey = strings.TrimPrefix(value, sortKeyCustomField+":")
+		if s.CustomFieldKey == "" {
+			return s, fmt.Errorf("sort %q needs a custom field key", value)
+		}
+		return s, nil
+	}
+	if _, ok := positionSortColumns[value]; !ok && value != sortKeyRelevance {
+		return s, fmt.Errorf("unsupported sort %q", value)
+	}
+	s.Key = value
+	return s, nil
+}
+
+// String formats the sort back into its parameter form
+func (s PositionSort) String() string {
+	if s.Key == "" {
+		return ""
+	}
+	key := s.Key
+	if s.Key == sortKeyCustomField {
+		key += ":" + s.CustomFieldKey
+	}
+	if s.Desc {
+		return "-" + key
+	}
+	return key
+}
+
+// exprSQL returns the SQL expression to sort by and its type. rankSQL is the
+// relevance expression of the current search (used for the relevance key).
+func (s PositionSort) exprSQL(rankSQL string, args *queryArgs) (string, string) {
+	switch s.Key {
+	case sortKeyRelevance:
+		// The rank is real; as float8 its text form in the cursor converts
+		// back to the same value, so rows tied with the cursor row are not
+		// skipped or repeated
+		return `(` + rankSQL + `)::float8`, "float8"
+	case sortKeyCustomField:
+		return `COALESCE((SELECT v.value FROM custom_fields_values v
+			JOIN custom_fields f ON f.id = v.custom_field_id
+			WHERE lower(f.key) = lower(` + args.add(s.CustomFieldKey) + `::text)
+			AND positions.custom_fields_values_id @> jsonb_build_array(v.id::text)
+			ORDER BY v.value LIMIT 1), '')`, "text"
+	}
+	column, ok := positionSortColumns[s.Key]
+	if !ok {
+		column = positionSortColumns["id"]
+	}
+	return column.expr, column.sqlType
+}
+
+// direction returns the SQL sort direction
+func (s PositionSort) direction() string {
+	if s.Desc {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// validatePositionSort checks that a custom field sort refers to an existing field
+func (h *Handler) validatePositionSort(ctx context.Context, s PositionSort) error {
+	if s.Key != sortKeyCustomField {
+		return nil
+	}
+	fieldInfoMap, err := h.customFieldsService.LoadFieldInfoMap(ctx)
+	if err != nil {
+		return err
+	}
+	for _, info := range fieldInfoMap {
+		if strings.EqualFold(info.Key, s.CustomFieldKey) {
+			return nil
+		}
+	}
+	return &positionQueryError{fmt.Sprintf("unknown custom field %q in sort", s.CustomFieldKey)}
+}
+
+// positionQueryError marks invalid filter, sort or cursor parameters of a position list
+type positionQueryError struct {
+	message string
+}
+
+func (e *positionQueryError) Error() string {
+	return e.message
+}
+
+// positionCursor is the keyset pagination cursor: the sort it was produced for
+// and the sort value and id of the last returned row
+type positionCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// encode returns the opaque cursor string passed to clients
+func (c positionCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePositionCursor parses a cursor string produced by encode
+func decodePositionCursor(value string) (*positionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c positionCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
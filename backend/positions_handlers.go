@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -53,44 +53,202 @@ func (h *Handler) GetPositions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse search query
-	searchQuery := ParseSearchQuery(search)
-	whereClause, whereArgs := BuildWhereClause(searchQuery)
+	searchQuery, err := h.parseSearch(r.Context(), search)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
 
-	var query string
-	var args []interface{}
+	// Structured filters, sort order and keyset cursor
+	filters, err := ParsePositionFilters(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sort, err := ParsePositionSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cursor *positionCursor
+	if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+		if cursor, err = decodePositionCursor(cursorStr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	baseQuery := `SELECT id, position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic, 
-		employee_profile_url, created_at, updated_at
-		FROM positions`
+	page, err := h.listPositions(r.Context(), positionListQuery{
+		Search:  searchQuery,
+		Filters: filters,
+		Sort:    sort,
+		Cursor:  cursor,
+		Limit:   limit,
+		Offset:  offset,
+	})
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
 
-	if whereClause != "" {
-		// Add WHERE clause and adjust parameter indices for LIMIT/OFFSET
-		argCount := len(whereArgs)
-		query = baseQuery + ` WHERE ` + whereClause + ` ORDER BY id LIMIT $` + strconv.Itoa(argCount+1) + ` OFFSET $` + strconv.Itoa(argCount+2)
-		args = append(whereArgs, limit, offset)
-	} else {
-		query = baseQuery + ` ORDER BY id LIMIT $1 OFFSET $2`
-		args = []interface{}{limit, offset}
+	response := map[string]interface{}{
+		"items":       page.Items,
+		"total":       page.Total,
+		"next_cursor": page.NextCursor,
 	}
 
-	rows, err := h.db.Query(query, args...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// positionListQuery combines a search query, structured filters, sort order and paging
+type positionListQuery struct {
+	Search  *SearchQuery
+	Filters PositionFilters
+	Sort    PositionSort    // empty: by relevance for searches, by id otherwise
+	Cursor  *positionCursor // keyset pagination; Offset is ignored when set
+	Limit   int
+	Offset  int
+}
+
+// positionPage is a page of positions in API response format
+type positionPage struct {
+	Items      []map[string]interface{}
+	Total      int     // number of positions matching the search and filters
+	NextCursor *string // nil when there are no more pages
+}
+
+// positionHit is a position found by queryPositions
+type positionHit struct {
+	Position  Position
+	Relevance float64
+	Highlight map[string]string // nil when the query has no free-text terms
+}
+
+// positionHits is a page of positions found by queryPositions
+type positionHits struct {
+	Items      []positionHit
+	Total      int     // number of positions matching the search and filters
+	NextCursor *string // nil when there are no more pages
+}
+
+// listPositions returns a page of positions in API response format and the total
+// number of matching positions
+func (h *Handler) listPositions(ctx context.Context, q positionListQuery) (*positionPage, error) {
+	hits, err := h.queryPositions(ctx, q)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	page := &positionPage{
+		Items:      make([]map[string]interface{}, 0, len(hits.Items)),
+		Total:      hits.Total,
+		NextCursor: hits.NextCursor,
+	}
+	for _, m := range hits.Items {
+		positionResponse, err := h.positionResponse(ctx, m.Position)
+		if err != nil {
+			return nil, err
+		}
+		if m.Highlight != nil {
+			// Matched words are wrapped with <mark>...</mark>
+			positionResponse["relevance"] = m.Relevance
+			positionResponse["highlight"] = m.Highlight
+		}
+		page.Items = append(page.Items, positionResponse)
+	}
+	return page, nil
+}
+
+// queryPositions returns a page of positions and the total number of
+// matching positions
+func (h *Handler) queryPositions(ctx context.Context, q positionListQuery) (*positionHits, error) {
+	whereArgs := &queryArgs{}
+	searchClause, err := q.Search.whereSQL(whereArgs)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []string
+	if searchClause != "" {
+		conditions = append(conditions, searchClause)
+	}
+	conditions = append(conditions, q.Filters.whereSQL(whereArgs)...)
+	whereClause := strings.Join(conditions, " AND ")
+
+	hasSearch := searchClause != ""
+	sort := q.Sort
+	if sort.Key == "" {
+		if hasSearch {
+			sort = PositionSort{Key: sortKeyRelevance, Desc: true}
+		} else {
+			sort = PositionSort{Key: "id"}
+		}
+	}
+	if err := h.validatePositionSort(ctx, sort); err != nil {
+		return nil, err
+	}
+
+	baseQuery := `SELECT id, position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic, 
+		employee_profile_url, created_at, updated_at`
+
+	// Relevance and highlighted fragments are computed from the free-text terms
+	selectArgs := &queryArgs{values: append([]interface{}{}, whereArgs.values...)}
+	rankSQL := q.Search.rankSQL(selectArgs)
+	sortSQL, sortType := sort.exprSQL(rankSQL, selectArgs)
+	query := baseQuery + `, (` + sortSQL + `)::text AS sort_cursor`
+	if hasSearch {
+		query += `, ` + rankSQL + ` AS relevance, 
+			` + q.Search.headlineSQL(selectArgs, `position_name`) + `, 
+			` + q.Search.headlineSQL(selectArgs, `concat_ws(' ', employee_surname, employee_name, employee_patronymic)`) + `, 
+			` + q.Search.headlineSQL(selectArgs, `COALESCE(employee_id, '')`) + `, 
+			` + q.Search.headlineSQL(selectArgs, `position_custom_values_text(custom_fields_values_id)`)
+	}
+	query += ` FROM positions`
+
+	// Keyset pagination: continue after the (sort value, id) of the cursor row
+	pageConditions := append([]string{}, conditions...)
+	if q.Cursor != nil {
+		if q.Cursor.Sort != sort.String() {
+			return nil, &positionQueryError{"cursor was issued for a different sort order"}
+		}
+		op := ">"
+		if sort.Desc {
+			op = "<"
+		}
+		pageConditions = append(pageConditions, `((`+sortSQL+`), id) `+op+` (`+
+			selectArgs.add(q.Cursor.Value)+`::`+sortType+`, `+selectArgs.add(q.Cursor.ID)+`::bigint)`)
+	}
+	if len(pageConditions) > 0 {
+		query += ` WHERE ` + strings.Join(pageConditions, " AND ")
+	}
+	query += ` ORDER BY ` + sortSQL + ` ` + sort.direction() + `, id ` + sort.direction()
+	query += ` LIMIT ` + selectArgs.add(q.Limit)
+	if q.Cursor == nil {
+		query += ` OFFSET ` + selectArgs.add(q.Offset)
+	}
+
+	rows, err := h.db.QueryContext(ctx, query, selectArgs.values...)
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
-	var positions []map[string]interface{}
+	page := &positionHits{Items: []positionHit{}}
+	var last positionCursor
 	for rows.Next() {
 		var p Position
 		var customFieldsIDsJSON []byte
 		var customFieldsValuesIDsJSON []byte
-		err := rows.Scan(&p.ID, &p.Name, &customFieldsIDsJSON, &customFieldsValuesIDsJSON,
+		var sortCursor string
+		dest := []interface{}{&p.ID, &p.Name, &customFieldsIDsJSON, &customFieldsValuesIDsJSON,
 			&p.EmployeeExternalID, &p.Surname, &p.EmployeeName, &p.Patronymic, &p.EmployeeProfileURL,
-			&p.CreatedAt, &p.UpdatedAt)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			&p.CreatedAt, &p.UpdatedAt, &sortCursor}
+		var relevance float64
+		var nameHeadline, employeeHeadline, employeeIDHeadline, customFieldsHeadline string
+		if hasSearch {
+			dest = append(dest, &relevance, &nameHeadline, &employeeHeadline, &employeeIDHeadline, &customFieldsHeadline)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
 		}
 		if customFieldsIDsJSON != nil {
 			json.Unmarshal(customFieldsIDsJSON, &p.CustomFieldsIDs)
@@ -99,50 +257,64 @@ func (h *Handler) GetPositions(w http.ResponseWriter, r *http.Request) {
 			json.Unmarshal(customFieldsValuesIDsJSON, &p.CustomFieldsValuesIDs)
 		}
 
-		// Build nested custom_fields array
-		customFieldsArray, err := h.buildCustomFieldsArrayFromIDs(p.CustomFieldsIDs, p.CustomFieldsValuesIDs)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Compute employee_full_name for backward compatibility
-		p.EmployeeFullName = combineEmployeeFullName(p.Surname, p.EmployeeName, p.Patronymic)
-
-		// Build response object with custom_fields array
-		positionResponse := map[string]interface{}{
-			"id":                   p.ID,
-			"name":                 p.Name,
-			"custom_fields":        customFieldsArray,
-			"employee_id": p.EmployeeExternalID,
-			"surname":              p.Surname,
-			"employee_name":        p.EmployeeName,
-			"patronymic":           p.Patronymic,
-			"employee_full_name":   p.EmployeeFullName,
-			"employee_profile_url": p.EmployeeProfileURL,
-			"created_at":           p.CreatedAt,
-			"updated_at":           p.UpdatedAt,
+		hit := positionHit{Position: p}
+		if hasSearch {
+			hit.Relevance = relevance
+			hit.Highlight = map[string]string{
+				"name":               nameHeadline,
+				"employee_full_name": employeeHeadline,
+				"employee_id":        employeeIDHeadline,
+				"custom_fields":      customFieldsHeadline,
+			}
 		}
-		positions = append(positions, positionResponse)
+		page.Items = append(page.Items, hit)
+		last = positionCursor{Sort: sort.String(), Value: sortCursor, ID: p.ID}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(page.Items) == q.Limit {
+		next := last.encode()
+		page.NextCursor = &next
 	}
 
-	// Get total count using the same search logic
-	var total int
+	// Get total count using the same conditions
 	countQuery := "SELECT COUNT(*) FROM positions"
 	if whereClause != "" {
 		countQuery = countQuery + " WHERE " + whereClause
-		h.db.QueryRow(countQuery, whereArgs...).Scan(&total)
-	} else {
-		h.db.QueryRow(countQuery).Scan(&total)
+	}
+	if err := h.db.QueryRowContext(ctx, countQuery, whereArgs.values...).Scan(&page.Total); err != nil {
+		return nil, err
 	}
 
-	response := map[string]interface{}{
-		"items": positions,
-		"total": total,
+	return page, nil
+}
+
+// positionResponse builds the API representation of a position with the nested
+// custom_fields array and the computed employee_full_name
+func (h *Handler) positionResponse(ctx context.Context, p Position) (map[string]interface{}, error) {
+	// Build nested custom_fields array
+	customFieldsArray, err := h.buildCustomFieldsArrayFromIDs(ctx, p.CustomFieldsIDs, p.CustomFieldsValuesIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// Compute employee_full_name for backward compatibility
+	p.EmployeeFullName = combineEmployeeFullName(p.Surname, p.EmployeeName, p.Patronymic)
+
+	return map[string]interface{}{
+		"id":                   p.ID,
+		"name":                 p.Name,
+		"custom_fields":        customFieldsArray,
+		"employee_id":          p.EmployeeExternalID,
+		"surname":              p.Surname,
+		"employee_name":        p.EmployeeName,
+		"patronymic":           p.Patronymic,
+		"employee_full_name":   p.EmployeeFullName,
+		"employee_profile_url": p.EmployeeProfileURL,
+		"created_at":           p.CreatedAt,
+		"updated_at":           p.UpdatedAt,
+	}, nil
 }
 
 func (h *Handler) GetPosition(w http.ResponseWriter, r *http.Request) {
@@ -157,7 +329,7 @@ func (h *Handler) GetPosition(w http.ResponseWriter, r *http.Request) {
 	var p Position
 	var customFieldsIDsJSON []byte
 	var customFieldsValuesIDsJSON []byte
-	err = h.db.QueryRow(
+	err = h.db.QueryRowContext(r.Context(),
 		`SELECT id, position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic, 
 		employee_profile_url, created_at, updated_at
 		FROM positions WHERE id = $1`,
@@ -183,7 +355,7 @@ func (h *Handler) GetPosition(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Build nested custom_fields array
-	customFieldsArray, err := h.buildCustomFieldsArrayFromIDs(p.CustomFieldsIDs, p.CustomFieldsValuesIDs)
+	customFieldsArray, err := h.buildCustomFieldsArrayFromIDs(r.Context(), p.CustomFieldsIDs, p.CustomFieldsValuesIDs)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -206,198 +378,266 @@ func (h *Handler) GetPosition(w http.ResponseWriter, r *http.Request) {
 		"updated_at":           p.UpdatedAt,
 	}
 
+	// Current assignments; the employee_* fields above show the primary one
+	assignments, err := loadAssignments(r.Context(), h.db,
+		`a.position_id = $1 AND `+assignmentActive, assignmentPrimaryOrder, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response["assignments"] = assignments
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (h *Handler) CreatePosition(w http.ResponseWriter, r *http.Request) {
-	// Parse request body - can accept either nested structure or flat structure
-	var requestBody map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+// positionEmployeeFields holds the employee columns of a position as sent by clients
+type positionEmployeeFields struct {
+	Surname      *string
+	EmployeeName *string
+	Patronymic   *string
+	ExternalID   *string
+	ProfileURL   *string
+}
 
-	// Extract basic fields
-	var name string
-	var surname *string
-	var employeeName *string
-	var patronymic *string
-	var employeeExternalID *string
-	var employeeProfileURL *string
+// parsePositionEmployeeFields reads the employee fields of a position request
+// body. Missing and null fields are cleared; the legacy employee_full_name is
+// split into surname, name and patronymic.
+func parsePositionEmployeeFields(body map[string]interface{}) positionEmployeeFields {
+	var f positionEmployeeFields
 
-	if n, ok := requestBody["name"].(string); ok {
-		name = n
-	}
 	// Handle both new format (surname, employee_name, patronymic) and old format (employee_full_name)
-	if s, ok := requestBody["surname"].(string); ok {
-		if s != "" {
-			surname = &s
-		}
-	} else if requestBody["surname"] == nil {
-		surname = nil
+	if s, ok := body["surname"].(string); ok && s != "" {
+		f.Surname = &s
 	}
-	if en, ok := requestBody["employee_name"].(string); ok {
-		if en != "" {
-			employeeName = &en
-		}
-	} else if requestBody["employee_name"] == nil {
-		employeeName = nil
+	if en, ok := body["employee_name"].(string); ok && en != "" {
+		f.EmployeeName = &en
 	}
-	if p, ok := requestBody["patronymic"].(string); ok {
-		if p != "" {
-			patronymic = &p
-		}
-	} else if requestBody["patronymic"] == nil {
-		patronymic = nil
+	if p, ok := body["patronymic"].(string); ok && p != "" {
+		f.Patronymic = &p
 	}
-	
+
 	// Backward compatibility: if employee_full_name is provided, parse it
-	if efn, ok := requestBody["employee_full_name"].(string); ok && efn != "" {
+	if efn, ok := body["employee_full_name"].(string); ok && efn != "" {
 		parts := strings.Fields(efn)
 		if len(parts) > 0 {
-			surname = &parts[0]
+			f.Surname = &parts[0]
 		}
 		if len(parts) > 1 {
-			employeeName = &parts[1]
+			f.EmployeeName = &parts[1]
 		}
 		if len(parts) > 2 {
 			pat := strings.Join(parts[2:], " ")
-			patronymic = &pat
+			f.Patronymic = &pat
 		}
 	}
-	
-	if eid, ok := requestBody["employee_id"].(string); ok {
-		employeeExternalID = &eid
-	} else if requestBody["employee_id"] == nil {
-		employeeExternalID = nil
-	}
-	if epu, ok := requestBody["employee_profile_url"].(string); ok {
-		employeeProfileURL = &epu
-	} else if requestBody["employee_profile_url"] == nil {
-		employeeProfileURL = nil
-	}
-
-	// Process custom_fields
-	// New format: custom_fields is an array with structure:
-	// [
-	//   {
-	//     "custom_field_id": "uuid поля из таблицы custom_fields",
-	//     "custom_field_value_id": "uuid значения из таблицы custom_fields_values",
-	//     "linked_custom_fields": [
-	//       {
-	//         "linked_custom_field_values": [
-	//           {
-	//             "linked_custom_field_value_id": "uuid значения из таблицы custom_fields_values"
-	//           }
-	//         ]
-	//       }
-	//     ]
-	//   }
-	// ]
-	// Note:
-	//   - В positions.custom_fields_ids храним ИМЕННО ID кастомных полей (custom_field_id)
-	//     для верхнеуровневых полей должности.
-	//   - В positions.custom_fields_values_ids храним ID значений (custom_field_value_id)
-	//     как для основного поля, так и для всех привязанных (linked_custom_field_value_id).
-	
-	// Save original custom_fields structure from request to return it in response
-	var originalCustomFields interface{}
-	if customFieldsRaw, ok := requestBody["custom_fields"]; ok {
-		originalCustomFields = customFieldsRaw
+
+	if eid, ok := body["employee_id"].(string); ok {
+		f.ExternalID = &eid
 	}
-	
-	// Use maps to track unique IDs and avoid duplicates
-	customFieldsIDsMap := make(map[uuid.UUID]bool)
-	customFieldsValuesIDsMap := make(map[uuid.UUID]bool)
-	
-	if customFieldsRaw, ok := requestBody["custom_fields"]; ok {
-		if customFieldsArray, ok := customFieldsRaw.([]interface{}); ok {
-			// Process each custom field
-			for _, cfItem := range customFieldsArray {
-				if cfMap, ok := cfItem.(map[string]interface{}); ok {
-					// 1) Сохраняем ID самого кастомного поля (custom_field_id) в custom_fields_ids
-					if customFieldIDRaw, ok := cfMap["custom_field_id"]; ok {
-						if customFieldIDStr, ok := customFieldIDRaw.(string); ok && customFieldIDStr != "" {
-							if fieldID, err := uuid.Parse(customFieldIDStr); err == nil {
-								customFieldsIDsMap[fieldID] = true
-							}
-						}
-					}
+	if epu, ok := body["employee_profile_url"].(string); ok {
+		f.ProfileURL = &epu
+	}
+	return f
+}
 
-					// 2) Сохраняем ID выбранного значения основного поля (custom_field_value_id)
-					//    в custom_fields_values_ids
-					if customFieldValueIDRaw, ok := cfMap["custom_field_value_id"]; ok {
-						if customFieldValueIDStr, ok := customFieldValueIDRaw.(string); ok && customFieldValueIDStr != "" {
-							// Parse custom_field_value_id as UUID and store it in custom_fields_values_ids
-							if valueID, err := uuid.Parse(customFieldValueIDStr); err == nil {
-								customFieldsValuesIDsMap[valueID] = true
-							}
-						}
-					}
+// positionInput is a position as written by POST and PUT /api/positions and
+// the GraphQL position mutations
+type positionInput struct {
+	Name                  string
+	CustomFieldsIDs       UUIDArray
+	CustomFieldsValuesIDs UUIDArray
+	Employee              positionEmployeeFields
+}
 
-					// 3) Обрабатываем привязанные кастомные поля и их значения
-					if linkedFields, ok := cfMap["linked_custom_fields"].([]interface{}); ok {
-						for _, lfItem := range linkedFields {
-							if lfMap, ok := lfItem.(map[string]interface{}); ok {
-								// 3.1) Сохраняем ID самого привязанного кастомного поля
-								if linkedFieldIDRaw, ok := lfMap["linked_custom_field_id"]; ok {
-									if linkedFieldIDStr, ok := linkedFieldIDRaw.(string); ok && linkedFieldIDStr != "" {
-										if fieldID, err := uuid.Parse(linkedFieldIDStr); err == nil {
-											// ID привязанного кастомного поля храним в custom_fields_ids
-											customFieldsIDsMap[fieldID] = true
-										}
-									}
-								}
+// parsePositionInput reads a position request body
+func parsePositionInput(body map[string]interface{}) positionInput {
+	in := positionInput{Employee: parsePositionEmployeeFields(body)}
+	if n, ok := body["name"].(string); ok {
+		in.Name = n
+	}
+	in.CustomFieldsIDs, in.CustomFieldsValuesIDs = parsePositionCustomFields(body["custom_fields"])
+	return in
+}
 
-								// 3.2) Сохраняем ID выбранных значений привязанных кастомных полей
-								if linkedValues, ok := lfMap["linked_custom_field_values"].([]interface{}); ok {
-									for _, lvItem := range linkedValues {
-										if lvMap, ok := lvItem.(map[string]interface{}); ok {
-											linkedValueID, _ := lvMap["linked_custom_field_value_id"].(string)
-											if linkedValueID != "" {
-												if valueID, err := uuid.Parse(linkedValueID); err == nil {
-													// Store linked value IDs in custom_fields_values_ids
-													customFieldsValuesIDsMap[valueID] = true
-												}
-											}
-										}
-									}
-								}
-							}
-						}
-					}
+// parsePositionCustomFields collects the IDs stored for the custom_fields of
+// a position request body. custom_fields is an array with structure:
+// [
+//   {
+//     "custom_field_id": "uuid поля из таблицы custom_fields",
+//     "custom_field_value_id": "uuid значения из таблицы custom_fields_values",
+//     "linked_custom_fields": [
+//       {
+//         "linked_custom_field_id": "uuid поля из таблицы custom_fields",
+//         "linked_custom_field_values": [
+//           {
+//             "linked_custom_field_value_id": "uuid значения из таблицы custom_fields_values"
+//           }
+//         ]
+//       }
+//     ]
+//   }
+// ]
+// Note:
+//   - В positions.custom_fields_ids храним ИМЕННО ID кастомных полей (custom_field_id
+//     и linked_custom_field_id).
+//   - В positions.custom_fields_values_ids храним ID значений (custom_field_value_id)
+//     как для основного поля, так и для всех привязанных (linked_custom_field_value_id).
+//
+// Invalid and repeated IDs are skipped.
+func parsePositionCustomFields(raw interface{}) (fieldIDs, valueIDs UUIDArray) {
+	fields := newUUIDSet()
+	values := newUUIDSet()
+	customFieldsArray, _ := raw.([]interface{})
+	for _, cfItem := range customFieldsArray {
+		cfMap, ok := cfItem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fields.addString(cfMap["custom_field_id"])
+		values.addString(cfMap["custom_field_value_id"])
+
+		linkedFields, _ := cfMap["linked_custom_fields"].([]interface{})
+		for _, lfItem := range linkedFields {
+			lfMap, ok := lfItem.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			fields.addString(lfMap["linked_custom_field_id"])
+			linkedValues, _ := lfMap["linked_custom_field_values"].([]interface{})
+			for _, lvItem := range linkedValues {
+				if lvMap, ok := lvItem.(map[string]interface{}); ok {
+					values.addString(lvMap["linked_custom_field_value_id"])
 				}
 			}
 		}
 	}
+	return fields.ids, values.ids
+}
+
+// uuidSet collects distinct UUIDs in the order they were added
+type uuidSet struct {
+	ids  UUIDArray
+	seen map[uuid.UUID]bool
+}
 
-	// Convert maps to slices
-	customFieldsIDs := make([]uuid.UUID, 0, len(customFieldsIDsMap))
-	for id := range customFieldsIDsMap {
-		customFieldsIDs = append(customFieldsIDs, id)
+func newUUIDSet() *uuidSet {
+	return &uuidSet{ids: UUIDArray{}, seen: make(map[uuid.UUID]bool)}
+}
+
+func (s *uuidSet) add(id uuid.UUID) {
+	if !s.seen[id] {
+		s.seen[id] = true
+		s.ids = append(s.ids, id)
 	}
-	customFieldsValuesIDs := make([]uuid.UUID, 0, len(customFieldsValuesIDsMap))
-	for id := range customFieldsValuesIDsMap {
-		customFieldsValuesIDs = append(customFieldsValuesIDs, id)
+}
+
+// addString adds raw if it is a string holding a valid UUID
+func (s *uuidSet) addString(raw interface{}) {
+	if str, ok := raw.(string); ok && str != "" {
+		if id, err := uuid.Parse(str); err == nil {
+			s.add(id)
+		}
 	}
+}
 
-	customFieldsIDsArray := UUIDArray(customFieldsIDs)
-	customFieldsIDsJSON, _ := json.Marshal(customFieldsIDsArray)
+// createPosition inserts a position and records its employee as an
+// assignment in one transaction; it returns the ID of the new position
+func (h *Handler) createPosition(ctx context.Context, in positionInput) (int64, error) {
+	customFieldsIDsJSON, _ := json.Marshal(in.CustomFieldsIDs)
+	customFieldsValuesIDsJSON, _ := json.Marshal(in.CustomFieldsValuesIDs)
+	employee := in.Employee
 
-	customFieldsValuesIDsArray := UUIDArray(customFieldsValuesIDs)
-	customFieldsValuesIDsJSON, _ := json.Marshal(customFieldsValuesIDsArray)
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
 	var positionID int64
-	err := h.db.QueryRow(
-		`INSERT INTO positions (position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic, 
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO positions (position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic,
 		employee_profile_url, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW(), NOW())
 		RETURNING id`,
-		name, customFieldsIDsJSON, customFieldsValuesIDsJSON,
-		employeeExternalID, surname, employeeName, patronymic, employeeProfileURL,
+		in.Name, customFieldsIDsJSON, customFieldsValuesIDsJSON,
+		employee.ExternalID, employee.Surname, employee.EmployeeName, employee.Patronymic, employee.ProfileURL,
 	).Scan(&positionID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Record the employee as an assignment to the position
+	if err := syncPositionEmployee(ctx, tx, positionID, employee); err != nil {
+		return 0, err
+	}
+	return positionID, tx.Commit()
+}
+
+// updatePosition replaces a position and records a changed employee as an
+// assignment in one transaction. It returns sql.ErrNoRows if the position
+// does not exist.
+func (h *Handler) updatePosition(ctx context.Context, id int64, in positionInput) error {
+	customFieldsIDsJSON, _ := json.Marshal(in.CustomFieldsIDs)
+	customFieldsValuesIDsJSON, _ := json.Marshal(in.CustomFieldsValuesIDs)
+	employee := in.Employee
+	logf(ctx, "[UpdatePosition] Final customFieldsIDs count: %d, IDs: %v", len(in.CustomFieldsIDs), in.CustomFieldsIDs)
+	logf(ctx, "[UpdatePosition] Final customFieldsValuesIDs count: %d, IDs: %v", len(in.CustomFieldsValuesIDs), in.CustomFieldsValuesIDs)
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		`UPDATE positions SET position_name = $1, custom_fields_id = $2, custom_fields_values_id = $3,
+		employee_id = $4, employee_surname = $5, employee_name = $6, employee_patronymic = $7, employee_profile_url = $8,
+		updated_at = NOW() WHERE id = $9`,
+		in.Name, customFieldsIDsJSON, customFieldsValuesIDsJSON,
+		employee.ExternalID, employee.Surname, employee.EmployeeName, employee.Patronymic, employee.ProfileURL, id,
+	)
+	if err != nil {
+		logErrorf(ctx, "[UpdatePosition] Error updating position: %v", err)
+		return err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	if err := syncPositionEmployee(ctx, tx, id, employee); err != nil {
+		logErrorf(ctx, "[UpdatePosition] Error recording the employee of position %d: %v", id, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logErrorf(ctx, "[UpdatePosition] tx commit error: %v", err)
+		return err
+	}
+	logf(ctx, "[UpdatePosition] Successfully updated position %d, rows affected: %d", id, rowsAffected)
+	return nil
+}
+
+// deletePosition deletes a position; deleting a missing position is not an error
+func (h *Handler) deletePosition(ctx context.Context, id int64) error {
+	_, err := h.db.ExecContext(ctx, "DELETE FROM positions WHERE id = $1", id)
+	return err
+}
 
+func (h *Handler) CreatePosition(w http.ResponseWriter, r *http.Request) {
+	// Parse request body - can accept either nested structure or flat structure
+	var requestBody map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Save original custom_fields structure from request to return it in response
+	var originalCustomFields interface{}
+	if customFieldsRaw, ok := requestBody["custom_fields"]; ok {
+		originalCustomFields = customFieldsRaw
+	}
+
+	positionID, err := h.createPosition(r.Context(), parsePositionInput(requestBody))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -407,7 +647,7 @@ func (h *Handler) CreatePosition(w http.ResponseWriter, r *http.Request) {
 	var p Position
 	var customFieldsIDsFromCreated []byte
 	var customFieldsValuesIDsFromCreated []byte
-	err = h.db.QueryRow(
+	err = h.db.QueryRowContext(r.Context(),
 		`SELECT id, position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic, 
 		employee_profile_url, created_at, updated_at
 		FROM positions WHERE id = $1`,
@@ -432,7 +672,7 @@ func (h *Handler) CreatePosition(w http.ResponseWriter, r *http.Request) {
 	// (key, label, value text) while preserving 100% structure match
 	var customFieldsForResponse interface{}
 	if originalCustomFields != nil {
-		enriched, err := h.enrichCustomFieldsFromRequest(originalCustomFields)
+		enriched, err := h.enrichCustomFieldsFromRequest(r.Context(), originalCustomFields)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -466,9 +706,9 @@ func (h *Handler) CreatePosition(w http.ResponseWriter, r *http.Request) {
 
 // enrichCustomFieldsFromRequest enriches the original custom_fields structure from request
 // with additional data from DB (key, label, value text) while preserving the original structure
-func (h *Handler) enrichCustomFieldsFromRequest(originalCustomFields interface{}) (interface{}, error) {
+func (h *Handler) enrichCustomFieldsFromRequest(ctx context.Context, originalCustomFields interface{}) (interface{}, error) {
 	// Pre-load all custom field definitions
-	fieldRows, err := h.db.Query(`SELECT id, key, label FROM custom_fields`)
+	fieldRows, err := h.db.QueryContext(ctx, `SELECT id, key, label FROM custom_fields`)
 	if err != nil {
 		return nil, err
 	}
@@ -490,7 +730,7 @@ func (h *Handler) enrichCustomFieldsFromRequest(originalCustomFields interface{}
 	}
 
 	// Pre-load all custom field values
-	valueRows, err := h.db.Query(`SELECT id, value FROM custom_fields_values`)
+	valueRows, err := h.db.QueryContext(ctx, `SELECT id, value FROM custom_fields_values`)
 	if err != nil {
 		return nil, err
 	}
@@ -655,169 +895,19 @@ func (h *Handler) enrichCustomFieldsFromRequest(originalCustomFields interface{}
 	return originalCustomFields, nil
 }
 
-// buildCustomFieldsArrayFromIDs builds the nested custom_fields array structure
-// customFieldsIDs          - массив ID кастомных полей (custom_field_id) для позиции
-// customFieldsValuesIDs    - массив ID выбранных значений (custom_field_value_id и linked_custom_field_value_id)
-func (h *Handler) buildCustomFieldsArrayFromIDs(customFieldsIDs *UUIDArray, customFieldsValuesIDs *UUIDArray) ([]PositionCustomFieldValue, error) {
-	customFieldsArray := []PositionCustomFieldValue{}
-
-	if customFieldsIDs == nil || len(*customFieldsIDs) == 0 || customFieldsValuesIDs == nil || len(*customFieldsValuesIDs) == 0 {
-		return customFieldsArray, nil
-	}
-
-	// Build a set of selected value IDs (как для основных, так и для привязанных значений)
-	selectedValueIDs := make(map[uuid.UUID]bool)
-	if customFieldsValuesIDs != nil {
-		for _, id := range *customFieldsValuesIDs {
-			selectedValueIDs[id] = true
-		}
-	}
-
-	// Load all custom fields data using service
-	fieldInfoMap, valueInfoMap, fieldToValuesMap, err := h.customFieldsService.LoadAllCustomFieldsData()
-	if err != nil {
-		return nil, err
-	}
-
-	// Load all custom field definitions
-	rows, err := h.db.Query(
-		`SELECT id, key, label, allowed_values_ids, created_at, updated_at
-		FROM custom_fields`,
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	// Build a map of custom field definitions by ID and map valueID -> fieldID
-	fieldDefsByID := make(map[uuid.UUID]CustomFieldDefinition)
-	valueToFieldMap := make(map[uuid.UUID]uuid.UUID) // Maps value ID to field ID
-	for rows.Next() {
-		var f CustomFieldDefinition
-		var allowedValueIDsJSON []byte
-		err := rows.Scan(&f.ID, &f.Key, &f.Label, &allowedValueIDsJSON,
-			&f.CreatedAt, &f.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		fieldDefsByID[f.ID] = f
-
-		// Map each allowed value to this field
-		if allowedValueIDsJSON != nil {
-			var ids []string
-			if err := json.Unmarshal(allowedValueIDsJSON, &ids); err == nil {
-				for _, idStr := range ids {
-					if valueID, err := uuid.Parse(idStr); err == nil {
-						valueToFieldMap[valueID] = f.ID
-					}
-				}
-			}
-		}
-	}
-
-	// Построим отображение: ID поля -> выбранное для него значение (valueID)
-	fieldToSelectedValue := make(map[uuid.UUID]uuid.UUID)
-	for _, valueID := range *customFieldsValuesIDs {
-		fieldID, exists := valueToFieldMap[valueID]
-		if !exists {
-			continue
-		}
-		// Берём первое найденное значение для поля (предполагаем по одному значению на поле)
-		if _, already := fieldToSelectedValue[fieldID]; !already {
-			fieldToSelectedValue[fieldID] = valueID
-		}
-	}
-
-	// Process each field ID from the position (верхнеуровневые поля должности)
-	for _, fieldID := range *customFieldsIDs {
-		valueID, hasValue := fieldToSelectedValue[fieldID]
-		if !hasValue {
-			continue
-		}
-
-		fieldDef := fieldDefsByID[fieldID]
-		valueText := valueInfoMap[valueID]
-
-		// Build linked custom fields structure from custom_fields_values
-		// Also load superior information (superior position ID and employee full name)
-		var linkedCustomFieldIDsJSON []byte
-		var linkedCustomFieldValueIDsJSON []byte
-		var superior sql.NullInt64
-		var superiorSurname sql.NullString
-		var superiorEmployeeName sql.NullString
-		var superiorPatronymic sql.NullString
-		err := h.db.QueryRow(
-			`SELECT cfv.linked_custom_fields_ids, cfv.linked_custom_fields_values_ids, 
-			        cfv.superior, p.employee_surname, p.employee_name, p.employee_patronymic
-			FROM custom_fields_values cfv
-			LEFT JOIN positions p ON cfv.superior = p.id
-			WHERE cfv.id = $1`,
-			valueID,
-		).Scan(&linkedCustomFieldIDsJSON, &linkedCustomFieldValueIDsJSON, 
-			&superior, &superiorSurname, &superiorEmployeeName, &superiorPatronymic)
-
-		var linkedFields []LinkedCustomField
-		if err == nil {
-			linkedFields, _ = h.customFieldsService.BuildLinkedCustomFields(
-				linkedCustomFieldIDsJSON,
-				linkedCustomFieldValueIDsJSON,
-				fieldInfoMap,
-				fieldToValuesMap,
-				valueInfoMap,
-				selectedValueIDs,
-			)
-		}
-
-		// Build superior employee full name if superior exists
-		var superiorEmployeeFullName *string
-		if superior.Valid && (superiorSurname.Valid || superiorEmployeeName.Valid || superiorPatronymic.Valid) {
-			var surnamePtr, employeeNamePtr, patronymicPtr *string
-			if superiorSurname.Valid {
-				surnamePtr = &superiorSurname.String
-			}
-			if superiorEmployeeName.Valid {
-				employeeNamePtr = &superiorEmployeeName.String
-			}
-			if superiorPatronymic.Valid {
-				patronymicPtr = &superiorPatronymic.String
-			}
-			fullName := combineEmployeeFullName(surnamePtr, employeeNamePtr, patronymicPtr)
-			if fullName != nil && *fullName != "" {
-				superiorEmployeeFullName = fullName
-			}
-		}
-
-		// Extract superior position ID
-		var superiorID *int64
-		if superior.Valid {
-			superiorID = &superior.Int64
-		}
-
-		valueItem := PositionCustomFieldValue{
-			CustomFieldID:           fieldDef.ID.String(),
-			CustomFieldKey:          fieldDef.Key,
-			CustomFieldLabel:        fieldDef.Label,
-			CustomFieldValue:        valueText,
-			CustomFieldValueID:      valueID,
-			Superior:                superiorID,
-			SuperiorEmployeeFullName: superiorEmployeeFullName,
-		}
-		if len(linkedFields) > 0 {
-			valueItem.LinkedCustomFields = linkedFields
-		}
-		customFieldsArray = append(customFieldsArray, valueItem)
-	}
-
-	return customFieldsArray, nil
+// buildCustomFieldsArrayFromIDs builds the nested custom_fields array structure,
+// see CustomFieldsService.BuildCustomFieldsArrayFromIDs
+func (h *Handler) buildCustomFieldsArrayFromIDs(ctx context.Context, customFieldsIDs *UUIDArray, customFieldsValuesIDs *UUIDArray) ([]PositionCustomFieldValue, error) {
+	return h.customFieldsService.BuildCustomFieldsArrayFromIDs(ctx, customFieldsIDs, customFieldsValuesIDs)
 }
 
 // buildCustomFieldsArray builds the nested custom_fields array structure from flat JSONB
 // DEPRECATED: Use buildCustomFieldsArrayFromIDs instead
-func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCustomFieldValue, error) {
+func (h *Handler) buildCustomFieldsArray(ctx context.Context, customFieldsJSON JSONB) ([]PositionCustomFieldValue, error) {
 	customFieldsArray := []PositionCustomFieldValue{}
 
 	// Pre-load all custom field definitions for linked fields lookup
-	allFieldsRows, err := h.db.Query(`SELECT id, key, label FROM custom_fields`)
+	allFieldsRows, err := h.db.QueryContext(ctx, `SELECT id, key, label FROM custom_fields`)
 	if err != nil {
 		return nil, err
 	}
@@ -838,7 +928,7 @@ func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCust
 	allFieldsRows.Close()
 
 	// Pre-load all custom field values for linked values lookup
-	allValuesRows, err := h.db.Query(`SELECT id, value FROM custom_fields_values`)
+	allValuesRows, err := h.db.QueryContext(ctx, `SELECT id, value FROM custom_fields_values`)
 	if err != nil {
 		return nil, err
 	}
@@ -854,7 +944,7 @@ func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCust
 
 	// Pre-load field-to-values mapping (which values belong to which fields)
 	fieldToValuesMap := make(map[uuid.UUID]map[uuid.UUID]bool)
-	fieldsForMappingRows, err := h.db.Query(`SELECT id, allowed_values_ids FROM custom_fields WHERE allowed_values_ids IS NOT NULL`)
+	fieldsForMappingRows, err := h.db.QueryContext(ctx, `SELECT id, allowed_values_ids FROM custom_fields WHERE allowed_values_ids IS NOT NULL`)
 	if err == nil {
 		for fieldsForMappingRows.Next() {
 			var fieldID uuid.UUID
@@ -876,7 +966,7 @@ func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCust
 	}
 
 	// Load all custom field definitions
-	rows, err := h.db.Query(
+	rows, err := h.db.QueryContext(ctx,
 		`SELECT id, key, label, allowed_values_ids, created_at, updated_at
 		FROM custom_fields`,
 	)
@@ -920,7 +1010,7 @@ func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCust
 		if valueID, err := uuid.Parse(storedValueStr); err == nil {
 			// It's a UUID, check if it exists in custom_fields_values
 			var valueText string
-			err := h.db.QueryRow(
+			err := h.db.QueryRowContext(ctx,
 				`SELECT value FROM custom_fields_values WHERE id = $1`,
 				valueID,
 			).Scan(&valueText)
@@ -935,7 +1025,7 @@ func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCust
 			// It's a text value, try to find matching value_id
 			// First, try exact match
 			var valueID uuid.UUID
-			err := h.db.QueryRow(
+			err := h.db.QueryRowContext(ctx,
 				`SELECT id FROM custom_fields_values WHERE value = $1 LIMIT 1`,
 				storedValueStr,
 			).Scan(&valueID)
@@ -964,7 +1054,7 @@ func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCust
 
 				if mainValue != "" {
 					// Try to find the main value in custom_fields_values
-					err := h.db.QueryRow(
+					err := h.db.QueryRowContext(ctx,
 						`SELECT id FROM custom_fields_values WHERE value = $1 LIMIT 1`,
 						mainValue,
 					).Scan(&valueID)
@@ -988,7 +1078,7 @@ func (h *Handler) buildCustomFieldsArray(customFieldsJSON JSONB) ([]PositionCust
 			// Load linked fields from custom_fields_values
 			var linkedCustomFieldIDsJSON []byte
 			var linkedCustomFieldValueIDsJSON []byte
-			err := h.db.QueryRow(
+			err := h.db.QueryRowContext(ctx,
 				`SELECT linked_custom_fields_ids, linked_custom_fields_values_ids
 				FROM custom_fields_values WHERE id = $1`,
 				*matchedValueID,
@@ -1090,208 +1180,11 @@ func (h *Handler) UpdatePosition(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extract basic fields
-	var name string
-	var surname *string
-	var employeeName *string
-	var patronymic *string
-	var employeeExternalID *string
-	var employeeProfileURL *string
-
-	if n, ok := requestBody["name"].(string); ok {
-		name = n
-	}
-	// Handle both new format (surname, employee_name, patronymic) and old format (employee_full_name)
-	if s, ok := requestBody["surname"].(string); ok {
-		if s != "" {
-			surname = &s
-		}
-	} else if requestBody["surname"] == nil {
-		surname = nil
-	}
-	if en, ok := requestBody["employee_name"].(string); ok {
-		if en != "" {
-			employeeName = &en
-		}
-	} else if requestBody["employee_name"] == nil {
-		employeeName = nil
-	}
-	if p, ok := requestBody["patronymic"].(string); ok {
-		if p != "" {
-			patronymic = &p
-		}
-	} else if requestBody["patronymic"] == nil {
-		patronymic = nil
-	}
-	
-	// Backward compatibility: if employee_full_name is provided, parse it
-	if efn, ok := requestBody["employee_full_name"].(string); ok && efn != "" {
-		parts := strings.Fields(efn)
-		if len(parts) > 0 {
-			surname = &parts[0]
-		}
-		if len(parts) > 1 {
-			employeeName = &parts[1]
-		}
-		if len(parts) > 2 {
-			pat := strings.Join(parts[2:], " ")
-			patronymic = &pat
-		}
-	}
-	
-	if eid, ok := requestBody["employee_id"].(string); ok {
-		employeeExternalID = &eid
-	} else if requestBody["employee_id"] == nil {
-		employeeExternalID = nil
-	}
-	if epu, ok := requestBody["employee_profile_url"].(string); ok {
-		employeeProfileURL = &epu
-	} else if requestBody["employee_profile_url"] == nil {
-		employeeProfileURL = nil
-	}
-
-	// Process custom_fields
-	// New format: custom_fields is an array with structure:
-	// [
-	//   {
-	//     "custom_field_id": "uuid поля из таблицы custom_fields",
-	//     "custom_field_value_id": "uuid значения из таблицы custom_fields_values",
-	//     "linked_custom_fields": [
-	//       {
-	//         "linked_custom_field_values": [
-	//           {
-	//             "linked_custom_field_value_id": "uuid значения из таблицы custom_fields_values"
-	//           }
-	//         ]
-	//       }
-	//     ]
-	//   }
-	// ]
-	// Note:
-	//   - В positions.custom_fields_ids храним ИМЕННО ID кастомных полей (custom_field_id)
-	//     для верхнеуровневых полей должности.
-	//   - В positions.custom_fields_values_ids храним ID значений (custom_field_value_id)
-	//     как для основного поля, так и для всех привязанных (linked_custom_field_value_id).
-	// Use maps to track unique IDs and avoid duplicates
-	customFieldsIDsMap := make(map[uuid.UUID]bool)
-	customFieldsValuesIDsMap := make(map[uuid.UUID]bool)
-	
-	if customFieldsRaw, ok := requestBody["custom_fields"]; ok {
-		if customFieldsArray, ok := customFieldsRaw.([]interface{}); ok {
-			log.Printf("[UpdatePosition] Processing custom_fields array with %d items", len(customFieldsArray))
-			// Process each custom field
-			for i, cfItem := range customFieldsArray {
-				if cfMap, ok := cfItem.(map[string]interface{}); ok {
-					log.Printf("[UpdatePosition] Processing custom field item %d: %+v", i, cfMap)
-
-					// 1) Сохраняем ID самого кастомного поля (custom_field_id) в custom_fields_ids
-					if customFieldIDRaw, ok := cfMap["custom_field_id"]; ok {
-						if customFieldIDStr, ok := customFieldIDRaw.(string); ok && customFieldIDStr != "" {
-							if fieldID, err := uuid.Parse(customFieldIDStr); err == nil {
-								customFieldsIDsMap[fieldID] = true
-								log.Printf("[UpdatePosition] Added custom_field_id to customFieldsIDs: %s", fieldID.String())
-							} else {
-								log.Printf("[UpdatePosition] Error parsing custom_field_id UUID: %v", err)
-							}
-						} else {
-							log.Printf("[UpdatePosition] custom_field_id is not a valid string or is empty: %v", customFieldIDRaw)
-						}
-					} else {
-						log.Printf("[UpdatePosition] custom_field_id not found in custom field item %d", i)
-					}
-
-					// 2) Сохраняем ID выбранного значения основного поля (custom_field_value_id)
-					//    в custom_fields_values_ids
-					if customFieldValueIDRaw, ok := cfMap["custom_field_value_id"]; ok {
-						log.Printf("[UpdatePosition] Found custom_field_value_id: %v (type: %T)", customFieldValueIDRaw, customFieldValueIDRaw)
-						if customFieldValueIDStr, ok := customFieldValueIDRaw.(string); ok && customFieldValueIDStr != "" {
-							log.Printf("[UpdatePosition] Parsing custom_field_value_id as UUID: %s", customFieldValueIDStr)
-							// Parse custom_field_value_id as UUID and store it in custom_fields_values_ids
-							if valueID, err := uuid.Parse(customFieldValueIDStr); err == nil {
-								log.Printf("[UpdatePosition] Successfully parsed UUID: %s, adding to customFieldsValuesIDs", valueID.String())
-								customFieldsValuesIDsMap[valueID] = true
-							} else {
-								log.Printf("[UpdatePosition] Error parsing UUID: %v", err)
-							}
-						} else {
-							log.Printf("[UpdatePosition] custom_field_value_id is not a valid string or is empty: %v", customFieldValueIDRaw)
-						}
-					} else {
-						log.Printf("[UpdatePosition] custom_field_value_id not found in custom field item %d", i)
-					}
-
-					// 3) Обрабатываем привязанные кастомные поля и их значения
-					if linkedFields, ok := cfMap["linked_custom_fields"].([]interface{}); ok {
-						for _, lfItem := range linkedFields {
-							if lfMap, ok := lfItem.(map[string]interface{}); ok {
-								// 3.1) Сохраняем ID самого привязанного кастомного поля
-								if linkedFieldIDRaw, ok := lfMap["linked_custom_field_id"]; ok {
-									if linkedFieldIDStr, ok := linkedFieldIDRaw.(string); ok && linkedFieldIDStr != "" {
-										if fieldID, err := uuid.Parse(linkedFieldIDStr); err == nil {
-											// ID привязанного кастомного поля храним в custom_fields_ids
-											customFieldsIDsMap[fieldID] = true
-										}
-									}
-								}
-
-								// 3.2) Сохраняем ID выбранных значений привязанных кастомных полей
-								if linkedValues, ok := lfMap["linked_custom_field_values"].([]interface{}); ok {
-									for _, lvItem := range linkedValues {
-										if lvMap, ok := lvItem.(map[string]interface{}); ok {
-											linkedValueID, _ := lvMap["linked_custom_field_value_id"].(string)
-											if linkedValueID != "" {
-												if valueID, err := uuid.Parse(linkedValueID); err == nil {
-													// Store linked value IDs in custom_fields_values_ids
-													customFieldsValuesIDsMap[valueID] = true
-												}
-											}
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Convert maps to slices
-	customFieldsIDs := make([]uuid.UUID, 0, len(customFieldsIDsMap))
-	for id := range customFieldsIDsMap {
-		customFieldsIDs = append(customFieldsIDs, id)
-	}
-	customFieldsValuesIDs := make([]uuid.UUID, 0, len(customFieldsValuesIDsMap))
-	for id := range customFieldsValuesIDsMap {
-		customFieldsValuesIDs = append(customFieldsValuesIDs, id)
-	}
-
-	log.Printf("[UpdatePosition] Final customFieldsIDs count: %d, IDs: %v", len(customFieldsIDs), customFieldsIDs)
-	log.Printf("[UpdatePosition] Final customFieldsValuesIDs count: %d, IDs: %v", len(customFieldsValuesIDs), customFieldsValuesIDs)
-
-	customFieldsIDsArray := UUIDArray(customFieldsIDs)
-	customFieldsIDsJSON, _ := json.Marshal(customFieldsIDsArray)
-	log.Printf("[UpdatePosition] customFieldsIDsJSON: %s", string(customFieldsIDsJSON))
-
-	customFieldsValuesIDsArray := UUIDArray(customFieldsValuesIDs)
-	customFieldsValuesIDsJSON, _ := json.Marshal(customFieldsValuesIDsArray)
-	log.Printf("[UpdatePosition] customFieldsValuesIDsJSON: %s", string(customFieldsValuesIDsJSON))
-
-	result, err := h.db.Exec(
-		`UPDATE positions SET position_name = $1, custom_fields_id = $2, custom_fields_values_id = $3, 
-		employee_id = $4, employee_surname = $5, employee_name = $6, employee_patronymic = $7, employee_profile_url = $8, 
-		updated_at = NOW() WHERE id = $9`,
-		name, customFieldsIDsJSON, customFieldsValuesIDsJSON,
-		employeeExternalID, surname, employeeName, patronymic, employeeProfileURL, id,
-	)
-
-	if err != nil {
-		log.Printf("[UpdatePosition] Error updating position: %v", err)
-	} else {
-		rowsAffected, _ := result.RowsAffected()
-		log.Printf("[UpdatePosition] Successfully updated position %d, rows affected: %d", id, rowsAffected)
+	err = h.updatePosition(r.Context(), id, parsePositionInput(requestBody))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Position not found", http.StatusNotFound)
+		return
 	}
-
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1301,7 +1194,7 @@ func (h *Handler) UpdatePosition(w http.ResponseWriter, r *http.Request) {
 	var p Position
 	var customFieldsIDsFromDB []byte
 	var customFieldsValuesIDsFromDB []byte
-	err = h.db.QueryRow(
+	err = h.db.QueryRowContext(r.Context(),
 		`SELECT id, position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic, 
 		employee_profile_url, created_at, updated_at
 		FROM positions WHERE id = $1`,
@@ -1323,7 +1216,7 @@ func (h *Handler) UpdatePosition(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Build nested custom_fields array
-	customFieldsArray, err := h.buildCustomFieldsArrayFromIDs(p.CustomFieldsIDs, p.CustomFieldsValuesIDs)
+	customFieldsArray, err := h.buildCustomFieldsArrayFromIDs(r.Context(), p.CustomFieldsIDs, p.CustomFieldsValuesIDs)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1359,8 +1252,7 @@ func (h *Handler) DeletePosition(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = h.db.Exec("DELETE FROM positions WHERE id = $1", id)
-	if err != nil {
+	if err := h.deletePosition(r.Context(), id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
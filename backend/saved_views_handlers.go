@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Saved view handlers
+//
+// Views belong to the user from the X-User-ID header. A view is visible to its
+// owner, to users listed in shared_with and, if is_public is set, to everyone.
+// Only the owner can change or delete a view.
+
+const savedViewColumns = `id, name, description, owner_id, shared_with, is_public, search_query, filters, sort, columns, tree_id, created_at, updated_at`
+
+// scanSavedView scans a saved_views row selected with savedViewColumns
+func scanSavedView(row interface{ Scan(...interface{}) error }) (SavedView, error) {
+	var v SavedView
+	var sharedWithJSON, filtersJSON, columnsJSON []byte
+	var treeID uuid.NullUUID
+	err := row.Scan(&v.ID, &v.Name, &v.Description, &v.OwnerID, &sharedWithJSON, &v.IsPublic,
+		&v.Search, &filtersJSON, &v.Sort, &columnsJSON, &treeID, &v.CreatedAt, &v.UpdatedAt)
+	if err != nil {
+		return v, err
+	}
+	if sharedWithJSON != nil {
+		json.Unmarshal(sharedWithJSON, &v.SharedWith)
+	}
+	if filtersJSON != nil {
+		json.Unmarshal(filtersJSON, &v.Filters)
+	}
+	if columnsJSON != nil {
+		json.Unmarshal(columnsJSON, &v.Columns)
+	}
+	if treeID.Valid {
+		v.TreeID = &treeID.UUID
+	}
+	if v.SharedWith == nil {
+		v.SharedWith = []string{}
+	}
+	if v.Columns == nil {
+		v.Columns = []string{}
+	}
+	return v, nil
+}
+
+// canView reports whether the user may read the view
+func (v SavedView) canView(userID string) bool {
+	if v.IsPublic || (userID != "" && v.OwnerID == userID) {
+		return true
+	}
+	for _, u := range v.SharedWith {
+		if userID != "" && u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// loadVisibleSavedView loads a view by ID and checks that the user can see it.
+// Invisible views are reported as sql.ErrNoRows so their existence is not disclosed.
+func (h *Handler) loadVisibleSavedView(ctx context.Context, id uuid.UUID, userID string) (SavedView, error) {
+	v, err := scanSavedView(h.db.QueryRowContext(ctx,
+		`SELECT `+savedViewColumns+` FROM saved_views WHERE id = $1`, id,
+	))
+	if err != nil {
+		return v, err
+	}
+	if !v.canView(userID) {
+		return v, sql.ErrNoRows
+	}
+	return v, nil
+}
+
+// savedViewValidationError marks an invalid view received from the client
+type savedViewValidationError struct {
+	message string
+}
+
+func (e *savedViewValidationError) Error() string {
+	return e.message
+}
+
+// validateSavedView normalizes and validates a view received from the client
+func (h *Handler) validateSavedView(ctx context.Context, v *SavedView) error {
+	v.Name = strings.TrimSpace(v.Name)
+	if v.Name == "" {
+		return &savedViewValidationError{"name is required"}
+	}
+	if _, err := h.parseSearch(ctx, v.Search); err != nil {
+		return err
+	}
+	if err := v.Filters.Validate(); err != nil {
+		return &savedViewValidationError{err.Error()}
+	}
+	sort, err := ParsePositionSort(v.Sort)
+	if err != nil {
+		return &savedViewValidationError{err.Error()}
+	}
+	if err := h.validatePositionSort(ctx, sort); err != nil {
+		var queryErr *positionQueryError
+		if errors.As(err, &queryErr) {
+			return &savedViewValidationError{queryErr.Error()}
+		}
+		return err
+	}
+	v.Sort = sort.String()
+	if v.TreeID != nil {
+		if _, err := h.loadTreeDefinition(ctx, *v.TreeID); err == sql.ErrNoRows {
+			return &savedViewValidationError{"tree not found"}
+		} else if err != nil {
+			return err
+		}
+	}
+	if v.SharedWith == nil {
+		v.SharedWith = []string{}
+	}
+	if v.Columns == nil {
+		v.Columns = []string{}
+	}
+	return nil
+}
+
+// writeSavedViewError reports validation problems as 400 and everything else as 500
+func writeSavedViewError(w http.ResponseWriter, err error) {
+	var validationErr *savedViewValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		return
+	}
+	writeSearchError(w, err)
+}
+
+func (h *Handler) GetSavedViews(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r)
+
+	rows, err := h.db.QueryContext(r.Context(),
+		`SELECT `+savedViewColumns+` FROM saved_views
+		WHERE is_public OR ($1 <> '' AND (owner_id = $1 OR shared_with @> jsonb_build_array($1::text)))
+		ORDER BY name`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	views := []SavedView{}
+	for rows.Next() {
+		v, err := scanSavedView(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		views = append(views, v)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func (h *Handler) GetSavedView(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	v, err := h.loadVisibleSavedView(r.Context(), id, currentUserID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) CreateSavedView(w http.ResponseWriter, r *http.Request) {
+	userID := currentUserID(r)
+	if userID == "" {
+		http.Error(w, userIDHeader+" header is required", http.StatusUnauthorized)
+		return
+	}
+
+	var v SavedView
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.validateSavedView(r.Context(), &v); err != nil {
+		writeSavedViewError(w, err)
+		return
+	}
+
+	v.ID = uuid.New()
+	v.OwnerID = userID
+	sharedWithJSON, _ := json.Marshal(v.SharedWith)
+	filtersJSON, _ := json.Marshal(v.Filters)
+	columnsJSON, _ := json.Marshal(v.Columns)
+
+	err := h.db.QueryRowContext(r.Context(),
+		`INSERT INTO saved_views (id, name, description, owner_id, shared_with, is_public, search_query, filters, sort, columns, tree_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW(), NOW())
+		RETURNING created_at, updated_at`,
+		v.ID, v.Name, v.Description, v.OwnerID, sharedWithJSON, v.IsPublic, v.Search, filtersJSON, v.Sort, columnsJSON, v.TreeID,
+	).Scan(&v.CreatedAt, &v.UpdatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) UpdateSavedView(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := currentUserID(r)
+	existing, err := h.loadVisibleSavedView(r.Context(), id, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing.OwnerID != userID {
+		http.Error(w, "Only the owner can change a view", http.StatusForbidden)
+		return
+	}
+
+	var v SavedView
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.validateSavedView(r.Context(), &v); err != nil {
+		writeSavedViewError(w, err)
+		return
+	}
+
+	v.ID = id
+	v.OwnerID = existing.OwnerID
+	v.CreatedAt = existing.CreatedAt
+	sharedWithJSON, _ := json.Marshal(v.SharedWith)
+	filtersJSON, _ := json.Marshal(v.Filters)
+	columnsJSON, _ := json.Marshal(v.Columns)
+
+	err = h.db.QueryRowContext(r.Context(),
+		`UPDATE saved_views SET name = $1, description = $2, shared_with = $3, is_public = $4, search_query = $5,
+		filters = $6, sort = $7, columns = $8, tree_id = $9, updated_at = NOW()
+		WHERE id = $10
+		RETURNING updated_at`,
+		v.Name, v.Description, sharedWithJSON, v.IsPublic, v.Search, filtersJSON, v.Sort, columnsJSON, v.TreeID, id,
+	).Scan(&v.UpdatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) DeleteSavedView(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := currentUserID(r)
+	existing, err := h.loadVisibleSavedView(r.Context(), id, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing.OwnerID != userID {
+		http.Error(w, "Only the owner can delete a view", http.StatusForbidden)
+		return
+	}
+
+	_, err = h.db.ExecContext(r.Context(), "DELETE FROM saved_views WHERE id = $1", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExecuteSavedViewPositions returns the positions selected by the view
+func (h *Handler) ExecuteSavedViewPositions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	v, err := h.loadVisibleSavedView(r.Context(), id, currentUserID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	limit := 100
+	offset := 0
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		limit = l
+	}
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
+		offset = o
+	}
+
+	searchQuery, err := h.parseSearch(r.Context(), v.Search)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	sort, err := ParsePositionSort(v.Sort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cursor *positionCursor
+	if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+		if cursor, err = decodePositionCursor(cursorStr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.listPositions(r.Context(), positionListQuery{
+		Search:  searchQuery,
+		Filters: v.Filters,
+		Sort:    sort,
+		Cursor:  cursor,
+		Limit:   limit,
+		Offset:  offset,
+	})
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"view":        v,
+		"columns":     v.Columns,
+		"items":       page.Items,
+		"total":       page.Total,
+		"next_cursor": page.NextCursor,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ExecuteSavedViewTree returns the view's tree (or the tree from ?tree_id=)
+// reduced to the positions selected by the view
+func (h *Handler) ExecuteSavedViewTree(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	v, err := h.loadVisibleSavedView(r.Context(), id, currentUserID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	treeID := v.TreeID
+	if treeIDStr := r.URL.Query().Get("tree_id"); treeIDStr != "" {
+		parsed, err := uuid.Parse(treeIDStr)
+		if err != nil {
+			http.Error(w, "Invalid tree_id", http.StatusBadRequest)
+			return
+		}
+		treeID = &parsed
+	}
+	if treeID == nil {
+		http.Error(w, "View has no tree; pass tree_id", http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.loadTreeDefinition(r.Context(), *treeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tree not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	searchQuery, err := h.parseSearch(r.Context(), v.Search)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	matches, err := h.searchPositions(r.Context(), searchQuery, v.Filters)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	keep := make(map[string]bool, len(matches))
+	for _, m := range matches {
+		keep[strconv.FormatInt(m.ID, 10)] = true
+	}
+
+	structure := buildTreeStructure(r.Context(), h.db, t)
+	structure.Root, _ = pruneTree(structure.Root, keep)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(structure)
+}
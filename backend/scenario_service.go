@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Scenario change types
+const (
+	scenarioChangeMovePositions  = "move_positions"
+	scenarioChangeAddValue       = "add_value"
+	scenarioChangeSetSuperior    = "set_superior"
+	scenarioChangeCreatePosition = "create_position"
+)
+
+// Scenario statuses
+const (
+	scenarioStatusDraft   = "draft"
+	scenarioStatusApplied = "applied"
+)
+
+// scenarioMovePositions moves positions to a node of a tree, as POST /api/trees/{id}/move
+type scenarioMovePositions struct {
+	TreeID      uuid.UUID            `json:"tree_id"`
+	PositionIDs []int64              `json:"position_ids"`
+	Path        map[string]uuid.UUID `json:"path"`
+}
+
+// scenarioAddValue adds an allowed value to a custom field. ValueID is
+// assigned when the change is recorded, so later changes can refer to it.
+type scenarioAddValue struct {
+	CustomFieldKey string    `json:"custom_field_key"`
+	Value          string    `json:"value"`
+	ValueID        uuid.UUID `json:"value_id"`
+}
+
+// scenarioSetSuperior sets or clears the superior position of a value
+type scenarioSetSuperior struct {
+	ValueID  uuid.UUID `json:"value_id"`
+	Superior *int64    `json:"superior"`
+}
+
+// scenarioCreatePosition creates a position, optionally placed into a node of a tree
+type scenarioCreatePosition struct {
+	PositionName string               `json:"position_name"`
+	Surname      *string              `json:"surname"`
+	EmployeeName *string              `json:"employee_name"`
+	Patronymic   *string              `json:"patronymic"`
+	TreeID       *uuid.UUID           `json:"tree_id"`
+	Path         map[string]uuid.UUID `json:"path"`
+}
+
+// scenarioChangeError reports a change that cannot be applied to the current data
+type scenarioChangeError struct {
+	changeID int64
+	message  string
+}
+
+func (e *scenarioChangeError) Error() string {
+	if e.changeID == 0 {
+		return e.message
+	}
+	return fmt.Sprintf("change %d: %s", e.changeID, e.message)
+}
+
+// normalizeScenarioChange checks the payload of a new change and fills in
+// generated values
+func normalizeScenarioChange(c *ScenarioChange) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &scenarioChangeError{message: fmt.Sprintf(format, args...)}
+	}
+
+	var payload interface{}
+	switch c.Type {
+	case scenarioChangeMovePositions:
+		var p scenarioMovePositions
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		if p.TreeID == uuid.Nil || len(p.PositionIDs) == 0 {
+			return invalid("tree_id and position_ids are required")
+		}
+		payload = p
+	case scenarioChangeAddValue:
+		var p scenarioAddValue
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		p.Value = strings.TrimSpace(p.Value)
+		if p.CustomFieldKey == "" || p.Value == "" {
+			return invalid("custom_field_key and value are required")
+		}
+		if p.ValueID == uuid.Nil {
+			p.ValueID = uuid.New()
+		}
+		payload = p
+	case scenarioChangeSetSuperior:
+		var p scenarioSetSuperior
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		if p.ValueID == uuid.Nil {
+			return invalid("value_id is required")
+		}
+		payload = p
+	case scenarioChangeCreatePosition:
+		var p scenarioCreatePosition
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		p.PositionName = strings.TrimSpace(p.PositionName)
+		if p.PositionName == "" {
+			return invalid("position_name is required")
+		}
+		if p.TreeID == nil && len(p.Path) > 0 {
+			return invalid("path requires tree_id")
+		}
+		payload = p
+	default:
+		return invalid("unknown change type %q (use %s, %s, %s or %s)", c.Type,
+			scenarioChangeMovePositions, scenarioChangeAddValue, scenarioChangeSetSuperior, scenarioChangeCreatePosition)
+	}
+
+	normalized, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	c.Payload = normalized
+	return nil
+}
+
+// loadScenarioChanges loads the changes of a scenario in the order they were recorded
+func loadScenarioChanges(ctx context.Context, db dbQuerier, scenarioID uuid.UUID) ([]ScenarioChange, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT id, change_type, payload, created_at FROM scenario_changes WHERE scenario_id = $1 ORDER BY id`,
+		scenarioID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []ScenarioChange{}
+	for rows.Next() {
+		var c ScenarioChange
+		var payload []byte
+		if err := rows.Scan(&c.ID, &c.Type, &payload, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.Payload = payload
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// scenarioChangeNeedingApproval returns the first change that edits allowed
+// values or superiors, which go through change requests when approval is enabled
+func scenarioChangeNeedingApproval(changes []ScenarioChange) (ScenarioChange, bool) {
+	for _, c := range changes {
+		if c.Type == scenarioChangeAddValue || c.Type == scenarioChangeSetSuperior {
+			return c, true
+		}
+	}
+	return ScenarioChange{}, false
+}
+
+// applyScenarioChanges applies changes within tx: to live tables when the
+// scenario is applied, to the copies made by withScenario for a preview.
+// Employees and assignments are only recorded when the scenario is applied.
+func (h *Handler) applyScenarioChanges(ctx context.Context, tx *sql.Tx, changes []ScenarioChange, preview bool) error {
+	for _, c := range changes {
+		if err := h.applyScenarioChange(ctx, tx, c, preview); err != nil {
+			var changeErr *scenarioChangeError
+			if errors.As(err, &changeErr) {
+				changeErr.changeID = c.ID
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) applyScenarioChange(ctx context.Context, tx *sql.Tx, c ScenarioChange, preview bool) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &scenarioChangeError{message: fmt.Sprintf(format, args...)}
+	}
+
+	switch c.Type {
+	case scenarioChangeMovePositions:
+		var p scenarioMovePositions
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		t, err := h.loadTreeDefinition(ctx, p.TreeID)
+		if err == sql.ErrNoRows {
+			return invalid("tree %s not found", p.TreeID)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = moveTreePositions(ctx, tx, t, p.Path, p.PositionIDs)
+		var moveErr *treeMoveError
+		if errors.As(err, &moveErr) {
+			return invalid("%s", moveErr.message)
+		}
+		return err
+
+	case scenarioChangeAddValue:
+		var p scenarioAddValue
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		var fieldID uuid.UUID
+		err := tx.QueryRowContext(ctx,
+			`SELECT id FROM custom_fields WHERE key = $1 FOR UPDATE`, p.CustomFieldKey,
+		).Scan(&fieldID)
+		if err == sql.ErrNoRows {
+			return invalid("custom field %q not found", p.CustomFieldKey)
+		}
+		if err != nil {
+			return err
+		}
+		var exists bool
+		if err := tx.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM custom_fields_values WHERE id = $1)`, p.ValueID,
+		).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return invalid("value %s already exists", p.ValueID)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO custom_fields_values (id, value, custom_field_id, linked_custom_fields_ids, linked_custom_fields_values_ids, created_at, updated_at)
+			VALUES ($1, $2, $3, '[]'::jsonb, '[]'::jsonb, NOW(), NOW())`,
+			p.ValueID, p.Value, fieldID,
+		); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			`UPDATE custom_fields
+			SET allowed_values_ids = COALESCE(allowed_values_ids, '[]'::jsonb) || jsonb_build_array($1::text),
+			    updated_at = NOW()
+			WHERE id = $2`,
+			p.ValueID.String(), fieldID,
+		)
+		return err
+
+	case scenarioChangeSetSuperior:
+		var p scenarioSetSuperior
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		if p.Superior != nil {
+			var exists bool
+			if err := tx.QueryRowContext(ctx,
+				`SELECT EXISTS (SELECT 1 FROM positions WHERE id = $1)`, *p.Superior,
+			).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return invalid("superior position %d not found", *p.Superior)
+			}
+		}
+		result, err := tx.ExecContext(ctx,
+			`UPDATE custom_fields_values SET superior = $1, updated_at = NOW() WHERE id = $2`,
+			p.Superior, p.ValueID,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return invalid("value %s not found", p.ValueID)
+		}
+		return nil
+
+	case scenarioChangeCreatePosition:
+		var p scenarioCreatePosition
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return invalid("invalid payload: %v", err)
+		}
+		fieldIDs, valueIDs := UUIDArray{}, UUIDArray{}
+		if p.TreeID != nil {
+			t, err := h.loadTreeDefinition(ctx, *p.TreeID)
+			if err == sql.ErrNoRows {
+				return invalid("tree %s not found", *p.TreeID)
+			}
+			if err != nil {
+				return err
+			}
+			move, err := planTreeMove(ctx, tx, t, p.Path)
+			var moveErr *treeMoveError
+			if errors.As(err, &moveErr) {
+				return invalid("%s", moveErr.message)
+			}
+			if err != nil {
+				return err
+			}
+			fieldIDs, valueIDs = move.rewrite(nil, nil)
+		}
+		var positionID int64
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO positions (position_name, custom_fields_id, custom_fields_values_id, employee_surname, employee_name, employee_patronymic, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+			RETURNING id`,
+			p.PositionName, fieldIDs, valueIDs, p.Surname, p.EmployeeName, p.Patronymic,
+		).Scan(&positionID)
+		if err != nil {
+			return err
+		}
+		if preview {
+			// The tree only shows the employee columns of the position
+			return nil
+		}
+		employee := positionEmployeeFields{Surname: p.Surname, EmployeeName: p.EmployeeName, Patronymic: p.Patronymic}
+		return syncPositionEmployee(ctx, tx, positionID, employee)
+	}
+
+	return invalid("unknown change type %q", c.Type)
+}
+
+// scenarioPreviewTables are the tables a preview writes to
+var scenarioPreviewTables = []string{"positions", "custom_fields", "custom_fields_values", "tree_position_order"}
+
+// withScenario runs fn on a transaction in which the scenario changes are
+// applied; the transaction is always rolled back. The changes are applied to
+// temporary copies of scenarioPreviewTables, which shadow the live tables in
+// unqualified queries, so a preview neither locks nor waits for live rows.
+func (h *Handler) withScenario(ctx context.Context, changes []ScenarioChange, fn func(tx *sql.Tx) error) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var schema string
+	if err := tx.QueryRowContext(ctx, `SELECT current_schema()`).Scan(&schema); err != nil {
+		return err
+	}
+	for _, table := range scenarioPreviewTables {
+		live := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+		// Generated columns become plain ones, defaults keep using the live sequences
+		if _, err := tx.ExecContext(ctx,
+			`CREATE TEMP TABLE `+pq.QuoteIdentifier(table)+` (LIKE `+live+` INCLUDING DEFAULTS) ON COMMIT DROP`,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO pg_temp.`+pq.QuoteIdentifier(table)+` SELECT * FROM `+live,
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := h.applyScenarioChanges(ctx, tx, changes, true); err != nil {
+		return err
+	}
+	return fn(tx)
+}
+
+// diffScenario compares tree t built from live data with the same tree with
+// the scenario changes applied
+func (h *Handler) diffScenario(ctx context.Context, t TreeDefinition, changes []ScenarioChange) (ScenarioDiff, error) {
+	diff := ScenarioDiff{
+		TreeID:    t.ID.String(),
+		Positions: []ScenarioPositionDiff{},
+		Values:    []ScenarioValueDiff{},
+		Superiors: []ScenarioSuperiorDiff{},
+	}
+
+	live := buildTreeStructure(ctx, h.db, t)
+	liveDefs := loadCustomFieldDefinitions(ctx, h.db)
+	liveSuperiors := loadSuperiorMap(ctx, h.db)
+
+	var scenario TreeStructure
+	var scenarioDefs map[string]CustomFieldDefinition
+	var scenarioSuperiors map[uuid.UUID]*int64
+	err := h.withScenario(ctx, changes, func(tx *sql.Tx) error {
+		scenario = buildTreeStructure(ctx, tx, t)
+		scenarioDefs = loadCustomFieldDefinitions(ctx, tx)
+		scenarioSuperiors = loadSuperiorMap(ctx, tx)
+		return nil
+	})
+	if err != nil {
+		return diff, err
+	}
+
+	// Positions: compare the paths from the root in both trees
+	livePaths, scenarioPaths := findTreePaths(live.Root), findTreePaths(scenario.Root)
+	liveNodes, scenarioNodes := make(map[string]TreeNode), make(map[string]TreeNode)
+	collectPositionNodes(live.Root, liveNodes)
+	collectPositionNodes(scenario.Root, scenarioNodes)
+
+	positionName := func(n TreeNode) string {
+		if n.PositionName != nil {
+			return *n.PositionName
+		}
+		return ""
+	}
+	for id, node := range liveNodes {
+		if _, ok := scenarioNodes[id]; !ok {
+			diff.Positions = append(diff.Positions, ScenarioPositionDiff{
+				PositionID: id, PositionName: positionName(node), Change: "removed", From: livePaths[id],
+			})
+		} else if treePathKey(livePaths[id]) != treePathKey(scenarioPaths[id]) {
+			diff.Positions = append(diff.Positions, ScenarioPositionDiff{
+				PositionID: id, PositionName: positionName(node), Change: "moved",
+				From: livePaths[id], To: scenarioPaths[id],
+			})
+		}
+	}
+	var added []ScenarioPositionDiff
+	for id, node := range scenarioNodes {
+		if _, ok := liveNodes[id]; !ok {
+			added = append(added, ScenarioPositionDiff{
+				PositionID: id, PositionName: positionName(node), Change: "added", To: scenarioPaths[id],
+			})
+		}
+	}
+	sortPositionDiffs(diff.Positions)
+	sortPositionDiffs(added)
+	for i := range added {
+		// IDs of created positions only exist inside the rolled back transaction
+		added[i].PositionID = ""
+	}
+	diff.Positions = append(diff.Positions, added...)
+
+	// Values added to custom fields
+	liveValues := make(map[uuid.UUID]bool)
+	for _, def := range liveDefs {
+		if def.AllowedValues != nil {
+			for _, v := range *def.AllowedValues {
+				liveValues[v.ValueID] = true
+			}
+		}
+	}
+	valueTexts := make(map[uuid.UUID]string)
+	for key, def := range scenarioDefs {
+		if def.AllowedValues == nil {
+			continue
+		}
+		for _, v := range *def.AllowedValues {
+			valueTexts[v.ValueID] = v.Value
+			if !liveValues[v.ValueID] {
+				diff.Values = append(diff.Values, ScenarioValueDiff{CustomFieldKey: key, ValueID: v.ValueID, Value: v.Value})
+			}
+		}
+	}
+	sort.Slice(diff.Values, func(i, j int) bool {
+		if diff.Values[i].CustomFieldKey != diff.Values[j].CustomFieldKey {
+			return diff.Values[i].CustomFieldKey < diff.Values[j].CustomFieldKey
+		}
+		return diff.Values[i].Value < diff.Values[j].Value
+	})
+
+	// Superiors of values
+	valueIDs := make(map[uuid.UUID]bool)
+	for id := range liveSuperiors {
+		valueIDs[id] = true
+	}
+	for id := range scenarioSuperiors {
+		valueIDs[id] = true
+	}
+	for id := range valueIDs {
+		from, to := liveSuperiors[id], scenarioSuperiors[id]
+		if (from == nil) != (to == nil) || (from != nil && *from != *to) {
+			diff.Superiors = append(diff.Superiors, ScenarioSuperiorDiff{ValueID: id, Value: valueTexts[id], From: from, To: to})
+		}
+	}
+	sort.Slice(diff.Superiors, func(i, j int) bool {
+		return diff.Superiors[i].Value < diff.Superiors[j].Value
+	})
+
+	return diff, nil
+}
+
+// treePathKey identifies a path by the node keys of its folders
+func treePathKey(path []TreePathNode) string {
+	segments := make([]string, len(path))
+	for i, p := range path {
+		segments[i] = treeNodeKeySegment(p)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sortPositionDiffs orders position diffs by numeric position ID
+func sortPositionDiffs(diffs []ScenarioPositionDiff) {
+	sort.Slice(diffs, func(i, j int) bool {
+		a, _ := strconv.ParseInt(diffs[i].PositionID, 10, 64)
+		b, _ := strconv.ParseInt(diffs[j].PositionID, 10, 64)
+		return a < b
+	})
+}
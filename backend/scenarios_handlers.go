@@ -0,0 +1,364 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Scenario handlers
+
+func (h *Handler) GetScenarios(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.QueryContext(r.Context(),
+		`SELECT id, name, description, owner_id, status, created_at, updated_at, applied_at
+		FROM scenarios ORDER BY created_at DESC`,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	scenarios := []Scenario{}
+	for rows.Next() {
+		var s Scenario
+		if err := rows.Scan(&s.ID, &s.Name, &s.Description, &s.OwnerID, &s.Status,
+			&s.CreatedAt, &s.UpdatedAt, &s.AppliedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		scenarios = append(scenarios, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scenarios)
+}
+
+func (h *Handler) GetScenario(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.loadScenarioFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func (h *Handler) CreateScenario(w http.ResponseWriter, r *http.Request) {
+	var s Scenario
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	s.ID = uuid.New()
+	s.OwnerID = currentUserID(r)
+	s.Status = scenarioStatusDraft
+	s.Changes = nil
+	s.AppliedAt = nil
+
+	err := h.db.QueryRowContext(r.Context(),
+		`INSERT INTO scenarios (id, name, description, owner_id, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+		RETURNING created_at, updated_at`,
+		s.ID, s.Name, s.Description, s.OwnerID, s.Status,
+	).Scan(&s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func (h *Handler) DeleteScenario(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.ExecContext(r.Context(), "DELETE FROM scenarios WHERE id = $1", id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddScenarioChange records a change in a draft scenario. The change is
+// checked by applying the whole scenario with it in a rolled back
+// transaction, so a scenario always stays applicable when it is recorded.
+func (h *Handler) AddScenarioChange(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.loadScenarioFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if s.Status != scenarioStatusDraft {
+		http.Error(w, "Scenario is already applied", http.StatusConflict)
+		return
+	}
+
+	var c ScenarioChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := normalizeScenarioChange(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := h.withScenario(r.Context(), append(s.Changes, c), func(tx *sql.Tx) error { return nil })
+	if writeScenarioChangeError(w, err) {
+		return
+	}
+
+	err = h.db.QueryRowContext(r.Context(),
+		`INSERT INTO scenario_changes (scenario_id, change_type, payload, created_at)
+		VALUES ($1, $2, $3, NOW())
+		RETURNING id, created_at`,
+		s.ID, c.Type, []byte(c.Payload),
+	).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.db.ExecContext(r.Context(), "UPDATE scenarios SET updated_at = NOW() WHERE id = $1", s.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func (h *Handler) DeleteScenarioChange(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.loadScenarioFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if s.Status != scenarioStatusDraft {
+		http.Error(w, "Scenario is already applied", http.StatusConflict)
+		return
+	}
+	changeID, err := strconv.ParseInt(mux.Vars(r)["changeId"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid change ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.ExecContext(r.Context(),
+		"DELETE FROM scenario_changes WHERE id = $1 AND scenario_id = $2", changeID, s.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Change not found", http.StatusNotFound)
+		return
+	}
+	h.db.ExecContext(r.Context(), "UPDATE scenarios SET updated_at = NOW() WHERE id = $1", s.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetScenarioTree builds the structure of tree tree_id as it would look with
+// the scenario applied
+func (h *Handler) GetScenarioTree(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.loadScenarioFromRequest(w, r)
+	if !ok {
+		return
+	}
+	t, ok := h.loadScenarioTree(w, r)
+	if !ok {
+		return
+	}
+
+	var structure TreeStructure
+	err := h.withScenario(r.Context(), s.Changes, func(tx *sql.Tx) error {
+		structure = buildTreeStructure(r.Context(), tx, t)
+		return nil
+	})
+	if writeScenarioChangeError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(structure)
+}
+
+// GetScenarioDiff lists what the scenario changes in tree tree_id compared
+// with live data
+func (h *Handler) GetScenarioDiff(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.loadScenarioFromRequest(w, r)
+	if !ok {
+		return
+	}
+	t, ok := h.loadScenarioTree(w, r)
+	if !ok {
+		return
+	}
+
+	diff, err := h.diffScenario(r.Context(), t, s.Changes)
+	if writeScenarioChangeError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// ApplyScenario applies all changes of a draft scenario to live data in one
+// transaction; if any change no longer applies nothing is changed
+func (h *Handler) ApplyScenario(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(r.Context(),
+		`SELECT status FROM scenarios WHERE id = $1 FOR UPDATE`, id,
+	).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != scenarioStatusDraft {
+		http.Error(w, "Scenario is already applied", http.StatusConflict)
+		return
+	}
+
+	changes, err := loadScenarioChanges(r.Context(), tx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if h.approval.enabled {
+		if c, ok := scenarioChangeNeedingApproval(changes); ok {
+			http.Error(w, fmt.Sprintf("Change %d (%s) requires approval; submit it as a change request", c.ID, c.Type), http.StatusConflict)
+			return
+		}
+	}
+	if writeScenarioChangeError(w, h.applyScenarioChanges(r.Context(), tx, changes, false)) {
+		return
+	}
+
+	if _, err := tx.ExecContext(r.Context(),
+		`UPDATE scenarios SET status = $1, applied_at = NOW(), updated_at = NOW() WHERE id = $2`,
+		scenarioStatusApplied, id,
+	); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s, ok := h.loadScenarioFromRequest(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// loadScenarioFromRequest loads the scenario {id} with its changes and writes
+// an error response if that fails
+func (h *Handler) loadScenarioFromRequest(w http.ResponseWriter, r *http.Request) (Scenario, bool) {
+	var s Scenario
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return s, false
+	}
+
+	err = h.db.QueryRowContext(r.Context(),
+		`SELECT id, name, description, owner_id, status, created_at, updated_at, applied_at
+		FROM scenarios WHERE id = $1`,
+		id,
+	).Scan(&s.ID, &s.Name, &s.Description, &s.OwnerID, &s.Status,
+		&s.CreatedAt, &s.UpdatedAt, &s.AppliedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Scenario not found", http.StatusNotFound)
+		return s, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return s, false
+	}
+
+	s.Changes, err = loadScenarioChanges(r.Context(), h.db, s.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return s, false
+	}
+	return s, true
+}
+
+// loadScenarioTree loads the tree given by the tree_id query parameter
+func (h *Handler) loadScenarioTree(w http.ResponseWriter, r *http.Request) (TreeDefinition, bool) {
+	treeID, err := uuid.Parse(r.URL.Query().Get("tree_id"))
+	if err != nil {
+		http.Error(w, "tree_id is required", http.StatusBadRequest)
+		return TreeDefinition{}, false
+	}
+	t, err := h.loadTreeDefinition(r.Context(), treeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tree not found", http.StatusNotFound)
+		return t, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return t, false
+	}
+	return t, true
+}
+
+// writeScenarioChangeError reports changes that no longer apply as 422 and
+// other errors as 500. Returns false if err is nil.
+func writeScenarioChangeError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+	var changeErr *scenarioChangeError
+	if errors.As(err, &changeErr) {
+		http.Error(w, changeErr.Error(), http.StatusUnprocessableEntity)
+		return true
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+	return true
+}
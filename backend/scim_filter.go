@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SCIM filter language (RFC 7644, section 3.4.2.2)
+//
+//	filter    := or
+//	or        := and ( "or" and )*
+//	and       := not ( "and" not )*
+//	not       := "not" "(" filter ")" | primary
+//	primary   := "(" filter ")" | attrPath "[" filter "]" | attrPath "pr" | attrPath compareOp compValue
+//	compareOp := eq | ne | co | sw | ew | gt | ge | lt | le
+//	compValue := "string" | number | true | false | null
+//
+// Filters are evaluated against resources rendered as JSON. Attribute names
+// and string comparisons are case insensitive; a multi-valued attribute
+// matches when any of its values does.
+
+const (
+	// maxSCIMFilterLength is the longest accepted filter, in bytes
+	maxSCIMFilterLength = 1000
+	// maxSCIMFilterNesting limits nested parentheses, value paths and nots
+	// so that a crafted filter cannot exhaust the parser's stack
+	maxSCIMFilterNesting = 64
+)
+
+// scimFilterError describes an invalid filter
+type scimFilterError struct {
+	Position int // 1-based character position in the filter
+	Message  string
+}
+
+func (e *scimFilterError) Error() string {
+	return fmt.Sprintf("invalid filter at position %d: %s", e.Position, e.Message)
+}
+
+// scimFilter matches a resource
+type scimFilter interface {
+	match(resource map[string]interface{}) bool
+}
+
+type scimAndFilter struct{ left, right scimFilter }
+
+func (f scimAndFilter) match(r map[string]interface{}) bool {
+	return f.left.match(r) && f.right.match(r)
+}
+
+type scimOrFilter struct{ left, right scimFilter }
+
+func (f scimOrFilter) match(r map[string]interface{}) bool {
+	return f.left.match(r) || f.right.match(r)
+}
+
+type scimNotFilter struct{ filter scimFilter }
+
+func (f scimNotFilter) match(r map[string]interface{}) bool { return !f.filter.match(r) }
+
+// scimCompareFilter compares the values of an attribute with a literal
+type scimCompareFilter struct {
+	path  string
+	op    string      // compareOp or "pr"
+	value interface{} // string, float64, bool or nil
+}
+
+func (f scimCompareFilter) match(r map[string]interface{}) bool {
+	values := scimAttributeValues(r, f.path)
+	if f.op == "pr" {
+		return len(values) > 0
+	}
+	if f.value == nil {
+		// "eq null" is true for absent attributes, "ne null" for present ones
+		return (len(values) == 0) == (f.op == "eq")
+	}
+	if f.op == "ne" {
+		for _, v := range values {
+			if scimCompare(v, "eq", f.value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if scimCompare(v, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimValuePathFilter matches elements of a multi-valued attribute, e.g.
+// groups[value eq "..."]
+type scimValuePathFilter struct {
+	path   string
+	filter scimFilter
+}
+
+func (f scimValuePathFilter) match(r map[string]interface{}) bool {
+	for _, v := range scimAttributeValues(r, f.path) {
+		if obj, ok := v.(map[string]interface{}); ok && f.filter.match(obj) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimCompare applies a comparison operator to an attribute value
+func scimCompare(value interface{}, op string, literal interface{}) bool {
+	switch l := literal.(type) {
+	case bool:
+		v, ok := value.(bool)
+		return ok && op == "eq" && v == l
+	case float64:
+		v, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return v == l
+		case "gt":
+			return v > l
+		case "ge":
+			return v >= l
+		case "lt":
+			return v < l
+		case "le":
+			return v <= l
+		}
+		return false
+	case string:
+		v, ok := value.(string)
+		if !ok {
+			return false
+		}
+		// Timestamps are compared as times, everything else as text
+		if vt, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			if lt, err := time.Parse(time.RFC3339Nano, l); err == nil {
+				switch op {
+				case "eq":
+					return vt.Equal(lt)
+				case "gt":
+					return vt.After(lt)
+				case "ge":
+					return !vt.Before(lt)
+				case "lt":
+					return vt.Before(lt)
+				case "le":
+					return !vt.After(lt)
+				}
+			}
+		}
+		v, l = strings.ToLower(v), strings.ToLower(l)
+		switch op {
+		case "eq":
+			return v == l
+		case "co":
+			return strings.Contains(v, l)
+		case "sw":
+			return strings.HasPrefix(v, l)
+		case "ew":
+			return strings.HasSuffix(v, l)
+		case "gt":
+			return v > l
+		case "ge":
+			return v >= l
+		case "lt":
+			return v < l
+		case "le":
+			return v <= l
+		}
+	}
+	return false
+}
+
+// scimAttributeValues returns the values at an attribute path such as
+// "name.familyName", "groups.value" or an extension attribute prefixed with
+// its schema URN. Arrays are flattened.
+func scimAttributeValues(r map[string]interface{}, path string) []interface{} {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		i := strings.LastIndex(path, ":")
+		schema, attr := path[:i], path[i+1:]
+		if ext, ok := scimLookup(r, schema); ok {
+			if obj, ok := ext.(map[string]interface{}); ok {
+				r = obj
+			} else {
+				return nil
+			}
+		}
+		path = attr
+	}
+
+	values := []interface{}{r}
+	for _, name := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, v := range values {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			child, ok := scimLookup(obj, name)
+			if !ok || child == nil {
+				continue
+			}
+			if items, ok := child.([]interface{}); ok {
+				next = append(next, items...)
+			} else {
+				next = append(next, child)
+			}
+		}
+		values = next
+	}
+	// Empty strings count as absent
+	present := values[:0]
+	for _, v := range values {
+		if s, ok := v.(string); ok && s == "" {
+			continue
+		}
+		present = append(present, v)
+	}
+	return present
+}
+
+// scimLookup finds an attribute of an object ignoring case
+func scimLookup(obj map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type scimFilterToken struct {
+	pos    int    // 0-based byte offset
+	text   string // word or punctuation
+	value  interface{}
+	quoted bool
+}
+
+// tokenizeSCIMFilter splits a filter into words, quoted strings and brackets
+func tokenizeSCIMFilter(filter string) ([]scimFilterToken, error) {
+	var tokens []scimFilterToken
+	i := 0
+	for i < len(filter) {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, scimFilterToken{pos: i, text: string(c)})
+			i++
+		case c == '"':
+			start := i
+			i++
+			for i < len(filter) && filter[i] != '"' {
+				if filter[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(filter) {
+				return nil, &scimFilterError{Position: start + 1, Message: "unterminated string"}
+			}
+			i++
+			var s string
+			if err := json.Unmarshal([]byte(filter[start:i]), &s); err != nil {
+				return nil, &scimFilterError{Position: start + 1, Message: "invalid string"}
+			}
+			tokens = append(tokens, scimFilterToken{pos: start, text: filter[start:i], value: s, quoted: true})
+		default:
+			start := i
+			for i < len(filter) && !strings.ContainsRune(" \t()[]\"", rune(filter[i])) {
+				i++
+			}
+			tokens = append(tokens, scimFilterToken{pos: start, text: filter[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []scimFilterToken
+	pos    int
+	end    int // length of the filter, for errors at the end
+	depth  int // nesting of parentheses, value paths and nots being parsed
+}
+
+// parseSCIMFilter parses a filter expression
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	if len(filter) > maxSCIMFilterLength {
+		return nil, &scimFilterError{
+			Position: maxSCIMFilterLength + 1,
+			Message:  fmt.Sprintf("filter is longer than %d characters", maxSCIMFilterLength),
+		}
+	}
+	tokens, err := tokenizeSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens, end: len(filter)}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, p.errorAt(t, "unexpected %q", t.text)
+	}
+	return f, nil
+}
+
+func (p *scimFilterParser) peek() (scimFilterToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return scimFilterToken{pos: p.end}, false
+}
+
+// keyword reports whether the next token is the given unquoted word and consumes it
+func (p *scimFilterParser) keyword(word string) bool {
+	if t, ok := p.peek(); ok && !t.quoted && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scimFilterParser) errorAt(t scimFilterToken, format string, args ...interface{}) error {
+	return &scimFilterError{Position: t.pos + 1, Message: fmt.Sprintf(format, args...)}
+}
+
+// enter descends into a parenthesis, value path or not at t; leave must be deferred
+func (p *scimFilterParser) enter(t scimFilterToken) error {
+	if p.depth >= maxSCIMFilterNesting {
+		return p.errorAt(t, "filter is nested more than %d levels deep", maxSCIMFilterNesting)
+	}
+	p.depth++
+	return nil
+}
+
+func (p *scimFilterParser) leave() {
+	p.depth--
+}
+
+func (p *scimFilterParser) expect(text string) error {
+	if !p.keyword(text) {
+		t, _ := p.peek()
+		return p.errorAt(t, "expected %q", text)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = scimOrFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = scimAndFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseNot() (scimFilter, error) {
+	if t, _ := p.peek(); p.keyword("not") {
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return scimNotFilter{f}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *scimFilterParser) parsePrimary() (scimFilter, error) {
+	if t, _ := p.peek(); p.keyword("(") {
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	t, ok := p.peek()
+	if !ok {
+		return nil, p.errorAt(t, "expected an attribute")
+	}
+	if t.quoted || !scimAttributePath(t.text) {
+		return nil, p.errorAt(t, "expected an attribute, got %q", t.text)
+	}
+	p.pos++
+	path := t.text
+
+	if t, _ := p.peek(); p.keyword("[") {
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return scimValuePathFilter{path: path, filter: f}, nil
+	}
+
+	t, ok = p.peek()
+	if !ok || t.quoted {
+		return nil, p.errorAt(t, "expected an operator after %q", path)
+	}
+	op := strings.ToLower(t.text)
+	p.pos++
+	switch op {
+	case "pr":
+		return scimCompareFilter{path: path, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, p.errorAt(t, "unknown operator %q", t.text)
+	}
+
+	t, ok = p.peek()
+	if !ok {
+		return nil, p.errorAt(t, "expected a value after %q", op)
+	}
+	p.pos++
+	f := scimCompareFilter{path: path, op: op}
+	switch {
+	case t.quoted:
+		f.value = t.value
+	case strings.EqualFold(t.text, "true"), strings.EqualFold(t.text, "false"):
+		f.value = strings.EqualFold(t.text, "true")
+	case strings.EqualFold(t.text, "null"):
+		if op != "eq" && op != "ne" {
+			return nil, p.errorAt(t, "null can only be compared with eq or ne")
+		}
+	default:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorAt(t, "invalid value %q", t.text)
+		}
+		f.value = n
+	}
+	if b, ok := f.value.(bool); ok && op != "eq" && op != "ne" {
+		return nil, p.errorAt(t, "%t can only be compared with eq or ne", b)
+	}
+	return f, nil
+}
+
+// scimAttributePath reports whether s looks like an attribute path
+func scimAttributePath(s string) bool {
+	if s == "" || !unicode.IsLetter(rune(s[0])) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("._-:$", r) {
+			return false
+		}
+	}
+	return true
+}
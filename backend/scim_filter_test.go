@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// scimTestUser is a User resource as filters see it after scimAttributes
+const scimTestUser = `{
+	"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+	"id": "42",
+	"userName": "Ivanov@Example.com",
+	"name": {"familyName": "Иванов", "givenName": "Иван"},
+	"title": "",
+	"active": true,
+	"emails": [
+		{"value": "ivanov@example.com", "primary": true},
+		{"value": "ivan@home.example"}
+	],
+	"groups": [
+		{"value": "g1", "display": "Sales"},
+		{"value": "g2", "display": "Support"}
+	],
+	"meta": {"resourceType": "User", "lastModified": "2024-05-01T10:00:00Z"},
+	"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {
+		"department": "Sales",
+		"manager": {"value": "7"}
+	}
+}`
+
+func scimTestResource(t *testing.T) map[string]interface{} {
+	t.Helper()
+	var resource map[string]interface{}
+	if err := json.Unmarshal([]byte(scimTestUser), &resource); err != nil {
+		t.Fatal(err)
+	}
+	return resource
+}
+
+func TestSCIMFilterMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		match  bool
+	}{
+		{name: "eq", filter: `userName eq "Ivanov@Example.com"`, match: true},
+		{name: "eq is case insensitive", filter: `USERNAME EQ "ivanov@example.com"`, match: true},
+		{name: "eq mismatch", filter: `userName eq "petrov@example.com"`, match: false},
+		{name: "eq does not match a substring", filter: `userName eq "ivanov"`, match: false},
+		{name: "eq on a sub-attribute", filter: `name.familyName eq "Иванов"`, match: true},
+		{name: "eq on any value of a multi-valued attribute", filter: `emails.value eq "ivan@home.example"`, match: true},
+		{name: "eq boolean", filter: `active eq true`, match: true},
+		{name: "eq boolean mismatch", filter: `active eq false`, match: false},
+		{name: "eq null for an absent attribute", filter: `nickName eq null`, match: true},
+		{name: "eq null for an empty attribute", filter: `title eq null`, match: true},
+		{name: "ne", filter: `userName ne "petrov@example.com"`, match: true},
+		{name: "ne with a matching value of a multi-valued attribute", filter: `emails.value ne "ivan@home.example"`, match: false},
+		{name: "co", filter: `userName co "example"`, match: true},
+		{name: "co is case insensitive", filter: `userName co "IVANOV@"`, match: true},
+		{name: "co mismatch", filter: `userName co "petrov"`, match: false},
+		{name: "co on a multi-valued attribute", filter: `emails.value co "home"`, match: true},
+		{name: "sw", filter: `userName sw "ivanov"`, match: true},
+		{name: "sw does not match the middle", filter: `userName sw "example"`, match: false},
+		{name: "sw on a sub-attribute", filter: `name.givenName sw "Ив"`, match: true},
+		{name: "ew", filter: `userName ew ".com"`, match: true},
+		{name: "pr", filter: `emails pr`, match: true},
+		{name: "pr of an empty attribute", filter: `title pr`, match: false},
+		{name: "gt compares timestamps as times", filter: `meta.lastModified gt "2024-05-01T09:00:00+00:00"`, match: true},
+		{name: "le compares timestamps as times", filter: `meta.lastModified le "2024-05-01T12:59:59+03:00"`, match: false},
+		{name: "and", filter: `userName sw "ivanov" and active eq true`, match: true},
+		{name: "and with a false operand", filter: `userName sw "ivanov" and active eq false`, match: false},
+		{name: "or", filter: `userName eq "petrov" or name.familyName eq "Иванов"`, match: true},
+		{name: "or with false operands", filter: `userName eq "petrov" or active eq false`, match: false},
+		{name: "operators are case insensitive", filter: `userName sw "ivanov" AND active EQ true`, match: true},
+		{name: "and binds tighter than or", filter: `active eq true or userName eq "petrov" and active eq false`, match: true},
+		{name: "parentheses override precedence", filter: `(active eq true or userName eq "petrov") and active eq false`, match: false},
+		{name: "not", filter: `not (userName co "petrov")`, match: true},
+		{name: "not of or", filter: `not (userName co "petrov" or active eq true)`, match: false},
+		{name: "value path", filter: `groups[display eq "Sales"]`, match: true},
+		{name: "value path with and", filter: `groups[value eq "g1" and display eq "Support"]`, match: false},
+		{name: "extension attribute", filter: `urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department eq "sales"`, match: true},
+		{name: "extension sub-attribute", filter: `urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager.value eq "7"`, match: true},
+	}
+
+	resource := scimTestResource(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := parseSCIMFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("parseSCIMFilter(%q): %v", tt.filter, err)
+			}
+			if got := filter.match(resource); got != tt.match {
+				t.Errorf("parseSCIMFilter(%q).match() = %t, want %t", tt.filter, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestSCIMFilterErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   string
+		position int
+		message  string
+	}{
+		{
+			name:     "missing value",
+			filter:   `userName eq`,
+			position: 12,
+			message:  `expected a value after "eq"`,
+		},
+		{
+			name:     "missing operator",
+			filter:   `userName`,
+			position: 9,
+			message:  `expected an operator after "userName"`,
+		},
+		{
+			name:     "unknown operator",
+			filter:   `userName like "ivanov"`,
+			position: 10,
+			message:  `unknown operator "like"`,
+		},
+		{
+			name:     "value instead of an attribute",
+			filter:   `"ivanov" eq userName`,
+			position: 1,
+			message:  `expected an attribute, got "\"ivanov\""`,
+		},
+		{
+			name:     "unquoted string value",
+			filter:   `userName eq ivanov`,
+			position: 13,
+			message:  `invalid value "ivanov"`,
+		},
+		{
+			name:     "unterminated string",
+			filter:   `userName eq "ivanov`,
+			position: 13,
+			message:  "unterminated string",
+		},
+		{
+			name:     "null with co",
+			filter:   `userName co null`,
+			position: 13,
+			message:  "null can only be compared with eq or ne",
+		},
+		{
+			name:     "boolean with gt",
+			filter:   `active gt true`,
+			position: 11,
+			message:  "true can only be compared with eq or ne",
+		},
+		{
+			name:     "and without a right operand",
+			filter:   `active eq true and`,
+			position: 19,
+			message:  "expected an attribute",
+		},
+		{
+			name:     "or without a left operand",
+			filter:   `or active eq true`,
+			position: 4,
+			message:  `unknown operator "active"`,
+		},
+		{
+			name:     "unclosed parenthesis",
+			filter:   `(active eq true or userName sw "i"`,
+			position: 35,
+			message:  `expected ")"`,
+		},
+		{
+			name:     "unclosed value path",
+			filter:   `groups[display eq "Sales"`,
+			position: 26,
+			message:  `expected "]"`,
+		},
+		{
+			name:     "not without parentheses",
+			filter:   `not active eq true`,
+			position: 5,
+			message:  `expected "("`,
+		},
+		{
+			name:     "parentheses nested too deep",
+			filter:   strings.Repeat("(", maxSCIMFilterNesting+1) + `active pr` + strings.Repeat(")", maxSCIMFilterNesting+1),
+			position: maxSCIMFilterNesting + 1,
+			message:  "filter is nested more than 64 levels deep",
+		},
+		{
+			name:     "nots nested too deep",
+			filter:   strings.Repeat("not (", maxSCIMFilterNesting+1) + `active pr` + strings.Repeat(")", maxSCIMFilterNesting+1),
+			position: 5*maxSCIMFilterNesting + 1,
+			message:  "filter is nested more than 64 levels deep",
+		},
+		{
+			name:     "value paths nested too deep",
+			filter:   strings.Repeat("groups[", maxSCIMFilterNesting+1) + `value pr` + strings.Repeat("]", maxSCIMFilterNesting+1),
+			position: 7*maxSCIMFilterNesting + 7,
+			message:  "filter is nested more than 64 levels deep",
+		},
+		{
+			name:     "filter too long",
+			filter:   `userName eq "` + strings.Repeat("a", maxSCIMFilterLength) + `"`,
+			position: maxSCIMFilterLength + 1,
+			message:  "filter is longer than 1000 characters",
+		},
+		{
+			name:     "trailing token",
+			filter:   `active eq true false`,
+			position: 16,
+			message:  `unexpected "false"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSCIMFilter(tt.filter)
+			var filterErr *scimFilterError
+			if !errors.As(err, &filterErr) {
+				t.Fatalf("parseSCIMFilter(%q) error = %v, want *scimFilterError", tt.filter, err)
+			}
+			if filterErr.Position != tt.position || filterErr.Message != tt.message {
+				t.Errorf("parseSCIMFilter(%q) error at %d: %q, want at %d: %q",
+					tt.filter, filterErr.Position, filterErr.Message, tt.position, tt.message)
+			}
+
+			// List endpoints answer an invalid filter with a SCIM 400 invalidFilter error
+			h := &Handler{scim: scimConfig{maxResults: 100}}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(tt.filter), nil)
+			h.writeSCIMList(w, r, []interface{}{scimTestResource(t)})
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/scim+json" {
+				t.Errorf("Content-Type = %q, want application/scim+json", ct)
+			}
+			var body struct {
+				Schemas  []string `json:"schemas"`
+				Status   string   `json:"status"`
+				ScimType string   `json:"scimType"`
+				Detail   string   `json:"detail"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode error response %q: %v", w.Body.String(), err)
+			}
+			if len(body.Schemas) != 1 || body.Schemas[0] != scimSchemaError {
+				t.Errorf("schemas = %q, want [%q]", body.Schemas, scimSchemaError)
+			}
+			if body.Status != "400" || body.ScimType != "invalidFilter" || body.Detail != err.Error() {
+				t.Errorf("error response = %+v, want status 400, scimType invalidFilter, detail %q", body, err.Error())
+			}
+		})
+	}
+}
+
+func TestSCIMListFilter(t *testing.T) {
+	var users []interface{}
+	for _, userName := range []string{"ivanov", "ivanova", "petrov"} {
+		users = append(users, map[string]interface{}{"id": userName, "userName": userName})
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		ids    []string
+	}{
+		{name: "no filter", filter: "", ids: []string{"ivanov", "ivanova", "petrov"}},
+		{name: "eq", filter: `userName eq "ivanov"`, ids: []string{"ivanov"}},
+		{name: "sw", filter: `userName sw "ivanov"`, ids: []string{"ivanov", "ivanova"}},
+		{name: "co", filter: `userName co "ov"`, ids: []string{"ivanov", "ivanova", "petrov"}},
+		{name: "and", filter: `userName sw "ivan" and userName ew "a"`, ids: []string{"ivanova"}},
+		{name: "or", filter: `userName eq "petrov" or userName eq "ivanov"`, ids: []string{"ivanov", "petrov"}},
+		{name: "no matches", filter: `userName eq "sidorov"`, ids: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{scim: scimConfig{maxResults: 100}}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/scim/v2/Users?filter="+url.QueryEscape(tt.filter), nil)
+			h.writeSCIMList(w, r, users)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			var list struct {
+				TotalResults int `json:"totalResults"`
+				Resources    []struct {
+					ID string `json:"id"`
+				} `json:"Resources"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatalf("decode list response %q: %v", w.Body.String(), err)
+			}
+			ids := []string{}
+			for _, resource := range list.Resources {
+				ids = append(ids, resource.ID)
+			}
+			if list.TotalResults != len(tt.ids) || len(ids) != len(tt.ids) {
+				t.Fatalf("filter %q matched %q (totalResults %d), want %q", tt.filter, ids, list.TotalResults, tt.ids)
+			}
+			for i := range ids {
+				if ids[i] != tt.ids[i] {
+					t.Errorf("filter %q matched %q, want %q", tt.filter, ids, tt.ids)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// SCIM 2.0 handlers (RFC 7643, RFC 7644). Users are employees, groups are
+// the allowed values of SCIM_GROUP_FIELDS and are read-only.
+
+// scimAuth checks the bearer token. SCIM changes employees, so it is not
+// served at all while SCIM_BEARER_TOKEN is unset.
+func (h *Handler) scimAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.scim.token == "" {
+			writeSCIMError(w, newSCIMError(http.StatusServiceUnavailable, "", "SCIM is disabled: SCIM_BEARER_TOKEN is not set"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(h.scim.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeSCIMError(w, newSCIMError(http.StatusUnauthorized, "", "invalid or missing bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scimBaseURL is the absolute URL of /scim/v2 as the client sees it
+func scimBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	return scheme + "://" + r.Host + "/scim/v2"
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeSCIMError writes err as a SCIM error; other errors are internal
+func writeSCIMError(w http.ResponseWriter, err error) {
+	var scimErr *scimError
+	if !errors.As(err, &scimErr) {
+		scimErr = &scimError{Status: http.StatusInternalServerError, Detail: err.Error()}
+	}
+	body := map[string]interface{}{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(scimErr.Status),
+		"detail":  scimErr.Detail,
+	}
+	if scimErr.ScimType != "" {
+		body["scimType"] = scimErr.ScimType
+	}
+	writeSCIM(w, scimErr.Status, body)
+}
+
+// scimAttributes renders a resource as JSON attributes
+func scimAttributes(resource interface{}) map[string]interface{} {
+	data, _ := json.Marshal(resource)
+	var obj map[string]interface{}
+	json.Unmarshal(data, &obj)
+	return obj
+}
+
+// scimProject removes the attributes left out by the attributes and
+// excludedAttributes parameters
+func scimProject(r *http.Request, obj map[string]interface{}) map[string]interface{} {
+	always := map[string]bool{"schemas": true, "id": true}
+	if attributes := splitList(r.URL.Query().Get("attributes")); len(attributes) > 0 {
+		keep := make(map[string]bool)
+		for _, name := range attributes {
+			keep[strings.ToLower(strings.SplitN(name, ".", 2)[0])] = true
+		}
+		for name := range obj {
+			if !always[name] && !keep[strings.ToLower(name)] {
+				delete(obj, name)
+			}
+		}
+	}
+	for _, name := range splitList(r.URL.Query().Get("excludedAttributes")) {
+		for key := range obj {
+			if !always[key] && strings.EqualFold(key, name) {
+				delete(obj, key)
+			}
+		}
+	}
+	return obj
+}
+
+// writeSCIMList filters and pages resources by the filter, startIndex and
+// count parameters
+func (h *Handler) writeSCIMList(w http.ResponseWriter, r *http.Request, resources []interface{}) {
+	query := r.URL.Query()
+	var filter scimFilter
+	if f := strings.TrimSpace(query.Get("filter")); f != "" {
+		var err error
+		if filter, err = parseSCIMFilter(f); err != nil {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidFilter", "%v", err))
+			return
+		}
+	}
+	startIndex := 1
+	if v := query.Get("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "startIndex must be a number"))
+			return
+		}
+		if n > 1 {
+			startIndex = n
+		}
+	}
+	count := 100
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "count must be a number"))
+			return
+		}
+		count = max(n, 0)
+	}
+	count = min(count, h.scim.maxResults)
+
+	var matched []map[string]interface{}
+	for _, resource := range resources {
+		// Filters see all attributes, the response only the requested ones
+		obj := scimAttributes(resource)
+		if filter == nil || filter.match(obj) {
+			matched = append(matched, scimProject(r, obj))
+		}
+	}
+
+	page := []interface{}{}
+	for i := startIndex - 1; i < len(matched) && len(page) < count; i++ {
+		page = append(page, matched[i])
+	}
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: len(matched),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+// GetSCIMServiceProviderConfig describes the supported SCIM features
+func (h *Handler) GetSCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	authenticationSchemes := []map[string]interface{}{{
+		"type":        "oauthbearertoken",
+		"name":        "Bearer token",
+		"description": "Static token from SCIM_BEARER_TOKEN in the Authorization header",
+	}}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":               []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":                 map[string]bool{"supported": true},
+		"bulk":                  map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":                map[string]interface{}{"supported": true, "maxResults": h.scim.maxResults},
+		"changePassword":        map[string]bool{"supported": false},
+		"sort":                  map[string]bool{"supported": false},
+		"etag":                  map[string]bool{"supported": false},
+		"authenticationSchemes": authenticationSchemes,
+		"meta": SCIMMeta{
+			ResourceType: "ServiceProviderConfig",
+			Location:     scimBaseURL(r) + "/ServiceProviderConfig",
+		},
+	})
+}
+
+// GetSCIMResourceTypes lists the User and Group resource types
+func (h *Handler) GetSCIMResourceTypes(w http.ResponseWriter, r *http.Request) {
+	baseURL := scimBaseURL(r)
+	resourceType := func(id, endpoint, schema string, extensions ...string) interface{} {
+		t := map[string]interface{}{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       id,
+			"name":     id,
+			"endpoint": endpoint,
+			"schema":   schema,
+			"meta":     SCIMMeta{ResourceType: "ResourceType", Location: baseURL + "/ResourceTypes/" + id},
+		}
+		if len(extensions) > 0 {
+			var schemaExtensions []map[string]interface{}
+			for _, ext := range extensions {
+				schemaExtensions = append(schemaExtensions, map[string]interface{}{"schema": ext, "required": false})
+			}
+			t["schemaExtensions"] = schemaExtensions
+		}
+		return t
+	}
+	resources := []interface{}{
+		resourceType("User", "/Users", scimSchemaUser, scimSchemaEnterpriseUser),
+		resourceType("Group", "/Groups", scimSchemaGroup),
+	}
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// GetSCIMUsers lists users matching the filter
+func (h *Handler) GetSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	dir, err := loadSCIMDirectory(r.Context(), h.db, h.scim, scimBaseURL(r), scimScope{})
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	resources := make([]interface{}, len(dir.Users))
+	for i := range dir.Users {
+		resources[i] = dir.Users[i]
+	}
+	h.writeSCIMList(w, r, resources)
+}
+
+// GetSCIMUser returns one user
+func (h *Handler) GetSCIMUser(w http.ResponseWriter, r *http.Request) {
+	u, err := h.loadSCIMUser(r, mux.Vars(r)["id"])
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimProject(r, scimAttributes(u)))
+}
+
+// loadSCIMUser builds the user with the given ID
+func (h *Handler) loadSCIMUser(r *http.Request, id string) (SCIMUser, error) {
+	employeeID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || employeeID <= 0 {
+		return SCIMUser{}, newSCIMError(http.StatusNotFound, "", "User %s not found", id)
+	}
+	dir, err := loadSCIMDirectory(r.Context(), h.db, h.scim, scimBaseURL(r), scimScope{userID: employeeID})
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	if len(dir.Users) == 0 {
+		return SCIMUser{}, newSCIMError(http.StatusNotFound, "", "User %s not found", id)
+	}
+	return dir.Users[0], nil
+}
+
+// CreateSCIMUser creates an employee
+func (h *Handler) CreateSCIMUser(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "%v", err))
+		return
+	}
+	in, err := decodeSCIMUser(body)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	var id int64
+	err = h.db.QueryRowContext(r.Context(),
+		`INSERT INTO employees (external_id, surname, name, patronymic, profile_url, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NOW(), NOW())
+		RETURNING id`,
+		in.UserName, in.FamilyName, in.GivenName, in.MiddleName, in.ProfileURL,
+	).Scan(&id)
+	if isUniqueViolation(err) {
+		writeSCIMError(w, newSCIMError(http.StatusConflict, "uniqueness", "userName %q is already taken", *in.UserName))
+		return
+	}
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	u, err := h.loadSCIMUser(r, strconv.FormatInt(id, 10))
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	w.Header().Set("Location", u.Meta.Location)
+	writeSCIM(w, http.StatusCreated, u)
+}
+
+// ReplaceSCIMUser replaces the stored attributes of an employee
+func (h *Handler) ReplaceSCIMUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "User %s not found", mux.Vars(r)["id"]))
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "%v", err))
+		return
+	}
+	in, err := decodeSCIMUser(body)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	h.saveSCIMUser(w, r, id, in)
+}
+
+// PatchSCIMUser applies PATCH operations to an employee
+func (h *Handler) PatchSCIMUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "User %s not found", mux.Vars(r)["id"]))
+		return
+	}
+	var req scimPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "%v", err))
+		return
+	}
+
+	e, err := scanEmployee(h.db.QueryRowContext(r.Context(),
+		`SELECT `+employeeColumns+` FROM employees WHERE id = $1`, id,
+	))
+	if err == sql.ErrNoRows {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "User %d not found", id))
+		return
+	}
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	in := scimUserInputFromEmployee(e)
+	if err := applySCIMPatch(&in, req); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	h.saveSCIMUser(w, r, id, in)
+}
+
+// saveSCIMUser stores a replaced or patched user and responds with it
+func (h *Handler) saveSCIMUser(w http.ResponseWriter, r *http.Request, id int64, in scimUserInput) {
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := saveSCIMUser(r.Context(), tx, id, in); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	u, err := h.loadSCIMUser(r, strconv.FormatInt(id, 10))
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, u)
+}
+
+// DeleteSCIMUser deletes an employee and vacates their positions
+func (h *Handler) DeleteSCIMUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "User %s not found", mux.Vars(r)["id"]))
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	found, err := deleteEmployee(r.Context(), tx, id)
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	if !found {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "User %d not found", id))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSCIMGroups lists groups matching the filter
+func (h *Handler) GetSCIMGroups(w http.ResponseWriter, r *http.Request) {
+	dir, err := loadSCIMDirectory(r.Context(), h.db, h.scim, scimBaseURL(r), scimScope{})
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	resources := make([]interface{}, len(dir.Groups))
+	for i := range dir.Groups {
+		resources[i] = dir.Groups[i]
+	}
+	h.writeSCIMList(w, r, resources)
+}
+
+// GetSCIMGroup returns one group with its members
+func (h *Handler) GetSCIMGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	valueID, err := uuid.Parse(id)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "Group %s not found", id))
+		return
+	}
+	dir, err := loadSCIMDirectory(r.Context(), h.db, h.scim, scimBaseURL(r), scimScope{groupID: valueID})
+	if err != nil {
+		writeSCIMError(w, err)
+		return
+	}
+	if len(dir.Groups) == 0 {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "Group %s not found", id))
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimProject(r, scimAttributes(dir.Groups[0])))
+}
+
+// RejectSCIMGroupChange answers changes to groups: membership follows the
+// values of positions and names are edited in the custom fields
+func (h *Handler) RejectSCIMGroupChange(w http.ResponseWriter, r *http.Request) {
+	writeSCIMError(w, newSCIMError(http.StatusNotImplemented, "",
+		"groups are derived from custom field values and cannot be changed through SCIM"))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSCIMAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}{
+		{name: "no token configured", token: "", authorization: "Bearer anything", status: http.StatusServiceUnavailable},
+		{name: "no token configured and none sent", token: "", authorization: "", status: http.StatusServiceUnavailable},
+		{name: "missing token", token: "secret", authorization: "", status: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", authorization: "Bearer other", status: http.StatusUnauthorized},
+		{name: "wrong scheme", token: "secret", authorization: "Basic secret", status: http.StatusUnauthorized},
+		{name: "valid token", token: "secret", authorization: "Bearer secret", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{scim: scimConfig{token: tt.token}}
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/scim/v2/Users", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			h.scimAuth(next).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status == http.StatusOK {
+				return
+			}
+			var body struct {
+				Schemas []string `json:"schemas"`
+				Status  string   `json:"status"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode error response %q: %v", w.Body.String(), err)
+			}
+			if len(body.Schemas) != 1 || body.Schemas[0] != scimSchemaError || body.Status != strconv.Itoa(tt.status) {
+				t.Errorf("error response = %+v, want a SCIM error", body)
+			}
+		})
+	}
+}
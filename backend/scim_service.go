@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// SCIM schema and message URNs
+const (
+	scimSchemaUser           = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaEnterpriseUser = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	scimSchemaGroup          = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaPatchOp        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimSchemaError          = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// scimEnterpriseAttributes are the enterprise extension attributes that can
+// be filled from custom fields
+var scimEnterpriseAttributes = []string{"department", "division", "organization", "costCenter"}
+
+// scimConfig is read from SCIM_* variables
+type scimConfig struct {
+	token            string            // bearer token clients must send; "" leaves authentication to the proxy
+	groupFields      []string          // custom field keys whose allowed values are groups
+	managerFields    []string          // custom field keys to look for a superior in, most specific first
+	enterpriseFields map[string]string // enterprise attribute -> custom field key
+	maxResults       int
+}
+
+func loadSCIMConfig() scimConfig {
+	cfg := scimConfig{
+		token:            os.Getenv("SCIM_BEARER_TOKEN"),
+		groupFields:      splitList(os.Getenv("SCIM_GROUP_FIELDS")),
+		managerFields:    splitList(os.Getenv("SCIM_MANAGER_FIELDS")),
+		enterpriseFields: make(map[string]string),
+		maxResults:       envInt("SCIM_MAX_RESULTS", 1000),
+	}
+	for _, pair := range splitList(os.Getenv("SCIM_ENTERPRISE_FIELDS")) {
+		attribute, key, ok := strings.Cut(pair, "=")
+		attribute, key = strings.TrimSpace(attribute), strings.TrimSpace(key)
+		known := false
+		for _, name := range scimEnterpriseAttributes {
+			if strings.EqualFold(attribute, name) {
+				attribute, known = name, true
+			}
+		}
+		if !ok || !known || key == "" {
+			log.Printf("Invalid SCIM_ENTERPRISE_FIELDS mapping %q ignored (use <%s>=<custom field key>)",
+				pair, strings.Join(scimEnterpriseAttributes, "|"))
+			continue
+		}
+		cfg.enterpriseFields[attribute] = key
+	}
+	return cfg
+}
+
+// scimError is an error response (RFC 7644, section 3.12)
+type scimError struct {
+	Status   int
+	ScimType string // e.g. invalidFilter, invalidPath, mutability, uniqueness
+	Detail   string
+}
+
+func (e *scimError) Error() string { return e.Detail }
+
+func newSCIMError(status int, scimType, format string, args ...interface{}) *scimError {
+	return &scimError{Status: status, ScimType: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+// SCIMMeta is the meta attribute of a resource
+type SCIMMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+// SCIMName is the name of a User
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	MiddleName string `json:"middleName,omitempty"`
+}
+
+// SCIMReference points to another resource, e.g. a group of a user or a member of a group
+type SCIMReference struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// SCIMManager is the manager of the enterprise extension
+type SCIMManager struct {
+	Value       string `json:"value"`
+	Ref         string `json:"$ref,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// SCIMEnterpriseUser is the enterprise extension of a User
+type SCIMEnterpriseUser struct {
+	EmployeeNumber string       `json:"employeeNumber,omitempty"`
+	Department     string       `json:"department,omitempty"`
+	Division       string       `json:"division,omitempty"`
+	Organization   string       `json:"organization,omitempty"`
+	CostCenter     string       `json:"costCenter,omitempty"`
+	Manager        *SCIMManager `json:"manager,omitempty"`
+}
+
+// SCIMUser is an employee. userName is the external ID (the employee ID
+// shown on positions), or the internal ID for employees without one.
+type SCIMUser struct {
+	Schemas     []string            `json:"schemas"`
+	ID          string              `json:"id"`
+	UserName    string              `json:"userName"`
+	Name        SCIMName            `json:"name"`
+	DisplayName string              `json:"displayName,omitempty"`
+	Title       string              `json:"title,omitempty"` // primary position
+	ProfileURL  string              `json:"profileUrl,omitempty"`
+	Active      bool                `json:"active"` // holds a position today
+	Groups      []SCIMReference     `json:"groups"`
+	Enterprise  *SCIMEnterpriseUser `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+	Meta        SCIMMeta            `json:"meta"`
+}
+
+// SCIMGroup is an allowed value of a group field; its members are the
+// employees holding positions with that value
+type SCIMGroup struct {
+	Schemas     []string        `json:"schemas"`
+	ID          string          `json:"id"`
+	DisplayName string          `json:"displayName"`
+	Members     []SCIMReference `json:"members"`
+	Meta        SCIMMeta        `json:"meta"`
+}
+
+// SCIMListResponse is a page of resources
+type SCIMListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// scimDirectory is the SCIM view of employees and group values
+type scimDirectory struct {
+	Users  []SCIMUser
+	Groups []SCIMGroup
+}
+
+// scimScope narrows loadSCIMDirectory to one resource; the zero value loads
+// everything
+type scimScope struct {
+	userID  int64     // only this user, with all their groups
+	groupID uuid.UUID // only this group and its members
+}
+
+// loadSCIMDirectory builds the users and groups of scope. Users take their
+// title, enterprise attributes and manager from their primary position and
+// belong to the groups of all positions they hold. baseURL is the URL of
+// /scim/v2.
+func loadSCIMDirectory(ctx context.Context, db dbQuerier, cfg scimConfig, baseURL string, scope scimScope) (scimDirectory, error) {
+	ctx, span := tracer.Start(ctx, "loadSCIMDirectory")
+	defer span.End()
+
+	var dir scimDirectory
+	managers, err := newManagerResolver(ctx, db, cfg.managerFields)
+	if err != nil {
+		return dir, err
+	}
+	fieldInfoMap, valueInfoMap, fieldToValuesMap, err := NewCustomFieldsService(db).LoadAllCustomFieldsData(ctx)
+	if err != nil {
+		return dir, err
+	}
+
+	// Groups in the order of SCIM_GROUP_FIELDS, then by name
+	groupIndex := make(map[uuid.UUID]int)
+	for _, key := range cfg.groupFields {
+		var groups []SCIMGroup
+		for fieldID, info := range fieldInfoMap {
+			if info.Key != key {
+				continue
+			}
+			for valueID := range fieldToValuesMap[fieldID] {
+				if _, seen := groupIndex[valueID]; seen {
+					continue
+				}
+				if scope.groupID != uuid.Nil && valueID != scope.groupID {
+					continue
+				}
+				groupIndex[valueID] = -1
+				groups = append(groups, SCIMGroup{
+					Schemas:     []string{scimSchemaGroup},
+					ID:          valueID.String(),
+					DisplayName: valueInfoMap[valueID],
+					Members:     []SCIMReference{},
+					Meta:        SCIMMeta{ResourceType: "Group", Location: baseURL + "/Groups/" + valueID.String()},
+				})
+			}
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if groups[i].DisplayName != groups[j].DisplayName {
+				return groups[i].DisplayName < groups[j].DisplayName
+			}
+			return groups[i].ID < groups[j].ID
+		})
+		for _, g := range groups {
+			groupIndex[uuid.MustParse(g.ID)] = len(dir.Groups)
+			dir.Groups = append(dir.Groups, g)
+		}
+	}
+
+	if scope.groupID != uuid.Nil && len(dir.Groups) == 0 {
+		return dir, nil
+	}
+
+	// Positions every employee holds, the primary one first. For a group only
+	// the positions with its value are needed to find the members.
+	type heldPosition struct {
+		id       int64
+		name     string
+		valueIDs UUIDArray
+	}
+	held := make(map[int64][]heldPosition)
+	positionsQuery := `SELECT a.employee_id, p.id, p.position_name, p.custom_fields_values_id
+		FROM position_assignments a JOIN positions p ON p.id = a.position_id
+		WHERE ` + assignmentActive
+	var positionsArgs []interface{}
+	switch {
+	case scope.userID != 0:
+		positionsQuery += ` AND a.employee_id = $1`
+		positionsArgs = append(positionsArgs, scope.userID)
+	case scope.groupID != uuid.Nil:
+		positionsQuery += ` AND p.custom_fields_values_id @> jsonb_build_array($1::text)`
+		positionsArgs = append(positionsArgs, scope.groupID.String())
+	}
+	rows, err := db.QueryContext(ctx, positionsQuery+` ORDER BY a.employee_id, `+assignmentPrimaryOrder, positionsArgs...)
+	if err != nil {
+		return dir, err
+	}
+	var memberIDs []int64
+	for rows.Next() {
+		var employeeID int64
+		var p heldPosition
+		if err := rows.Scan(&employeeID, &p.id, &p.name, &p.valueIDs); err != nil {
+			rows.Close()
+			return dir, err
+		}
+		if held[employeeID] == nil {
+			memberIDs = append(memberIDs, employeeID)
+		}
+		held[employeeID] = append(held[employeeID], p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return dir, err
+	}
+
+	employeesQuery := `SELECT ` + employeeColumns + ` FROM employees`
+	var employeesArgs []interface{}
+	switch {
+	case scope.userID != 0:
+		employeesQuery += ` WHERE id = $1`
+		employeesArgs = append(employeesArgs, scope.userID)
+	case scope.groupID != uuid.Nil:
+		employeesQuery += ` WHERE id = ANY($1::bigint[])`
+		employeesArgs = append(employeesArgs, pq.Array(memberIDs))
+	}
+	rows, err = db.QueryContext(ctx, employeesQuery+` ORDER BY id`, employeesArgs...)
+	if err != nil {
+		return dir, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanEmployee(rows)
+		if err != nil {
+			return dir, err
+		}
+		u := scimUserFromEmployee(e, baseURL)
+		positions := held[e.ID]
+		u.Active = len(positions) > 0
+
+		ext := &SCIMEnterpriseUser{EmployeeNumber: trimmed(e.ExternalID)}
+		if u.Active {
+			primary := positions[0]
+			u.Title = primary.name
+			values := managers.fieldValues(primary.valueIDs)
+			for attribute, key := range cfg.enterpriseFields {
+				valueID, ok := values[key]
+				if !ok {
+					continue
+				}
+				switch attribute {
+				case "department":
+					ext.Department = valueInfoMap[valueID]
+				case "division":
+					ext.Division = valueInfoMap[valueID]
+				case "organization":
+					ext.Organization = valueInfoMap[valueID]
+				case "costCenter":
+					ext.CostCenter = valueInfoMap[valueID]
+				}
+			}
+			if manager, ok := managers.manager(primary.id, e.ID, primary.valueIDs, nil); ok {
+				id := strconv.FormatInt(manager.EmployeeID, 10)
+				ext.Manager = &SCIMManager{Value: id, Ref: baseURL + "/Users/" + id}
+				if manager.FullName != nil {
+					ext.Manager.DisplayName = *manager.FullName
+				}
+			}
+		}
+		u.Enterprise = ext
+
+		for _, p := range positions {
+			for _, valueID := range p.valueIDs {
+				i, ok := groupIndex[valueID]
+				if !ok || i < 0 || scimHasReference(u.Groups, valueID.String()) {
+					continue
+				}
+				g := &dir.Groups[i]
+				u.Groups = append(u.Groups, SCIMReference{
+					Value: g.ID, Ref: g.Meta.Location, Display: g.DisplayName, Type: "direct",
+				})
+				g.Members = append(g.Members, SCIMReference{
+					Value: u.ID, Ref: u.Meta.Location, Display: u.DisplayName, Type: "User",
+				})
+			}
+		}
+		dir.Users = append(dir.Users, u)
+	}
+	return dir, rows.Err()
+}
+
+// scimUserFromEmployee renders the stored attributes of an employee
+func scimUserFromEmployee(e Employee, baseURL string) SCIMUser {
+	id := strconv.FormatInt(e.ID, 10)
+	u := SCIMUser{
+		Schemas:    []string{scimSchemaUser, scimSchemaEnterpriseUser},
+		ID:         id,
+		UserName:   trimmed(e.ExternalID),
+		ProfileURL: trimmed(e.ProfileURL),
+		Name: SCIMName{
+			FamilyName: trimmed(e.Surname),
+			GivenName:  trimmed(e.Name),
+			MiddleName: trimmed(e.Patronymic),
+		},
+		Groups: []SCIMReference{},
+		Meta: SCIMMeta{
+			ResourceType: "User",
+			Created:      &e.CreatedAt,
+			LastModified: &e.UpdatedAt,
+			Location:     baseURL + "/Users/" + id,
+		},
+	}
+	if u.UserName == "" {
+		u.UserName = id
+	}
+	if e.FullName != nil {
+		u.Name.Formatted, u.DisplayName = *e.FullName, *e.FullName
+	}
+	return u
+}
+
+func scimHasReference(refs []SCIMReference, value string) bool {
+	for _, ref := range refs {
+		if ref.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// scimUserInput holds the User attributes that are stored on the employee
+type scimUserInput struct {
+	UserName   *string // external ID
+	FamilyName *string
+	GivenName  *string
+	MiddleName *string
+	ProfileURL *string
+	Active     *bool // false ends the assignments of the employee
+}
+
+// scimUserInputFromEmployee is the starting point for PATCH
+func scimUserInputFromEmployee(e Employee) scimUserInput {
+	return scimUserInput{
+		UserName:   e.ExternalID,
+		FamilyName: e.Surname,
+		GivenName:  e.Name,
+		MiddleName: e.Patronymic,
+		ProfileURL: e.ProfileURL,
+	}
+}
+
+// decodeSCIMUser reads a User from a POST or PUT body. Read-only and
+// unsupported attributes are ignored.
+func decodeSCIMUser(body []byte) (scimUserInput, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return scimUserInput{}, newSCIMError(http.StatusBadRequest, "invalidSyntax", "%v", err)
+	}
+	var u scimUserInput
+	for name, value := range obj {
+		switch strings.ToLower(name) {
+		case "username", "name", "profileurl", "active":
+			if err := u.set(name, value, false); err != nil {
+				return u, err
+			}
+		}
+	}
+	if u.UserName == nil {
+		return u, newSCIMError(http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+	return u, nil
+}
+
+// scimPatchRequest is a PATCH body (RFC 7644, section 3.5.2)
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applySCIMPatch applies PATCH operations to the stored attributes of a User
+func applySCIMPatch(u *scimUserInput, req scimPatchRequest) error {
+	if len(req.Operations) == 0 {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "no Operations")
+	}
+	for _, op := range req.Operations {
+		remove := false
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+		case "remove":
+			remove = true
+		default:
+			return newSCIMError(http.StatusBadRequest, "invalidSyntax", "unknown op %q", op.Op)
+		}
+
+		if op.Path != "" {
+			if err := u.set(op.Path, op.Value, remove); err != nil {
+				return err
+			}
+			continue
+		}
+		if remove {
+			return newSCIMError(http.StatusBadRequest, "noTarget", "remove requires a path")
+		}
+		// Without a path the value holds the attributes to set
+		var attributes map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return newSCIMError(http.StatusBadRequest, "invalidValue", "value must be an object when path is omitted")
+		}
+		for name, value := range attributes {
+			if err := u.set(name, value, false); err != nil {
+				return err
+			}
+		}
+	}
+	if u.UserName == nil {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "userName is required")
+	}
+	return nil
+}
+
+// set changes one attribute; remove clears it
+func (u *scimUserInput) set(path string, value json.RawMessage, remove bool) error {
+	if i := len(scimSchemaUser) + 1; len(path) > i && strings.EqualFold(path[:i], scimSchemaUser+":") {
+		path = path[i:]
+	}
+
+	var target **string
+	switch strings.ToLower(path) {
+	case "username":
+		target = &u.UserName
+	case "name.familyname":
+		target = &u.FamilyName
+	case "name.givenname":
+		target = &u.GivenName
+	case "name.middlename":
+		target = &u.MiddleName
+	case "profileurl":
+		target = &u.ProfileURL
+	case "name":
+		if remove {
+			u.FamilyName, u.GivenName, u.MiddleName = nil, nil, nil
+			return nil
+		}
+		var name map[string]json.RawMessage
+		if err := json.Unmarshal(value, &name); err != nil {
+			return newSCIMError(http.StatusBadRequest, "invalidValue", "name must be an object")
+		}
+		for sub, subValue := range name {
+			if strings.EqualFold(sub, "formatted") {
+				continue // derived from the name parts
+			}
+			if err := u.set("name."+sub, subValue, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "active":
+		if remove {
+			return newSCIMError(http.StatusBadRequest, "mutability", "active cannot be removed")
+		}
+		active, err := scimBool(value)
+		if err != nil {
+			return err
+		}
+		u.Active = &active
+		return nil
+	case "externalid":
+		return nil // identifiers of provisioning clients are not stored
+	case "id", "meta", "groups", "title", "displayname", "name.formatted":
+		return newSCIMError(http.StatusBadRequest, "mutability", "%s is read-only", path)
+	default:
+		if strings.HasPrefix(strings.ToLower(path), strings.ToLower(scimSchemaEnterpriseUser)) {
+			return newSCIMError(http.StatusBadRequest, "mutability", "enterprise attributes are derived from positions")
+		}
+		return newSCIMError(http.StatusBadRequest, "invalidPath", "unsupported attribute %q", path)
+	}
+
+	if remove {
+		*target = nil
+		return nil
+	}
+	s, err := scimString(value)
+	if err != nil {
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "%s must be a string", path)
+	}
+	*target = s
+	return nil
+}
+
+// scimString decodes a string value; null and blank strings are nil
+func scimString(value json.RawMessage) (*string, error) {
+	var s *string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, err
+	}
+	if s == nil || strings.TrimSpace(*s) == "" {
+		return nil, nil
+	}
+	trimmedValue := strings.TrimSpace(*s)
+	return &trimmedValue, nil
+}
+
+// scimBool decodes a boolean; some clients send "True" and "False" strings
+func scimBool(value json.RawMessage) (bool, error) {
+	var v interface{}
+	if err := json.Unmarshal(value, &v); err == nil {
+		switch b := v.(type) {
+		case bool:
+			return b, nil
+		case string:
+			if parsed, err := strconv.ParseBool(strings.ToLower(b)); err == nil {
+				return parsed, nil
+			}
+		}
+	}
+	return false, newSCIMError(http.StatusBadRequest, "invalidValue", "active must be a boolean")
+}
+
+// saveSCIMUser stores the attributes of an employee within tx. Deactivating
+// ends the current and future assignments of the employee today.
+func saveSCIMUser(ctx context.Context, tx *sql.Tx, id int64, u scimUserInput) error {
+	var updated int64
+	err := tx.QueryRowContext(ctx,
+		`UPDATE employees SET external_id = $1, surname = $2, name = $3, patronymic = $4, profile_url = $5, updated_at = NOW()
+		WHERE id = $6 RETURNING id`,
+		u.UserName, u.FamilyName, u.GivenName, u.MiddleName, u.ProfileURL, id,
+	).Scan(&updated)
+	if err == sql.ErrNoRows {
+		return newSCIMError(http.StatusNotFound, "", "User %d not found", id)
+	}
+	if isUniqueViolation(err) {
+		return newSCIMError(http.StatusConflict, "uniqueness", "userName %q is already taken", *u.UserName)
+	}
+	if err != nil {
+		return err
+	}
+	if err := refreshEmployeePositions(ctx, tx, id); err != nil {
+		return err
+	}
+	if u.Active == nil || *u.Active {
+		return nil
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`UPDATE position_assignments SET end_date = GREATEST(start_date, CURRENT_DATE), updated_at = NOW()
+		WHERE employee_id = $1 AND (end_date IS NULL OR end_date > CURRENT_DATE)
+		RETURNING position_id`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	var positionIDs []int64
+	for rows.Next() {
+		var positionID *int64
+		if err := rows.Scan(&positionID); err != nil {
+			rows.Close()
+			return err
+		}
+		if positionID != nil {
+			positionIDs = append(positionIDs, *positionID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, positionID := range positionIDs {
+		if err := refreshPositionEmployee(ctx, tx, positionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search query language
+//
+//	query    := or
+//	or       := and ( OR and )*
+//	and      := not ( [AND] not )*        // adjacent terms are joined with AND
+//	not      := NOT not | primary
+//	primary  := "(" or ")" | term
+//	term     := [field ":"] ( word | "quoted phrase" )
+//
+// Operators are case insensitive. A trailing "*" in an unquoted word makes it
+// a prefix match, e.g. surname:Ив*.
+
+const (
+	// maxSearchQueryLength is the longest accepted query, in characters
+	maxSearchQueryLength = 1000
+	// maxSearchNesting limits nested parentheses and NOTs so that a crafted
+	// query cannot exhaust the parser's stack
+	maxSearchNesting = 64
+)
+
+// SearchSyntaxError describes an invalid search query
+type SearchSyntaxError struct {
+	Position int // 1-based character position in the query
+	Message  string
+}
+
+func (e *SearchSyntaxError) Error() string {
+	return fmt.Sprintf("search syntax error at position %d: %s", e.Position, e.Message)
+}
+
+type searchTokenKind int
+
+const (
+	searchTokenEOF searchTokenKind = iota
+	searchTokenTerm
+	searchTokenAnd
+	searchTokenOr
+	searchTokenNot
+	searchTokenLParen
+	searchTokenRParen
+)
+
+type searchToken struct {
+	kind     searchTokenKind
+	pos      int // 0-based rune offset
+	field    string
+	value    string
+	quoted   bool
+	wildcard bool
+}
+
+func (t searchToken) describe() string {
+	switch t.kind {
+	case searchTokenEOF:
+		return "end of query"
+	case searchTokenAnd:
+		return "AND"
+	case searchTokenOr:
+		return "OR"
+	case searchTokenNot:
+		return "NOT"
+	case searchTokenLParen:
+		return `"("`
+	case searchTokenRParen:
+		return `")"`
+	}
+	if t.field != "" {
+		return fmt.Sprintf("%q", t.field+":"+t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+// tokenizeSearchQuery splits the query into operators, parentheses and terms
+func tokenizeSearchQuery(search string) ([]searchToken, error) {
+	runes := []rune(search)
+	var tokens []searchToken
+	i := 0
+
+	isWordRune := func(r rune) bool {
+		return !unicode.IsSpace(r) && r != '(' && r != ')' && r != '"'
+	}
+
+	readQuoted := func(start int) (string, int, error) {
+		// runes[start] is the opening quote
+		var b strings.Builder
+		j := start + 1
+		for j < len(runes) {
+			switch runes[j] {
+			case '\\':
+				if j+1 < len(runes) {
+					b.WriteRune(runes[j+1])
+					j += 2
+					continue
+				}
+			case '"':
+				return b.String(), j + 1, nil
+			}
+			b.WriteRune(runes[j])
+			j++
+		}
+		return "", 0, &SearchSyntaxError{Position: start + 1, Message: "unterminated quoted phrase"}
+	}
+
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, searchToken{kind: searchTokenLParen, pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, searchToken{kind: searchTokenRParen, pos: i})
+			i++
+		case r == '"':
+			value, next, err := readQuoted(i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, searchToken{kind: searchTokenTerm, pos: i, value: value, quoted: true})
+			i = next
+		default:
+			start := i
+			for i < len(runes) && isWordRune(runes[i]) && runes[i] != ':' {
+				i++
+			}
+			word := string(runes[start:i])
+
+			// field:value or field:"quoted value"
+			if i < len(runes) && runes[i] == ':' {
+				field := strings.ToLower(word)
+				if field == "" {
+					return nil, &SearchSyntaxError{Position: start + 1, Message: `missing field name before ":"`}
+				}
+				i++
+				if i < len(runes) && runes[i] == '"' {
+					value, next, err := readQuoted(i)
+					if err != nil {
+						return nil, err
+					}
+					tokens = append(tokens, searchToken{kind: searchTokenTerm, pos: start, field: field, value: value, quoted: true})
+					i = next
+					continue
+				}
+				valueStart := i
+				for i < len(runes) && isWordRune(runes[i]) {
+					i++
+				}
+				value := string(runes[valueStart:i])
+				if value == "" {
+					return nil, &SearchSyntaxError{Position: start + 1, Message: fmt.Sprintf("missing value for field %q", field)}
+				}
+				tokens = append(tokens, newSearchTermToken(start, field, value))
+				continue
+			}
+
+			switch strings.ToUpper(word) {
+			case "AND":
+				tokens = append(tokens, searchToken{kind: searchTokenAnd, pos: start})
+			case "OR":
+				tokens = append(tokens, searchToken{kind: searchTokenOr, pos: start})
+			case "NOT":
+				tokens = append(tokens, searchToken{kind: searchTokenNot, pos: start})
+			default:
+				tokens = append(tokens, newSearchTermToken(start, "", word))
+			}
+		}
+	}
+
+	tokens = append(tokens, searchToken{kind: searchTokenEOF, pos: len(runes)})
+	return tokens, nil
+}
+
+// newSearchTermToken creates an unquoted term token, detecting the wildcard suffix
+func newSearchTermToken(pos int, field, value string) searchToken {
+	t := searchToken{kind: searchTokenTerm, pos: pos, field: field, value: value}
+	if strings.Contains(value, "*") {
+		t.wildcard = true
+	}
+	return t
+}
+
+// SearchNode is a node of the parsed search query
+type SearchNode interface {
+	searchNode()
+}
+
+// SearchAnd matches when all children match
+type SearchAnd struct {
+	Children []SearchNode
+}
+
+// SearchOr matches when any child matches
+type SearchOr struct {
+	Children []SearchNode
+}
+
+// SearchNot matches when its child does not match
+type SearchNot struct {
+	Child SearchNode
+}
+
+// SearchTerm is a single (optionally field-qualified) search term
+type SearchTerm struct {
+	Field    string // empty for free-text terms
+	Value    string
+	Quoted   bool // "quoted phrase"
+	Wildcard bool // contains "*"
+	Position int  // 1-based position in the query, for error reporting
+}
+
+func (SearchAnd) searchNode()  {}
+func (SearchOr) searchNode()   {}
+func (SearchNot) searchNode()  {}
+func (SearchTerm) searchNode() {}
+
+// SearchQuery represents a parsed search query
+type SearchQuery struct {
+	Root SearchNode // nil for an empty query
+}
+
+// IsEmpty reports whether the query has no conditions
+func (q *SearchQuery) IsEmpty() bool {
+	return q == nil || q.Root == nil
+}
+
+// Terms returns all terms of the query in order of appearance
+func (q *SearchQuery) Terms() []SearchTerm {
+	var terms []SearchTerm
+	if q.IsEmpty() {
+		return terms
+	}
+	var walk func(n SearchNode)
+	walk = func(n SearchNode) {
+		switch node := n.(type) {
+		case SearchAnd:
+			for _, c := range node.Children {
+				walk(c)
+			}
+		case SearchOr:
+			for _, c := range node.Children {
+				walk(c)
+			}
+		case SearchNot:
+			walk(node.Child)
+		case SearchTerm:
+			terms = append(terms, node)
+		}
+	}
+	walk(q.Root)
+	return terms
+}
+
+// PositiveTextTerms returns free-text terms that are not negated;
+// they are used for relevance ranking and highlighting.
+func (q *SearchQuery) PositiveTextTerms() []string {
+	var terms []string
+	if q.IsEmpty() {
+		return terms
+	}
+	var walk func(n SearchNode, negated bool)
+	walk = func(n SearchNode, negated bool) {
+		switch node := n.(type) {
+		case SearchAnd:
+			for _, c := range node.Children {
+				walk(c, negated)
+			}
+		case SearchOr:
+			for _, c := range node.Children {
+				walk(c, negated)
+			}
+		case SearchNot:
+			walk(node.Child, !negated)
+		case SearchTerm:
+			if !negated && node.Field == "" {
+				terms = append(terms, strings.ReplaceAll(node.Value, "*", ""))
+			}
+		}
+	}
+	walk(q.Root, false)
+	return terms
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+	depth  int // nesting of parentheses and NOTs being parsed
+}
+
+func (p *searchParser) peek() searchToken {
+	return p.tokens[p.pos]
+}
+
+func (p *searchParser) next() searchToken {
+	t := p.tokens[p.pos]
+	if t.kind != searchTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *searchParser) errorAt(t searchToken, msg string) error {
+	return &SearchSyntaxError{Position: t.pos + 1, Message: msg}
+}
+
+// enter descends into a parenthesis or NOT at t; leave must be deferred
+func (p *searchParser) enter(t searchToken) error {
+	if p.depth >= maxSearchNesting {
+		return p.errorAt(t, fmt.Sprintf("query is nested more than %d levels deep", maxSearchNesting))
+	}
+	p.depth++
+	return nil
+}
+
+func (p *searchParser) leave() {
+	p.depth--
+}
+
+func (p *searchParser) parseOr() (SearchNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []SearchNode{first}
+	for p.peek().kind == searchTokenOr {
+		p.next()
+		child, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return SearchOr{Children: children}, nil
+}
+
+func (p *searchParser) parseAnd() (SearchNode, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	children := []SearchNode{first}
+	for {
+		t := p.peek()
+		if t.kind == searchTokenAnd {
+			p.next()
+		} else if t.kind != searchTokenTerm && t.kind != searchTokenNot && t.kind != searchTokenLParen {
+			break
+		}
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return SearchAnd{Children: children}, nil
+}
+
+func (p *searchParser) parseNot() (SearchNode, error) {
+	if t := p.peek(); t.kind == searchTokenNot {
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		p.next()
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return SearchNot{Child: child}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *searchParser) parsePrimary() (SearchNode, error) {
+	t := p.next()
+	switch t.kind {
+	case searchTokenLParen:
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		if p.peek().kind == searchTokenRParen {
+			return nil, p.errorAt(p.peek(), "empty parentheses")
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.kind != searchTokenRParen {
+			return nil, p.errorAt(closing, fmt.Sprintf(`expected ")" to close "(" at position %d, got %s`, t.pos+1, closing.describe()))
+		}
+		return node, nil
+	case searchTokenTerm:
+		if t.value == "" {
+			return nil, p.errorAt(t, "empty quoted phrase")
+		}
+		return SearchTerm{
+			Field:    t.field,
+			Value:    t.value,
+			Quoted:   t.quoted,
+			Wildcard: t.wildcard,
+			Position: t.pos + 1,
+		}, nil
+	default:
+		return nil, p.errorAt(t, fmt.Sprintf("expected search term, got %s", t.describe()))
+	}
+}
+
+// ParseSearchQuery parses a search query string into a query tree.
+// Returns *SearchSyntaxError for malformed queries.
+func ParseSearchQuery(search string) (*SearchQuery, error) {
+	if strings.TrimSpace(search) == "" {
+		return &SearchQuery{}, nil
+	}
+	if utf8.RuneCountInString(search) > maxSearchQueryLength {
+		return nil, &SearchSyntaxError{
+			Position: maxSearchQueryLength + 1,
+			Message:  fmt.Sprintf("query is longer than %d characters", maxSearchQueryLength),
+		}
+	}
+
+	tokens, err := tokenizeSearchQuery(search)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &searchParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != searchTokenEOF {
+		if t.kind == searchTokenRParen {
+			return nil, p.errorAt(t, `unexpected ")" without matching "("`)
+		}
+		return nil, p.errorAt(t, fmt.Sprintf("unexpected %s", t.describe()))
+	}
+
+	return &SearchQuery{Root: root}, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// textTermSQL is the condition of an unquoted free-text term whose value is
+// bound to $p and its escaped ILIKE pattern to $p+1
+func textTermSQL(p int) string {
+	return fmt.Sprintf(`(positions.search_vector @@ (plainto_tsquery('russian', $%[1]d::text) || plainto_tsquery('english', $%[1]d::text)) OR `+
+		`positions.search_document ILIKE $%[2]d ESCAPE '\' OR word_similarity($%[1]d::text, positions.search_document) >= 0.4)`, p, p+1)
+}
+
+// phraseTermSQL is the condition of a quoted free-text phrase bound like textTermSQL
+func phraseTermSQL(p int) string {
+	return fmt.Sprintf(`(positions.search_vector @@ (phraseto_tsquery('russian', $%[1]d::text) || phraseto_tsquery('english', $%[1]d::text)) OR `+
+		`positions.search_document ILIKE $%[2]d ESCAPE '\')`, p, p+1)
+}
+
+const vacantSQL = `(COALESCE(employee_id, '') = '' AND COALESCE(employee_surname, '') = '' AND ` +
+	`COALESCE(employee_name, '') = '' AND COALESCE(employee_patronymic, '') = '')`
+
+var sqlSpaces = regexp.MustCompile(`\s+`)
+
+// compileSearch parses search and compiles it to a condition with its args
+func compileSearch(search string) (string, []interface{}, error) {
+	q, err := ParseSearchQuery(search)
+	if err != nil {
+		return "", nil, err
+	}
+	var args queryArgs
+	where, err := q.whereSQL(&args)
+	return sqlSpaces.ReplaceAllString(where, " "), args.values, err
+}
+
+func TestSearchQuerySQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		search string
+		sql    string
+		args   []interface{}
+	}{
+		{
+			name:   "empty",
+			search: "   ",
+			sql:    "",
+		},
+		{
+			name:   "single term",
+			search: "developer",
+			sql:    textTermSQL(1),
+			args:   []interface{}{"developer", "%developer%"},
+		},
+		{
+			name:   "adjacent terms are joined with AND",
+			search: "senior developer",
+			sql:    "(" + textTermSQL(1) + " AND " + textTermSQL(3) + ")",
+			args:   []interface{}{"senior", "%senior%", "developer", "%developer%"},
+		},
+		{
+			name:   "AND binds tighter than OR",
+			search: "a AND b OR c",
+			sql:    "((" + textTermSQL(1) + " AND " + textTermSQL(3) + ") OR " + textTermSQL(5) + ")",
+			args:   []interface{}{"a", "%a%", "b", "%b%", "c", "%c%"},
+		},
+		{
+			name:   "implicit AND binds tighter than OR",
+			search: "a OR b c",
+			sql:    "(" + textTermSQL(1) + " OR (" + textTermSQL(3) + " AND " + textTermSQL(5) + "))",
+			args:   []interface{}{"a", "%a%", "b", "%b%", "c", "%c%"},
+		},
+		{
+			name:   "parentheses override precedence",
+			search: "(a OR b) c",
+			sql:    "((" + textTermSQL(1) + " OR " + textTermSQL(3) + ") AND " + textTermSQL(5) + ")",
+			args:   []interface{}{"a", "%a%", "b", "%b%", "c", "%c%"},
+		},
+		{
+			name:   "operators are case insensitive",
+			search: "a or not b",
+			sql:    "(" + textTermSQL(1) + " OR NOT " + textTermSQL(3) + ")",
+			args:   []interface{}{"a", "%a%", "b", "%b%"},
+		},
+		{
+			name:   "NOT of a group",
+			search: "NOT (a OR b)",
+			sql:    "NOT (" + textTermSQL(1) + " OR " + textTermSQL(3) + ")",
+			args:   []interface{}{"a", "%a%", "b", "%b%"},
+		},
+		{
+			name:   "nesting up to the limit",
+			search: strings.Repeat("(", maxSearchNesting) + "a" + strings.Repeat(")", maxSearchNesting),
+			sql:    textTermSQL(1),
+			args:   []interface{}{"a", "%a%"},
+		},
+		{
+			name:   "double NOT",
+			search: "NOT NOT a",
+			sql:    "NOT NOT " + textTermSQL(1),
+			args:   []interface{}{"a", "%a%"},
+		},
+		{
+			name:   "quoted phrase",
+			search: `"senior developer"`,
+			sql:    phraseTermSQL(1),
+			args:   []interface{}{"senior developer", "%senior developer%"},
+		},
+		{
+			name:   "quoted phrase with escaped quote",
+			search: `"say \"hi\""`,
+			sql:    phraseTermSQL(1),
+			args:   []interface{}{`say "hi"`, `%say "hi"%`},
+		},
+		{
+			name:   "LIKE special characters in a term are escaped",
+			search: `50%_off\`,
+			sql:    textTermSQL(1),
+			args:   []interface{}{`50%_off\`, `%50\%\_off\\%`},
+		},
+		{
+			name:   "LIKE special characters and stars in a phrase are escaped",
+			search: `"100% *done*"`,
+			sql:    phraseTermSQL(1),
+			args:   []interface{}{"100% *done*", `%100\% *done*%`},
+		},
+		{
+			name:   "free-text wildcard",
+			search: "dev*",
+			sql:    `positions.search_document ILIKE $1 ESCAPE '\'`,
+			args:   []interface{}{"%dev%%"},
+		},
+		{
+			name:   "free-text wildcard keeps other characters literal",
+			search: "a_b*",
+			sql:    `positions.search_document ILIKE $1 ESCAPE '\'`,
+			args:   []interface{}{`%a\_b%%`},
+		},
+		{
+			name:   "built-in field",
+			search: "surname:Иванов",
+			sql:    `lower(COALESCE(employee_surname, '')) = lower($1::text)`,
+			args:   []interface{}{"Иванов"},
+		},
+		{
+			name:   "field names are case insensitive",
+			search: "NAME:Manager",
+			sql:    `lower(COALESCE(position_name, '')) = lower($1::text)`,
+			args:   []interface{}{"Manager"},
+		},
+		{
+			name:   "built-in field with wildcard",
+			search: "surname:Ив*",
+			sql:    `COALESCE(employee_surname, '') ILIKE $1 ESCAPE '\'`,
+			args:   []interface{}{"Ив%"},
+		},
+		{
+			name:   "built-in field with quoted value",
+			search: `name:"Head of Sales"`,
+			sql:    `lower(COALESCE(position_name, '')) = lower($1::text)`,
+			args:   []interface{}{"Head of Sales"},
+		},
+		{
+			name:   "custom field",
+			search: `department:"Sales"`,
+			sql: `EXISTS (SELECT 1 FROM custom_fields_values v JOIN custom_fields f ON f.id = v.custom_field_id ` +
+				`WHERE lower(f.key) = $1 AND positions.custom_fields_values_id @> jsonb_build_array(v.id::text) ` +
+				`AND lower(COALESCE(v.value, '')) = lower($2::text))`,
+			args: []interface{}{"department", "Sales"},
+		},
+		{
+			name:   "custom field with wildcard",
+			search: "department:Sal*",
+			sql: `EXISTS (SELECT 1 FROM custom_fields_values v JOIN custom_fields f ON f.id = v.custom_field_id ` +
+				`WHERE lower(f.key) = $1 AND positions.custom_fields_values_id @> jsonb_build_array(v.id::text) ` +
+				`AND COALESCE(v.value, '') ILIKE $2 ESCAPE '\')`,
+			args: []interface{}{"department", "Sal%"},
+		},
+		{
+			name:   "vacant",
+			search: "vacant:true",
+			sql:    vacantSQL,
+		},
+		{
+			name:   "not vacant",
+			search: "vacant:no",
+			sql:    "NOT " + vacantSQL,
+		},
+		{
+			name:   "fields combined with free text",
+			search: "vacant:false AND NOT surname:Ив* manager",
+			sql:    "(NOT " + vacantSQL + ` AND NOT COALESCE(employee_surname, '') ILIKE $1 ESCAPE '\' AND ` + textTermSQL(2) + ")",
+			args:   []interface{}{"Ив%", "manager", "%manager%"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args, err := compileSearch(tt.search)
+			if err != nil {
+				t.Fatalf("compileSearch(%q): %v", tt.search, err)
+			}
+			if sql != tt.sql {
+				t.Errorf("compileSearch(%q) SQL =\n%s\nwant\n%s", tt.search, sql, tt.sql)
+			}
+			if len(args) != 0 || len(tt.args) != 0 {
+				if !reflect.DeepEqual(args, tt.args) {
+					t.Errorf("compileSearch(%q) args = %q, want %q", tt.search, args, tt.args)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		search   string
+		position int
+		message  string
+	}{
+		{
+			name:     "unclosed parenthesis",
+			search:   "(a OR b",
+			position: 8,
+			message:  `expected ")" to close "(" at position 1, got end of query`,
+		},
+		{
+			name:     "unclosed nested parenthesis",
+			search:   "((a) b",
+			position: 7,
+			message:  `expected ")" to close "(" at position 1, got end of query`,
+		},
+		{
+			name:     "unmatched closing parenthesis",
+			search:   "a OR b)",
+			position: 7,
+			message:  `unexpected ")" without matching "("`,
+		},
+		{
+			name:     "empty parentheses",
+			search:   "a ()",
+			position: 4,
+			message:  "empty parentheses",
+		},
+		{
+			name:     "unterminated phrase",
+			search:   `name:"Head of`,
+			position: 6,
+			message:  "unterminated quoted phrase",
+		},
+		{
+			name:     "empty phrase",
+			search:   `a ""`,
+			position: 3,
+			message:  "empty quoted phrase",
+		},
+		{
+			name:     "leading operator",
+			search:   "OR a",
+			position: 1,
+			message:  "expected search term, got OR",
+		},
+		{
+			name:     "trailing operator",
+			search:   "a AND",
+			position: 6,
+			message:  "expected search term, got end of query",
+		},
+		{
+			name:     "NOT without operand",
+			search:   "a NOT",
+			position: 6,
+			message:  "expected search term, got end of query",
+		},
+		{
+			name:     "missing field name",
+			search:   "a :b",
+			position: 3,
+			message:  `missing field name before ":"`,
+		},
+		{
+			name:     "missing field value",
+			search:   "a surname:",
+			position: 3,
+			message:  `missing value for field "surname"`,
+		},
+		{
+			name:     "position counts characters, not bytes",
+			search:   "Иванов OR",
+			position: 10,
+			message:  "expected search term, got end of query",
+		},
+		{
+			name:     "parentheses nested too deep",
+			search:   strings.Repeat("(", maxSearchNesting+1) + "a" + strings.Repeat(")", maxSearchNesting+1),
+			position: maxSearchNesting + 1,
+			message:  "query is nested more than 64 levels deep",
+		},
+		{
+			name:     "NOTs nested too deep",
+			search:   strings.Repeat("NOT ", maxSearchNesting+1) + "a",
+			position: 4*maxSearchNesting + 1,
+			message:  "query is nested more than 64 levels deep",
+		},
+		{
+			name:     "query too long",
+			search:   strings.Repeat("a ", maxSearchQueryLength/2) + "b",
+			position: maxSearchQueryLength + 1,
+			message:  "query is longer than 1000 characters",
+		},
+		{
+			name:     "invalid vacant value",
+			search:   "a vacant:maybe",
+			position: 3,
+			message:  `field "vacant" expects true or false, got "maybe"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := compileSearch(tt.search)
+			var syntaxErr *SearchSyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("compileSearch(%q) error = %v, want *SearchSyntaxError", tt.search, err)
+			}
+			if syntaxErr.Position != tt.position || syntaxErr.Message != tt.message {
+				t.Errorf("compileSearch(%q) error at %d: %q, want at %d: %q",
+					tt.search, syntaxErr.Position, syntaxErr.Message, tt.position, tt.message)
+			}
+		})
+	}
+}
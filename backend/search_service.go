@@ -1,124 +1,315 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 )
 
-// SearchQuery represents a parsed search query
-type SearchQuery struct {
-	Conditions []SearchCondition
+// queryArgs accumulates positional parameters of a SQL statement
+type queryArgs struct {
+	values []interface{}
 }
 
-// SearchCondition represents a single search condition (AND group)
-type SearchCondition struct {
-	Terms []string // OR terms within this condition
+// add appends a parameter and returns its placeholder ($n)
+func (a *queryArgs) add(value interface{}) string {
+	a.values = append(a.values, value)
+	return `$` + strconv.Itoa(len(a.values))
 }
 
-// ParseSearchQuery parses a search query string into structured conditions
-// Supports AND/OR operators (case insensitive)
-func ParseSearchQuery(search string) *SearchQuery {
-	if search == "" {
-		return &SearchQuery{Conditions: []SearchCondition{}}
+// searchDocumentSQL is the text a position is searched in: position name,
+// employee name parts, employee_id and the text of its custom field values.
+// It is stored by triggers (see migration 029) and has a trigram index, so
+// ILIKE conditions on it can use the index.
+const searchDocumentSQL = `positions.search_document`
+
+// searchVectorSQL combines Russian and English full-text configurations so that
+// both Cyrillic and Latin words are stemmed. It is a generated column of
+// searchDocumentSQL with a GIN index.
+const searchVectorSQL = `positions.search_vector`
+
+// vacantPositionSQL matches positions without any employee data
+const vacantPositionSQL = `(COALESCE(employee_id, '') = '' AND COALESCE(employee_surname, '') = '' AND
+	COALESCE(employee_name, '') = '' AND COALESCE(employee_patronymic, '') = '')`
+
+// searchFieldColumns maps built-in search fields to positions columns.
+// Any other field is treated as a custom field key.
+var searchFieldColumns = map[string]string{
+	"name":          "position_name",
+	"position":      "position_name",
+	"surname":       "employee_surname",
+	"employee_name": "employee_name",
+	"patronymic":    "employee_patronymic",
+	"employee_id":   "employee_id",
+}
+
+// searchFieldVacant is a boolean field matching positions without an employee
+const searchFieldVacant = "vacant"
+
+// searchTSQuery builds a tsquery for the given parameter in both configurations
+func searchTSQuery(param string) string {
+	return `(plainto_tsquery('russian', ` + param + `) || plainto_tsquery('english', ` + param + `))`
+}
+
+// searchPhraseTSQuery builds a phrase tsquery for the given parameter in both configurations
+func searchPhraseTSQuery(param string) string {
+	return `(phraseto_tsquery('russian', ` + param + `) || phraseto_tsquery('english', ` + param + `))`
+}
+
+// fuzzyMatchThreshold is the minimal trigram word similarity of a fuzzy match
+const fuzzyMatchThreshold = "0.4"
+
+// termMatchSQL returns the condition matching a single search term: full-text
+// match, substring match or trigram word similarity of at least
+// fuzzyMatchThreshold.
+func termMatchSQL(value string, args *queryArgs) string {
+	param := args.add(value) + `::text`
+	return `(` + searchVectorSQL + ` @@ ` + searchTSQuery(param) + ` OR
+		` + substringMatchSQL(likeEscape(value), args) + ` OR
+		word_similarity(` + param + `, ` + searchDocumentSQL + `) >= ` + fuzzyMatchThreshold + `)`
+}
+
+// substringMatchSQL matches the search document containing an ILIKE pattern
+// built with likeEscape or likePattern
+func substringMatchSQL(pattern string, args *queryArgs) string {
+	return searchDocumentSQL + ` ILIKE ` + args.add("%"+pattern+"%") + ` ESCAPE '\'`
+}
+
+// termRankSQL returns the relevance of a position for a single search term:
+// full-text rank plus trigram similarity, so exact word matches go first and
+// typos still get a non-zero score.
+func termRankSQL(param string) string {
+	return `(ts_rank(` + searchVectorSQL + `, ` + searchTSQuery(param) + `) +
+		word_similarity(` + param + `, ` + searchDocumentSQL + `))`
+}
+
+// likeEscape escapes LIKE special characters so value matches literally
+// (with ESCAPE '\')
+func likeEscape(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(value)
+}
+
+// likePattern converts a term with "*" wildcards into an ILIKE pattern,
+// escaping LIKE special characters
+func likePattern(value string) string {
+	return strings.ReplaceAll(likeEscape(value), "*", "%")
+}
+
+// valueMatchSQL compares a text column with a field-qualified term:
+// case-insensitive equality, or ILIKE when the term contains wildcards
+func valueMatchSQL(columnSQL string, term SearchTerm, args *queryArgs) string {
+	if term.Wildcard {
+		return `COALESCE(` + columnSQL + `, '') ILIKE ` + args.add(likePattern(term.Value)) + ` ESCAPE '\'`
 	}
+	return `lower(COALESCE(` + columnSQL + `, '')) = lower(` + args.add(term.Value) + `::text)`
+}
+
+// termSQL compiles a single search term into a SQL condition
+func termSQL(term SearchTerm, args *queryArgs) (string, error) {
+	switch {
+	case term.Field == "":
+		// Free-text term
+		if term.Wildcard {
+			return substringMatchSQL(likePattern(term.Value), args), nil
+		}
+		if term.Quoted {
+			return `(` + searchVectorSQL + ` @@ ` + searchPhraseTSQuery(args.add(term.Value)+`::text`) + ` OR
+				` + substringMatchSQL(likeEscape(term.Value), args) + `)`, nil
+		}
+		return termMatchSQL(term.Value, args), nil
 
-	searchLower := strings.ToLower(search)
-	hasAnd := strings.Contains(searchLower, " and ")
-	hasOr := strings.Contains(searchLower, " or ")
+	case term.Field == searchFieldVacant:
+		switch strings.ToLower(term.Value) {
+		case "true", "yes", "1":
+			return vacantPositionSQL, nil
+		case "false", "no", "0":
+			return `NOT ` + vacantPositionSQL, nil
+		}
+		return "", &SearchSyntaxError{
+			Position: term.Position,
+			Message:  fmt.Sprintf("field %q expects true or false, got %q", searchFieldVacant, term.Value),
+		}
 
-	if !hasAnd && !hasOr {
-		// Simple search - single term
-		return &SearchQuery{
-			Conditions: []SearchCondition{
-				{Terms: []string{strings.TrimSpace(search)}},
-			},
+	default:
+		if column, ok := searchFieldColumns[term.Field]; ok {
+			return valueMatchSQL(column, term, args), nil
 		}
+		// Custom field key: match the text of the position's value for this field
+		return `EXISTS (SELECT 1 FROM custom_fields_values v
+			JOIN custom_fields f ON f.id = v.custom_field_id
+			WHERE lower(f.key) = ` + args.add(term.Field) + `
+			AND positions.custom_fields_values_id @> jsonb_build_array(v.id::text)
+			AND ` + valueMatchSQL("v.value", term, args) + `)`, nil
 	}
+}
 
-	var conditions []SearchCondition
+// searchNodeSQL compiles a query node into a SQL condition
+func searchNodeSQL(node SearchNode, args *queryArgs) (string, error) {
+	switch n := node.(type) {
+	case SearchTerm:
+		return termSQL(n, args)
+	case SearchNot:
+		child, err := searchNodeSQL(n.Child, args)
+		if err != nil {
+			return "", err
+		}
+		return `NOT ` + child, nil
+	case SearchAnd:
+		return joinSearchNodesSQL(n.Children, " AND ", args)
+	case SearchOr:
+		return joinSearchNodesSQL(n.Children, " OR ", args)
+	}
+	return "", fmt.Errorf("unknown search node %T", node)
+}
 
-	// Split by AND first (higher priority)
+// joinSearchNodesSQL compiles child nodes and joins them with the given operator
+func joinSearchNodesSQL(children []SearchNode, op string, args *queryArgs) (string, error) {
 	var parts []string
-	if hasAnd {
-		parts = strings.Split(search, " AND ")
-		for i, part := range parts {
-			parts[i] = strings.TrimSpace(part)
-		}
-	} else {
-		parts = []string{search}
-	}
-
-	// Process each part (which may contain OR)
-	for _, part := range parts {
-		if strings.Contains(strings.ToLower(part), " or ") {
-			orParts := strings.Split(part, " OR ")
-			var terms []string
-			for _, orPart := range orParts {
-				orPart = strings.TrimSpace(orPart)
-				if orPart != "" {
-					terms = append(terms, orPart)
-				}
-			}
-			if len(terms) > 0 {
-				conditions = append(conditions, SearchCondition{Terms: terms})
-			}
-		} else {
-			if part != "" {
-				conditions = append(conditions, SearchCondition{Terms: []string{part}})
-			}
+	for _, c := range children {
+		part, err := searchNodeSQL(c, args)
+		if err != nil {
+			return "", err
 		}
+		parts = append(parts, part)
+	}
+	return "(" + strings.Join(parts, op) + ")", nil
+}
+
+// whereSQL compiles the query into a SQL condition over the positions table,
+// appending its parameters to args. Returns "" for an empty query.
+func (q *SearchQuery) whereSQL(args *queryArgs) (string, error) {
+	if q.IsEmpty() {
+		return "", nil
 	}
+	return searchNodeSQL(q.Root, args)
+}
 
-	return &SearchQuery{Conditions: conditions}
+// rankSQL builds a SQL expression computing search relevance from the
+// non-negated free-text terms of the query
+func (q *SearchQuery) rankSQL(args *queryArgs) string {
+	terms := q.PositiveTextTerms()
+	if len(terms) == 0 {
+		return "0"
+	}
+	var ranks []string
+	for _, term := range terms {
+		ranks = append(ranks, termRankSQL(args.add(term)+`::text`))
+	}
+	return "(" + strings.Join(ranks, " + ") + ")"
 }
 
-// BuildWhereClause builds a SQL WHERE clause from parsed search conditions
-func BuildWhereClause(query *SearchQuery) (string, []interface{}) {
-	if query == nil || len(query.Conditions) == 0 {
-		return "", []interface{}{}
+// searchHeadlineOptions wraps matched words with <mark> tags
+const searchHeadlineOptions = `StartSel=<mark>, StopSel=</mark>, HighlightAll=true`
+
+// headlineSQL builds a ts_headline expression that highlights matches of the
+// non-negated free-text terms in the given text expression
+func (q *SearchQuery) headlineSQL(args *queryArgs, textSQL string) string {
+	terms := q.PositiveTextTerms()
+	if len(terms) == 0 {
+		return textSQL
 	}
+	var tsQueries []string
+	for _, term := range terms {
+		tsQueries = append(tsQueries, searchTSQuery(args.add(term)+`::text`))
+	}
+	return `ts_headline('russian', ` + textSQL + `, ` + strings.Join(tsQueries, " || ") + `, '` + searchHeadlineOptions + `')`
+}
 
-	var conditions []string
-	var args []interface{}
-	argIndex := 1
+// parseSearch parses a search query and checks that every field-qualified term
+// refers to a built-in field or an existing custom field key.
+func (h *Handler) parseSearch(ctx context.Context, search string) (*SearchQuery, error) {
+	query, err := ParseSearchQuery(search)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, condition := range query.Conditions {
-		if len(condition.Terms) == 0 {
+	var customFieldKeys map[string]bool
+	for _, term := range query.Terms() {
+		if term.Field == "" || term.Field == searchFieldVacant {
 			continue
 		}
-
-		if len(condition.Terms) == 1 {
-			// Single term - simple condition
-			conditions = append(conditions,
-				`(position_name ILIKE $`+strconv.Itoa(argIndex)+` OR 
-				COALESCE(employee_surname, '') ILIKE $`+strconv.Itoa(argIndex)+` OR 
-				COALESCE(employee_name, '') ILIKE $`+strconv.Itoa(argIndex)+` OR 
-				COALESCE(employee_patronymic, '') ILIKE $`+strconv.Itoa(argIndex)+`)`)
-			args = append(args, "%"+condition.Terms[0]+"%")
-			argIndex++
-		} else {
-			// Multiple terms - OR condition
-			var orConditions []string
-			for _, term := range condition.Terms {
-				orConditions = append(orConditions,
-					`(position_name ILIKE $`+strconv.Itoa(argIndex)+` OR 
-					COALESCE(employee_surname, '') ILIKE $`+strconv.Itoa(argIndex)+` OR 
-					COALESCE(employee_name, '') ILIKE $`+strconv.Itoa(argIndex)+` OR 
-					COALESCE(employee_patronymic, '') ILIKE $`+strconv.Itoa(argIndex)+`)`)
-				args = append(args, "%"+term+"%")
-				argIndex++
+		if _, ok := searchFieldColumns[term.Field]; ok {
+			continue
+		}
+		if customFieldKeys == nil {
+			fieldInfoMap, err := h.customFieldsService.LoadFieldInfoMap(ctx)
+			if err != nil {
+				return nil, err
 			}
-			if len(orConditions) > 0 {
-				conditions = append(conditions, "("+strings.Join(orConditions, " OR ")+")")
+			customFieldKeys = make(map[string]bool, len(fieldInfoMap))
+			for _, info := range fieldInfoMap {
+				customFieldKeys[strings.ToLower(info.Key)] = true
+			}
+		}
+		if !customFieldKeys[term.Field] {
+			return nil, &SearchSyntaxError{
+				Position: term.Position,
+				Message:  fmt.Sprintf("unknown field %q", term.Field),
 			}
 		}
 	}
 
-	if len(conditions) == 0 {
-		return "", []interface{}{}
-	}
+	return query, nil
+}
 
-	return strings.Join(conditions, " AND "), args
+// PositionMatch is a position matched by a search query with its relevance
+type PositionMatch struct {
+	ID        int64
+	Relevance float64
 }
 
+// searchPositions returns positions matching the search query and filters,
+// ordered by relevance
+func (h *Handler) searchPositions(ctx context.Context, query *SearchQuery, filters PositionFilters) ([]PositionMatch, error) {
+	args := &queryArgs{}
+	searchClause, err := query.whereSQL(args)
+	if err != nil {
+		return nil, err
+	}
+	conditions := []string{"TRUE"}
+	if searchClause != "" {
+		conditions = append(conditions, searchClause)
+	}
+	conditions = append(conditions, filters.whereSQL(args)...)
+	where := strings.Join(conditions, " AND ")
+
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT id, `+query.rankSQL(args)+` AS relevance FROM positions
+		WHERE `+where+` ORDER BY relevance DESC, id`,
+		args.values...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	var matches []PositionMatch
+	for rows.Next() {
+		var m PositionMatch
+		if err := rows.Scan(&m.ID, &m.Relevance); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// writeSearchError reports an invalid search query or list parameters as
+// 400 Bad Request and any other error as 500
+func writeSearchError(w http.ResponseWriter, err error) {
+	var syntaxErr *SearchSyntaxError
+	if errors.As(err, &syntaxErr) {
+		http.Error(w, syntaxErr.Error(), http.StatusBadRequest)
+		return
+	}
+	var queryErr *positionQueryError
+	if errors.As(err, &queryErr) {
+		http.Error(w, queryErr.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// embeddedWeb holds the built frontend copied into backend/web before
+// `go build` (see SETUP.md). Without a build only web/.gitkeep is embedded
+// and the server serves the API alone.
+//
+//go:embed all:web
+var embeddedWeb embed.FS
+
+// newSPAHandler serves the embedded frontend: existing files as is and
+// index.html for any other path so that client-side routing works.
+// Returns nil when no frontend build is embedded.
+func newSPAHandler() http.Handler {
+	webFS, err := fs.Sub(embeddedWeb, "web")
+	if err != nil {
+		return nil
+	}
+	if _, err := fs.Stat(webFS, "index.html"); err != nil {
+		return nil
+	}
+	fileServer := http.FileServer(http.FS(webFS))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Unknown API paths stay 404 instead of returning index.html
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			http.NotFound(w, r)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" || name == "index.html" {
+			serveSPAIndex(w, r, webFS)
+			return
+		}
+		if info, err := fs.Stat(webFS, name); err != nil || info.IsDir() {
+			serveSPAIndex(w, r, webFS)
+			return
+		}
+		// Hashed assets from the build can be cached for long
+		if strings.HasPrefix(name, "static/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// serveSPAIndex writes index.html; it is never cached so new builds are picked up
+func serveSPAIndex(w http.ResponseWriter, r *http.Request, webFS fs.FS) {
+	content, err := fs.ReadFile(webFS, "index.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(content)
+}
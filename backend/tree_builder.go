@@ -1,20 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
-	// Local handler to reuse helper logic that builds custom_fields with linked_custom_fields
-	h := &Handler{
-		db:                  db,
-		customFieldsService: NewCustomFieldsService(db),
-	}
+// buildTreeStructure builds the runtime tree. db may be a transaction, which
+// lets scenarios render a tree with their changes applied.
+func buildTreeStructure(ctx context.Context, db dbQuerier, tree TreeDefinition) TreeStructure {
 
 	structure := TreeStructure{
 		TreeID: tree.ID.String(),
@@ -25,10 +26,18 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 			Children: []TreeNode{},
 		},
 	}
+	start := time.Now()
+	defer observeTreeBuild(start, &structure)
+
+	ctx, span := tracer.Start(ctx, "buildTreeStructure", trace.WithAttributes(
+		attribute.String("tree.id", tree.ID.String()),
+		attribute.Int("tree.levels", len(tree.Levels)),
+	))
+	defer span.End()
 
 	// If no levels, return plain list of positions
 	if len(tree.Levels) == 0 {
-		rows, _ := db.Query(
+		rows, _ := db.QueryContext(ctx,
 			`SELECT id, position_name, employee_surname, employee_name, employee_patronymic FROM positions ORDER BY id`,
 		)
 		defer rows.Close()
@@ -79,12 +88,16 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 				})
 			}
 		}
+		orderTreeNodes(&structure.Root, "", loadTreePositionOrder(ctx, db, tree.ID))
 		return structure
 	}
 
+	// Phase: load positions and restore their custom fields
+	positionsCtx, positionsSpan := tracer.Start(ctx, "buildTreeStructure.loadPositions")
+
 	// Pre-load field-to-values mapping using service
 	customFieldsService := NewCustomFieldsService(db)
-	_, _, fieldToValuesMap, _ := customFieldsService.LoadAllCustomFieldsData()
+	_, _, fieldToValuesMap, _ := customFieldsService.LoadAllCustomFieldsData(positionsCtx)
 
 	// Build value-to-field mapping
 	valueToFieldMap := make(map[uuid.UUID]uuid.UUID)
@@ -95,7 +108,7 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 	}
 
 	// Get all positions в порядке их создания (по id)
-	rows, _ := db.Query(
+	rows, _ := db.QueryContext(positionsCtx,
 		// ВАЖНО:
 		//  - custom_fields_id теперь хранит ID самих кастомных полей (field_id),
 		//  - custom_fields_values_id хранит ID выбранных значений (value_id).
@@ -105,7 +118,6 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 		// с учётом linked_custom_fields так же, как это делает ручка positions/{id}.
 		`SELECT id, position_name, custom_fields_id, custom_fields_values_id, employee_id, employee_surname, employee_name, employee_patronymic FROM positions ORDER BY id`,
 	)
-	defer rows.Close()
 
 	var positions []struct {
 		ID                   string
@@ -115,7 +127,29 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 		EmployeeFullName     *string
 	}
 
-	for rows.Next() {
+	// Rows are read completely before custom fields are restored: inside a
+	// transaction no other query can run while they are open.
+	type positionRow struct {
+		id, name                  string
+		customFieldsIDsJSON       []byte
+		customFieldsValuesIDsJSON []byte
+		surname                   sql.NullString
+		employeeName              sql.NullString
+		patronymic                sql.NullString
+	}
+	var positionRows []positionRow
+	if rows != nil {
+		for rows.Next() {
+			var row positionRow
+			var employeeExternalID sql.NullString
+			if err := rows.Scan(&row.id, &row.name, &row.customFieldsIDsJSON, &row.customFieldsValuesIDsJSON, &employeeExternalID, &row.surname, &row.employeeName, &row.patronymic); err == nil {
+				positionRows = append(positionRows, row)
+			}
+		}
+		rows.Close()
+	}
+
+	for _, row := range positionRows {
 		var p struct {
 			ID                 string
 			Name               string
@@ -123,69 +157,74 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 			CustomFieldDetails map[string]PositionCustomFieldValue
 			EmployeeFullName   *string
 		}
-		var customFieldsIDsJSON []byte
-		var customFieldsValuesIDsJSON []byte
-		var employeeExternalID sql.NullString
-		var surname sql.NullString
-		var employeeName sql.NullString
-		var patronymic sql.NullString
-		if err := rows.Scan(&p.ID, &p.Name, &customFieldsIDsJSON, &customFieldsValuesIDsJSON, &employeeExternalID, &surname, &employeeName, &patronymic); err == nil {
-			p.CustomFields = make(map[string]string)
-			p.CustomFieldDetails = make(map[string]PositionCustomFieldValue)
-
-			// Восстанавливаем те же структуры custom_fields, что и в ручке positions/{id},
-			// чтобы структура дерева учитывала все linked_custom_fields и их значения.
-			var cfIDs UUIDArray
-			var cfValueIDs UUIDArray
-			if customFieldsIDsJSON != nil {
-				_ = json.Unmarshal(customFieldsIDsJSON, &cfIDs)
-			}
-			if customFieldsValuesIDsJSON != nil {
-				_ = json.Unmarshal(customFieldsValuesIDsJSON, &cfValueIDs)
-			}
-
-			if len(cfIDs) > 0 && len(cfValueIDs) > 0 {
-				if customFieldsArray, err := h.buildCustomFieldsArrayFromIDs(&cfIDs, &cfValueIDs); err == nil {
-					for _, cf := range customFieldsArray {
-						// Сохраняем основное значение поля по его key —
-						// именно по нему строится путь в дереве.
-						if _, exists := p.CustomFields[cf.CustomFieldKey]; !exists {
-							p.CustomFields[cf.CustomFieldKey] = cf.CustomFieldValue
-						}
-						// И отдельную детальную структуру, включающую linked_custom_fields.
-						if _, exists := p.CustomFieldDetails[cf.CustomFieldKey]; !exists {
-							p.CustomFieldDetails[cf.CustomFieldKey] = cf
-						}
+		p.ID, p.Name = row.id, row.name
+		customFieldsIDsJSON, customFieldsValuesIDsJSON := row.customFieldsIDsJSON, row.customFieldsValuesIDsJSON
+		surname, employeeName, patronymic := row.surname, row.employeeName, row.patronymic
+		p.CustomFields = make(map[string]string)
+		p.CustomFieldDetails = make(map[string]PositionCustomFieldValue)
+
+		// Восстанавливаем те же структуры custom_fields, что и в ручке positions/{id},
+		// чтобы структура дерева учитывала все linked_custom_fields и их значения.
+		var cfIDs UUIDArray
+		var cfValueIDs UUIDArray
+		if customFieldsIDsJSON != nil {
+			_ = json.Unmarshal(customFieldsIDsJSON, &cfIDs)
+		}
+		if customFieldsValuesIDsJSON != nil {
+			_ = json.Unmarshal(customFieldsValuesIDsJSON, &cfValueIDs)
+		}
+
+		if len(cfIDs) > 0 && len(cfValueIDs) > 0 {
+			if customFieldsArray, err := customFieldsService.BuildCustomFieldsArrayFromIDs(positionsCtx, &cfIDs, &cfValueIDs); err == nil {
+				for _, cf := range customFieldsArray {
+					// Сохраняем основное значение поля по его key —
+					// именно по нему строится путь в дереве.
+					if _, exists := p.CustomFields[cf.CustomFieldKey]; !exists {
+						p.CustomFields[cf.CustomFieldKey] = cf.CustomFieldValue
+					}
+					// И отдельную детальную структуру, включающую linked_custom_fields.
+					if _, exists := p.CustomFieldDetails[cf.CustomFieldKey]; !exists {
+						p.CustomFieldDetails[cf.CustomFieldKey] = cf
 					}
 				}
 			}
+		}
 
-			// Combine surname, employee_name, patronymic into full name
-			var parts []string
-			if surname.Valid && surname.String != "" {
-				parts = append(parts, surname.String)
-			}
-			if employeeName.Valid && employeeName.String != "" {
-				parts = append(parts, employeeName.String)
-			}
-			if patronymic.Valid && patronymic.String != "" {
-				parts = append(parts, patronymic.String)
-			}
-			if len(parts) > 0 {
-				fullName := fmt.Sprintf("%s", parts[0])
-				for i := 1; i < len(parts); i++ {
-					fullName += " " + parts[i]
-				}
-				p.EmployeeFullName = &fullName
+		// Combine surname, employee_name, patronymic into full name
+		var parts []string
+		if surname.Valid && surname.String != "" {
+			parts = append(parts, surname.String)
+		}
+		if employeeName.Valid && employeeName.String != "" {
+			parts = append(parts, employeeName.String)
+		}
+		if patronymic.Valid && patronymic.String != "" {
+			parts = append(parts, patronymic.String)
+		}
+		if len(parts) > 0 {
+			fullName := fmt.Sprintf("%s", parts[0])
+			for i := 1; i < len(parts); i++ {
+				fullName += " " + parts[i]
 			}
-			positions = append(positions, p)
+			p.EmployeeFullName = &fullName
 		}
+		positions = append(positions, p)
 	}
 
+	positionsSpan.SetAttributes(attribute.Int("positions", len(positions)))
+	positionsSpan.End()
+
 	// First, determine positions that have at least one non‑empty value
 	// for any of the tree levels. Остальные считаем полностью "вне структуры".
+	// If the first level sets missing_value explicitly, it also decides where
+	// these positions go, so all of them are passed into the tree builder.
 	structuredPositionIDs := make(map[string]bool)
+	placeAllPositions := tree.Levels[0].MissingValue != ""
 	for _, pos := range positions {
+		if placeAllPositions {
+			structuredPositionIDs[pos.ID] = true
+			continue
+		}
 	levelScan:
 		for _, lvl := range tree.Levels {
 			if val, ok := pos.CustomFields[lvl.CustomFieldKey]; ok && val != "" {
@@ -211,10 +250,10 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 	}
 
 	// Load custom field definitions to check for linked fields
-	fieldDefsByKey := loadCustomFieldDefinitions(db)
+	fieldDefsByKey := loadCustomFieldDefinitions(ctx, db)
 
 	// Pre-load superior information for all custom_field_values
-	superiorMap := loadSuperiorMap(db)
+	superiorMap := loadSuperiorMap(ctx, db)
 
 	// Create a map of tree level field keys for quick lookup
 	treeLevelFieldKeys := make(map[string]bool)
@@ -223,9 +262,9 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 	}
 
 	// Build structured part of the tree recursively на основе только структурированных позиций.
-	structuredChildren := buildTreeLevel(structuredPositions, tree.Levels, 0, nil, fieldDefsByKey, treeLevelFieldKeys, superiorMap)
-
-	// Collect positions that don't participate in the tree at all (no values for any tree level keys)
+	// Positions of levels with missing_value "outside" are collected into
+	// unstructuredPositions and shown in the "Вне структуры" group.
+	_, levelsSpan := tracer.Start(ctx, "buildTreeStructure.buildLevels")
 	unstructuredPositions := make([]struct {
 		ID                 string
 		Name               string
@@ -233,9 +272,18 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 		CustomFieldDetails map[string]PositionCustomFieldValue
 		EmployeeFullName   *string
 	}, 0)
+	structuredChildren := buildTreeLevel(structuredPositions, tree.Levels, 0, nil, fieldDefsByKey, treeLevelFieldKeys, superiorMap, &unstructuredPositions)
+	levelsSpan.End()
 
+	// Collect positions that don't participate in the tree at all (no values for any tree level keys)
+	// together with the ones moved out by levels, keeping the order by id
+	outsidePositionIDs := make(map[string]bool)
+	for _, pos := range unstructuredPositions {
+		outsidePositionIDs[pos.ID] = true
+	}
+	unstructuredPositions = unstructuredPositions[:0]
 	for _, pos := range positions {
-		if !structuredPositionIDs[pos.ID] {
+		if !structuredPositionIDs[pos.ID] || outsidePositionIDs[pos.ID] {
 			unstructuredPositions = append(unstructuredPositions, pos)
 		}
 	}
@@ -272,7 +320,14 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 	// Защитный fallback: если по какой‑то причине дерево уровней не смогло
 	// распределить ни одной должности по веткам, показываем все позиции
 	// плоским списком, чтобы они не "пропадали" из интерфейса.
-	if len(structuredChildren) == 0 && len(positions) > 0 {
+	// Levels that hide positions may legitimately leave the tree empty.
+	hidesPositions := false
+	for _, level := range tree.Levels {
+		if level.MissingValue == TreeMissingHide {
+			hidesPositions = true
+		}
+	}
+	if len(structuredChildren) == 0 && len(positions) > 0 && !hidesPositions {
 		var flat []TreeNode
 		for _, pos := range positions {
 			positionID := pos.ID
@@ -291,75 +346,98 @@ func buildTreeStructure(db *sql.DB, tree TreeDefinition) TreeStructure {
 
 	structure.Root.Children = structuredChildren
 
+	// Manual order of positions within nodes (PUT /api/trees/{id}/order)
+	orderTreeNodes(&structure.Root, "", loadTreePositionOrder(ctx, db, tree.ID))
+
 	return structure
 }
 
-func loadCustomFieldDefinitions(db *sql.DB) map[string]CustomFieldDefinition {
+func loadCustomFieldDefinitions(ctx context.Context, db dbQuerier) map[string]CustomFieldDefinition {
+	ctx, span := tracer.Start(ctx, "loadCustomFieldDefinitions")
+	defer span.End()
+
 	fieldDefsByKey := make(map[string]CustomFieldDefinition)
 
 	// Pre-load all custom fields data using service
 	customFieldsService := NewCustomFieldsService(db)
-	fieldInfoMap, valueInfoMap, fieldToValuesMap, err := customFieldsService.LoadAllCustomFieldsData()
+	fieldInfoMap, valueInfoMap, fieldToValuesMap, err := customFieldsService.LoadAllCustomFieldsData(ctx)
 	if err != nil {
 		return fieldDefsByKey
 	}
 
-	// Load custom field definitions with allowed values and linked fields
-	rows, err := db.Query(
+	// Load custom field definitions with allowed values and linked fields.
+	// Definitions are read completely before their values are queried, so this
+	// also works inside a transaction.
+	rows, err := db.QueryContext(ctx,
 		`SELECT id, key, label, allowed_values_ids, created_at, updated_at
 		FROM custom_fields`,
 	)
 	if err != nil {
 		return fieldDefsByKey
 	}
-	defer rows.Close()
-
+	type fieldRow struct {
+		field               CustomFieldDefinition
+		allowedValueIDsJSON []byte
+	}
+	var fieldRows []fieldRow
 	for rows.Next() {
-		var f CustomFieldDefinition
-		var allowedValueIDsJSON []byte
-		if err := rows.Scan(&f.ID, &f.Key, &f.Label, &allowedValueIDsJSON,
-			&f.CreatedAt, &f.UpdatedAt); err == nil {
-			// Load custom_fields_values and build allowed_values with linked_custom_fields
-			if allowedValueIDsJSON != nil {
-				var ids []string
-				if err := json.Unmarshal(allowedValueIDsJSON, &ids); err == nil {
-					var allowedValues AllowedValuesArray
-
-					for _, idStr := range ids {
-						if valueID, err := uuid.Parse(idStr); err == nil {
-							var cv CustomFieldValue
-							var linkedCustomFieldIDsJSON []byte
-							var linkedCustomFieldValueIDsJSON []byte
-
-							err := db.QueryRow(
-								`SELECT id, value, linked_custom_fields_ids, linked_custom_fields_values_ids, created_at, updated_at
-								FROM custom_fields_values WHERE id = $1`,
-								valueID,
-							).Scan(&cv.ID, &cv.Value, &linkedCustomFieldIDsJSON, &linkedCustomFieldValueIDsJSON, &cv.CreatedAt, &cv.UpdatedAt)
-							if err == nil {
-								// Build linked_custom_fields structure using service
-								linkedCustomFields, _ := customFieldsService.BuildLinkedCustomFields(
-									linkedCustomFieldIDsJSON,
-									linkedCustomFieldValueIDsJSON,
-									fieldInfoMap,
-									fieldToValuesMap,
-									valueInfoMap,
-									nil, // No filtering by selected values in this context
-								)
-
-								allowedValues = append(allowedValues, AllowedValue{
-									ValueID:            cv.ID,
-									Value:              cv.Value,
-									LinkedCustomFields: linkedCustomFields,
-								})
+		var row fieldRow
+		if err := rows.Scan(&row.field.ID, &row.field.Key, &row.field.Label, &row.allowedValueIDsJSON,
+			&row.field.CreatedAt, &row.field.UpdatedAt); err == nil {
+			fieldRows = append(fieldRows, row)
+		}
+	}
+	rows.Close()
+
+	for _, row := range fieldRows {
+		f := row.field
+		allowedValueIDsJSON := row.allowedValueIDsJSON
+		// Load custom_fields_values and build allowed_values with linked_custom_fields
+		if allowedValueIDsJSON != nil {
+			var ids []string
+			if err := json.Unmarshal(allowedValueIDsJSON, &ids); err == nil {
+				var allowedValues AllowedValuesArray
+
+				for _, idStr := range ids {
+					if valueID, err := uuid.Parse(idStr); err == nil {
+						var cv CustomFieldValue
+						var linkedCustomFieldIDsJSON []byte
+						var linkedCustomFieldValueIDsJSON []byte
+						var sortOrder sql.NullInt64
+
+						err := db.QueryRowContext(ctx,
+							`SELECT id, value, linked_custom_fields_ids, linked_custom_fields_values_ids, sort_order, created_at, updated_at
+							FROM custom_fields_values WHERE id = $1`,
+							valueID,
+						).Scan(&cv.ID, &cv.Value, &linkedCustomFieldIDsJSON, &linkedCustomFieldValueIDsJSON, &sortOrder, &cv.CreatedAt, &cv.UpdatedAt)
+						if err == nil {
+							// Build linked_custom_fields structure using service
+							linkedCustomFields, _ := customFieldsService.BuildLinkedCustomFields(
+								linkedCustomFieldIDsJSON,
+								linkedCustomFieldValueIDsJSON,
+								fieldInfoMap,
+								fieldToValuesMap,
+								valueInfoMap,
+								nil, // No filtering by selected values in this context
+							)
+
+							allowedValue := AllowedValue{
+								ValueID:            cv.ID,
+								Value:              cv.Value,
+								LinkedCustomFields: linkedCustomFields,
 							}
+							if sortOrder.Valid {
+								order := int(sortOrder.Int64)
+								allowedValue.SortOrder = &order
+							}
+							allowedValues = append(allowedValues, allowedValue)
 						}
 					}
-					f.AllowedValues = &allowedValues
 				}
+				f.AllowedValues = &allowedValues
 			}
-			fieldDefsByKey[f.Key] = f
 		}
+		fieldDefsByKey[f.Key] = f
 	}
 
 	return fieldDefsByKey
@@ -382,7 +460,13 @@ func buildTreeLevel(positions []struct {
 	CustomFields       map[string]string
 	CustomFieldDetails map[string]PositionCustomFieldValue
 	EmployeeFullName   *string
-}, levels []TreeLevel, levelIndex int, path map[string]string, fieldDefsByKey map[string]CustomFieldDefinition, treeLevelFieldKeys map[string]bool, superiorMap map[uuid.UUID]*int64) []TreeNode {
+}, levels []TreeLevel, levelIndex int, path map[string]string, fieldDefsByKey map[string]CustomFieldDefinition, treeLevelFieldKeys map[string]bool, superiorMap map[uuid.UUID]*int64, outside *[]struct {
+	ID                 string
+	Name               string
+	CustomFields       map[string]string
+	CustomFieldDetails map[string]PositionCustomFieldValue
+	EmployeeFullName   *string
+}) []TreeNode {
 	if levelIndex >= len(levels) {
 		// Leaf level - return positions
 		var nodes []TreeNode
@@ -431,27 +515,55 @@ func buildTreeLevel(positions []struct {
 		valueSet[val] = true
 	}
 
+	// Get field definition to check for linked fields
+	fieldDef, hasFieldDef := fieldDefsByKey[fieldKey]
+	levelLabel := level.Label
+	if levelLabel == "" && hasFieldDef {
+		levelLabel = fieldDef.Label
+	}
+
+	// Должности без значения текущего уровня размещаются согласно missing_value уровня
+	var missingNodes []TreeNode
+	for _, pos := range positionsWithoutValue {
+		if level.MissingValue == TreeMissingOutside {
+			*outside = append(*outside, pos)
+			continue
+		}
+		if level.MissingValue == TreeMissingHide {
+			continue
+		}
+		positionID := pos.ID
+		positionName := pos.Name
+		missingNodes = append(missingNodes, TreeNode{
+			Type:             "position",
+			PositionID:       &positionID,
+			PositionName:     &positionName,
+			EmployeeFullName: pos.EmployeeFullName,
+			Children:         []TreeNode{},
+		})
+	}
+	if level.MissingValue == TreeMissingGroup && len(missingNodes) > 0 {
+		missingLabel := level.MissingLabel
+		if missingLabel == "" {
+			missingLabel = "Не указано"
+		}
+		levelOrder := order
+		// custom_field_key is intentionally nil so that frontend won't add any path constraints
+		missingNodes = []TreeNode{{
+			Type:             "custom_field_value",
+			LevelOrder:       &levelOrder,
+			CustomFieldValue: &missingLabel,
+			LevelLabel:       &levelLabel,
+			Children:         missingNodes,
+		}}
+	}
+
 	// Если по текущему уровню вообще нет значений (ни одна должность не заполнила это поле),
 	// дальше делить смысла нет — отображаем должности на текущем уровне как листья.
-	if len(valueSet) == 0 {
-		var nodes []TreeNode
-		for _, pos := range positionsWithoutValue {
-			positionID := pos.ID
-			positionName := pos.Name
-			nodes = append(nodes, TreeNode{
-				Type:            "position",
-				PositionID:      &positionID,
-				PositionName:    &positionName,
-				EmployeeFullName: pos.EmployeeFullName,
-				Children:        []TreeNode{},
-			})
-		}
+	if len(valueSet) == 0 && !level.ShowEmptyValues {
 		// Сохраняем порядок по id (как пришло из БД), без сортировки по имени
-		return nodes
+		return missingNodes
 	}
-
-	// Get field definition to check for linked fields
-	fieldDef, hasFieldDef := fieldDefsByKey[fieldKey]
 	
 	// Check if any value has linked custom fields
 	hasLinkedFields := false
@@ -614,7 +726,7 @@ func buildTreeLevel(positions []struct {
 				}
 				newPath[fieldKey] = val
 
-				children := buildTreeLevel(groupPositions, levels, levelIndex+1, newPath, fieldDefsByKey, treeLevelFieldKeys, superiorMap)
+				children := buildTreeLevel(groupPositions, levels, levelIndex+1, newPath, fieldDefsByKey, treeLevelFieldKeys, superiorMap, outside)
 
 				// Build linked custom fields и основное значение на основе той же логики,
 				// что и в ручке positions/{id}: берём структуру из CustomFieldDetails.
@@ -691,7 +803,7 @@ func buildTreeLevel(positions []struct {
 				}
 				newPath[fieldKey] = val
 
-				children := buildTreeLevel(positionsWithoutLinkedValue, levels, levelIndex+1, newPath, fieldDefsByKey, treeLevelFieldKeys, superiorMap)
+				children := buildTreeLevel(positionsWithoutLinkedValue, levels, levelIndex+1, newPath, fieldDefsByKey, treeLevelFieldKeys, superiorMap, outside)
 
 				// Build linked custom fields (all linked fields from definition)
 				linkedFields := buildLinkedCustomFields(matchedAllowedValue)
@@ -762,7 +874,7 @@ func buildTreeLevel(positions []struct {
 				displayValue = matchedAllowedValue.Value
 			}
 
-			children := buildTreeLevel(matchingPositions, levels, levelIndex+1, newPath, fieldDefsByKey, treeLevelFieldKeys, superiorMap)
+			children := buildTreeLevel(matchingPositions, levels, levelIndex+1, newPath, fieldDefsByKey, treeLevelFieldKeys, superiorMap, outside)
 
 			// Build linked custom fields (all linked fields from definition)
 			var linkedFields []LinkedCustomField
@@ -809,22 +921,41 @@ func buildTreeLevel(positions []struct {
 		}
 	}
 
-	// Добавляем должности без значения текущего уровня как отдельные листовые узлы
-	// на одном уровне с "папками" значений.
-	for _, pos := range positionsWithoutValue {
-		positionID := pos.ID
-		positionName := pos.Name
-		nodes = append(nodes, TreeNode{
-			Type:            "position",
-			PositionID:      &positionID,
-			PositionName:    &positionName,
-			EmployeeFullName: pos.EmployeeFullName,
-			Children:        []TreeNode{},
-		})
+	// Папки для допустимых значений, которые не выбраны ни у одной должности
+	if level.ShowEmptyValues && hasFieldDef && fieldDef.AllowedValues != nil {
+		for i := range *fieldDef.AllowedValues {
+			allowedVal := &(*fieldDef.AllowedValues)[i]
+			valueIDStr := allowedVal.ValueID.String()
+			if valueSet[valueIDStr] || valueSet[allowedVal.Value] {
+				continue
+			}
+			levelOrder := order
+			customFieldID := fieldDef.ID.String()
+			customFieldKey := fieldKey
+			customFieldValue := allowedVal.Value
+			nodes = append(nodes, TreeNode{
+				Type:               "custom_field_value",
+				LevelOrder:         &levelOrder,
+				CustomFieldID:      &customFieldID,
+				CustomFieldKey:     &customFieldKey,
+				CustomFieldValue:   &customFieldValue,
+				CustomFieldValueID: &valueIDStr,
+				LinkedCustomFields: buildLinkedCustomFields(allowedVal),
+				Superior:           superiorMap[allowedVal.ValueID],
+				Children:           []TreeNode{},
+			})
+		}
+	}
+
+	for i := range nodes {
+		nodes[i].LevelLabel = &levelLabel
+		if level.HoistSingleChild {
+			nodes[i] = hoistSingleChild(nodes[i])
+		}
 	}
 
-	// Сортировка: папки (узлы-значения поля) по названию, должности в том порядке,
-	// в котором они пришли из БД (по id), и всегда после папок.
+	// Сортировка: папки (узлы-значения поля) согласно режиму сортировки уровня,
+	// должности в том порядке, в котором они пришли из БД (по id).
 	var fieldNodes, positionNodes []TreeNode
 	for _, n := range nodes {
 		if n.Type == "custom_field_value" {
@@ -833,22 +964,152 @@ func buildTreeLevel(positions []struct {
 			positionNodes = append(positionNodes, n)
 		}
 	}
+	sortTreeFolders(fieldNodes, level, fieldDef)
+
+	// Должности без значения уровня — до или после папок (по умолчанию после)
+	if level.MissingValue == TreeMissingBefore {
+		return append(append(missingNodes, fieldNodes...), positionNodes...)
+	}
+	return append(append(fieldNodes, positionNodes...), missingNodes...)
+}
+
+// hoistSingleChild replaces a folder that has exactly one child by that child.
+// A hoisted folder remembers the folders it replaced in HoistedFrom, so the
+// full path (and the values to prefill) is still known.
+func hoistSingleChild(node TreeNode) TreeNode {
+	if node.Type != "custom_field_value" || len(node.Children) != 1 {
+		return node
+	}
+	child := node.Children[0]
+	if child.Type != "custom_field_value" {
+		return child
+	}
+	hoisted := append([]TreePathNode{}, node.HoistedFrom...)
+	hoisted = append(hoisted, treePathNodeOf(node))
+	child.HoistedFrom = append(hoisted, child.HoistedFrom...)
+	return child
+}
+
+// sortTreeFolders orders folder nodes of one level according to level.Sort
+// and the values' persisted sort_order. Ties and values not covered by the
+// mode are ordered alphabetically.
+func sortTreeFolders(nodes []TreeNode, level TreeLevel, fieldDef CustomFieldDefinition) {
+	rank := make(map[string]int)
+	sortMode := level.Sort
+	byPersistedOrder := false
+	if sortMode == "" || (sortMode == TreeSortManual && len(level.ValueOrder) == 0) {
+		if fieldDef.AllowedValues != nil {
+			for _, allowedVal := range *fieldDef.AllowedValues {
+				if allowedVal.SortOrder != nil {
+					byPersistedOrder = true
+					rank[allowedVal.ValueID.String()] = *allowedVal.SortOrder
+				}
+			}
+		}
+		if byPersistedOrder {
+			sortMode = TreeSortManual
+		}
+	}
+	switch {
+	case byPersistedOrder:
+	case sortMode == TreeSortAllowedValues:
+		if fieldDef.AllowedValues != nil {
+			for i, allowedVal := range *fieldDef.AllowedValues {
+				rank[allowedVal.ValueID.String()] = i
+				if _, exists := rank[allowedVal.Value]; !exists {
+					rank[allowedVal.Value] = i
+				}
+			}
+		}
+	case sortMode == TreeSortManual:
+		for i, value := range level.ValueOrder {
+			if _, exists := rank[value]; !exists {
+				rank[value] = i
+			}
+		}
+	}
+	nodeRank := func(n TreeNode) (int, bool) {
+		if n.CustomFieldValueID != nil {
+			if r, ok := rank[*n.CustomFieldValueID]; ok {
+				return r, true
+			}
+		}
+		if n.CustomFieldValue != nil {
+			if r, ok := rank[*n.CustomFieldValue]; ok {
+				return r, true
+			}
+		}
+		return 0, false
+	}
 
-	// Сортируем только папки по названию
-	sort.Slice(fieldNodes, func(i, j int) bool {
-		vi := ""
-		if fieldNodes[i].CustomFieldValue != nil {
-			vi = *fieldNodes[i].CustomFieldValue
+	counts := make(map[int]int)
+	if sortMode == TreeSortPositionCount {
+		for i := range nodes {
+			counts[i] = countTreePositions(nodes[i])
 		}
-		vj := ""
-		if fieldNodes[j].CustomFieldValue != nil {
-			vj = *fieldNodes[j].CustomFieldValue
+	}
+	labels := make([]string, len(nodes))
+	for i, n := range nodes {
+		labels[i] = treeFolderSortLabel(n)
+	}
+	indexes := make([]int, len(nodes))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	sort.SliceStable(indexes, func(a, b int) bool {
+		i, j := indexes[a], indexes[b]
+		switch sortMode {
+		case TreeSortPositionCount:
+			if counts[i] != counts[j] {
+				return counts[i] > counts[j]
+			}
+		case TreeSortAllowedValues, TreeSortManual:
+			ri, oki := nodeRank(nodes[i])
+			rj, okj := nodeRank(nodes[j])
+			if oki != okj {
+				return oki
+			}
+			if ri != rj {
+				return ri < rj
+			}
 		}
-		return vi < vj
+		return labels[i] < labels[j]
 	})
 
-	// Возвращаем: сначала отсортированные папки, затем должности в исходном порядке
-	return append(fieldNodes, positionNodes...)
+	sorted := make([]TreeNode, len(nodes))
+	for k, i := range indexes {
+		sorted[k] = nodes[i]
+	}
+	copy(nodes, sorted)
+}
+
+// treeFolderSortLabel is the folder name used for alphabetical ordering:
+// the value followed by its linked values, so linked value branches of one
+// value keep a stable order
+func treeFolderSortLabel(node TreeNode) string {
+	label := ""
+	if node.CustomFieldValue != nil {
+		label = *node.CustomFieldValue
+	}
+	for _, linked := range node.LinkedCustomFields {
+		for _, v := range linked.LinkedCustomFieldValues {
+			label += " - " + v.LinkedCustomFieldValue
+		}
+	}
+	return label
+}
+
+// countTreePositions counts position nodes under node
+func countTreePositions(node TreeNode) int {
+	if node.Type == "position" {
+		return 1
+	}
+	count := 0
+	for _, child := range node.Children {
+		count += countTreePositions(child)
+	}
+	return count
 }
 
 func matchesPath(customFields map[string]string, path map[string]string) bool {
@@ -864,9 +1125,12 @@ func matchesPath(customFields map[string]string, path map[string]string) bool {
 }
 
 // loadSuperiorMap loads superior information for all custom_field_values
-func loadSuperiorMap(db *sql.DB) map[uuid.UUID]*int64 {
+func loadSuperiorMap(ctx context.Context, db dbQuerier) map[uuid.UUID]*int64 {
+	ctx, span := tracer.Start(ctx, "loadSuperiorMap")
+	defer span.End()
+
 	superiorMap := make(map[uuid.UUID]*int64)
-	rows, err := db.Query(`SELECT id, superior FROM custom_fields_values WHERE superior IS NOT NULL`)
+	rows, err := db.QueryContext(ctx, `SELECT id, superior FROM custom_fields_values WHERE superior IS NOT NULL`)
 	if err != nil {
 		return superiorMap
 	}
@@ -882,3 +1146,243 @@ func loadSuperiorMap(db *sql.DB) map[uuid.UUID]*int64 {
 	return superiorMap
 }
 
+// defaultTreeFieldKeys returns the custom field keys of the default tree levels in order
+func defaultTreeFieldKeys(ctx context.Context, db dbQuerier) ([]string, error) {
+	var levels []TreeLevel
+	var levelsJSON []byte
+	err := db.QueryRowContext(ctx, `SELECT levels FROM tree_definitions WHERE is_default = true LIMIT 1`).Scan(&levelsJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(levelsJSON, &levels); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(levels, func(i, j int) bool { return levels[i].Order < levels[j].Order })
+	keys := make([]string, len(levels))
+	for i, level := range levels {
+		keys[i] = level.CustomFieldKey
+	}
+	return keys, nil
+}
+
+// loadTreePositionOrder loads the manual order of positions within the nodes
+// of a tree: node_key -> position ID -> sort_order
+func loadTreePositionOrder(ctx context.Context, db dbQuerier, treeID uuid.UUID) map[string]map[string]int {
+	positionOrder := make(map[string]map[string]int)
+	rows, err := db.QueryContext(ctx,
+		`SELECT node_key, position_id, sort_order FROM tree_position_order WHERE tree_id = $1`,
+		treeID,
+	)
+	if err != nil {
+		return positionOrder
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nodeKey string
+		var positionID int64
+		var sortOrder int
+		if err := rows.Scan(&nodeKey, &positionID, &sortOrder); err == nil {
+			if positionOrder[nodeKey] == nil {
+				positionOrder[nodeKey] = make(map[string]int)
+			}
+			positionOrder[nodeKey][fmt.Sprint(positionID)] = sortOrder
+		}
+	}
+	return positionOrder
+}
+
+// treeNodeKeySegment is the part of a node key contributed by one folder:
+// "<custom_field_key>=<custom_field_value_id>", or the value text for folders
+// without a value ID (such as "Вне структуры")
+func treeNodeKeySegment(p TreePathNode) string {
+	key := ""
+	if p.CustomFieldKey != nil {
+		key = *p.CustomFieldKey
+	}
+	value := ""
+	if p.CustomFieldValueID != nil {
+		value = *p.CustomFieldValueID
+	} else if p.CustomFieldValue != nil {
+		value = *p.CustomFieldValue
+	}
+	return key + "=" + value
+}
+
+// orderTreeNodes sets node_key on the folders under node and reorders their
+// position children by the manual order. Positions without a manual order keep
+// their place after the ordered ones; folders are not moved.
+func orderTreeNodes(node *TreeNode, key string, positionOrder map[string]map[string]int) {
+	if order := positionOrder[key]; len(order) > 0 {
+		var slots []int
+		var positions []TreeNode
+		for i, child := range node.Children {
+			if child.Type == "position" {
+				slots = append(slots, i)
+				positions = append(positions, child)
+			}
+		}
+		sort.SliceStable(positions, func(i, j int) bool {
+			ri, oki := order[*positions[i].PositionID]
+			rj, okj := order[*positions[j].PositionID]
+			if oki != okj {
+				return oki
+			}
+			return ri < rj
+		})
+		for k, slot := range slots {
+			node.Children[slot] = positions[k]
+		}
+	}
+
+	for i := range node.Children {
+		child := &node.Children[i]
+		if child.Type != "custom_field_value" {
+			continue
+		}
+		childKey := key
+		for _, p := range append(append([]TreePathNode{}, child.HoistedFrom...), treePathNodeOf(*child)) {
+			if childKey != "" {
+				childKey += "/"
+			}
+			childKey += treeNodeKeySegment(p)
+		}
+		child.NodeKey = &childKey
+		orderTreeNodes(child, childKey, positionOrder)
+	}
+}
+
+// findTreePaths walks the built tree and returns, for every position node,
+// the chain of folder nodes leading to it from the root
+func findTreePaths(root TreeNode) map[string][]TreePathNode {
+	paths := make(map[string][]TreePathNode)
+
+	var walk func(node TreeNode, path []TreePathNode)
+	walk = func(node TreeNode, path []TreePathNode) {
+		if node.Type == "position" && node.PositionID != nil {
+			if _, exists := paths[*node.PositionID]; !exists {
+				paths[*node.PositionID] = append([]TreePathNode{}, path...)
+			}
+			return
+		}
+		if node.Type == "custom_field_value" {
+			path = append(path, node.HoistedFrom...)
+			path = append(path, treePathNodeOf(node))
+		}
+		for _, child := range node.Children {
+			walk(child, path[:len(path):len(path)])
+		}
+	}
+	walk(root, nil)
+
+	return paths
+}
+
+// treePathNodeOf returns the path entry describing a folder node
+func treePathNodeOf(node TreeNode) TreePathNode {
+	return TreePathNode{
+		LevelOrder:         node.LevelOrder,
+		CustomFieldID:      node.CustomFieldID,
+		CustomFieldKey:     node.CustomFieldKey,
+		CustomFieldValue:   node.CustomFieldValue,
+		CustomFieldValueID: node.CustomFieldValueID,
+		LinkedCustomFields: node.LinkedCustomFields,
+	}
+}
+
+// collectPositionNodes indexes all position nodes of the tree by position ID
+func collectPositionNodes(node TreeNode, nodes map[string]TreeNode) {
+	if node.Type == "position" && node.PositionID != nil {
+		if _, exists := nodes[*node.PositionID]; !exists {
+			nodes[*node.PositionID] = node
+		}
+		return
+	}
+	for _, child := range node.Children {
+		collectPositionNodes(child, nodes)
+	}
+}
+
+// pruneTree keeps only the position nodes listed in keep and the folder nodes
+// leading to them. The second result is false if nothing is left under node.
+func pruneTree(node TreeNode, keep map[string]bool) (TreeNode, bool) {
+	if node.Type == "position" {
+		return node, node.PositionID != nil && keep[*node.PositionID]
+	}
+
+	children := []TreeNode{}
+	for _, child := range node.Children {
+		if pruned, ok := pruneTree(child, keep); ok {
+			children = append(children, pruned)
+		}
+	}
+	node.Children = children
+	return node, len(children) > 0
+}
+
+// isUnstructuredGroup reports whether node is the "Вне структуры" group that
+// buildTreeStructure adds for positions without values for any tree level
+func isUnstructuredGroup(node TreeNode) bool {
+	return node.Type == "custom_field_value" && node.LevelOrder == nil && node.CustomFieldKey == nil
+}
+
+// computeTreeStats counts folders and positions per level, positions outside
+// the structure and folders that contain no positions at all
+func computeTreeStats(structure TreeStructure) TreeStats {
+	stats := TreeStats{
+		Levels:        make([]TreeLevelStats, len(structure.Levels)),
+		EmptyBranches: [][]TreePathNode{},
+	}
+	levelIndex := make(map[int]int)
+	for i, level := range structure.Levels {
+		stats.Levels[i] = TreeLevelStats{LevelOrder: level.Order, CustomFieldKey: level.CustomFieldKey}
+		levelIndex[level.Order] = i
+	}
+
+	// walk returns the number of positions under node
+	var walk func(node TreeNode, path []TreePathNode) int
+	walk = func(node TreeNode, path []TreePathNode) int {
+		var level *TreeLevelStats
+		if node.LevelOrder != nil {
+			if i, ok := levelIndex[*node.LevelOrder]; ok {
+				level = &stats.Levels[i]
+				level.Nodes++
+			}
+		}
+		path = append(path, node.HoistedFrom...)
+		path = append(path, treePathNodeOf(node))
+
+		positions := 0
+		for _, child := range node.Children {
+			if child.Type == "position" {
+				positions++
+				if level != nil {
+					level.Positions++
+				}
+				continue
+			}
+			positions += walk(child, path[:len(path):len(path)])
+		}
+		if positions == 0 {
+			stats.EmptyBranches = append(stats.EmptyBranches, path)
+		}
+		return positions
+	}
+
+	for _, child := range structure.Root.Children {
+		switch {
+		case child.Type == "position":
+			stats.RootPositions++
+			stats.TotalPositions++
+		case isUnstructuredGroup(child):
+			stats.UnstructuredPositions += len(child.Children)
+			stats.TotalPositions += len(child.Children)
+		default:
+			stats.TotalPositions += walk(child, nil)
+		}
+	}
+	return stats
+}
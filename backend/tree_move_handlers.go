@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// TreeMoveRequest is the body of POST /api/trees/{id}/move. Path maps level
+// keys (and keys of fields linked to the selected values) to value IDs; levels
+// missing from the end of the path are cleared, so an empty path moves the
+// positions to the tree root.
+type TreeMoveRequest struct {
+	PositionIDs []int64              `json:"position_ids"`
+	Path        map[string]uuid.UUID `json:"path"`
+}
+
+// treeMoveError marks a move target that does not exist in the tree
+type treeMoveError struct {
+	message string
+}
+
+func (e *treeMoveError) Error() string {
+	return e.message
+}
+
+// treeMove rewrites the custom field IDs of positions for the fields a tree
+// manages: its levels and the fields linked to their allowed values
+type treeMove struct {
+	managedFields map[uuid.UUID]bool
+	valueToField  map[uuid.UUID]uuid.UUID
+	targetFields  []uuid.UUID
+	targetValues  []uuid.UUID
+}
+
+// planTreeMove resolves a target path in the tree to the field and value IDs
+// positions moved there must have
+func planTreeMove(ctx context.Context, db dbQuerier, t TreeDefinition, path map[string]uuid.UUID) (*treeMove, error) {
+	fieldDefsByKey := loadCustomFieldDefinitions(ctx, db)
+	fieldToValuesMap, err := NewCustomFieldsService(db).LoadFieldToValuesMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	move := &treeMove{
+		managedFields: make(map[uuid.UUID]bool),
+		valueToField:  make(map[uuid.UUID]uuid.UUID),
+	}
+	for fieldID, valueSet := range fieldToValuesMap {
+		for valueID := range valueSet {
+			move.valueToField[valueID] = fieldID
+		}
+	}
+
+	levels := append([]TreeLevel{}, t.Levels...)
+	sort.SliceStable(levels, func(i, j int) bool { return levels[i].Order < levels[j].Order })
+
+	used := make(map[string]bool)
+	selectedLinked := make(map[string]LinkedCustomField)
+	skippedLevel := ""
+	for _, level := range levels {
+		def, ok := fieldDefsByKey[level.CustomFieldKey]
+		if !ok {
+			return nil, &treeMoveError{fmt.Sprintf("tree level %q refers to a missing custom field", level.CustomFieldKey)}
+		}
+		move.managedFields[def.ID] = true
+		if def.AllowedValues != nil {
+			for _, allowed := range *def.AllowedValues {
+				for _, linked := range allowed.LinkedCustomFields {
+					move.managedFields[linked.LinkedCustomFieldID] = true
+				}
+			}
+		}
+
+		valueID, inPath := path[level.CustomFieldKey]
+		if !inPath {
+			if skippedLevel == "" {
+				skippedLevel = level.CustomFieldKey
+			}
+			continue
+		}
+		used[level.CustomFieldKey] = true
+		if skippedLevel != "" {
+			return nil, &treeMoveError{fmt.Sprintf("path sets %q but skips the upper level %q", level.CustomFieldKey, skippedLevel)}
+		}
+
+		var matched *AllowedValue
+		if def.AllowedValues != nil {
+			for i := range *def.AllowedValues {
+				if (*def.AllowedValues)[i].ValueID == valueID {
+					matched = &(*def.AllowedValues)[i]
+					break
+				}
+			}
+		}
+		if matched == nil {
+			return nil, &treeMoveError{fmt.Sprintf("value %s is not an allowed value of %q", valueID, level.CustomFieldKey)}
+		}
+		move.addTarget(def.ID, valueID)
+		for _, linked := range matched.LinkedCustomFields {
+			selectedLinked[linked.LinkedCustomFieldKey] = linked
+		}
+	}
+
+	for key, valueID := range path {
+		if used[key] {
+			continue
+		}
+		linked, ok := selectedLinked[key]
+		if !ok {
+			return nil, &treeMoveError{fmt.Sprintf("%q is neither a level of this tree nor a field linked to a selected value", key)}
+		}
+		found := false
+		for _, v := range linked.LinkedCustomFieldValues {
+			if v.LinkedCustomFieldValueID == valueID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &treeMoveError{fmt.Sprintf("value %s is not linked to the selected values as %q", valueID, key)}
+		}
+		move.addTarget(linked.LinkedCustomFieldID, valueID)
+	}
+
+	return move, nil
+}
+
+func (m *treeMove) addTarget(fieldID, valueID uuid.UUID) {
+	m.targetFields = append(m.targetFields, fieldID)
+	m.targetValues = append(m.targetValues, valueID)
+}
+
+// rewrite replaces the managed fields of a position with the move target and
+// keeps all other fields and values as they are
+func (m *treeMove) rewrite(fieldIDs, valueIDs UUIDArray) (UUIDArray, UUIDArray) {
+	newFields := UUIDArray{}
+	seenFields := make(map[uuid.UUID]bool)
+	for _, id := range fieldIDs {
+		if !m.managedFields[id] && !seenFields[id] {
+			seenFields[id] = true
+			newFields = append(newFields, id)
+		}
+	}
+	newValues := UUIDArray{}
+	seenValues := make(map[uuid.UUID]bool)
+	for _, id := range valueIDs {
+		if fieldID, ok := m.valueToField[id]; ok && m.managedFields[fieldID] {
+			continue
+		}
+		if !seenValues[id] {
+			seenValues[id] = true
+			newValues = append(newValues, id)
+		}
+	}
+
+	for _, id := range m.targetFields {
+		if !seenFields[id] {
+			seenFields[id] = true
+			newFields = append(newFields, id)
+		}
+	}
+	for _, id := range m.targetValues {
+		if !seenValues[id] {
+			seenValues[id] = true
+			newValues = append(newValues, id)
+		}
+	}
+	return newFields, newValues
+}
+
+// moveTreePositions moves positions to the node of tree t given by path within
+// tx and returns the IDs of moved positions. Invalid paths and unknown positions
+// are reported as *treeMoveError.
+func moveTreePositions(ctx context.Context, tx dbQuerier, t TreeDefinition, path map[string]uuid.UUID, positionIDs []int64) ([]int64, error) {
+	move, err := planTreeMove(ctx, tx, t, path)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := []int64{}
+	seen := make(map[int64]bool)
+	for _, positionID := range positionIDs {
+		if seen[positionID] {
+			continue
+		}
+		seen[positionID] = true
+
+		var fieldIDs, valueIDs UUIDArray
+		err := tx.QueryRowContext(ctx,
+			`SELECT custom_fields_id, custom_fields_values_id FROM positions WHERE id = $1 FOR UPDATE`,
+			positionID,
+		).Scan(&fieldIDs, &valueIDs)
+		if err == sql.ErrNoRows {
+			return nil, &treeMoveError{fmt.Sprintf("position %d not found", positionID)}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		newFields, newValues := move.rewrite(fieldIDs, valueIDs)
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE positions SET custom_fields_id = $1, custom_fields_values_id = $2, updated_at = NOW() WHERE id = $3`,
+			newFields, newValues, positionID,
+		); err != nil {
+			return nil, err
+		}
+		moved = append(moved, positionID)
+	}
+
+	// The manual order of the old nodes no longer applies to moved positions
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM tree_position_order WHERE tree_id = $1 AND position_id = ANY($2::bigint[])`,
+		t.ID, pq.Array(moved),
+	); err != nil {
+		return nil, err
+	}
+	return moved, nil
+}
+
+// MoveTreePositions moves positions to a node of a tree in one transaction by
+// rewriting their values for exactly the fields the tree is built from
+func (h *Handler) MoveTreePositions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var req TreeMoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.PositionIDs) == 0 {
+		http.Error(w, "position_ids is required", http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.loadTreeDefinition(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tree not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	moved, err := moveTreePositions(r.Context(), tx, t, req.Path, req.PositionIDs)
+	var moveErr *treeMoveError
+	if errors.As(err, &moveErr) {
+		http.Error(w, moveErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tree_id": id.String(),
+		"moved":   moved,
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// UpdateTreeOrder persists the manual order of custom field values and of
+// positions within tree nodes. Value order is stored per custom field (so it
+// applies to every tree using the field); position order is stored per tree
+// and node. Every listed order replaces the previous one completely.
+func (h *Handler) UpdateTreeOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	var req TreeOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.loadTreeDefinition(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tree not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if msg := validateTreeOrderRequest(t, req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	// Unknown positions would fail on the foreign key; report them explicitly
+	var positionIDs []int64
+	for _, p := range req.Positions {
+		positionIDs = append(positionIDs, p.PositionIDs...)
+	}
+	if len(positionIDs) > 0 {
+		var missing []int64
+		rows, err := h.db.QueryContext(r.Context(),
+			`SELECT u.id FROM unnest($1::bigint[]) AS u(id)
+			WHERE NOT EXISTS (SELECT 1 FROM positions p WHERE p.id = u.id)`,
+			pq.Array(positionIDs),
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var positionID int64
+			if err := rows.Scan(&positionID); err == nil {
+				missing = append(missing, positionID)
+			}
+		}
+		rows.Close()
+		if len(missing) > 0 {
+			http.Error(w, fmt.Sprintf("Positions not found: %v", missing), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, v := range req.Values {
+		var fieldID uuid.UUID
+		err := tx.QueryRowContext(r.Context(),
+			`SELECT id FROM custom_fields WHERE key = $1`, v.CustomFieldKey,
+		).Scan(&fieldID)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Custom field %q not found", v.CustomFieldKey), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := tx.ExecContext(r.Context(),
+			`UPDATE custom_fields_values SET sort_order = NULL WHERE custom_field_id = $1 AND sort_order IS NOT NULL`,
+			fieldID,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, valueID := range v.ValueIDs {
+			result, err := tx.ExecContext(r.Context(),
+				`UPDATE custom_fields_values SET sort_order = $1, updated_at = NOW() WHERE id = $2 AND custom_field_id = $3`,
+				i+1, valueID, fieldID,
+			)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				http.Error(w, fmt.Sprintf("Value %s does not belong to custom field %q", valueID, v.CustomFieldKey), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	for _, p := range req.Positions {
+		if _, err := tx.ExecContext(r.Context(),
+			`DELETE FROM tree_position_order WHERE tree_id = $1 AND node_key = $2`,
+			id, p.NodeKey,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i, positionID := range p.PositionIDs {
+			if _, err := tx.ExecContext(r.Context(),
+				`INSERT INTO tree_position_order (tree_id, node_key, position_id, sort_order) VALUES ($1, $2, $3, $4)`,
+				id, p.NodeKey, positionID, i+1,
+			); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateTreeOrderRequest checks that value orders refer to levels of the
+// tree and that no value, position or node is listed twice. Returns an error
+// message or "" if the request is valid.
+func validateTreeOrderRequest(t TreeDefinition, req TreeOrderRequest) string {
+	levelKeys := make(map[string]bool)
+	for _, level := range t.Levels {
+		levelKeys[level.CustomFieldKey] = true
+	}
+
+	seenFields := make(map[string]bool)
+	for _, v := range req.Values {
+		if !levelKeys[v.CustomFieldKey] {
+			return fmt.Sprintf("Custom field %q is not a level of this tree", v.CustomFieldKey)
+		}
+		if seenFields[v.CustomFieldKey] {
+			return fmt.Sprintf("Custom field %q is listed more than once", v.CustomFieldKey)
+		}
+		seenFields[v.CustomFieldKey] = true
+
+		seenValues := make(map[uuid.UUID]bool)
+		for _, valueID := range v.ValueIDs {
+			if seenValues[valueID] {
+				return fmt.Sprintf("Value %s is listed more than once", valueID)
+			}
+			seenValues[valueID] = true
+		}
+	}
+
+	seenNodes := make(map[string]bool)
+	for _, p := range req.Positions {
+		if seenNodes[p.NodeKey] {
+			return fmt.Sprintf("Node %q is listed more than once", p.NodeKey)
+		}
+		seenNodes[p.NodeKey] = true
+
+		seenPositions := make(map[int64]bool)
+		for _, positionID := range p.PositionIDs {
+			if seenPositions[positionID] {
+				return fmt.Sprintf("Position %d is listed more than once in node %q", positionID, p.NodeKey)
+			}
+			seenPositions[positionID] = true
+		}
+	}
+	return ""
+}
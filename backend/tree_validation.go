@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Tree definition validation error codes
+const (
+	treeErrRequired             = "required"
+	treeErrUnknownCustomField   = "unknown_custom_field"
+	treeErrDuplicateCustomField = "duplicate_custom_field"
+	treeErrDuplicateOrder       = "duplicate_order"
+	treeErrLinkedFieldConflict  = "linked_field_conflict"
+	treeErrInvalidOption        = "invalid_option"
+)
+
+// TreeValidationError describes one problem of a tree definition
+type TreeValidationError struct {
+	Field   string `json:"field"` // e.g. "name" or "levels[1].custom_field_key"
+	Code    string `json:"code"`  // one of the treeErr* codes
+	Message string `json:"message"`
+	Level   *int   `json:"level,omitempty"` // index in the submitted levels array
+}
+
+// TreeValidationErrors is a list of problems; it is returned as 422 Unprocessable Entity
+type TreeValidationErrors []TreeValidationError
+
+func (e TreeValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Field + ": " + err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validateTreeDefinition checks a tree definition against existing custom fields
+// and normalizes its levels: they are sorted by order and renumbered 1..n, which
+// is the order buildTreeStructure walks them in. Returns TreeValidationErrors
+// for invalid definitions and other errors for database failures.
+func (h *Handler) validateTreeDefinition(ctx context.Context, t *TreeDefinition) error {
+	var problems TreeValidationErrors
+	levelProblem := func(i int, field, code, message string) {
+		index := i
+		problems = append(problems, TreeValidationError{
+			Field:   fmt.Sprintf("levels[%d].%s", i, field),
+			Code:    code,
+			Message: message,
+			Level:   &index,
+		})
+	}
+
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		problems = append(problems, TreeValidationError{Field: "name", Code: treeErrRequired, Message: "name is required"})
+	}
+
+	fieldDefsByKey := loadCustomFieldDefinitions(ctx, h.db)
+	if len(t.Levels) > 0 && len(fieldDefsByKey) == 0 {
+		// loadCustomFieldDefinitions hides errors; make sure the table is reachable
+		if err := h.db.QueryRowContext(ctx, `SELECT 1 FROM custom_fields LIMIT 1`).Err(); err != nil {
+			return err
+		}
+	}
+
+	keyLevels := make(map[string]int)
+	orderLevels := make(map[int]int)
+	for i := range t.Levels {
+		level := &t.Levels[i]
+		level.CustomFieldKey = strings.TrimSpace(level.CustomFieldKey)
+
+		if level.CustomFieldKey == "" {
+			levelProblem(i, "custom_field_key", treeErrRequired, "custom_field_key is required")
+		} else if _, ok := fieldDefsByKey[level.CustomFieldKey]; !ok {
+			levelProblem(i, "custom_field_key", treeErrUnknownCustomField,
+				fmt.Sprintf("custom field %q does not exist", level.CustomFieldKey))
+		} else if first, ok := keyLevels[level.CustomFieldKey]; ok {
+			levelProblem(i, "custom_field_key", treeErrDuplicateCustomField,
+				fmt.Sprintf("custom field %q is already used by levels[%d]", level.CustomFieldKey, first))
+		} else {
+			keyLevels[level.CustomFieldKey] = i
+		}
+
+		switch level.Sort {
+		case "", TreeSortAlphabetical, TreeSortAllowedValues, TreeSortPositionCount, TreeSortManual:
+		default:
+			levelProblem(i, "sort", treeErrInvalidOption,
+				fmt.Sprintf("unknown sort mode %q (use alphabetical, allowed_values, position_count or manual)", level.Sort))
+		}
+		switch level.MissingValue {
+		case "", TreeMissingAfter, TreeMissingBefore, TreeMissingGroup, TreeMissingOutside, TreeMissingHide:
+		default:
+			levelProblem(i, "missing_value", treeErrInvalidOption,
+				fmt.Sprintf("unknown missing_value placement %q (use after, before, group, outside or hide)", level.MissingValue))
+		}
+		level.Label = strings.TrimSpace(level.Label)
+		level.MissingLabel = strings.TrimSpace(level.MissingLabel)
+
+		if first, ok := orderLevels[level.Order]; ok {
+			levelProblem(i, "order", treeErrDuplicateOrder,
+				fmt.Sprintf("order %d is already used by levels[%d]", level.Order, first))
+		} else {
+			orderLevels[level.Order] = i
+		}
+	}
+
+	// A value with linked fields splits its branch by the linked values
+	// ("Sales - North"); a level over the same linked field would split it again.
+	for i, level := range t.Levels {
+		def, ok := fieldDefsByKey[level.CustomFieldKey]
+		if !ok || def.AllowedValues == nil {
+			continue
+		}
+		reported := make(map[string]bool)
+		for _, allowed := range *def.AllowedValues {
+			for _, linked := range allowed.LinkedCustomFields {
+				other, isLevel := keyLevels[linked.LinkedCustomFieldKey]
+				if !isLevel || other == i || reported[linked.LinkedCustomFieldKey] {
+					continue
+				}
+				reported[linked.LinkedCustomFieldKey] = true
+				levelProblem(i, "custom_field_key", treeErrLinkedFieldConflict,
+					fmt.Sprintf("values of %q are linked to %q, which is expanded into the branch name and cannot also be levels[%d]",
+						level.CustomFieldKey, linked.LinkedCustomFieldKey, other))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	sort.SliceStable(t.Levels, func(i, j int) bool {
+		return t.Levels[i].Order < t.Levels[j].Order
+	})
+	for i := range t.Levels {
+		t.Levels[i].Order = i + 1
+	}
+	return nil
+}
+
+// writeTreeValidationError reports validation problems as 422 with a JSON body
+// listing them and any other error as 500
+func writeTreeValidationError(w http.ResponseWriter, err error) {
+	problems, ok := err.(TreeValidationErrors)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "invalid tree definition",
+		"errors": problems,
+	})
+}
+
+// checkStoredTrees validates all stored tree definitions and logs their
+// problems. It runs on startup and never fails: broken trees still load,
+// but admins see what to fix.
+func (h *Handler) checkStoredTrees(ctx context.Context) {
+	rows, err := h.db.QueryContext(ctx, `SELECT id, name, levels FROM tree_definitions ORDER BY name`)
+	if err != nil {
+		logErrorf(ctx, "Tree definition check skipped: %v", err)
+		return
+	}
+	var trees []TreeDefinition
+	for rows.Next() {
+		var t TreeDefinition
+		var levelsJSON []byte
+		if err := rows.Scan(&t.ID, &t.Name, &levelsJSON); err != nil {
+			rows.Close()
+			logErrorf(ctx, "Tree definition check skipped: %v", err)
+			return
+		}
+		if levelsJSON != nil {
+			json.Unmarshal(levelsJSON, &t.Levels)
+		}
+		trees = append(trees, t)
+	}
+	rows.Close()
+
+	for _, t := range trees {
+		err := h.validateTreeDefinition(ctx, &t)
+		if problems, ok := err.(TreeValidationErrors); ok {
+			for _, p := range problems {
+				logf(ctx, "Tree %q (%s) is invalid: %s: %s", t.Name, t.ID, p.Field, p.Message)
+			}
+		} else if err != nil {
+			logErrorf(ctx, "Tree definition check failed: %v", err)
+			return
+		}
+	}
+}
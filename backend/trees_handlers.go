@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -11,31 +15,11 @@ import (
 // Tree handlers
 
 func (h *Handler) GetTrees(w http.ResponseWriter, r *http.Request) {
-	rows, err := h.db.Query(
-		`SELECT id, name, description, is_default, levels, created_at, updated_at
-		FROM tree_definitions ORDER BY is_default DESC, name`,
-	)
+	trees, err := h.loadTreeDefinitions(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var trees []TreeDefinition
-	for rows.Next() {
-		var t TreeDefinition
-		var levelsJSON []byte
-		err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.IsDefault, &levelsJSON,
-			&t.CreatedAt, &t.UpdatedAt)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if levelsJSON != nil {
-			json.Unmarshal(levelsJSON, &t.Levels)
-		}
-		trees = append(trees, t)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(trees)
@@ -51,7 +35,7 @@ func (h *Handler) GetTree(w http.ResponseWriter, r *http.Request) {
 
 	var t TreeDefinition
 	var levelsJSON []byte
-	err = h.db.QueryRow(
+	err = h.db.QueryRowContext(r.Context(),
 		`SELECT id, name, description, is_default, levels, created_at, updated_at
 		FROM tree_definitions WHERE id = $1`,
 		id,
@@ -81,23 +65,8 @@ func (h *Handler) CreateTree(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	t.ID = uuid.New()
-	levelsJSON, _ := json.Marshal(t.Levels)
-
-	// If this is set as default, unset other defaults
-	if t.IsDefault {
-		_, _ = h.db.Exec("UPDATE tree_definitions SET is_default = false")
-	}
-
-	_, err := h.db.Exec(
-		`INSERT INTO tree_definitions (id, name, description, is_default, levels, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, NOW(), NOW())`,
-		t.ID, t.Name, t.Description, t.IsDefault, levelsJSON,
-	)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.createTree(r.Context(), &t); err != nil {
+		writeTreeValidationError(w, err)
 		return
 	}
 
@@ -119,31 +88,119 @@ func (h *Handler) UpdateTree(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	err = h.updateTree(r.Context(), id, &t)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tree not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeTreeValidationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
 
+func (h *Handler) DeleteTree(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	err = h.deleteTree(r.Context(), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tree not found", http.StatusNotFound)
+		return
+	}
+	if err == errDeleteDefaultTree {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createTree validates and stores a new tree definition, filling in its ID.
+// Invalid definitions are reported as TreeValidationErrors.
+func (h *Handler) createTree(ctx context.Context, t *TreeDefinition) error {
+	if err := h.validateTreeDefinition(ctx, t); err != nil {
+		return err
+	}
+
+	t.ID = uuid.New()
 	levelsJSON, _ := json.Marshal(t.Levels)
 
 	// If this is set as default, unset other defaults
 	if t.IsDefault {
-		_, _ = h.db.Exec("UPDATE tree_definitions SET is_default = false WHERE id != $1", id)
+		_, _ = h.db.ExecContext(ctx, "UPDATE tree_definitions SET is_default = false")
 	}
 
-	_, err = h.db.Exec(
-		`UPDATE tree_definitions SET name = $1, description = $2, is_default = $3, 
+	_, err := h.db.ExecContext(ctx,
+		`INSERT INTO tree_definitions (id, name, description, is_default, levels, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NOW(), NOW())`,
+		t.ID, t.Name, t.Description, t.IsDefault, levelsJSON,
+	)
+	return err
+}
+
+// updateTree validates and replaces tree definition id. Invalid definitions
+// are reported as TreeValidationErrors; a missing tree as sql.ErrNoRows.
+func (h *Handler) updateTree(ctx context.Context, id uuid.UUID, t *TreeDefinition) error {
+	if err := h.validateTreeDefinition(ctx, t); err != nil {
+		return err
+	}
+	t.ID = id
+	levelsJSON, _ := json.Marshal(t.Levels)
+
+	result, err := h.db.ExecContext(ctx,
+		`UPDATE tree_definitions SET name = $1, description = $2, is_default = $3,
 		levels = $4, updated_at = NOW() WHERE id = $5`,
 		t.Name, t.Description, t.IsDefault, levelsJSON, id,
 	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
 
+	// If this is set as default, unset other defaults
+	if t.IsDefault {
+		_, _ = h.db.ExecContext(ctx, "UPDATE tree_definitions SET is_default = false WHERE id != $1", id)
+	}
+	return nil
+}
+
+// errDeleteDefaultTree is returned when deleting the default tree
+var errDeleteDefaultTree = errors.New("Cannot delete default tree")
+
+// deleteTree deletes a tree definition other than the default one. It
+// returns sql.ErrNoRows if the tree does not exist.
+func (h *Handler) deleteTree(ctx context.Context, id uuid.UUID) error {
+	var isDefault bool
+	err := h.db.QueryRowContext(ctx,
+		"SELECT is_default FROM tree_definitions WHERE id = $1",
+		id,
+	).Scan(&isDefault)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
+	}
+	if isDefault {
+		return errDeleteDefaultTree
 	}
 
-	t.ID = id
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(t)
+	_, err = h.db.ExecContext(ctx, "DELETE FROM tree_definitions WHERE id = $1", id)
+	return err
 }
 
-func (h *Handler) DeleteTree(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) GetTreeStructure(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := uuid.Parse(vars["id"])
 	if err != nil {
@@ -151,13 +208,8 @@ func (h *Handler) DeleteTree(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if it's the default tree
-	var isDefault bool
-	err = h.db.QueryRow(
-		"SELECT is_default FROM tree_definitions WHERE id = $1",
-		id,
-	).Scan(&isDefault)
-
+	// Get tree definition
+	t, err := h.loadTreeDefinition(r.Context(), id)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Tree not found", http.StatusNotFound)
 		return
@@ -167,21 +219,43 @@ func (h *Handler) DeleteTree(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if isDefault {
-		http.Error(w, "Cannot delete default tree", http.StatusConflict)
+	// Build tree structure
+	structure := buildTreeStructure(r.Context(), h.db, t)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(structure)
+}
+
+// PreviewTree builds the structure of an unsaved tree definition together
+// with its statistics, so a hierarchy can be designed without creating trees
+func (h *Handler) PreviewTree(w http.ResponseWriter, r *http.Request) {
+	var t TreeDefinition
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	_, err = h.db.Exec("DELETE FROM tree_definitions WHERE id = $1", id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if strings.TrimSpace(t.Name) == "" {
+		t.Name = "Preview"
+	}
+	if err := h.validateTreeDefinition(r.Context(), &t); err != nil {
+		writeTreeValidationError(w, err)
 		return
 	}
+	t.ID = uuid.Nil
 
-	w.WriteHeader(http.StatusNoContent)
+	structure := buildTreeStructure(r.Context(), h.db, t)
+	preview := TreePreview{
+		Structure: structure,
+		Stats:     computeTreeStats(structure),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
 }
 
-func (h *Handler) GetTreeStructure(w http.ResponseWriter, r *http.Request) {
+// SearchTree runs a search query on the server and returns matching positions
+// together with their node paths in the given tree
+func (h *Handler) SearchTree(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := uuid.Parse(vars["id"])
 	if err != nil {
@@ -189,16 +263,20 @@ func (h *Handler) GetTreeStructure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get tree definition
-	var t TreeDefinition
-	var levelsJSON []byte
-	err = h.db.QueryRow(
-		`SELECT id, name, description, is_default, levels, created_at, updated_at
-		FROM tree_definitions WHERE id = $1`,
-		id,
-	).Scan(&t.ID, &t.Name, &t.Description, &t.IsDefault, &levelsJSON,
-		&t.CreatedAt, &t.UpdatedAt)
+	search := r.URL.Query().Get("q")
+	if strings.TrimSpace(search) == "" {
+		http.Error(w, "Query parameter q is required", http.StatusBadRequest)
+		return
+	}
 
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	t, err := h.loadTreeDefinition(r.Context(), id)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Tree not found", http.StatusNotFound)
 		return
@@ -208,13 +286,106 @@ func (h *Handler) GetTreeStructure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if levelsJSON != nil {
-		json.Unmarshal(levelsJSON, &t.Levels)
+	searchQuery, err := h.parseSearch(r.Context(), search)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	matches, err := h.searchPositions(r.Context(), searchQuery, PositionFilters{})
+	if err != nil {
+		writeSearchError(w, err)
+		return
 	}
 
-	// Build tree structure
-	structure := buildTreeStructure(h.db, t)
+	items := []TreeSearchResult{}
+	if len(matches) > 0 {
+		// Paths are taken from the built tree so they match exactly what
+		// GET /api/trees/{id}/structure returns (including linked value branches)
+		structure := buildTreeStructure(r.Context(), h.db, t)
+		paths := findTreePaths(structure.Root)
+		positionNodes := make(map[string]TreeNode)
+		collectPositionNodes(structure.Root, positionNodes)
+
+		for _, m := range matches {
+			if len(items) >= limit {
+				break
+			}
+			positionID := strconv.FormatInt(m.ID, 10)
+			node, ok := positionNodes[positionID]
+			if !ok {
+				continue
+			}
+			result := TreeSearchResult{
+				PositionID:       positionID,
+				EmployeeFullName: node.EmployeeFullName,
+				Relevance:        m.Relevance,
+				Path:             paths[positionID],
+			}
+			if node.PositionName != nil {
+				result.PositionName = *node.PositionName
+			}
+			if result.Path == nil {
+				result.Path = []TreePathNode{}
+			}
+			items = append(items, result)
+		}
+	}
+
+	response := map[string]interface{}{
+		"tree_id": t.ID.String(),
+		"query":   search,
+		"items":   items,
+		"total":   len(matches),
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(structure)
+	json.NewEncoder(w).Encode(response)
+}
+
+// loadTreeDefinitions returns all tree definitions, the default one first
+func (h *Handler) loadTreeDefinitions(ctx context.Context) ([]TreeDefinition, error) {
+	rows, err := h.db.QueryContext(ctx,
+		`SELECT id, name, description, is_default, levels, created_at, updated_at
+		FROM tree_definitions ORDER BY is_default DESC, name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trees []TreeDefinition
+	for rows.Next() {
+		var t TreeDefinition
+		var levelsJSON []byte
+		err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.IsDefault, &levelsJSON,
+			&t.CreatedAt, &t.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if levelsJSON != nil {
+			json.Unmarshal(levelsJSON, &t.Levels)
+		}
+		trees = append(trees, t)
+	}
+	return trees, rows.Err()
+}
+
+// loadTreeDefinition loads a tree definition by ID. Returns sql.ErrNoRows if it does not exist.
+func (h *Handler) loadTreeDefinition(ctx context.Context, id uuid.UUID) (TreeDefinition, error) {
+	var t TreeDefinition
+	var levelsJSON []byte
+	err := h.db.QueryRowContext(ctx,
+		`SELECT id, name, description, is_default, levels, created_at, updated_at
+		FROM tree_definitions WHERE id = $1`,
+		id,
+	).Scan(&t.ID, &t.Name, &t.Description, &t.IsDefault, &levelsJSON,
+		&t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return t, err
+	}
+
+	if levelsJSON != nil {
+		json.Unmarshal(levelsJSON, &t.Levels)
+	}
+	return t, nil
 }